@@ -0,0 +1,193 @@
+/*************************************************************************************************
+ * Assertions for the test cases
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func CheckEq(t *testing.T, want interface{}, got interface{}) {
+	_, _, line, _ := runtime.Caller(1)
+	if IsNilData(want) {
+		if !IsNilData(got) {
+			println(got, IsNilData(got), got == nil)
+			t.Errorf("line=%d: not equal: want=%q, got=%q", line, want, got)
+		}
+		return
+	}
+	switch want := want.(type) {
+	case int, uint, int8, uint8, int16, uint16, int32, uint32, int64, uint64:
+		if ToInt(want) != ToInt(got) {
+			t.Errorf("line=%d: not equal: want=%d, got=%d", line, want, got)
+		}
+	case float32, float64, complex64, complex128:
+		if ToFloat(want) != ToFloat(got) {
+			t.Errorf("line=%d: not equal: want=%d, got=%d", line, want, got)
+		}
+	case string:
+		if want != ToString(got) {
+			t.Errorf("line=%d: not equal: want=%s, got=%s", line, want, got)
+		}
+	case []byte:
+		if !reflect.DeepEqual(want, ToByteArray(got)) {
+			t.Errorf("line=%d: not equal: want=%q, got=%q", line, want, got)
+		}
+	case Status:
+		if !want.Equals(got) {
+			t.Errorf("line=%d: not equal: want=%s, got=%s", line, want.String(), got)
+		}
+	case *Status:
+		if !want.Equals(got) {
+			t.Errorf("line=%d: not equal: want=%s, got=%s", line, want.String(), got)
+		}
+	case StatusCode:
+		switch got := got.(type) {
+		case Status:
+			if !got.Equals(want) {
+				t.Errorf("line=%d: not equal: want=%s, got=%s", line, StatusCodeName(want), got.String())
+			}
+		case *Status:
+			if !got.Equals(want) {
+				t.Errorf("line=%d: not equal: want=%s, got=%s", line, StatusCodeName(want), got.String())
+			}
+		case StatusCode:
+			if want != got {
+				t.Errorf("line=%d: not equal: want=%s, got=%s", line,
+					StatusCodeName(want), StatusCodeName(got))
+			}
+		default:
+			t.Errorf("line=%d: not comparable: want=%s, got=%q", line, StatusCodeName(want), got)
+		}
+	default:
+		if want != got {
+			t.Errorf("line=%d: not equal: want=%q, got=%q", line, want, got)
+		}
+	}
+}
+
+func CheckNe(t *testing.T, want interface{}, got interface{}) {
+	_, _, line, _ := runtime.Caller(1)
+	if IsNilData(want) {
+		if IsNilData(got) {
+			t.Errorf("line=%d: equal: want=%q, got=%q", line, want, got)
+		}
+		return
+	}
+	switch want := want.(type) {
+	case int, uint, int8, uint8, int16, uint16, int32, uint32, int64, uint64:
+		if ToInt(want) == ToInt(got) {
+			t.Errorf("line=%d: equal: want=%d, got=%d", line, want, got)
+		}
+	case float32, float64, complex64, complex128:
+		if ToFloat(want) == ToFloat(got) {
+			t.Errorf("line=%d: equal: want=%d, got=%d", line, want, got)
+		}
+	case string:
+		if want == ToString(got) {
+			t.Errorf("line=%d: equal: want=%s, got=%s", line, want, got)
+		}
+	case []byte:
+		if reflect.DeepEqual(want, ToByteArray(got)) {
+			t.Errorf("line=%d: equal: want=%q, got=%q", line, want, got)
+		}
+	case Status:
+		if want.Equals(got) {
+			t.Errorf("line=%d: equal: want=%s, got=%s", line, want.String(), got)
+		}
+	case *Status:
+		if want.Equals(got) {
+			t.Errorf("line=%d: equal: want=%s, got=%s", line, want.String(), got)
+		}
+	case StatusCode:
+		switch got := got.(type) {
+		case Status:
+			if got.Equals(want) {
+				t.Errorf("line=%d: equal: want=%s, got=%s", line, StatusCodeName(want), got.String())
+			}
+		case *Status:
+			if got.Equals(want) {
+				t.Errorf("line=%d: equal: want=%s, got=%s", line, StatusCodeName(want), got.String())
+			}
+		case StatusCode:
+			if want == got {
+				t.Errorf("line=%d: equal: want=%s, got=%s",
+					line, StatusCodeName(want), StatusCodeName(got))
+			}
+		default:
+			t.Errorf("line=%d: not comparable: want=%s, got=%q", line, StatusCodeName(want), got)
+		}
+	default:
+		if want == got {
+			t.Errorf("line=%d: equal: want=%q, got=%q", line, want, got)
+		}
+	}
+}
+
+func CheckTrue(t *testing.T, got bool) {
+	_, _, line, _ := runtime.Caller(1)
+	if !got {
+		t.Errorf("line=%d: not true", line)
+	}
+}
+
+func CheckFalse(t *testing.T, got bool) {
+	_, _, line, _ := runtime.Caller(1)
+	if got {
+		t.Errorf("line=%d: true", line)
+	}
+}
+
+func MakeTempDir() string {
+	tmpPath := path.Join(os.TempDir(), fmt.Sprintf(
+		"tkrzw-test-%04x%08x", os.Getpid()%(1<<16), time.Now().Unix()%(1<<32)))
+	error := os.MkdirAll(tmpPath, 0755)
+	if error != nil {
+		panic(fmt.Sprintf("cannot create directory: %s", error))
+	}
+	return tmpPath
+}
+
+func TestAssertion(t *testing.T) {
+	CheckEq(t, nil, nil)
+	CheckEq(t, interface{}(nil), interface{}(nil))
+	CheckNe(t, nil, 0)
+	CheckEq(t, 2, 2)
+	CheckEq(t, 2.0, 2.0)
+	CheckEq(t, "two", "two")
+	CheckEq(t, []byte("two"), []byte("two"))
+	CheckEq(t, nil, nil)
+	CheckEq(t, 2, 2.0)
+	CheckEq(t, 2, "2")
+	CheckEq(t, 2.0, 2)
+	CheckEq(t, 2.0, "2")
+	CheckEq(t, "2", 2)
+	CheckEq(t, []byte("2"), 2)
+	CheckNe(t, 2, 3)
+	CheckNe(t, 2.0, 3.0)
+	CheckNe(t, "two", "three")
+	CheckNe(t, []byte("two"), []byte("three"))
+	CheckNe(t, nil, 0)
+	CheckTrue(t, true)
+	CheckTrue(t, 1 > 0)
+	CheckFalse(t, false)
+	CheckFalse(t, 1 < 0)
+}
+
+// END OF FILE
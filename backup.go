@@ -0,0 +1,470 @@
+/*************************************************************************************************
+ * Streaming backup and restoration
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"github.com/estraier/tkrzw-go/flatrec"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// The magic data at the top of a backup archive.
+const backupMagic = "TKRZWBAK"
+
+// The format version of backup archives.
+const backupFormatVersion = 1
+
+// The magic data at the top of an incremental backup segment.
+const incrementalMagic = "TKRZWINC"
+
+// The maximum size of the region to check the continuity of incremental backup segments.
+const incrementalAnchorSize = 4096
+
+// Compression types of backup archives.
+const (
+	backupCompNone = 0
+	backupCompGzip = 1
+	backupCompZlib = 2
+)
+
+// Database classes which can be given as the "dbm" parameter.
+var backupClassNames = []string{
+	"HashDBM", "TreeDBM", "SkipDBM", "TinyDBM", "BabyDBM", "CacheDBM", "StdHashDBM", "StdTreeDBM",
+}
+
+// Tuning parameters which are carried from the source database to the restored one.
+var backupTuningParams = []string{
+	"offset_width", "align_pow", "num_buckets", "max_page_size", "max_branches",
+	"key_comparator", "step_unit", "max_level",
+}
+
+// Converts an error of the standard library into a status.
+func errorToStatus(err error) *Status {
+	if err == nil {
+		return NewStatus1(StatusSuccess)
+	}
+	if status, ok := err.(*Status); ok {
+		return status
+	}
+	if err == io.ErrUnexpectedEOF {
+		return NewStatus2(StatusBrokenDataError, "unexpected end of data")
+	}
+	return NewStatus2(StatusSystemError, err.Error())
+}
+
+// Makes a parameter expression from a string map.
+func makeParamsExpr(params map[string]string) string {
+	fields := make([]string, 0, len(params))
+	for name, value := range params {
+		fields = append(fields, name+"="+value)
+	}
+	return strings.Join(fields, ",")
+}
+
+// Writes a backup archive of the database to a stream.
+//
+// @param w The writer to send the archive to.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The result status.
+//
+// The archive is self-describing.  It contains a header with the database class and its tuning parameters, all records in the flat record format, and a trailer with the number of records and the CRC-32 checksum of the content.  The optional parameter "compress" specifies the compression algorithm: "none" for no compression, "gzip" for gzip, or "zlib" for zlib.  By default, no compression is done.
+//
+// The records are read with an iterator while the database is usable by other threads.  Records which are updated during the backup may or may not be included.
+func (self *DBM) BackupTo(w io.Writer, params map[string]string) *Status {
+	if self.dbm == 0 {
+		return NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	compType := backupCompNone
+	switch strings.ToLower(params["compress"]) {
+	case "", "none":
+	case "gzip":
+		compType = backupCompGzip
+	case "zlib":
+		compType = backupCompZlib
+	default:
+		return NewStatus2(StatusInvalidArgumentError, "unknown compression: "+params["compress"])
+	}
+	head := []byte(backupMagic)
+	head = append(head, backupFormatVersion, byte(compType))
+	if _, err := w.Write(head); err != nil {
+		return errorToStatus(err)
+	}
+	var body io.Writer
+	var closer io.Closer
+	switch compType {
+	case backupCompGzip:
+		gzipWriter := gzip.NewWriter(w)
+		body, closer = gzipWriter, gzipWriter
+	case backupCompZlib:
+		zlibWriter := zlib.NewWriter(w)
+		body, closer = zlibWriter, zlibWriter
+	default:
+		body = w
+	}
+	bufWriter := bufio.NewWriter(body)
+	checksum := crc32.NewIEEE()
+	content := io.MultiWriter(bufWriter, checksum)
+	status := self.writeBackupContent(content, bufWriter, checksum)
+	if closer != nil {
+		status.Join(errorToStatus(closer.Close()))
+	}
+	return status
+}
+
+// Writes the content of a backup archive.
+func (self *DBM) writeBackupContent(
+	content io.Writer, bufWriter *bufio.Writer, checksum hash.Hash32) *Status {
+	inspection := self.Inspect()
+	header := map[string]string{"class": inspection["class"]}
+	for _, name := range backupTuningParams {
+		if value, ok := inspection[name]; ok && len(value) > 0 {
+			header[name] = value
+		}
+	}
+	writer := flatrec.NewFlatRecordWriter(content)
+	if err := writer.WriteMetadata([]byte(makeParamsExpr(header))); err != nil {
+		return errorToStatus(err)
+	}
+	numRecords := int64(0)
+	iter := self.MakeIterator()
+	defer iter.Destruct()
+	status := iter.First()
+	if !status.IsOK() {
+		return status
+	}
+	for {
+		key, value, status := iter.Step()
+		if status.Equals(StatusNotFoundError) {
+			break
+		}
+		if !status.IsOK() {
+			return status
+		}
+		if err := writer.WriteKeyValue(key, value); err != nil {
+			return errorToStatus(err)
+		}
+		numRecords++
+	}
+	trailer := fmt.Sprintf("num_records=%d,checksum=%08x", numRecords, checksum.Sum32())
+	if err := flatrec.NewFlatRecordWriter(bufWriter).WriteMetadata([]byte(trailer)); err != nil {
+		return errorToStatus(err)
+	}
+	return errorToStatus(bufWriter.Flush())
+}
+
+// Restores a database from a backup archive read from a stream.
+//
+// @param r The reader to receive the archive from.
+// @param destPath The path of the new database to be created.
+// @param params Optional parameters to open the new database.  If it is nil, it is ignored.
+// @return The result status.  If the archive is broken, StatusBrokenDataError is returned.
+//
+// The new database is created with the class and the tuning parameters recorded in the archive.  The given parameters supercede the recorded ones.  If the content doesn't match the checksum or the number of records in the trailer, the new database file is removed.
+func RestoreFrom(r io.Reader, destPath string, params map[string]string) *Status {
+	head := make([]byte, len(backupMagic)+2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return NewStatus2(StatusBrokenDataError, "missing archive header")
+	}
+	if string(head[:len(backupMagic)]) != backupMagic {
+		return NewStatus2(StatusBrokenDataError, "invalid archive magic data")
+	}
+	if head[len(backupMagic)] != backupFormatVersion {
+		return NewStatus2(StatusNotImplementedError, "unsupported archive version")
+	}
+	body := r
+	switch head[len(backupMagic)+1] {
+	case backupCompNone:
+	case backupCompGzip:
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return NewStatus2(StatusBrokenDataError, err.Error())
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+	case backupCompZlib:
+		zlibReader, err := zlib.NewReader(r)
+		if err != nil {
+			return NewStatus2(StatusBrokenDataError, err.Error())
+		}
+		defer zlibReader.Close()
+		body = zlibReader
+	default:
+		return NewStatus2(StatusBrokenDataError, "unknown compression type")
+	}
+	reader := flatrec.NewFlatRecordReader(body)
+	checksum := crc32.NewIEEE()
+	checksumWriter := flatrec.NewFlatRecordWriter(checksum)
+	headerData, isMetadata, err := reader.Read()
+	if err != nil || !isMetadata {
+		return NewStatus2(StatusBrokenDataError, "missing content header")
+	}
+	checksumWriter.WriteMetadata(headerData)
+	header := ParseParams(string(headerData))
+	openParams := make(map[string]string)
+	for _, className := range backupClassNames {
+		if header["class"] == className {
+			openParams["dbm"] = className
+		}
+	}
+	for _, name := range backupTuningParams {
+		if value, ok := header[name]; ok {
+			openParams[name] = value
+		}
+	}
+	for name, value := range params {
+		openParams[name] = value
+	}
+	openParams["truncate"] = "true"
+	dbm := NewDBM()
+	status := dbm.Open(destPath, true, openParams)
+	if !status.IsOK() {
+		return status
+	}
+	status = restoreBackupContent(dbm, reader, checksum)
+	status.Join(dbm.Close())
+	if !status.IsOK() {
+		os.Remove(destPath)
+	}
+	return status
+}
+
+// Reads the content of a backup archive into a database.
+func restoreBackupContent(
+	dbm *DBM, reader *flatrec.FlatRecordReader, checksum hash.Hash32) *Status {
+	checksumWriter := flatrec.NewFlatRecordWriter(checksum)
+	numRecords := int64(0)
+	var key []byte
+	for {
+		data, isMetadata, err := reader.Read()
+		if err == io.EOF {
+			return NewStatus2(StatusBrokenDataError, "missing content trailer")
+		}
+		if err != nil {
+			return NewStatus2(StatusBrokenDataError, err.Error())
+		}
+		if isMetadata {
+			if key != nil {
+				return NewStatus2(StatusBrokenDataError, "missing record value")
+			}
+			trailer := ParseParams(string(data))
+			if trailer["checksum"] != fmt.Sprintf("%08x", checksum.Sum32()) {
+				return NewStatus2(StatusBrokenDataError, "checksum mismatch")
+			}
+			if ToInt(trailer["num_records"]) != numRecords {
+				return NewStatus2(StatusBrokenDataError, "record count mismatch")
+			}
+			return NewStatus1(StatusSuccess)
+		}
+		checksumWriter.Write(data)
+		if key == nil {
+			key = data
+			continue
+		}
+		status := dbm.Set(key, data, true)
+		if !status.IsOK() {
+			return status
+		}
+		key = nil
+		numRecords++
+	}
+}
+
+// Writes an incremental backup segment of a HashDBM file in the appending update mode.
+//
+// @param w The writer to send the segment to.
+// @param sinceOffset The file offset returned by the previous backup.  0 means a full backup.
+// @return The file offset to be given to the next backup, and the result status.
+//
+// In the appending update mode, the records of a HashDBM are only appended to the end of the file.  Thus, a segment contains only the region of the file appended since the previous backup, together with the metadata and the bucket region at the top of the file.  If the file has been shrunk by rebuilding, StatusInfeasibleError is returned and a full backup should be done.  The database is synchronized before reading the file.  Records which are updated during the backup may or may not be included.
+func (self *DBM) BackupIncrementalTo(w io.Writer, sinceOffset int64) (int64, *Status) {
+	if self.dbm == 0 {
+		return 0, NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	inspection := self.Inspect()
+	if inspection["class"] != "HashDBM" {
+		return 0, NewStatus2(StatusNotImplementedError, "not a HashDBM")
+	}
+	if !strings.Contains(strings.ToLower(inspection["update_mode"]), "append") {
+		return 0, NewStatus2(StatusPreconditionError, "not in the appending update mode")
+	}
+	status := self.Synchronize(false, nil)
+	if !status.IsOK() {
+		return 0, status
+	}
+	filePath, status := self.GetFilePath()
+	if !status.IsOK() {
+		return 0, status
+	}
+	fileSize, status := self.GetFileSize()
+	if !status.IsOK() {
+		return 0, status
+	}
+	if sinceOffset < 0 || sinceOffset > fileSize {
+		return 0, NewStatus2(StatusInfeasibleError, "the file has been shrunk")
+	}
+	headSize := sinceOffset
+	if recordBase := ToInt(inspection["record_base"]); recordBase > 0 && recordBase < headSize {
+		headSize = recordBase
+	}
+	anchorSize := sinceOffset - headSize
+	if anchorSize > incrementalAnchorSize {
+		anchorSize = incrementalAnchorSize
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, errorToStatus(err)
+	}
+	defer file.Close()
+	anchor := make([]byte, anchorSize)
+	if _, err := file.ReadAt(anchor, sinceOffset-anchorSize); err != nil {
+		return 0, errorToStatus(err)
+	}
+	checksum := crc32.NewIEEE()
+	content := io.MultiWriter(w, checksum)
+	if _, err := w.Write([]byte(incrementalMagic)); err != nil {
+		return 0, errorToStatus(err)
+	}
+	var header [37]byte
+	header[0] = backupFormatVersion
+	binary.BigEndian.PutUint64(header[1:], uint64(sinceOffset))
+	binary.BigEndian.PutUint64(header[9:], uint64(fileSize))
+	binary.BigEndian.PutUint64(header[17:], uint64(headSize))
+	binary.BigEndian.PutUint64(header[25:], uint64(anchorSize))
+	binary.BigEndian.PutUint32(header[33:], crc32.ChecksumIEEE(anchor))
+	if _, err := content.Write(header[:]); err != nil {
+		return 0, errorToStatus(err)
+	}
+	if _, err := io.Copy(content, io.NewSectionReader(file, 0, headSize)); err != nil {
+		return 0, errorToStatus(err)
+	}
+	if _, err := io.Copy(content, io.NewSectionReader(
+		file, sinceOffset, fileSize-sinceOffset)); err != nil {
+		return 0, errorToStatus(err)
+	}
+	var trailer [4]byte
+	binary.BigEndian.PutUint32(trailer[:], checksum.Sum32())
+	if _, err := w.Write(trailer[:]); err != nil {
+		return 0, errorToStatus(err)
+	}
+	return fileSize, NewStatus1(StatusSuccess)
+}
+
+// Restores a HashDBM database from a chain of incremental backup segments.
+//
+// @param segments Readers of the segments, in the order of creation.  The first one must be a full backup.
+// @param destPath The path of the new database to be created.
+// @param cipherKey The encryption key for cipher compressors.
+// @return The result status.  If a segment is broken or the chain is discontinuous, StatusBrokenDataError is returned.
+//
+// The segments are reassembled into a temporary file next to the new database, whose records are then restored by RestoreDatabase.  The temporary file is removed in any case.
+func RestoreIncremental(segments []io.Reader, destPath string, cipherKey string) *Status {
+	tmpPath := destPath + ".tmp.incremental"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errorToStatus(err)
+	}
+	defer os.Remove(tmpPath)
+	endOffset := int64(0)
+	for i, segment := range segments {
+		var status *Status
+		endOffset, status = restoreIncrementalSegment(segment, tmpFile, endOffset)
+		if !status.IsOK() {
+			tmpFile.Close()
+			return NewStatus2(status.GetCode(), fmt.Sprintf("segment %d: %s", i, status.GetMessage()))
+		}
+	}
+	if err := tmpFile.Truncate(endOffset); err != nil {
+		tmpFile.Close()
+		return errorToStatus(err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errorToStatus(err)
+	}
+	return RestoreDatabase(tmpPath, destPath, "HashDBM", -1, cipherKey)
+}
+
+// Validates an incremental backup segment and writes its data into a file.
+func restoreIncrementalSegment(
+	segment io.Reader, file *os.File, prevEndOffset int64) (int64, *Status) {
+	magic := make([]byte, len(incrementalMagic))
+	if _, err := io.ReadFull(segment, magic); err != nil || string(magic) != incrementalMagic {
+		return 0, NewStatus2(StatusBrokenDataError, "invalid segment magic data")
+	}
+	checksum := crc32.NewIEEE()
+	content := io.TeeReader(segment, checksum)
+	var header [37]byte
+	if _, err := io.ReadFull(content, header[:]); err != nil {
+		return 0, NewStatus2(StatusBrokenDataError, "missing segment header")
+	}
+	if header[0] != backupFormatVersion {
+		return 0, NewStatus2(StatusNotImplementedError, "unsupported segment version")
+	}
+	startOffset := int64(binary.BigEndian.Uint64(header[1:]))
+	endOffset := int64(binary.BigEndian.Uint64(header[9:]))
+	headSize := int64(binary.BigEndian.Uint64(header[17:]))
+	anchorSize := int64(binary.BigEndian.Uint64(header[25:]))
+	anchorChecksum := binary.BigEndian.Uint32(header[33:])
+	if startOffset != prevEndOffset {
+		return 0, NewStatus2(StatusBrokenDataError, "discontinuous segment")
+	}
+	if endOffset < startOffset || headSize > startOffset || anchorSize > startOffset-headSize {
+		return 0, NewStatus2(StatusBrokenDataError, "invalid segment header")
+	}
+	anchor := make([]byte, anchorSize)
+	if _, err := file.ReadAt(anchor, startOffset-anchorSize); err != nil {
+		return 0, errorToStatus(err)
+	}
+	if crc32.ChecksumIEEE(anchor) != anchorChecksum {
+		return 0, NewStatus2(StatusBrokenDataError, "the previous segment doesn't match")
+	}
+	head := make([]byte, headSize)
+	if _, err := io.ReadFull(content, head); err != nil {
+		return 0, NewStatus2(StatusBrokenDataError, "missing segment head data")
+	}
+	buf := make([]byte, 1<<20)
+	for offset := startOffset; offset < endOffset; {
+		size := endOffset - offset
+		if size > int64(len(buf)) {
+			size = int64(len(buf))
+		}
+		if _, err := io.ReadFull(content, buf[:size]); err != nil {
+			return 0, NewStatus2(StatusBrokenDataError, "missing segment body data")
+		}
+		if _, err := file.WriteAt(buf[:size], offset); err != nil {
+			return 0, errorToStatus(err)
+		}
+		offset += size
+	}
+	var trailer [4]byte
+	if _, err := io.ReadFull(segment, trailer[:]); err != nil {
+		return 0, NewStatus2(StatusBrokenDataError, "missing segment trailer")
+	}
+	if binary.BigEndian.Uint32(trailer[:]) != checksum.Sum32() {
+		return 0, NewStatus2(StatusBrokenDataError, "checksum mismatch")
+	}
+	if _, err := file.WriteAt(head, 0); err != nil {
+		return 0, errorToStatus(err)
+	}
+	return endOffset, NewStatus1(StatusSuccess)
+}
+
+// END OF FILE
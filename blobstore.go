@@ -0,0 +1,503 @@
+/*************************************************************************************************
+ * Storage of large values split into chunks
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+// The default size of each chunk of blobs.
+const blobChunkSize = 1 << 20
+
+// The size of the suffix of chunk keys, which is a separator, a generation, and an index.
+const blobChunkSuffixSize = 33
+
+// Store of large values which are split into chunks.
+//
+// Each blob is stored as a manifest record and chunk records.  The manifest record has the key made of the prefix, "M", and the blob key.  Its value has the size, the chunk size, and the generation of the blob.  Each chunk record has the key made of the prefix, "C", the blob key, a zero byte, and the generation and the index of the chunk in hexadecimal.  The generation is issued by incrementing the counter record whose key is the prefix and "G".  A blob is committed by swapping the manifest with CompareExchange so that readers see either the old content or the new content.
+type BlobStore struct {
+	// The underlying database.
+	dbm *DBM
+	// The prefix of the keys.
+	prefix string
+	// The size of each chunk.
+	chunkSize int64
+	// The mutex for the active generations.
+	mutex sync.Mutex
+	// The generations being written.
+	activeGens map[int64]bool
+}
+
+// Manifest of a blob.
+type blobManifest struct {
+	size      int64
+	chunkSize int64
+	gen       int64
+}
+
+// Makes a blob store.
+//
+// @param dbm The underlying database.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The new blob store.
+//
+// The optional parameter "prefix" specifies the prefix of the keys of the records so that blobs can share the database with other records.  The optional parameter "chunk_size" specifies the size of each chunk.  By default, it is 1MiB.  The chunk size of an existing blob is recorded in its manifest and it is used to read the blob.
+func NewBlobStore(dbm *DBM, params map[string]string) *BlobStore {
+	store := &BlobStore{
+		dbm:        dbm,
+		prefix:     params["prefix"],
+		chunkSize:  blobChunkSize,
+		activeGens: make(map[int64]bool),
+	}
+	if size := ToInt(params["chunk_size"]); size > 0 {
+		store.chunkSize = size
+	}
+	return store
+}
+
+// Makes a string representing the blob store.
+//
+// @return The string representing the blob store.
+func (self *BlobStore) String() string {
+	return fmt.Sprintf("#<tkrzw.BlobStore:%p:prefix=%q,chunk_size=%d>",
+		&self, self.prefix, self.chunkSize)
+}
+
+// Makes the key of the manifest of a blob.
+func (self *BlobStore) manifestKey(key []byte) []byte {
+	return append([]byte(self.prefix+"M"), key...)
+}
+
+// Makes the key of a chunk of a blob.
+func (self *BlobStore) chunkKey(key []byte, gen int64, index int64) []byte {
+	chunkKey := append([]byte(self.prefix+"C"), key...)
+	return append(chunkKey, fmt.Sprintf("\x00%016x%016x", gen, index)...)
+}
+
+// Serializes a manifest.
+func (self *blobManifest) serialize() []byte {
+	return []byte(fmt.Sprintf("size=%d,chunk_size=%d,gen=%d", self.size, self.chunkSize, self.gen))
+}
+
+// Gets the manifest of a blob.
+func (self *BlobStore) getManifest(key []byte) ([]byte, *blobManifest, *Status) {
+	data, status := self.dbm.Get(self.manifestKey(key))
+	if !status.IsOK() {
+		return nil, nil, status
+	}
+	fields := ParseParams(string(data))
+	manifest := &blobManifest{
+		size:      ToInt(fields["size"]),
+		chunkSize: ToInt(fields["chunk_size"]),
+		gen:       ToInt(fields["gen"]),
+	}
+	if manifest.chunkSize <= 0 || manifest.size < 0 {
+		return nil, nil, NewStatus2(StatusBrokenDataError, "invalid manifest")
+	}
+	return data, manifest, status
+}
+
+// Removes the chunks of a generation of a blob.
+func (self *BlobStore) removeChunks(key []byte, manifest *blobManifest) *Status {
+	status := NewStatus1(StatusSuccess)
+	numChunks := (manifest.size + manifest.chunkSize - 1) / manifest.chunkSize
+	for index := int64(0); index < numChunks; index++ {
+		removeStatus := self.dbm.Remove(self.chunkKey(key, manifest.gen, index))
+		if !removeStatus.Equals(StatusNotFoundError) {
+			status.Join(removeStatus)
+		}
+	}
+	return status
+}
+
+// Creates a blob.
+//
+// @param key The key of the blob.
+// @return The writer of the blob and the result status.
+//
+// The data written to the writer is not visible until the writer is closed.  If a blob of the same key exists, it is replaced atomically when the writer is closed and its chunks are removed.
+func (self *BlobStore) Create(key interface{}) (*BlobWriter, *Status) {
+	gen, status := self.dbm.Increment(self.prefix+"G", 1, 0)
+	if !status.IsOK() {
+		return nil, status
+	}
+	self.mutex.Lock()
+	self.activeGens[gen] = true
+	self.mutex.Unlock()
+	writer := &BlobWriter{
+		store:     self,
+		key:       ToByteArray(key),
+		gen:       gen,
+		chunkSize: self.chunkSize,
+		buf:       make([]byte, 0, self.chunkSize),
+	}
+	return writer, status
+}
+
+// Opens a blob to read.
+//
+// @param key The key of the blob.
+// @return The reader of the blob and the result status.  If there's no matching blob, the status is StatusNotFoundError.
+//
+// The reader reads the content at the time of opening.  If the blob is replaced or removed while reading, reading the remaining chunks fails with StatusNotFoundError.
+func (self *BlobStore) OpenReader(key interface{}) (*BlobReader, *Status) {
+	rawKey := ToByteArray(key)
+	_, manifest, status := self.getManifest(rawKey)
+	if !status.IsOK() {
+		return nil, status
+	}
+	return &BlobReader{store: self, key: rawKey, manifest: manifest, chunkIndex: -1}, status
+}
+
+// Gets the size of a blob.
+//
+// @param key The key of the blob.
+// @return The size of the blob and the result status.  If there's no matching blob, the status is StatusNotFoundError.
+func (self *BlobStore) Size(key interface{}) (int64, *Status) {
+	_, manifest, status := self.getManifest(ToByteArray(key))
+	if !status.IsOK() {
+		return 0, status
+	}
+	return manifest.size, status
+}
+
+// Removes a blob.
+//
+// @param key The key of the blob.
+// @return The result status.  If there's no matching blob, the status is StatusNotFoundError.
+//
+// The manifest is removed atomically and then the chunks are removed.
+func (self *BlobStore) Remove(key interface{}) *Status {
+	rawKey := ToByteArray(key)
+	for {
+		data, manifest, status := self.getManifest(rawKey)
+		if !status.IsOK() {
+			return status
+		}
+		status = self.dbm.CompareExchange(self.manifestKey(rawKey), data, nil)
+		if status.Equals(StatusInfeasibleError) {
+			continue
+		}
+		if !status.IsOK() {
+			return status
+		}
+		return self.removeChunks(rawKey, manifest)
+	}
+}
+
+// Removes chunks which are not referred to by any manifest.
+//
+// @return The number of removed chunks and the result status.
+//
+// Chunks of writers of this object which are not closed yet are kept.  However, chunks of writers of other objects or other processes are removed, so this method should be called when no other writer is active.  Chunks are left orphaned if a writer is not closed or the process crashes while writing or committing.
+func (self *BlobStore) CollectGarbage() (int64, *Status) {
+	chunkPrefix := []byte(self.prefix + "C")
+	self.mutex.Lock()
+	activeGens := make(map[int64]bool)
+	for gen := range self.activeGens {
+		activeGens[gen] = true
+	}
+	self.mutex.Unlock()
+	var orphans [][]byte
+	liveGens := make(map[string]int64)
+	iter := self.dbm.MakeIterator()
+	defer iter.Destruct()
+	var status *Status
+	ordered := self.dbm.IsOrdered()
+	if ordered {
+		status = iter.Jump(chunkPrefix)
+	} else {
+		status = iter.First()
+	}
+	for status.IsOK() {
+		var chunkKey []byte
+		chunkKey, status = iter.GetKey()
+		if !status.IsOK() {
+			break
+		}
+		status = iter.Next()
+		if !bytes.HasPrefix(chunkKey, chunkPrefix) {
+			if ordered {
+				break
+			}
+			continue
+		}
+		if len(chunkKey) < len(chunkPrefix)+blobChunkSuffixSize {
+			continue
+		}
+		keyEnd := len(chunkKey) - blobChunkSuffixSize
+		if chunkKey[keyEnd] != 0 {
+			continue
+		}
+		gen, err := strconv.ParseInt(string(chunkKey[keyEnd+1:keyEnd+17]), 16, 64)
+		if err != nil || activeGens[gen] {
+			continue
+		}
+		key := string(chunkKey[len(chunkPrefix):keyEnd])
+		liveGen, ok := liveGens[key]
+		if !ok {
+			liveGen = -1
+			if _, manifest, manifestStatus := self.getManifest([]byte(key)); manifestStatus.IsOK() {
+				liveGen = manifest.gen
+			}
+			liveGens[key] = liveGen
+		}
+		if gen != liveGen {
+			orphans = append(orphans, chunkKey)
+		}
+	}
+	if !status.Equals(StatusNotFoundError) && !status.IsOK() {
+		return 0, status
+	}
+	numRemoved := int64(0)
+	for _, chunkKey := range orphans {
+		if self.dbm.Remove(chunkKey).IsOK() {
+			numRemoved++
+		}
+	}
+	return numRemoved, NewStatus1(StatusSuccess)
+}
+
+// Writer of a blob.
+//
+// BlobWriter implements io.Writer and io.Closer.  Every writer should be closed by the "Close" method to commit the blob or discarded by the "Abort" method.
+type BlobWriter struct {
+	store     *BlobStore
+	key       []byte
+	gen       int64
+	chunkSize int64
+	size      int64
+	numChunks int64
+	buf       []byte
+	status    *Status
+	closed    bool
+}
+
+// Ends the writer and deactivates the generation.
+func (self *BlobWriter) end() {
+	self.closed = true
+	self.store.mutex.Lock()
+	delete(self.store.activeGens, self.gen)
+	self.store.mutex.Unlock()
+}
+
+// Stores the buffered data as a chunk.
+func (self *BlobWriter) flushChunk() *Status {
+	status := self.store.dbm.Set(
+		self.store.chunkKey(self.key, self.gen, self.numChunks), self.buf, true)
+	if status.IsOK() {
+		self.numChunks++
+		self.buf = self.buf[:0]
+	}
+	return status
+}
+
+// Writes data.
+//
+// @param p The data to write.
+// @return The number of bytes written and the error or nil.
+func (self *BlobWriter) Write(p []byte) (int, error) {
+	if self.closed {
+		return 0, NewStatus2(StatusPreconditionError, "closed writer")
+	}
+	if self.status != nil {
+		return 0, self.status
+	}
+	written := 0
+	for len(p) > 0 {
+		size := int(self.chunkSize) - len(self.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		self.buf = append(self.buf, p[:size]...)
+		p = p[size:]
+		written += size
+		self.size += int64(size)
+		if int64(len(self.buf)) >= self.chunkSize {
+			if status := self.flushChunk(); !status.IsOK() {
+				self.status = status
+				return written, status
+			}
+		}
+	}
+	return written, nil
+}
+
+// Commits the blob and closes the writer.
+//
+// @return The error or nil.
+//
+// The manifest is swapped atomically by CompareExchange.  If another writer of the same key commits concurrently, the last one wins.  On failure, the written chunks are removed.
+func (self *BlobWriter) Close() error {
+	if self.closed {
+		return NewStatus2(StatusPreconditionError, "closed writer")
+	}
+	defer self.end()
+	status := NewStatus1(StatusSuccess)
+	if self.status != nil {
+		status = self.status
+	} else if len(self.buf) > 0 {
+		status = self.flushChunk()
+	}
+	manifest := &blobManifest{self.size, self.chunkSize, self.gen}
+	if !status.IsOK() {
+		self.store.removeChunks(self.key, manifest)
+		return status
+	}
+	manifestKey := self.store.manifestKey(self.key)
+	for {
+		oldData, oldManifest, status := self.store.getManifest(self.key)
+		if !status.IsOK() && !status.Equals(StatusNotFoundError) {
+			self.store.removeChunks(self.key, manifest)
+			return status
+		}
+		status = self.store.dbm.CompareExchange(manifestKey, oldData, manifest.serialize())
+		if status.Equals(StatusInfeasibleError) {
+			continue
+		}
+		if !status.IsOK() {
+			self.store.removeChunks(self.key, manifest)
+			return status
+		}
+		if oldManifest != nil {
+			self.store.removeChunks(self.key, oldManifest)
+		}
+		return nil
+	}
+}
+
+// Discards the blob and closes the writer.
+//
+// @return The result status.
+func (self *BlobWriter) Abort() *Status {
+	if self.closed {
+		return NewStatus2(StatusPreconditionError, "closed writer")
+	}
+	defer self.end()
+	return self.store.removeChunks(self.key, &blobManifest{self.size, self.chunkSize, self.gen})
+}
+
+// Reader of a blob.
+//
+// BlobReader implements io.Reader, io.ReaderAt, io.Seeker, and io.Closer.
+type BlobReader struct {
+	store      *BlobStore
+	key        []byte
+	manifest   *blobManifest
+	offset     int64
+	chunkIndex int64
+	chunk      []byte
+}
+
+// Gets the size of the blob.
+//
+// @return The size of the blob.
+func (self *BlobReader) Size() int64 {
+	return self.manifest.size
+}
+
+// Loads a chunk into the cache.
+func (self *BlobReader) loadChunk(index int64) *Status {
+	if index == self.chunkIndex {
+		return NewStatus1(StatusSuccess)
+	}
+	chunk, status := self.store.dbm.GetInto(
+		self.store.chunkKey(self.key, self.manifest.gen, index), self.chunk)
+	if !status.IsOK() {
+		return status
+	}
+	self.chunk = chunk
+	self.chunkIndex = index
+	return status
+}
+
+// Reads data at a position.
+//
+// @param p The buffer to store the read data.
+// @param off The offset of the position.
+// @return The number of bytes read and the error or nil.  If the number is less than the buffer size, io.EOF or another error is returned.
+func (self *BlobReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, NewStatus2(StatusInvalidArgumentError, "negative offset")
+	}
+	read := 0
+	for read < len(p) {
+		if off >= self.manifest.size {
+			return read, io.EOF
+		}
+		index := off / self.manifest.chunkSize
+		status := self.loadChunk(index)
+		if !status.IsOK() {
+			return read, status
+		}
+		chunkOff := off - index*self.manifest.chunkSize
+		if chunkOff >= int64(len(self.chunk)) {
+			return read, NewStatus2(StatusBrokenDataError, "short chunk")
+		}
+		size := copy(p[read:], self.chunk[chunkOff:])
+		read += size
+		off += int64(size)
+	}
+	return read, nil
+}
+
+// Reads data at the cursor and advances the cursor.
+//
+// @param p The buffer to store the read data.
+// @return The number of bytes read and the error or nil.  io.EOF is returned if the cursor is at the end of the blob.
+func (self *BlobReader) Read(p []byte) (int, error) {
+	n, err := self.ReadAt(p, self.offset)
+	self.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Sets the cursor.
+//
+// @param offset The offset relative to the origin.
+// @param whence The origin: io.SeekStart, io.SeekCurrent, or io.SeekEnd.
+// @return The new offset from the beginning of the blob and the error or nil.
+func (self *BlobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += self.offset
+	case io.SeekEnd:
+		offset += self.manifest.size
+	default:
+		return self.offset, NewStatus2(StatusInvalidArgumentError, "invalid whence")
+	}
+	if offset < 0 {
+		return self.offset, NewStatus2(StatusInvalidArgumentError, "negative offset")
+	}
+	self.offset = offset
+	return offset, nil
+}
+
+// Closes the reader.
+//
+// @return The error or nil.
+func (self *BlobReader) Close() error {
+	self.chunk = nil
+	self.chunkIndex = -1
+	return nil
+}
+
+// END OF FILE
@@ -0,0 +1,446 @@
+/*************************************************************************************************
+ * Bulk loading of records
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"fmt"
+	"github.com/estraier/tkrzw-go/flatrec"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The default number of records set at once by batch updates, like bulk loading and importing.
+const defaultBatchSize = 1000
+
+// The default size of the sort buffer of the bulk loader.
+const bulkSortBufferSize = 64 << 20
+
+// Statistics of bulk loading.
+type BulkLoadStats struct {
+	// The number of added records.
+	NumRecords int64
+	// The total size of added keys and values.
+	NumBytes int64
+	// The number of sorted runs spilled to temporary files.
+	NumSpills int64
+	// The elapsed time in seconds.
+	Elapsed float64
+}
+
+// Makes a string representing the statistics.
+//
+// @return The string representing the statistics.
+func (self *BulkLoadStats) String() string {
+	return fmt.Sprintf(
+		"#<tkrzw.BulkLoadStats:records=%d,bytes=%d,spills=%d,elapsed=%.3f,qps=%.1f>",
+		self.NumRecords, self.NumBytes, self.NumSpills, self.Elapsed, self.RecordsPerSec())
+}
+
+// Gets the throughput in records.
+//
+// @return The number of records per second.
+func (self *BulkLoadStats) RecordsPerSec() float64 {
+	if self.Elapsed <= 0 {
+		return 0
+	}
+	return float64(self.NumRecords) / self.Elapsed
+}
+
+// Gets the throughput in bytes.
+//
+// @return The number of bytes per second.
+func (self *BulkLoadStats) BytesPerSec() float64 {
+	if self.Elapsed <= 0 {
+		return 0
+	}
+	return float64(self.NumBytes) / self.Elapsed
+}
+
+// Loader to store a large number of records efficiently.
+//
+// Records are stored by the SetMulti method in batches to reduce the number of calls to the native library.  Every loader should be finished by the "Finish" method.  The methods can be called from multiple threads.
+type BulkLoader struct {
+	dbm            *DBM
+	batchSize      int
+	inOrder        bool
+	sortedInput    bool
+	sortBufferSize int64
+	tmpDir         string
+	finish         string
+	rebuildParams  map[string]string
+	mutex          sync.Mutex
+	status         *Status
+	finished       bool
+	stats          BulkLoadStats
+	startTime      time.Time
+	batches        []map[string][]byte
+	channels       []chan map[string][]byte
+	workerStatuses []*Status
+	wg             sync.WaitGroup
+	lastKey        []byte
+	sortBuffer     []KeyValuePair
+	sortBufferUsed int64
+	runPaths       []string
+}
+
+// Makes a bulk loader.
+//
+// @param dbm The database to store records in.  It should be opened as writable.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The new bulk loader.
+//
+// The optional parameter "batch_size" specifies the number of records stored by each call of SetMulti.  By default, it is 1000.  The optional parameter "num_workers" specifies the number of threads to store records.  Records are distributed to the threads by the secondary hash of the key, which is the same way as ShardDBM chooses shards.  Thus, setting the number of shards parallelizes writes across shards.  By default, it is the number of shards of ShardDBM or 1 otherwise.
+//
+// The optional parameter "insert_in_order" makes records stored in the ascending order of the key, which is required by SkipDBM opened with the "insert_in_order" parameter.  If the optional parameter "sorted_input" is also true, records are passed through without sorting and the loader fails if the order is violated.  Otherwise, records are sorted in a buffer whose size is specified by the optional parameter "sort_buffer_size", 64MiB by default.  When the buffer is full, the sorted records are spilled to a temporary file in the directory specified by the optional parameter "tmp_dir" and all of them are merged by the Finish method.
+//
+// The optional parameter "finish" specifies the operation done by the Finish method: "sync" to call Synchronize, "rebuild" to call Rebuild, or "none" to do nothing.  By default, "sync" is used.  Other optional parameters beginning with "rebuild_" are given to the Rebuild method without the prefix.
+func NewBulkLoader(dbm *DBM, params map[string]string) *BulkLoader {
+	loader := &BulkLoader{
+		dbm:            dbm,
+		batchSize:      defaultBatchSize,
+		inOrder:        ToInt(params["insert_in_order"]) > 0 || params["insert_in_order"] == "true",
+		sortedInput:    ToInt(params["sorted_input"]) > 0 || params["sorted_input"] == "true",
+		sortBufferSize: bulkSortBufferSize,
+		tmpDir:         params["tmp_dir"],
+		finish:         "sync",
+		rebuildParams:  make(map[string]string),
+		status:         NewStatus1(StatusSuccess),
+		startTime:      time.Now(),
+	}
+	if num := ToInt(params["batch_size"]); num > 0 {
+		loader.batchSize = int(num)
+	}
+	if num := ToInt(params["sort_buffer_size"]); num > 0 {
+		loader.sortBufferSize = num
+	}
+	if expr, ok := params["finish"]; ok {
+		loader.finish = expr
+	}
+	for name, value := range params {
+		if len(name) > 8 && name[:8] == "rebuild_" {
+			loader.rebuildParams[name[8:]] = value
+		}
+	}
+	numWorkers := int(ToInt(params["num_workers"]))
+	if numWorkers < 1 {
+		numWorkers = int(ToInt(dbm.Inspect()["num_shards"]))
+	}
+	if numWorkers < 1 || loader.inOrder {
+		numWorkers = 1
+	}
+	loader.batches = make([]map[string][]byte, numWorkers)
+	loader.workerStatuses = make([]*Status, numWorkers)
+	for i := range loader.batches {
+		loader.batches[i] = make(map[string][]byte)
+		loader.workerStatuses[i] = NewStatus1(StatusSuccess)
+	}
+	if numWorkers > 1 {
+		loader.channels = make([]chan map[string][]byte, numWorkers)
+		for i := range loader.channels {
+			loader.channels[i] = make(chan map[string][]byte, 2)
+			loader.wg.Add(1)
+			go loader.work(i)
+		}
+	}
+	return loader
+}
+
+// Makes a string representing the loader.
+//
+// @return The string representing the loader.
+func (self *BulkLoader) String() string {
+	stats := self.Stats()
+	return fmt.Sprintf("#<tkrzw.BulkLoader:%p:records=%d,bytes=%d>",
+		&self, stats.NumRecords, stats.NumBytes)
+}
+
+// Stores batches sent to a worker thread.
+func (self *BulkLoader) work(id int) {
+	defer self.wg.Done()
+	for batch := range self.channels[id] {
+		if self.workerStatuses[id].IsOK() {
+			self.workerStatuses[id] = self.dbm.SetMulti(batch, true)
+		}
+	}
+}
+
+// Adds a record into the batch of a worker and sends the batch if it is full.
+//
+// Although Go maps are iterated at random, the records of each batch are stored in the ascending order of the key, as required by "insert_in_order", because the native SetMulti puts them into a sorted map before storing them.  As batches are stored one by one by a single worker in that case, the whole order is kept too.
+func (self *BulkLoader) addToBatch(key []byte, value []byte) *Status {
+	id := 0
+	if len(self.batches) > 1 {
+		id = int(SecondaryHash(key, uint64(len(self.batches))))
+	}
+	batch := self.batches[id]
+	batch[string(key)] = value
+	if len(batch) < self.batchSize {
+		return NewStatus1(StatusSuccess)
+	}
+	self.batches[id] = make(map[string][]byte)
+	if self.channels != nil {
+		self.channels[id] <- batch
+		return NewStatus1(StatusSuccess)
+	}
+	return self.dbm.SetMulti(batch, true)
+}
+
+// Adds a record.
+//
+// @param key The key of the record.
+// @param value The value of the record.
+// @return The result status.  If an error has occurred in the loader, the error is returned.
+//
+// Records of the same key are stored in the order of addition so that the last value wins.
+func (self *BulkLoader) Add(key interface{}, value interface{}) *Status {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.finished {
+		return NewStatus2(StatusPreconditionError, "finished loader")
+	}
+	if !self.status.IsOK() {
+		return self.status
+	}
+	rawKey := append([]byte{}, ToByteArray(key)...)
+	rawValue := append([]byte{}, ToByteArray(value)...)
+	if self.inOrder && !self.sortedInput {
+		self.sortBuffer = append(self.sortBuffer, KeyValuePair{rawKey, rawValue})
+		self.sortBufferUsed += int64(len(rawKey) + len(rawValue))
+		if self.sortBufferUsed >= self.sortBufferSize {
+			self.status = self.spill()
+		}
+	} else {
+		if self.inOrder {
+			if self.lastKey != nil && bytes.Compare(rawKey, self.lastKey) < 0 {
+				self.status = NewStatus2(StatusInvalidArgumentError, "unsorted input")
+				return self.status
+			}
+			self.lastKey = rawKey
+		}
+		self.status = self.addToBatch(rawKey, rawValue)
+	}
+	if self.status.IsOK() {
+		self.stats.NumRecords++
+		self.stats.NumBytes += int64(len(rawKey) + len(rawValue))
+	}
+	return self.status
+}
+
+// Sorts the records in the sort buffer and writes them into a temporary file.
+func (self *BulkLoader) spill() *Status {
+	sort.SliceStable(self.sortBuffer, func(i, j int) bool {
+		return bytes.Compare(self.sortBuffer[i].Key, self.sortBuffer[j].Key) < 0
+	})
+	file, err := ioutil.TempFile(self.tmpDir, "tkrzw-bulk-*.dat")
+	if err != nil {
+		return errorToStatus(err)
+	}
+	self.runPaths = append(self.runPaths, file.Name())
+	bufWriter := bufio.NewWriter(file)
+	writer := flatrec.NewFlatRecordWriter(bufWriter)
+	for _, record := range self.sortBuffer {
+		writer.WriteKeyValue(record.Key, record.Value)
+	}
+	status := errorToStatus(bufWriter.Flush())
+	status.Join(errorToStatus(file.Close()))
+	self.sortBuffer = nil
+	self.sortBufferUsed = 0
+	self.stats.NumSpills++
+	return status
+}
+
+// Cursor of a sorted run in merging.
+type bulkRunCursor struct {
+	reader *flatrec.FlatRecordReader
+	file   *os.File
+	order  int
+	key    []byte
+	value  []byte
+	buffer []KeyValuePair
+}
+
+// Reads the next record of the run.
+func (self *bulkRunCursor) next() (bool, *Status) {
+	if self.file == nil {
+		if len(self.buffer) == 0 {
+			return false, NewStatus1(StatusSuccess)
+		}
+		self.key, self.value = self.buffer[0].Key, self.buffer[0].Value
+		self.buffer = self.buffer[1:]
+		return true, NewStatus1(StatusSuccess)
+	}
+	key, value, err := self.reader.ReadKeyValue()
+	if err == io.EOF {
+		return false, NewStatus1(StatusSuccess)
+	}
+	if err != nil {
+		return false, errorToStatus(err)
+	}
+	self.key, self.value = key, value
+	return true, NewStatus1(StatusSuccess)
+}
+
+// Heap of run cursors ordered by the key and the order of the run.
+type bulkRunHeap []*bulkRunCursor
+
+func (self bulkRunHeap) Len() int {
+	return len(self)
+}
+
+func (self bulkRunHeap) Less(i, j int) bool {
+	cmp := bytes.Compare(self[i].key, self[j].key)
+	if cmp != 0 {
+		return cmp < 0
+	}
+	return self[i].order < self[j].order
+}
+
+func (self bulkRunHeap) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func (self *bulkRunHeap) Push(x interface{}) {
+	*self = append(*self, x.(*bulkRunCursor))
+}
+
+func (self *bulkRunHeap) Pop() interface{} {
+	old := *self
+	cursor := old[len(old)-1]
+	*self = old[:len(old)-1]
+	return cursor
+}
+
+// Merges the spilled runs and the sort buffer and stores them in order.
+func (self *BulkLoader) merge() *Status {
+	sort.SliceStable(self.sortBuffer, func(i, j int) bool {
+		return bytes.Compare(self.sortBuffer[i].Key, self.sortBuffer[j].Key) < 0
+	})
+	cursors := &bulkRunHeap{}
+	status := NewStatus1(StatusSuccess)
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for i, runPath := range self.runPaths {
+		file, err := os.Open(runPath)
+		if err != nil {
+			return errorToStatus(err)
+		}
+		files = append(files, file)
+		cursor := &bulkRunCursor{reader: flatrec.NewFlatRecordReader(file), file: file, order: i}
+		ok, status := cursor.next()
+		if !status.IsOK() {
+			return status
+		}
+		if ok {
+			heap.Push(cursors, cursor)
+		}
+	}
+	cursor := &bulkRunCursor{order: len(self.runPaths), buffer: self.sortBuffer}
+	if ok, _ := cursor.next(); ok {
+		heap.Push(cursors, cursor)
+	}
+	for cursors.Len() > 0 && status.IsOK() {
+		cursor := (*cursors)[0]
+		status = self.addToBatch(cursor.key, cursor.value)
+		ok, nextStatus := cursor.next()
+		status.Join(nextStatus)
+		if ok {
+			heap.Fix(cursors, 0)
+		} else {
+			heap.Pop(cursors)
+		}
+	}
+	self.sortBuffer = nil
+	return status
+}
+
+// Stores all remaining records and finishes the loader.
+//
+// @return The statistics and the result status.
+//
+// Temporary files are removed and the operation specified by the "finish" parameter is done.  The loader cannot be used after this method is called.
+func (self *BulkLoader) Finish() (*BulkLoadStats, *Status) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.finished {
+		return nil, NewStatus2(StatusPreconditionError, "finished loader")
+	}
+	self.finished = true
+	status := NewStatus1(StatusSuccess)
+	status.Join(self.status)
+	if status.IsOK() && self.inOrder && !self.sortedInput {
+		status = self.merge()
+	}
+	for _, runPath := range self.runPaths {
+		os.Remove(runPath)
+	}
+	self.runPaths = nil
+	for i, batch := range self.batches {
+		if len(batch) > 0 && status.IsOK() {
+			if self.channels != nil {
+				self.channels[i] <- batch
+			} else {
+				status = self.dbm.SetMulti(batch, true)
+			}
+		}
+		self.batches[i] = make(map[string][]byte)
+	}
+	if self.channels != nil {
+		for _, channel := range self.channels {
+			close(channel)
+		}
+		self.wg.Wait()
+		self.channels = nil
+	}
+	for _, workerStatus := range self.workerStatuses {
+		status.Join(workerStatus)
+	}
+	if status.IsOK() {
+		switch self.finish {
+		case "sync":
+			status = self.dbm.Synchronize(false, nil)
+		case "rebuild":
+			status = self.dbm.Rebuild(self.rebuildParams)
+		}
+	}
+	self.status = status
+	self.stats.Elapsed = time.Since(self.startTime).Seconds()
+	stats := self.stats
+	return &stats, status
+}
+
+// Gets the statistics of the loader.
+//
+// @return The statistics at the moment.
+func (self *BulkLoader) Stats() *BulkLoadStats {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	stats := self.stats
+	if !self.finished {
+		stats.Elapsed = time.Since(self.startTime).Seconds()
+	}
+	return &stats
+}
+
+// END OF FILE
@@ -0,0 +1,286 @@
+/*************************************************************************************************
+ * Content-addressable object store
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Store of objects keyed by the SHA-256 digests of their content.
+//
+// Each object is stored as an object record and a reference count record.  The object record has the key made of the prefix, "O", and the digest in lowercase hexadecimal.  The reference count record has the key made of the prefix, "R", and the digest.  Its value is an 8-byte big-endian integer maintained by DBM.Increment.  Objects whose reference counts are zero or less are removed by garbage collection.
+type CAS struct {
+	// The underlying database.
+	dbm *DBM
+	// The prefix of the keys.
+	prefix string
+}
+
+// Makes a content-addressable store.
+//
+// @param dbm The underlying database.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The new content-addressable store.
+//
+// The optional parameter "prefix" specifies the prefix of the keys of the records so that objects can share the database with other records.
+func NewCAS(dbm *DBM, params map[string]string) *CAS {
+	return &CAS{dbm: dbm, prefix: params["prefix"]}
+}
+
+// Makes a string representing the content-addressable store.
+//
+// @return The string representing the content-addressable store.
+func (self *CAS) String() string {
+	return fmt.Sprintf("#<tkrzw.CAS:%p:prefix=%q>", &self, self.prefix)
+}
+
+// Calculates the digest of data.
+//
+// @param data The data.
+// @return The SHA-256 digest in lowercase hexadecimal.
+func CASDigest(data interface{}) string {
+	sum := sha256.Sum256(ToByteArray(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// Checks whether a string is a valid digest.
+func isValidCASDigest(digest string) bool {
+	if len(digest) != sha256.Size*2 {
+		return false
+	}
+	for i := 0; i < len(digest); i++ {
+		c := digest[i]
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Makes the key of an object record.
+func (self *CAS) objectKey(digest string) string {
+	return self.prefix + "O" + digest
+}
+
+// Makes the key of a reference count record.
+func (self *CAS) refKey(digest string) string {
+	return self.prefix + "R" + digest
+}
+
+// Stores an object and increments its reference count.
+//
+// @param data The content of the object.
+// @return The digest of the object and the result status.
+//
+// If the same content is already stored, the content is not written again and only the reference count is incremented.  The reference count is incremented before the object is stored so that concurrent garbage collection doesn't remove the object.
+func (self *CAS) Put(data interface{}) (string, *Status) {
+	rawData := ToByteArray(data)
+	digest := CASDigest(rawData)
+	_, status := self.dbm.Increment(self.refKey(digest), 1, 0)
+	if !status.IsOK() {
+		return "", status
+	}
+	status = self.dbm.Set(self.objectKey(digest), rawData, false)
+	if status.Equals(StatusDuplicationError) {
+		status = NewStatus1(StatusSuccess)
+	}
+	if !status.IsOK() {
+		self.decrementRef(digest)
+		return "", status
+	}
+	return digest, status
+}
+
+// Gets an object and verifies its content.
+//
+// @param digest The digest of the object.
+// @return The content of the object and the result status.  If there's no matching object, StatusNotFoundError is returned.  If the content doesn't match the digest, StatusBrokenDataError is returned.
+func (self *CAS) Get(digest string) ([]byte, *Status) {
+	if !isValidCASDigest(digest) {
+		return nil, NewStatus2(StatusInvalidArgumentError, "invalid digest")
+	}
+	data, status := self.dbm.Get(self.objectKey(digest))
+	if !status.IsOK() {
+		return nil, status
+	}
+	if CASDigest(data) != digest {
+		return nil, NewStatus2(StatusBrokenDataError, "digest mismatch")
+	}
+	return data, status
+}
+
+// Checks whether an object exists.
+//
+// @param digest The digest of the object.
+// @return True if the object exists, or false if not.
+func (self *CAS) Contains(digest string) bool {
+	if !isValidCASDigest(digest) {
+		return false
+	}
+	_, status := self.dbm.Get(self.objectKey(digest))
+	return status.IsOK()
+}
+
+// Increments the reference count of an existing object.
+//
+// @param digest The digest of the object.
+// @return The new reference count and the result status.  If there's no matching object, StatusNotFoundError is returned.
+func (self *CAS) AddRef(digest string) (int64, *Status) {
+	if !isValidCASDigest(digest) {
+		return 0, NewStatus2(StatusInvalidArgumentError, "invalid digest")
+	}
+	count, status := self.dbm.Increment(self.refKey(digest), 1, 0)
+	if !status.IsOK() {
+		return 0, status
+	}
+	if !self.Contains(digest) {
+		self.decrementRef(digest)
+		return 0, NewStatus2(StatusNotFoundError, "no such object")
+	}
+	return count, status
+}
+
+// Decrements the reference count of an object.
+//
+// @param digest The digest of the object.
+// @return The new reference count and the result status.  If there's no matching reference count, StatusNotFoundError is returned.
+//
+// The object is not removed immediately even if the count becomes zero.  It is removed by the "CollectGarbage" method.  The count is decremented atomically by the "Process" method and it doesn't go below zero.
+func (self *CAS) Release(digest string) (int64, *Status) {
+	if !isValidCASDigest(digest) {
+		return 0, NewStatus2(StatusInvalidArgumentError, "invalid digest")
+	}
+	return self.decrementRef(digest)
+}
+
+// Decrements an existing reference count atomically, without going below zero.
+func (self *CAS) decrementRef(digest string) (int64, *Status) {
+	count := int64(0)
+	found := false
+	status := self.dbm.Process(self.refKey(digest), func(key []byte, value []byte) interface{} {
+		if value == nil {
+			return nil
+		}
+		found = true
+		count = DeserializeInt(value)
+		if count <= 0 {
+			count = 0
+			return nil
+		}
+		count--
+		return SerializeInt(count)
+	}, true)
+	if !status.IsOK() {
+		return 0, status
+	}
+	if !found {
+		return 0, NewStatus2(StatusNotFoundError, "no reference count")
+	}
+	return count, status
+}
+
+// Gets the reference count of an object.
+//
+// @param digest The digest of the object.
+// @return The reference count and the result status.  If there's no matching reference count, StatusNotFoundError is returned.
+func (self *CAS) RefCount(digest string) (int64, *Status) {
+	if !isValidCASDigest(digest) {
+		return 0, NewStatus2(StatusInvalidArgumentError, "invalid digest")
+	}
+	data, status := self.dbm.Get(self.refKey(digest))
+	if !status.IsOK() {
+		return 0, status
+	}
+	return DeserializeInt(data), status
+}
+
+// Removes objects which are not referred to.
+//
+// @return The number of removed objects and the result status.
+//
+// An object is removed if its reference count is zero or less, or if it has no reference count record.  Each object is removed together with its reference count record by CompareExchangeMulti on condition that the reference count is not changed, so objects referred to concurrently are kept.
+func (self *CAS) CollectGarbage() (int64, *Status) {
+	var digests []string
+	checked := make(map[string]bool)
+	ordered := self.dbm.IsOrdered()
+	for _, kind := range []string{"R", "O"} {
+		prefix := []byte(self.prefix + kind)
+		iter := self.dbm.MakeIterator()
+		var status *Status
+		if ordered {
+			status = iter.Jump(prefix)
+		} else {
+			status = iter.First()
+		}
+		for status.IsOK() {
+			var key, value []byte
+			key, value, status = iter.Get()
+			if !status.IsOK() {
+				break
+			}
+			status = iter.Next()
+			if !bytes.HasPrefix(key, prefix) {
+				if ordered {
+					break
+				}
+				continue
+			}
+			digest := string(key[len(prefix):])
+			if !isValidCASDigest(digest) || checked[digest] {
+				continue
+			}
+			checked[digest] = true
+			if kind == "R" {
+				if DeserializeInt(value) <= 0 {
+					digests = append(digests, digest)
+				}
+			} else {
+				if _, refStatus := self.dbm.Get(self.refKey(digest)); refStatus.Equals(
+					StatusNotFoundError) {
+					digests = append(digests, digest)
+				}
+			}
+		}
+		iter.Destruct()
+		if !status.IsOK() && !status.Equals(StatusNotFoundError) {
+			return 0, status
+		}
+	}
+	numRemoved := int64(0)
+	for _, digest := range digests {
+		refKey := []byte(self.refKey(digest))
+		objectKey := []byte(self.objectKey(digest))
+		refData, status := self.dbm.Get(refKey)
+		if status.IsOK() && DeserializeInt(refData) > 0 {
+			continue
+		}
+		if !status.IsOK() && !status.Equals(StatusNotFoundError) {
+			return numRemoved, status
+		}
+		expected := []KeyValuePair{{refKey, refData}}
+		desired := []KeyValuePair{{refKey, nil}, {objectKey, nil}}
+		status = self.dbm.CompareExchangeMulti(expected, desired)
+		if status.IsOK() {
+			numRemoved++
+		} else if !status.Equals(StatusInfeasibleError) {
+			return numRemoved, status
+		}
+	}
+	return numRemoved, NewStatus1(StatusSuccess)
+}
+
+// END OF FILE
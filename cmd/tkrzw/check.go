@@ -0,0 +1,82 @@
+/*************************************************************************************************
+ * Check subcommand of the command-line utility
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"github.com/estraier/tkrzw-go"
+)
+
+func runCheck(args []string) int {
+	flags := newFlagSet("check")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	flagClass := flags.String("class", "", "the class name of the database")
+	flagCipherKey := flags.String("cipher_key", "", "the encryption key for cipher compressors")
+	flagRepair := flags.String("repair", "", "the path of the repaired database to be written")
+	if !parseFlags(flags, args, 1) {
+		return 2
+	}
+	path := flags.Arg(0)
+	params := tkrzw.ParseParams(*flagParams)
+	if *flagClass != "" {
+		params["dbm"] = *flagClass
+	}
+	if *flagCipherKey != "" {
+		params["cipher_key"] = *flagCipherKey
+	}
+	report, status := tkrzw.VerifyDatabase(path, params)
+	if report == nil {
+		printError(status)
+		return 1
+	}
+	fmt.Printf("class: %s\n", report.Class)
+	fmt.Printf("healthy: %t\n", report.Healthy)
+	fmt.Printf("record_crc_mode: %s\n", report.RecordCRCMode)
+	fmt.Printf("file_size: %d\n", report.FileSize)
+	fmt.Printf("num_records: %d\n", report.NumRecords)
+	fmt.Printf("num_scanned: %d\n", report.NumScanned)
+	fmt.Printf("num_broken_regions: %d\n", len(report.BrokenRegions))
+	for _, region := range report.BrokenRegions {
+		offset := "unknown"
+		if region.Offset >= 0 {
+			offset = fmt.Sprintf("%d", region.Offset)
+		}
+		prevKey := "(beginning)"
+		if region.PrevKey != nil {
+			prevKey = fmt.Sprintf("%q", region.PrevKey)
+		}
+		fmt.Printf("broken: offset=%s after=%s error=%s\n", offset, prevKey, region.Message)
+	}
+	if !status.IsOK() {
+		printError(status)
+	}
+	if *flagRepair != "" {
+		repair, status := tkrzw.RepairDatabase(path, *flagRepair, *flagClass, *flagCipherKey)
+		if !status.IsOK() {
+			printError(status)
+			return 1
+		}
+		fmt.Printf("repaired: %s\n", *flagRepair)
+		fmt.Printf("num_expected: %d\n", repair.NumExpected)
+		fmt.Printf("num_recovered: %d\n", repair.NumRecovered)
+		fmt.Printf("num_lost: %d\n", repair.NumLost)
+		return 0
+	}
+	if !report.IsOK() || !status.IsOK() {
+		return 1
+	}
+	return 0
+}
+
+// END OF FILE
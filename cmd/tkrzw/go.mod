@@ -0,0 +1,7 @@
+module github.com/estraier/tkrzw-go/cmd/tkrzw
+
+go 1.14
+
+replace github.com/estraier/tkrzw-go => ../../../tkrzw-go
+
+require github.com/estraier/tkrzw-go v0.0.0-00010101000000-000000000000
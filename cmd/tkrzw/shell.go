@@ -0,0 +1,520 @@
+/*************************************************************************************************
+ * Interactive shell of the command-line utility
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/estraier/tkrzw-go"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// The maximum number of candidates of completion.
+const shellMaxCandidates = 100
+
+var shellHelp = []string{
+	"first                    move the cursor to the first record",
+	"last                     move the cursor to the last record",
+	"next                     move the cursor to the next record",
+	"prev                     move the cursor to the previous record",
+	"jump key [value]         move the cursor to the record of the key",
+	"cur                      show the record at the cursor",
+	"get key                  show the value of the key",
+	"set key value            set the value of the key",
+	"remove key [value]       remove the record of the key",
+	"search mode pattern      search for keys, paginated; indexes support only prefixes",
+	"more                     show the next page of the search result",
+	"pagesize num             set the number of keys per page",
+	"count                    show the number of records",
+	"display escape|hex       set how keys and values are displayed",
+	"transcript path|off      start or stop recording the session",
+	"help                     show this help",
+	"quit                     quit the shell",
+}
+
+// State of the interactive shell.
+type shell struct {
+	dbm        *tkrzw.DBM
+	index      *tkrzw.Index
+	iter       *tkrzw.Iterator
+	indexIter  *tkrzw.IndexIterator
+	hexMode    bool
+	pageSize   int
+	searchMode string
+	searchPat  string
+	searchPage int
+	transcript *os.File
+}
+
+// Writes a line to the standard output and the transcript.
+func (self *shell) printf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	fmt.Print(line)
+	if self.transcript != nil {
+		self.transcript.WriteString(line)
+	}
+}
+
+// Formats data in the display mode.
+func (self *shell) format(data []byte) string {
+	if self.hexMode {
+		return hex.EncodeToString(data)
+	}
+	return tkrzw.EscapeCStyle(data)
+}
+
+// Parses an argument in the display mode.
+func (self *shell) parseArg(arg string) []byte {
+	if self.hexMode {
+		if data, err := hex.DecodeString(arg); err == nil {
+			return data
+		}
+	}
+	return []byte(arg)
+}
+
+// Splits a command line into arguments.
+//
+// Arguments are separated by spaces.  Double-quoted arguments can contain spaces and C-style escapes.
+func splitCommandLine(line string) []string {
+	var args []string
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+		if line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end > len(line) {
+				end = len(line)
+			}
+			args = append(args, string(tkrzw.UnescapeCStyle(line[i+1:end])))
+			i = end + 1
+			continue
+		}
+		end := i
+		for end < len(line) && line[end] != ' ' && line[end] != '\t' {
+			end++
+		}
+		args = append(args, line[i:end])
+		i = end
+	}
+	return args
+}
+
+// Quotes an argument if necessary.
+func quoteArg(arg string) string {
+	escaped := tkrzw.EscapeCStyle([]byte(arg))
+	if escaped == arg && !strings.ContainsAny(arg, " \"") && len(arg) > 0 {
+		return arg
+	}
+	return "\"" + strings.Replace(escaped, "\"", "\\\"", -1) + "\""
+}
+
+// Gets keys beginning with a prefix.
+func (self *shell) getKeysWithPrefix(prefix string, capacity int) []string {
+	if self.dbm != nil {
+		return self.dbm.Search("begin", prefix, capacity)
+	}
+	var keys []string
+	iter := self.index.MakeIterator()
+	defer iter.Destruct()
+	iter.Jump(prefix, "")
+	for len(keys) < capacity {
+		key, _, ok := iter.GetStr()
+		if !ok || !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if len(keys) == 0 || keys[len(keys)-1] != key {
+			keys = append(keys, key)
+		}
+		iter.Next()
+	}
+	return keys
+}
+
+// Completes the last argument of a command line.
+func (self *shell) complete(line string) (string, []string) {
+	start := strings.LastIndexAny(line, " \t") + 1
+	prefix := line[start:]
+	var keys []string
+	if start == 0 {
+		for _, help := range shellHelp {
+			name := strings.Fields(help)[0]
+			if strings.HasPrefix(name, prefix) {
+				keys = append(keys, name)
+			}
+		}
+	} else {
+		if strings.HasPrefix(prefix, "\"") {
+			prefix = string(tkrzw.UnescapeCStyle(prefix[1:]))
+		}
+		keys = self.getKeysWithPrefix(prefix, shellMaxCandidates)
+	}
+	if len(keys) == 0 {
+		return line, nil
+	}
+	common := keys[0]
+	for _, key := range keys[1:] {
+		for !strings.HasPrefix(key, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(keys) > 1 && len(common) <= len(prefix) {
+		return line, keys
+	}
+	completed := quoteArg(common)
+	if len(keys) > 1 && strings.HasSuffix(completed, "\"") && completed != common {
+		completed = completed[:len(completed)-1]
+	}
+	if len(keys) == 1 {
+		completed += " "
+	}
+	return line[:start] + completed, nil
+}
+
+// Runs the stty command on the terminal.
+func runStty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+// Reads a line in the raw mode of the terminal, with completion.
+func (self *shell) readLineRaw(reader *bufio.Reader, prompt string) (string, error) {
+	fmt.Print(prompt)
+	var line []byte
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '\r', '\n':
+			fmt.Print("\r\n")
+			return string(line), nil
+		case 0x04:
+			if len(line) == 0 {
+				fmt.Print("\r\n")
+				return "", io.EOF
+			}
+		case 0x7f, 0x08:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				fmt.Print("\b \b")
+			}
+		case 0x15:
+			fmt.Print("\r\x1b[K" + prompt)
+			line = line[:0]
+		case 0x1b:
+			if next, _ := reader.ReadByte(); next == '[' {
+				reader.ReadByte()
+			}
+		case '\t':
+			completed, candidates := self.complete(string(line))
+			if len(candidates) > 0 {
+				fmt.Print("\r\n" + strings.Join(candidates, "  ") + "\r\n")
+			}
+			line = []byte(completed)
+			fmt.Print("\r\x1b[K" + prompt + completed)
+		default:
+			if c >= 0x20 {
+				line = append(line, c)
+				os.Stdout.Write([]byte{c})
+			}
+		}
+	}
+}
+
+// Shows the record at the cursor.
+func (self *shell) showCursor() {
+	if self.dbm != nil {
+		key, value, status := self.iter.Get()
+		if !status.IsOK() {
+			self.printf("%s\n", status.String())
+			return
+		}
+		self.printf("%s\t%s\n", self.format(key), self.format(value))
+		return
+	}
+	key, value, ok := self.indexIter.Get()
+	if !ok {
+		self.printf("no record\n")
+		return
+	}
+	self.printf("%s\t%s\n", self.format(key), self.format(value))
+}
+
+// Moves the cursor and shows the record.
+func (self *shell) move(name string, args []string) {
+	if self.dbm != nil {
+		var status *tkrzw.Status
+		switch name {
+		case "first":
+			status = self.iter.First()
+		case "last":
+			status = self.iter.Last()
+		case "next":
+			status = self.iter.Next()
+		case "prev":
+			status = self.iter.Previous()
+		case "jump":
+			status = self.iter.Jump(self.parseArg(args[0]))
+		}
+		if !status.IsOK() {
+			self.printf("%s\n", status.String())
+			return
+		}
+	} else {
+		switch name {
+		case "first":
+			self.indexIter.First()
+		case "last":
+			self.indexIter.Last()
+		case "next":
+			self.indexIter.Next()
+		case "prev":
+			self.indexIter.Previous()
+		case "jump":
+			value := []byte{}
+			if len(args) > 1 {
+				value = self.parseArg(args[1])
+			}
+			self.indexIter.Jump(self.parseArg(args[0]), value)
+		}
+	}
+	self.showCursor()
+}
+
+// Shows the current page of the search result.
+func (self *shell) showSearchPage() {
+	if self.searchMode == "" {
+		self.printf("no search\n")
+		return
+	}
+	capacity := (self.searchPage + 1) * self.pageSize
+	var keys []string
+	if self.dbm != nil {
+		keys = self.dbm.Search(self.searchMode, self.searchPat, capacity+1)
+	} else {
+		keys = self.getKeysWithPrefix(self.searchPat, capacity+1)
+	}
+	begin := self.searchPage * self.pageSize
+	for i := begin; i < capacity && i < len(keys); i++ {
+		self.printf("%s\n", self.format([]byte(keys[i])))
+	}
+	if len(keys) > capacity {
+		self.printf("-- more --\n")
+		self.searchPage++
+	} else {
+		self.searchMode = ""
+	}
+}
+
+// Executes a command line.
+//
+// @return False if the shell should quit.
+func (self *shell) execute(line string) bool {
+	args := splitCommandLine(line)
+	if len(args) == 0 {
+		return true
+	}
+	name := args[0]
+	args = args[1:]
+	numArgs := map[string]int{"jump": 1, "get": 1, "set": 2, "remove": 1, "search": 2,
+		"pagesize": 1, "display": 1, "transcript": 1}
+	if len(args) < numArgs[name] {
+		self.printf("too few arguments for %s\n", name)
+		return true
+	}
+	switch name {
+	case "quit", "exit":
+		return false
+	case "help":
+		for _, help := range shellHelp {
+			self.printf("%s\n", help)
+		}
+	case "first", "last", "next", "prev", "jump":
+		self.move(name, args)
+	case "cur":
+		self.showCursor()
+	case "get":
+		if self.dbm != nil {
+			value, status := self.dbm.Get(self.parseArg(args[0]))
+			if status.IsOK() {
+				self.printf("%s\n", self.format(value))
+			} else {
+				self.printf("%s\n", status.String())
+			}
+		} else {
+			for _, value := range self.index.GetValues(self.parseArg(args[0]), 0) {
+				self.printf("%s\n", self.format(value))
+			}
+		}
+	case "set":
+		var status *tkrzw.Status
+		if self.dbm != nil {
+			status = self.dbm.Set(self.parseArg(args[0]), self.parseArg(args[1]), true)
+		} else {
+			status = self.index.Add(self.parseArg(args[0]), self.parseArg(args[1]))
+		}
+		self.printf("%s\n", status.String())
+	case "remove":
+		var status *tkrzw.Status
+		if self.dbm != nil {
+			status = self.dbm.Remove(self.parseArg(args[0]))
+		} else if len(args) > 1 {
+			status = self.index.Remove(self.parseArg(args[0]), self.parseArg(args[1]))
+		} else {
+			status = tkrzw.NewStatus2(tkrzw.StatusInvalidArgumentError, "value is required")
+		}
+		self.printf("%s\n", status.String())
+	case "search":
+		self.searchMode = args[0]
+		self.searchPat = string(self.parseArg(args[1]))
+		self.searchPage = 0
+		self.showSearchPage()
+	case "more":
+		self.showSearchPage()
+	case "pagesize":
+		if size := int(tkrzw.ToInt(args[0])); size > 0 {
+			self.pageSize = size
+		}
+	case "count":
+		if self.dbm != nil {
+			self.printf("%d\n", self.dbm.CountSimple())
+		} else {
+			self.printf("%d\n", self.index.Count())
+		}
+	case "display":
+		self.hexMode = args[0] == "hex"
+	case "transcript":
+		if self.transcript != nil {
+			self.transcript.Close()
+			self.transcript = nil
+		}
+		if args[0] != "off" {
+			file, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				self.printf("%s\n", err.Error())
+				break
+			}
+			self.transcript = file
+			self.printf("# transcript started at %s\n", time.Now().Format(time.RFC3339))
+		}
+	default:
+		self.printf("unknown command: %s\n", name)
+	}
+	return true
+}
+
+func runShell(args []string) int {
+	flags := newFlagSet("shell")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	flagIndex := flags.Bool("index", false, "whether to open the file as an index")
+	flagWritable := flags.Bool("writable", false, "whether to open the file as writable")
+	flagTranscript := flags.String("transcript", "", "the path of the transcript file")
+	if !parseFlags(flags, args, 1) {
+		return 2
+	}
+	sh := &shell{pageSize: 20}
+	if *flagIndex {
+		sh.index = tkrzw.NewIndex()
+		status := sh.index.Open(flags.Arg(0), *flagWritable, tkrzw.ParseParams(*flagParams))
+		if !status.IsOK() {
+			printError(status)
+			return 1
+		}
+		sh.indexIter = sh.index.MakeIterator()
+		sh.indexIter.First()
+	} else {
+		sh.dbm = openDBM(flags.Arg(0), *flagWritable, *flagParams)
+		if sh.dbm == nil {
+			return 1
+		}
+		sh.iter = sh.dbm.MakeIterator()
+		sh.iter.First()
+	}
+	if *flagTranscript != "" {
+		sh.execute("transcript " + quoteArg(*flagTranscript))
+	}
+	reader := bufio.NewReader(os.Stdin)
+	savedMode, err := runStty("-g")
+	rawMode := err == nil && savedMode != ""
+	if rawMode {
+		if _, err := runStty("-icanon", "-echo", "min", "1"); err != nil {
+			rawMode = false
+		}
+	}
+	if rawMode {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt)
+		go func() {
+			<-signals
+			runStty(savedMode)
+			fmt.Print("\r\n")
+			os.Exit(1)
+		}()
+		defer runStty(savedMode)
+	}
+	prompt := "tkrzw> "
+	for {
+		var line string
+		if rawMode {
+			line, err = sh.readLineRaw(reader, prompt)
+		} else {
+			fmt.Print(prompt)
+			line, err = reader.ReadString('\n')
+			if err == io.EOF && len(line) > 0 {
+				err = nil
+			}
+		}
+		if err != nil {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if sh.transcript != nil {
+			sh.transcript.WriteString(prompt + line + "\n")
+		}
+		if !sh.execute(line) {
+			break
+		}
+	}
+	if sh.transcript != nil {
+		sh.transcript.Close()
+	}
+	if sh.dbm != nil {
+		sh.iter.Destruct()
+		return closeDBM(sh.dbm, 0)
+	}
+	sh.indexIter.Destruct()
+	status := sh.index.Close()
+	sh.index.Destruct()
+	return checkStatus(status)
+}
+
+// END OF FILE
@@ -0,0 +1,508 @@
+/*************************************************************************************************
+ * Command-line utility
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/estraier/tkrzw-go"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Subcommand of the utility.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"get", "[--params expr] path key", runGet},
+		{"set", "[--params expr] [--no_overwrite] [--append delim] path key value", runSet},
+		{"remove", "[--params expr] path key", runRemove},
+		{"list", "[--params expr] [--prefix str] [--begin key] [--end key] [--max num] " +
+			"[--keys] path", runList},
+		{"search", "[--params expr] [--mode name] [--max num] path pattern", runSearch},
+		{"inspect", "[--params expr] path", runInspect},
+		{"count", "[--params expr] path", runCount},
+		{"rebuild", "[--params expr] [--rebuild_params expr] path", runRebuild},
+		{"sync", "[--params expr] [--hard] path", runSync},
+		{"export", "[--params expr] [--format flat|tsv|csv|jsonl] [--escape none|c|base64] " +
+			"path dest", runExport},
+		{"import", "[--params expr] [--format flat|tsv|csv|jsonl] [--escape none|c|base64] " +
+			"[--duplicate overwrite|append|skip] [--delim str] [--threads num] path src",
+			runImport},
+		{"copy", "[--params expr] [--hard] path dest", runCopy},
+		{"restore", "[--class name] [--end_offset num] [--cipher_key key] path dest",
+			runRestore},
+		{"shell", "[--params expr] [--index] [--writable] [--transcript path] path", runShell},
+		{"check", "[--params expr] [--class name] [--cipher_key key] [--repair path] path",
+			runCheck},
+	}
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  tkrzw-go %s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		for _, cmd := range commands {
+			if cmd.name == name {
+				fmt.Fprintf(os.Stderr, "Usage: tkrzw-go %s %s\n", cmd.name, cmd.usage)
+			}
+		}
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func parseFlags(flags *flag.FlagSet, args []string, numArgs int) bool {
+	if flags.Parse(args) != nil || flags.NArg() != numArgs {
+		flags.Usage()
+		return false
+	}
+	return true
+}
+
+func checkTextFlags(flags *flag.FlagSet, format string) bool {
+	if format != "flat" {
+		return true
+	}
+	valid := true
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "escape", "duplicate", "delim", "threads":
+			fmt.Fprintf(os.Stderr, "tkrzw-go: --%s is not supported by the flat format\n", f.Name)
+			valid = false
+		}
+	})
+	return valid
+}
+
+func printError(status *tkrzw.Status) {
+	fmt.Fprintf(os.Stderr, "tkrzw-go: %s\n", status.String())
+}
+
+func openDBM(path string, writable bool, paramsExpr string) *tkrzw.DBM {
+	dbm := tkrzw.NewDBM()
+	status := dbm.Open(path, writable, tkrzw.ParseParams(paramsExpr))
+	if !status.IsOK() {
+		printError(status)
+		dbm.Destruct()
+		return nil
+	}
+	return dbm
+}
+
+func closeDBM(dbm *tkrzw.DBM, rv int) int {
+	status := dbm.Close()
+	dbm.Destruct()
+	if !status.IsOK() {
+		printError(status)
+		return 1
+	}
+	return rv
+}
+
+func checkStatus(status *tkrzw.Status) int {
+	if !status.IsOK() {
+		printError(status)
+		return 1
+	}
+	return 0
+}
+
+func runGet(args []string) int {
+	flags := newFlagSet("get")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	if !parseFlags(flags, args, 2) {
+		return 2
+	}
+	dbm := openDBM(flags.Arg(0), false, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	value, status := dbm.Get(flags.Arg(1))
+	if status.IsOK() {
+		fmt.Println(tkrzw.EscapeCStyle(value))
+	}
+	return closeDBM(dbm, checkStatus(status))
+}
+
+func runSet(args []string) int {
+	flags := newFlagSet("set")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	flagNoOverwrite := flags.Bool("no_overwrite", false, "whether to keep the existing value")
+	flagAppend := flags.String("append", "", "the delimiter to append the value")
+	if !parseFlags(flags, args, 3) {
+		return 2
+	}
+	appending := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "append" {
+			appending = true
+		}
+	})
+	dbm := openDBM(flags.Arg(0), true, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	var status *tkrzw.Status
+	if appending {
+		status = dbm.Append(flags.Arg(1), flags.Arg(2), *flagAppend)
+	} else {
+		status = dbm.Set(flags.Arg(1), flags.Arg(2), !*flagNoOverwrite)
+	}
+	return closeDBM(dbm, checkStatus(status))
+}
+
+func runRemove(args []string) int {
+	flags := newFlagSet("remove")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	if !parseFlags(flags, args, 2) {
+		return 2
+	}
+	dbm := openDBM(flags.Arg(0), true, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	return closeDBM(dbm, checkStatus(dbm.Remove(flags.Arg(1))))
+}
+
+func runList(args []string) int {
+	flags := newFlagSet("list")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	flagPrefix := flags.String("prefix", "", "the prefix of keys to list")
+	flagBegin := flags.String("begin", "", "the key to begin with, inclusive, in the order of the database")
+	flagEnd := flags.String("end", "", "the key to end with, exclusive, in the order of the database")
+	flagMax := flags.Int("max", 0, "the maximum number of records to list, 0 for unlimited")
+	flagKeys := flags.Bool("keys", false, "whether to list keys only")
+	if !parseFlags(flags, args, 1) {
+		return 2
+	}
+	dbm := openDBM(flags.Arg(0), false, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	prefix := []byte(*flagPrefix)
+	ordered := dbm.IsOrdered()
+	if (*flagBegin != "" || *flagEnd != "") && !ordered {
+		printError(tkrzw.NewStatus2(
+			tkrzw.StatusInvalidArgumentError, "range listing needs an ordered database"))
+		return closeDBM(dbm, 1)
+	}
+	writer := bufio.NewWriter(os.Stdout)
+	iter := dbm.MakeIterator()
+	status := tkrzw.NewStatus1(tkrzw.StatusSuccess)
+	var stopKey []byte
+	hasStop := false
+	if *flagEnd != "" {
+		if status = iter.Jump(*flagEnd); status.IsOK() {
+			stopKey, status = iter.GetKey()
+			hasStop = status.IsOK()
+		}
+		if status.Equals(tkrzw.StatusNotFoundError) {
+			status = tkrzw.NewStatus1(tkrzw.StatusSuccess)
+		}
+	}
+	inPrefix := false
+	if status.IsOK() {
+		switch {
+		case *flagBegin != "":
+			status = iter.Jump(*flagBegin)
+			inPrefix = strings.HasPrefix(*flagBegin, *flagPrefix)
+		case ordered && len(prefix) > 0:
+			status = iter.Jump(prefix)
+			inPrefix = true
+		default:
+			status = iter.First()
+		}
+	}
+	for count := 0; status.IsOK() && (*flagMax < 1 || count < *flagMax); {
+		var key, value []byte
+		key, value, status = iter.Step()
+		if !status.IsOK() {
+			break
+		}
+		if hasStop && bytes.Equal(key, stopKey) {
+			break
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			if inPrefix {
+				break
+			}
+			continue
+		}
+		inPrefix = ordered
+		if *flagKeys {
+			fmt.Fprintf(writer, "%s\n", tkrzw.EscapeCStyle(key))
+		} else {
+			fmt.Fprintf(writer, "%s\t%s\n", tkrzw.EscapeCStyle(key), tkrzw.EscapeCStyle(value))
+		}
+		count++
+	}
+	iter.Destruct()
+	writer.Flush()
+	if status.Equals(tkrzw.StatusNotFoundError) {
+		status = tkrzw.NewStatus1(tkrzw.StatusSuccess)
+	}
+	return closeDBM(dbm, checkStatus(status))
+}
+
+func runSearch(args []string) int {
+	flags := newFlagSet("search")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	flagMode := flags.String("mode", "contain", "the search mode: contain, begin, end, regex, "+
+		"edit, editbin, containcase, containword, containcaseword, upper, upperinc, lower, "+
+		"lowerinc")
+	flagMax := flags.Int("max", 0, "the maximum number of keys to list, 0 for unlimited")
+	if !parseFlags(flags, args, 2) {
+		return 2
+	}
+	dbm := openDBM(flags.Arg(0), false, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	writer := bufio.NewWriter(os.Stdout)
+	for _, key := range dbm.Search(*flagMode, flags.Arg(1), *flagMax) {
+		fmt.Fprintf(writer, "%s\n", tkrzw.EscapeCStyle([]byte(key)))
+	}
+	writer.Flush()
+	return closeDBM(dbm, 0)
+}
+
+func runInspect(args []string) int {
+	flags := newFlagSet("inspect")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	if !parseFlags(flags, args, 1) {
+		return 2
+	}
+	dbm := openDBM(flags.Arg(0), false, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	props := dbm.Inspect()
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s: %s\n", name, props[name])
+	}
+	return closeDBM(dbm, 0)
+}
+
+func runCount(args []string) int {
+	flags := newFlagSet("count")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	if !parseFlags(flags, args, 1) {
+		return 2
+	}
+	dbm := openDBM(flags.Arg(0), false, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	count, status := dbm.Count()
+	if status.IsOK() {
+		fmt.Println(count)
+	}
+	return closeDBM(dbm, checkStatus(status))
+}
+
+func runRebuild(args []string) int {
+	flags := newFlagSet("rebuild")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	flagRebuildParams := flags.String("rebuild_params", "", "the parameters for rebuilding")
+	if !parseFlags(flags, args, 1) {
+		return 2
+	}
+	dbm := openDBM(flags.Arg(0), true, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	return closeDBM(dbm, checkStatus(dbm.Rebuild(tkrzw.ParseParams(*flagRebuildParams))))
+}
+
+func runSync(args []string) int {
+	flags := newFlagSet("sync")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	flagHard := flags.Bool("hard", false, "whether to synchronize with the hardware")
+	if !parseFlags(flags, args, 1) {
+		return 2
+	}
+	dbm := openDBM(flags.Arg(0), true, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	return closeDBM(dbm, checkStatus(dbm.Synchronize(*flagHard, nil)))
+}
+
+func runExport(args []string) int {
+	flags := newFlagSet("export")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	flagFormat := flags.String("format", "flat", "the format: flat, tsv, csv, or jsonl")
+	flagEscape := flags.String("escape", "", "the escape mode: none, c, or base64")
+	if !parseFlags(flags, args, 2) || !checkTextFlags(flags, *flagFormat) {
+		return 2
+	}
+	dbm := openDBM(flags.Arg(0), false, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	var status *tkrzw.Status
+	switch *flagFormat {
+	case "flat":
+		file := tkrzw.NewFile()
+		status = file.Open(flags.Arg(1), true, tkrzw.ParseParams("truncate=true"))
+		if status.IsOK() {
+			status = dbm.ExportToFlatRecords(file)
+			status.Join(file.Close())
+		}
+		file.Destruct()
+	case "tsv", "csv", "jsonl":
+		output, err := os.Create(flags.Arg(1))
+		if err != nil {
+			status = tkrzw.NewStatus2(tkrzw.StatusSystemError, err.Error())
+			break
+		}
+		params := map[string]string{}
+		if *flagEscape != "" {
+			params["escape"] = *flagEscape
+		}
+		switch *flagFormat {
+		case "tsv":
+			status = dbm.ExportTSV(output, params)
+		case "csv":
+			status = dbm.ExportCSV(output, params)
+		default:
+			status = dbm.ExportJSONL(output, params)
+		}
+		if err := output.Close(); err != nil {
+			status.Join(tkrzw.NewStatus2(tkrzw.StatusSystemError, err.Error()))
+		}
+	default:
+		status = tkrzw.NewStatus2(tkrzw.StatusInvalidArgumentError, "unknown format")
+	}
+	return closeDBM(dbm, checkStatus(status))
+}
+
+func runImport(args []string) int {
+	flags := newFlagSet("import")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	flagFormat := flags.String("format", "flat", "the format: flat, tsv, csv, or jsonl")
+	flagEscape := flags.String("escape", "", "the escape mode: none, c, or base64")
+	flagDuplicate := flags.String("duplicate", "overwrite",
+		"how to treat existing records: overwrite, append, or skip")
+	flagDelim := flags.String("delim", "", "the delimiter to append values")
+	flagThreads := flags.Int("threads", 1, "the number of threads to store records")
+	if !parseFlags(flags, args, 2) || !checkTextFlags(flags, *flagFormat) {
+		return 2
+	}
+	dbm := openDBM(flags.Arg(0), true, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	var status *tkrzw.Status
+	switch *flagFormat {
+	case "flat":
+		file := tkrzw.NewFile()
+		status = file.Open(flags.Arg(1), false, nil)
+		if status.IsOK() {
+			status = dbm.ImportFromFlatRecords(file)
+			status.Join(file.Close())
+		}
+		file.Destruct()
+	case "tsv", "csv", "jsonl":
+		input, err := os.Open(flags.Arg(1))
+		if err != nil {
+			status = tkrzw.NewStatus2(tkrzw.StatusSystemError, err.Error())
+			break
+		}
+		params := map[string]string{
+			"duplicate":    *flagDuplicate,
+			"append_delim": *flagDelim,
+			"num_threads":  tkrzw.ToString(*flagThreads),
+		}
+		if *flagEscape != "" {
+			params["escape"] = *flagEscape
+		}
+		switch *flagFormat {
+		case "tsv":
+			status = dbm.ImportTSV(input, params)
+		case "csv":
+			status = dbm.ImportCSV(input, params)
+		default:
+			status = dbm.ImportJSONL(input, params)
+		}
+		input.Close()
+	default:
+		status = tkrzw.NewStatus2(tkrzw.StatusInvalidArgumentError, "unknown format")
+	}
+	return closeDBM(dbm, checkStatus(status))
+}
+
+func runCopy(args []string) int {
+	flags := newFlagSet("copy")
+	flagParams := flags.String("params", "", "the parameters to open the database")
+	flagHard := flags.Bool("hard", false, "whether to synchronize with the hardware")
+	if !parseFlags(flags, args, 2) {
+		return 2
+	}
+	dbm := openDBM(flags.Arg(0), false, *flagParams)
+	if dbm == nil {
+		return 1
+	}
+	return closeDBM(dbm, checkStatus(dbm.CopyFileData(flags.Arg(1), *flagHard)))
+}
+
+func runRestore(args []string) int {
+	flags := newFlagSet("restore")
+	flagClass := flags.String("class", "", "the class name of the database")
+	flagEndOffset := flags.Int64("end_offset", -1, "the exclusive end offset of records to read")
+	flagCipherKey := flags.String("cipher_key", "", "the encryption key for cipher compressors")
+	if !parseFlags(flags, args, 2) {
+		return 2
+	}
+	return checkStatus(tkrzw.RestoreDatabase(
+		flags.Arg(0), flags.Arg(1), *flagClass, *flagEndOffset, *flagCipherKey))
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
+	}
+	printUsage()
+	os.Exit(2)
+}
+
+// END OF FILE
@@ -0,0 +1,628 @@
+/*************************************************************************************************
+ * Hashes, lists, sets, and sorted sets on an ordered database
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// A pair of a member of a sorted set and its score.
+type ScoredMember struct {
+	// The member.
+	Member []byte
+	// The score.
+	Score float64
+}
+
+// Hashes, lists, sets, and sorted sets stored as records of an ordered database.
+//
+// Every record key is made of the prefix, a type character, the 4-byte big-endian length of the collection name, the name, and the part of each type.  A hash field is stored with the type "H" and the field name.  A set member is stored with the type "S" and the member.  A list has a metadata record with the type "L" and "M", whose value is the head and tail positions, and item records with the type "L", "I", and the position.  Positions are 8-byte big-endian integers whose sign bits are flipped so that they are ordered as bytes.  A sorted set has a score record for each member with the type "Z", "M", and the member, whose value is the score serialized by SerializeFloat, and a range record with the type "Z", "S", the order-preserving score bytes, and the member.  Mutations of multiple records are done atomically by ProcessMulti.  Operations to enumerate or count elements need an ordered database such as TreeDBM.
+type Collections struct {
+	// The underlying database.
+	dbm *DBM
+	// The prefix of the keys.
+	prefix string
+}
+
+// Makes a set of collections on a database.
+//
+// @param dbm The underlying database, which should be ordered.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The new set of collections.
+//
+// The optional parameter "prefix" specifies the prefix of the keys of the records so that collections can share the database with other records.
+func NewCollections(dbm *DBM, params map[string]string) *Collections {
+	return &Collections{dbm: dbm, prefix: params["prefix"]}
+}
+
+// Makes a string representing the set of collections.
+//
+// @return The string representing the set of collections.
+func (self *Collections) String() string {
+	return fmt.Sprintf("#<tkrzw.Collections:%p:prefix=%q>", &self, self.prefix)
+}
+
+// Makes the common key prefix of a collection.
+func (self *Collections) namePrefix(kind string, name interface{}, part string) []byte {
+	rawName := ToByteArray(name)
+	key := make([]byte, 0, len(self.prefix)+len(kind)+4+len(rawName)+len(part))
+	key = append(key, self.prefix...)
+	key = append(key, kind...)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(rawName)))
+	key = append(key, size[:]...)
+	key = append(key, rawName...)
+	return append(key, part...)
+}
+
+// Makes a key of an element of a collection.
+func (self *Collections) elementKey(
+	kind string, name interface{}, part string, element []byte) []byte {
+	return append(self.namePrefix(kind, name, part), element...)
+}
+
+// Encodes a list position into order-preserving bytes.
+func encodeListPos(pos int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(pos)^(1<<63))
+	return buf[:]
+}
+
+// Encodes a score into order-preserving bytes.
+func encodeScore(score float64) []byte {
+	if score == 0 {
+		// Negative zero is stored as positive zero so that ranges from zero include it.
+		score = 0
+	}
+	buf := SerializeFloat(score)
+	if buf[0]&0x80 != 0 {
+		for i := range buf {
+			buf[i] = ^buf[i]
+		}
+	} else {
+		buf[0] ^= 0x80
+	}
+	return buf
+}
+
+// Decodes order-preserving bytes into a score.
+func decodeScore(data []byte) float64 {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	if buf[0]&0x80 != 0 {
+		buf[0] ^= 0x80
+	} else {
+		for i := range buf {
+			buf[i] = ^buf[i]
+		}
+	}
+	return DeserializeFloat(buf)
+}
+
+// Iterates records whose keys begin with a prefix.
+func (self *Collections) scan(prefix []byte, proc func(suffix []byte, value []byte) bool) *Status {
+	if !self.dbm.IsOrdered() {
+		return NewStatus2(StatusPreconditionError, "unordered database")
+	}
+	iter := self.dbm.MakeIterator()
+	defer iter.Destruct()
+	status := iter.Jump(prefix)
+	for status.IsOK() {
+		var key, value []byte
+		key, value, status = iter.Get()
+		if !status.IsOK() || !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if !proc(key[len(prefix):], value) {
+			break
+		}
+		status = iter.Next()
+	}
+	if !status.IsOK() && !status.Equals(StatusNotFoundError) {
+		return status
+	}
+	return NewStatus1(StatusSuccess)
+}
+
+// Counts records whose keys begin with a prefix.
+func (self *Collections) count(prefix []byte) (int64, *Status) {
+	count := int64(0)
+	status := self.scan(prefix, func(suffix []byte, value []byte) bool {
+		count++
+		return true
+	})
+	return count, status
+}
+
+// Updates a record on condition of its current value, together with other records.
+//
+// The condition record is processed first.  If its value doesn't match the expected value, where nil means no record, the other records are not modified and StatusInfeasibleError is returned.  If the desired value is nil, the condition record is removed.
+func (self *Collections) processChecked(
+	key []byte, expected []byte, desired []byte, others []KeyProcPair) *Status {
+	conflict := false
+	checkProc := func(k []byte, v []byte) interface{} {
+		if (v == nil) != (expected == nil) || !bytes.Equal(v, expected) {
+			conflict = true
+			return nil
+		}
+		if desired == nil {
+			return RemoveBytes
+		}
+		return desired
+	}
+	pairs := []KeyProcPair{{key, checkProc}}
+	for _, other := range others {
+		proc := other.Proc
+		pairs = append(pairs, KeyProcPair{other.Key, func(k []byte, v []byte) interface{} {
+			if conflict {
+				return nil
+			}
+			return proc(k, v)
+		}})
+	}
+	status := self.dbm.ProcessMulti(pairs, true)
+	if status.IsOK() && conflict {
+		return NewStatus1(StatusInfeasibleError)
+	}
+	return status
+}
+
+// Makes a processor to set a value.
+func setProc(value []byte) RecordProcessor {
+	return func(k []byte, v []byte) interface{} {
+		return value
+	}
+}
+
+// Makes a processor to remove a record.
+func removeProc() RecordProcessor {
+	return func(k []byte, v []byte) interface{} {
+		return RemoveBytes
+	}
+}
+
+// Sets a field of a hash.
+//
+// @param name The name of the hash.
+// @param field The name of the field.
+// @param value The value of the field.
+// @return True if the field is new, and the result status.
+func (self *Collections) HSet(name interface{}, field interface{}, value interface{}) (
+	bool, *Status) {
+	created := false
+	rawValue := ToByteArray(value)
+	status := self.dbm.Process(self.elementKey("H", name, "", ToByteArray(field)),
+		func(k []byte, v []byte) interface{} {
+			created = v == nil
+			return rawValue
+		}, true)
+	return created, status
+}
+
+// Gets a field of a hash.
+//
+// @param name The name of the hash.
+// @param field The name of the field.
+// @return The value of the field and the result status.  If there's no matching field, StatusNotFoundError is returned.
+func (self *Collections) HGet(name interface{}, field interface{}) ([]byte, *Status) {
+	return self.dbm.Get(self.elementKey("H", name, "", ToByteArray(field)))
+}
+
+// Removes fields of a hash.
+//
+// @param name The name of the hash.
+// @param fields The names of the fields.
+// @return The number of removed fields and the result status.
+func (self *Collections) HDel(name interface{}, fields ...interface{}) (int64, *Status) {
+	numRemoved := int64(0)
+	pairs := make([]KeyProcPair, 0, len(fields))
+	for _, field := range fields {
+		pairs = append(pairs, KeyProcPair{self.elementKey("H", name, "", ToByteArray(field)),
+			func(k []byte, v []byte) interface{} {
+				if v == nil {
+					return nil
+				}
+				numRemoved++
+				return RemoveBytes
+			}})
+	}
+	status := self.dbm.ProcessMulti(pairs, true)
+	return numRemoved, status
+}
+
+// Gets all fields of a hash.
+//
+// @param name The name of the hash.
+// @return A list of pairs of the field names and their values in the order of the names, and the result status.
+func (self *Collections) HGetAll(name interface{}) ([]KeyValuePair, *Status) {
+	fields := make([]KeyValuePair, 0)
+	status := self.scan(self.namePrefix("H", name, ""), func(suffix []byte, value []byte) bool {
+		fields = append(fields, KeyValuePair{suffix, value})
+		return true
+	})
+	return fields, status
+}
+
+// Gets the number of fields of a hash.
+//
+// @param name The name of the hash.
+// @return The number of fields and the result status.
+func (self *Collections) HLen(name interface{}) (int64, *Status) {
+	return self.count(self.namePrefix("H", name, ""))
+}
+
+// Adds members to a set.
+//
+// @param name The name of the set.
+// @param members The members to add.
+// @return The number of added members which didn't exist, and the result status.
+func (self *Collections) SAdd(name interface{}, members ...interface{}) (int64, *Status) {
+	numAdded := int64(0)
+	pairs := make([]KeyProcPair, 0, len(members))
+	for _, member := range members {
+		pairs = append(pairs, KeyProcPair{self.elementKey("S", name, "", ToByteArray(member)),
+			func(k []byte, v []byte) interface{} {
+				if v != nil {
+					return nil
+				}
+				numAdded++
+				return []byte{}
+			}})
+	}
+	status := self.dbm.ProcessMulti(pairs, true)
+	return numAdded, status
+}
+
+// Removes members from a set.
+//
+// @param name The name of the set.
+// @param members The members to remove.
+// @return The number of removed members, and the result status.
+func (self *Collections) SRem(name interface{}, members ...interface{}) (int64, *Status) {
+	numRemoved := int64(0)
+	pairs := make([]KeyProcPair, 0, len(members))
+	for _, member := range members {
+		pairs = append(pairs, KeyProcPair{self.elementKey("S", name, "", ToByteArray(member)),
+			func(k []byte, v []byte) interface{} {
+				if v == nil {
+					return nil
+				}
+				numRemoved++
+				return RemoveBytes
+			}})
+	}
+	status := self.dbm.ProcessMulti(pairs, true)
+	return numRemoved, status
+}
+
+// Checks whether a member is in a set.
+//
+// @param name The name of the set.
+// @param member The member to check.
+// @return True if the member is in the set, or false if not.
+func (self *Collections) SIsMember(name interface{}, member interface{}) bool {
+	_, status := self.dbm.Get(self.elementKey("S", name, "", ToByteArray(member)))
+	return status.IsOK()
+}
+
+// Gets all members of a set.
+//
+// @param name The name of the set.
+// @return A list of the members in ascending order, and the result status.
+func (self *Collections) SMembers(name interface{}) ([][]byte, *Status) {
+	members := make([][]byte, 0)
+	status := self.scan(self.namePrefix("S", name, ""), func(suffix []byte, value []byte) bool {
+		members = append(members, suffix)
+		return true
+	})
+	return members, status
+}
+
+// Gets the number of members of a set.
+//
+// @param name The name of the set.
+// @return The number of members and the result status.
+func (self *Collections) SCard(name interface{}) (int64, *Status) {
+	return self.count(self.namePrefix("S", name, ""))
+}
+
+// Gets the head and tail positions of a list.
+func (self *Collections) listMeta(name interface{}) ([]byte, int64, int64, *Status) {
+	meta, status := self.dbm.Get(self.namePrefix("L", name, "M"))
+	if status.Equals(StatusNotFoundError) {
+		return nil, 0, 0, NewStatus1(StatusSuccess)
+	}
+	if !status.IsOK() {
+		return nil, 0, 0, status
+	}
+	if len(meta) != 16 {
+		return nil, 0, 0, NewStatus2(StatusBrokenDataError, "invalid list metadata")
+	}
+	return meta, DeserializeInt(meta[:8]), DeserializeInt(meta[8:]), status
+}
+
+// Pushes values to either end of a list.
+func (self *Collections) push(name interface{}, values []interface{}, left bool) (int64, *Status) {
+	for {
+		meta, head, tail, status := self.listMeta(name)
+		if !status.IsOK() {
+			return 0, status
+		}
+		pairs := make([]KeyProcPair, 0, len(values))
+		for _, value := range values {
+			pos := tail
+			if left {
+				head--
+				pos = head
+			} else {
+				tail++
+			}
+			pairs = append(pairs, KeyProcPair{
+				self.elementKey("L", name, "I", encodeListPos(pos)), setProc(ToByteArray(value))})
+		}
+		newMeta := append(SerializeInt(head), SerializeInt(tail)...)
+		status = self.processChecked(self.namePrefix("L", name, "M"), meta, newMeta, pairs)
+		if !status.Equals(StatusInfeasibleError) {
+			return tail - head, status
+		}
+	}
+}
+
+// Pops a value from either end of a list.
+func (self *Collections) pop(name interface{}, left bool) ([]byte, *Status) {
+	for {
+		meta, head, tail, status := self.listMeta(name)
+		if !status.IsOK() {
+			return nil, status
+		}
+		if head == tail {
+			return nil, NewStatus1(StatusNotFoundError)
+		}
+		pos := head
+		if left {
+			head++
+		} else {
+			tail--
+			pos = tail
+		}
+		var newMeta []byte
+		if head < tail {
+			newMeta = append(SerializeInt(head), SerializeInt(tail)...)
+		}
+		var value []byte
+		pairs := []KeyProcPair{{self.elementKey("L", name, "I", encodeListPos(pos)),
+			func(k []byte, v []byte) interface{} {
+				value = v
+				return RemoveBytes
+			}}}
+		status = self.processChecked(self.namePrefix("L", name, "M"), meta, newMeta, pairs)
+		if !status.Equals(StatusInfeasibleError) {
+			if status.IsOK() && value == nil {
+				return nil, NewStatus2(StatusBrokenDataError, "missing list item")
+			}
+			return value, status
+		}
+	}
+}
+
+// Pushes values to the head of a list.
+//
+// @param name The name of the list.
+// @param values The values to push.  Each value is pushed in turn, so the last one becomes the head.
+// @return The length of the list after the operation, and the result status.
+func (self *Collections) LPush(name interface{}, values ...interface{}) (int64, *Status) {
+	return self.push(name, values, true)
+}
+
+// Pushes values to the tail of a list.
+//
+// @param name The name of the list.
+// @param values The values to push.
+// @return The length of the list after the operation, and the result status.
+func (self *Collections) RPush(name interface{}, values ...interface{}) (int64, *Status) {
+	return self.push(name, values, false)
+}
+
+// Removes the head value of a list and gets it.
+//
+// @param name The name of the list.
+// @return The value and the result status.  If the list is empty, StatusNotFoundError is returned.
+func (self *Collections) LPop(name interface{}) ([]byte, *Status) {
+	return self.pop(name, true)
+}
+
+// Removes the tail value of a list and gets it.
+//
+// @param name The name of the list.
+// @return The value and the result status.  If the list is empty, StatusNotFoundError is returned.
+func (self *Collections) RPop(name interface{}) ([]byte, *Status) {
+	return self.pop(name, false)
+}
+
+// Gets values in a range of a list.
+//
+// @param name The name of the list.
+// @param start The index of the first value.  A negative index counts from the tail.
+// @param stop The index of the last value, inclusive.  A negative index counts from the tail.
+// @return A list of the values and the result status.
+func (self *Collections) LRange(name interface{}, start int64, stop int64) ([][]byte, *Status) {
+	values := make([][]byte, 0)
+	_, head, tail, status := self.listMeta(name)
+	if !status.IsOK() {
+		return nil, status
+	}
+	length := tail - head
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	for index := start; index <= stop; index++ {
+		value, status := self.dbm.Get(self.elementKey("L", name, "I", encodeListPos(head+index)))
+		if !status.IsOK() {
+			return nil, status
+		}
+		values = append(values, value)
+	}
+	return values, NewStatus1(StatusSuccess)
+}
+
+// Gets the length of a list.
+//
+// @param name The name of the list.
+// @return The length of the list and the result status.
+func (self *Collections) LLen(name interface{}) (int64, *Status) {
+	_, head, tail, status := self.listMeta(name)
+	return tail - head, status
+}
+
+// Adds a member to a sorted set or updates its score.
+//
+// @param name The name of the sorted set.
+// @param score The score of the member.
+// @param member The member.
+// @return True if the member is new, and the result status.
+func (self *Collections) ZAdd(name interface{}, score float64, member interface{}) (
+	bool, *Status) {
+	if math.IsNaN(score) {
+		return false, NewStatus2(StatusInvalidArgumentError, "NaN score")
+	}
+	rawMember := ToByteArray(member)
+	memberKey := self.elementKey("Z", name, "M", rawMember)
+	for {
+		oldScore, status := self.dbm.Get(memberKey)
+		if !status.IsOK() && !status.Equals(StatusNotFoundError) {
+			return false, status
+		}
+		newScore := SerializeFloat(score)
+		if bytes.Equal(oldScore, newScore) {
+			return false, NewStatus1(StatusSuccess)
+		}
+		pairs := make([]KeyProcPair, 0, 2)
+		if oldScore != nil {
+			oldKey := append(self.namePrefix("Z", name, "S"), encodeScore(DeserializeFloat(oldScore))...)
+			pairs = append(pairs, KeyProcPair{append(oldKey, rawMember...), removeProc()})
+		}
+		newKey := append(self.namePrefix("Z", name, "S"), encodeScore(score)...)
+		pairs = append(pairs, KeyProcPair{append(newKey, rawMember...), setProc([]byte{})})
+		status = self.processChecked(memberKey, oldScore, newScore, pairs)
+		if !status.Equals(StatusInfeasibleError) {
+			return oldScore == nil, status
+		}
+	}
+}
+
+// Gets the score of a member of a sorted set.
+//
+// @param name The name of the sorted set.
+// @param member The member.
+// @return The score and the result status.  If there's no matching member, StatusNotFoundError is returned.
+func (self *Collections) ZScore(name interface{}, member interface{}) (float64, *Status) {
+	score, status := self.dbm.Get(self.elementKey("Z", name, "M", ToByteArray(member)))
+	if !status.IsOK() {
+		return 0, status
+	}
+	return DeserializeFloat(score), status
+}
+
+// Removes members from a sorted set.
+//
+// @param name The name of the sorted set.
+// @param members The members to remove.
+// @return The number of removed members, and the result status.
+//
+// Each member is removed atomically with its range record.
+func (self *Collections) ZRem(name interface{}, members ...interface{}) (int64, *Status) {
+	numRemoved := int64(0)
+	for _, member := range members {
+		rawMember := ToByteArray(member)
+		memberKey := self.elementKey("Z", name, "M", rawMember)
+		for {
+			oldScore, status := self.dbm.Get(memberKey)
+			if status.Equals(StatusNotFoundError) {
+				break
+			}
+			if !status.IsOK() {
+				return numRemoved, status
+			}
+			oldKey := append(self.namePrefix("Z", name, "S"), encodeScore(DeserializeFloat(oldScore))...)
+			pairs := []KeyProcPair{{append(oldKey, rawMember...), removeProc()}}
+			status = self.processChecked(memberKey, oldScore, nil, pairs)
+			if status.IsOK() {
+				numRemoved++
+				break
+			}
+			if !status.Equals(StatusInfeasibleError) {
+				return numRemoved, status
+			}
+		}
+	}
+	return numRemoved, NewStatus1(StatusSuccess)
+}
+
+// Gets members of a sorted set in a range of scores.
+//
+// @param name The name of the sorted set.
+// @param min The minimum score, inclusive.
+// @param max The maximum score, inclusive.
+// @param limit The maximum number of members to get.  If it is negative, no limit is applied.
+// @return A list of the members and their scores in ascending order of the scores, and the result status.  Members of the same score are ordered by the members.
+func (self *Collections) ZRangeByScore(
+	name interface{}, min float64, max float64, limit int) ([]ScoredMember, *Status) {
+	members := make([]ScoredMember, 0)
+	prefix := self.namePrefix("Z", name, "S")
+	if !self.dbm.IsOrdered() {
+		return nil, NewStatus2(StatusPreconditionError, "unordered database")
+	}
+	iter := self.dbm.MakeIterator()
+	defer iter.Destruct()
+	status := iter.Jump(append(prefix, encodeScore(min)...))
+	for status.IsOK() && (limit < 0 || len(members) < limit) {
+		var key []byte
+		key, status = iter.GetKey()
+		if !status.IsOK() || !bytes.HasPrefix(key, prefix) || len(key) < len(prefix)+8 {
+			break
+		}
+		score := decodeScore(key[len(prefix) : len(prefix)+8])
+		if score > max {
+			break
+		}
+		members = append(members, ScoredMember{key[len(prefix)+8:], score})
+		status = iter.Next()
+	}
+	if !status.IsOK() && !status.Equals(StatusNotFoundError) {
+		return nil, status
+	}
+	return members, NewStatus1(StatusSuccess)
+}
+
+// Gets the number of members of a sorted set.
+//
+// @param name The name of the sorted set.
+// @return The number of members and the result status.
+func (self *Collections) ZCard(name interface{}) (int64, *Status) {
+	return self.count(self.namePrefix("Z", name, "M"))
+}
+
+// END OF FILE
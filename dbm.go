@@ -15,14 +15,17 @@ package tkrzw
 
 import (
 	"fmt"
+	"sync"
 )
 
 // Polymorphic database manager.
 //
-// All operations except for "Open" and "Close" are thread-safe; Multiple threads can access the same database concurrently.  You can specify a data structure when you call the "Open" method.  Every opened database must be closed explicitly by the "Close" method to avoid data corruption.
+// All operations except for "Open" and "Close" are thread-safe; Multiple threads can access the same database concurrently.  As an exception, "Close" can be called while other goroutines are waiting in "PopFirstWait".  You can specify a data structure when you call the "Open" method.  Every opened database must be closed explicitly by the "Close" method to avoid data corruption.
 type DBM struct {
 	// Pointer to the internal object.
 	dbm uintptr
+	// Mutex to exclude closing while goroutines are waiting in "PopFirstWait".
+	waitMutex sync.RWMutex
 }
 
 // Function to process a record.
@@ -64,7 +67,7 @@ type KeyBytesProcPair struct {
 //
 // @return The pointer to the created database object.
 func NewDBM() *DBM {
-	return &DBM{0}
+	return &DBM{}
 }
 
 // Releases the resource explicitly.
@@ -184,7 +187,9 @@ func (self *DBM) Open(path string, writable bool, params map[string]string) *Sta
 	}
 	dbm, status := dbm_open(path, writable, params)
 	if status.code == StatusSuccess {
+		self.waitMutex.Lock()
 		self.dbm = dbm
+		self.waitMutex.Unlock()
 	}
 	return status
 }
@@ -192,13 +197,19 @@ func (self *DBM) Open(path string, writable bool, params map[string]string) *Sta
 // Closes the database file.
 //
 // @return The result status.
+//
+// Goroutines waiting in the "PopFirstWait" method are woken up and they return StatusPreconditionError.  The database is closed after their ongoing retrievals finish.
 func (self *DBM) Close() *Status {
-	if self.dbm == 0 {
+	self.waitMutex.Lock()
+	dbm := self.dbm
+	if dbm == 0 {
+		self.waitMutex.Unlock()
 		return NewStatus2(StatusPreconditionError, "not opened database")
 	}
-	status := dbm_close(self.dbm)
 	self.dbm = 0
-	return status
+	releasePush(dbm)
+	self.waitMutex.Unlock()
+	return dbm_close(dbm)
 }
 
 // Processes a record with an arbitrary function.
@@ -236,6 +247,43 @@ func (self *DBM) Get(key interface{}) ([]byte, *Status) {
 	return dbm_get(self.dbm, ToByteArray(key))
 }
 
+// Gets the value of a record of a key into a buffer.
+//
+// @param key The key of the record.
+// @param buf The buffer to store the value.  If its capacity is not enough, a new buffer is allocated.
+// @return The value stored in the buffer and the result status.  If there's no matching record, the status is StatusNotFoundError.
+//
+// The value is copied from the native memory directly into the buffer, which avoids allocation of a new slice for each call if the buffer is reused.
+func (self *DBM) GetInto(key interface{}, buf []byte) ([]byte, *Status) {
+	if self.dbm == 0 {
+		return buf[:0], NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	result := buf[:0]
+	status := dbm_view(self.dbm, ToByteArray(key), func(value []byte) {
+		if cap(buf) < len(value) {
+			result = make([]byte, len(value))
+		} else {
+			result = buf[:len(value)]
+		}
+		copy(result, value)
+	})
+	return result, status
+}
+
+// Calls a function with a borrowed view of the value of a record of a key.
+//
+// @param key The key of the record.
+// @param proc The function to receive the value.  It is called only if there's a matching record.
+// @return The result status.  If there's no matching record, the status is StatusNotFoundError.
+//
+// The value given to the function refers to the native memory without copying.  It is valid only inside the function; it must not be modified or retained after the function returns, since the memory is released then.  Copy the value if it is needed afterward.
+func (self *DBM) View(key interface{}, proc func(value []byte)) *Status {
+	if self.dbm == 0 {
+		return NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	return dbm_view(self.dbm, ToByteArray(key), proc)
+}
+
 // Gets the value of a record of a key, as a string.
 //
 // @param key The key of the record.
@@ -668,12 +716,16 @@ func (self *DBM) PopFirstStr() (string, string, *Status) {
 // @param wtime The current wall time used to generate the key.  If it is None, the system clock is used.
 // @return The result status.
 //
-// The key is generated as an 8-bite big-endian binary string of the timestamp.  If there is an existing record matching the generated key, the key is regenerated and the attempt is repeated until it succeeds.
+// The key is generated as an 8-bite big-endian binary string of the timestamp.  If there is an existing record matching the generated key, the key is regenerated and the attempt is repeated until it succeeds.  Goroutines waiting in the "PopFirstWait" method are woken up.
 func (self *DBM) PushLast(value interface{}, wtime float64) *Status {
 	if self.dbm == 0 {
 		return NewStatus2(StatusPreconditionError, "not opened database")
 	}
-	return dbm_push_last(self.dbm, ToByteArray(value), wtime)
+	status := dbm_push_last(self.dbm, ToByteArray(value), wtime)
+	if status.code == StatusSuccess {
+		notifyPush(self.dbm)
+	}
+	return status
 }
 
 // Processes each and every record in the database with an arbitrary function.
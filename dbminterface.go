@@ -0,0 +1,53 @@
+/*************************************************************************************************
+ * Common interface of database managers
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+// Interface of database managers, implemented by the local DBM and remote clients.
+//
+// Each method has the same semantics as the method of the same name of DBM.  The "Process" method is not included because arbitrary functions cannot run on remote databases.  Use the "CompareExchange" method in a loop for atomic read-modify-write operations instead.
+type DBMInterface interface {
+	// Gets the value of a record of a key.
+	Get(key interface{}) ([]byte, *Status)
+	// Gets the value of a record of a key, as a string.
+	GetStr(key interface{}) (string, *Status)
+	// Gets the values of multiple records of keys.
+	GetMulti(keys []string) map[string][]byte
+	// Sets a record of a key and a value.
+	Set(key interface{}, value interface{}, overwrite bool) *Status
+	// Sets multiple records.
+	SetMulti(records map[string][]byte, overwrite bool) *Status
+	// Removes a record of a key.
+	Remove(key interface{}) *Status
+	// Removes records of keys.
+	RemoveMulti(keys []string) *Status
+	// Compares the value of a record and exchanges if the condition meets.
+	CompareExchange(key interface{}, expected interface{}, desired interface{}) *Status
+	// Increments the numeric value of a record.
+	Increment(key interface{}, inc interface{}, init interface{}) (int64, *Status)
+	// Gets the number of records.
+	Count() (int64, *Status)
+	// Searches the database and get keys which match a pattern.
+	Search(mode string, pattern string, capacity int) []string
+	// Inspects the database.
+	Inspect() map[string]string
+	// Makes a channel to read each records.
+	Each() <-chan KeyValuePair
+	// Closes the database.
+	Close() *Status
+}
+
+// Checks that DBM implements the interface.
+var _ DBMInterface = (*DBM)(nil)
+
+// END OF FILE
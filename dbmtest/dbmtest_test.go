@@ -0,0 +1,135 @@
+/*************************************************************************************************
+ * Test cases of the differential test driver
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package dbmtest
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/estraier/tkrzw-go"
+)
+
+// Database with a bug that removing a missing record succeeds.
+type brokenDBM struct {
+	*tkrzw.MemoryDBM
+}
+
+func (self brokenDBM) Remove(key interface{}) *tkrzw.Status {
+	self.MemoryDBM.Remove(key)
+	return tkrzw.NewStatus1(tkrzw.StatusSuccess)
+}
+
+func TestGenerateOps(t *testing.T) {
+	ops := GenerateOps(rand.New(rand.NewSource(1)), 500, 10)
+	if len(ops) != 500 {
+		t.Fatalf("unexpected number of ops: %d", len(ops))
+	}
+	if !reflect.DeepEqual(ops, GenerateOps(rand.New(rand.NewSource(1)), 500, 10)) {
+		t.Errorf("not deterministic")
+	}
+	kinds := make(map[OpKind]bool)
+	for _, op := range ops {
+		kinds[op.Kind] = true
+		if op.Kind == OpIncrement && !strings.HasPrefix(op.Key, counterPrefix) {
+			t.Errorf("increment on a textual key: %s", op)
+		}
+		if op.Kind == OpRekey && (op.Key == op.Aux || strings.HasPrefix(op.Aux, counterPrefix)) {
+			t.Errorf("invalid rekey: %s", op)
+		}
+	}
+	for kind := OpGet; kind <= OpClear; kind++ {
+		if !kinds[kind] {
+			t.Errorf("missing kind: %s", kind)
+		}
+	}
+}
+
+func TestModel(t *testing.T) {
+	model := NewModel(true)
+	cases := []struct {
+		op   Op
+		want Result
+	}{
+		{Op{OpGet, "a", "", ""}, Result{tkrzw.StatusNotFoundError, ""}},
+		{Op{OpSet, "a", "x", ""}, Result{tkrzw.StatusSuccess, ""}},
+		{Op{OpAdd, "a", "y", ""}, Result{tkrzw.StatusDuplicationError, ""}},
+		{Op{OpAppend, "a", "z", ""}, Result{tkrzw.StatusSuccess, ""}},
+		{Op{OpGet, "a", "", ""}, Result{tkrzw.StatusSuccess, "x:z"}},
+		{Op{OpCompareExchange, "a", "w", ""}, Result{tkrzw.StatusInfeasibleError, ""}},
+		{Op{OpCompareExchange, "a", "w", "x:z"}, Result{tkrzw.StatusSuccess, ""}},
+		{Op{OpRekey, "a", "", "b"}, Result{tkrzw.StatusSuccess, ""}},
+		{Op{OpRekey, "a", "", "b"}, Result{tkrzw.StatusNotFoundError, ""}},
+		{Op{OpProcess, "b", "!", ""}, Result{tkrzw.StatusSuccess, ""}},
+		{Op{OpIncrement, "#c", "3", ""}, Result{tkrzw.StatusSuccess, "3"}},
+		{Op{OpIncrement, "#c", "-5", ""}, Result{tkrzw.StatusSuccess, "-2"}},
+		{Op{OpCount, "", "", ""}, Result{tkrzw.StatusSuccess, "2"}},
+		{Op{OpPopFirst, "", "", ""},
+			Result{tkrzw.StatusSuccess, `"#c"="\xff\xff\xff\xff\xff\xff\xff\xfe"`}},
+		{Op{OpScan, "", "", ""}, Result{tkrzw.StatusSuccess, `"b"="w!"`}},
+		{Op{OpProcess, "b", "", ""}, Result{tkrzw.StatusSuccess, ""}},
+		{Op{OpPopFirst, "", "", ""}, Result{tkrzw.StatusNotFoundError, ""}},
+	}
+	for i, c := range cases {
+		if got := model.Apply(c.op, Result{}); got != c.want {
+			t.Errorf("#%d %s: want=%s, got=%s", i, c.op, c.want, got)
+		}
+	}
+}
+
+func TestMemoryDBMClasses(t *testing.T) {
+	Test(t, MemoryDBMClasses(), map[string]string{"num_rounds": "3", "num_ops": "500"})
+}
+
+func TestDBMClasses(t *testing.T) {
+	Test(t, DBMClasses(), map[string]string{"num_rounds": "2", "num_ops": "300"})
+}
+
+func TestShrink(t *testing.T) {
+	class := Class{
+		Name: "brokenDBM",
+		Open: func(dir string) (tkrzw.Storage, *tkrzw.Status) {
+			return brokenDBM{tkrzw.NewMemoryDBM(false)}, tkrzw.NewStatus1(tkrzw.StatusSuccess)
+		},
+	}
+	ops := GenerateOps(rand.New(rand.NewSource(1)), 1000, 20)
+	failure, status := Run(class, "", ops)
+	if !status.IsOK() {
+		t.Fatalf("cannot open: %s", status)
+	}
+	if failure == nil {
+		t.Fatalf("no failure")
+	}
+	if failure.Ops[failure.Index].Kind != OpRemove {
+		t.Errorf("unexpected failure: %s", failure.Error())
+	}
+	failure = Shrink(class, "", failure, 1000)
+	if len(failure.Ops) != 1 || failure.Ops[0].Kind != OpRemove {
+		t.Fatalf("not shrunk: %s", failure.Error())
+	}
+	want := Result{tkrzw.StatusNotFoundError, ""}
+	if failure.Index != 0 || failure.Want != want || failure.Got.Code != tkrzw.StatusSuccess {
+		t.Errorf("unexpected failure: %s", failure.Error())
+	}
+	if !strings.Contains(failure.Error(), "reproduction: []dbmtest.Op{") {
+		t.Errorf("no reproduction: %s", failure.Error())
+	}
+	failure, _ = Run(MemoryDBMClasses()[0], "", failure.Ops)
+	if failure != nil {
+		t.Errorf("unexpected failure: %s", failure.Error())
+	}
+}
+
+// END OF FILE
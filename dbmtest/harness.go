@@ -0,0 +1,383 @@
+/*************************************************************************************************
+ * Driver of the differential test
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package dbmtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/estraier/tkrzw-go"
+)
+
+// A database class to be tested.
+type Class struct {
+	// The name of the class, used as the name of the subtest.
+	Name string
+	// Whether the records are iterated in ascending order of the keys.
+	Ordered bool
+	// Whether updates are visible only after synchronization, like SkipDBM.
+	SyncEachUpdate bool
+	// The function to open a new empty database in a directory.
+	Open func(dir string) (tkrzw.Storage, *tkrzw.Status)
+}
+
+// Interface of databases which can be synchronized.
+type synchronizer interface {
+	Synchronize(hard bool, params map[string]string) *tkrzw.Status
+}
+
+// Interface of databases which can be rebuilt.
+type rebuilder interface {
+	Rebuild(params map[string]string) *tkrzw.Status
+}
+
+// Makes a class of tkrzw.DBM.
+//
+// @param dbmClass The name of the class, like "HashDBM".
+// @param ext The extension of the file name.
+// @param ordered Whether the class is ordered.
+// @param numShards The number of shards, or 0 not to shard the database.
+// @return The class.
+func NewDBMClass(dbmClass string, ext string, ordered bool, numShards int) Class {
+	name := dbmClass
+	params := "truncate=true,dbm=" + dbmClass
+	if numShards > 0 {
+		name += fmt.Sprintf("-shards%d", numShards)
+		params += fmt.Sprintf(",num_shards=%d", numShards)
+	}
+	return Class{
+		Name:           name,
+		Ordered:        ordered,
+		SyncEachUpdate: dbmClass == "SkipDBM",
+		Open: func(dir string) (tkrzw.Storage, *tkrzw.Status) {
+			dbm := tkrzw.NewDBM()
+			status := dbm.Open(filepath.Join(dir, "casket"+ext), true, tkrzw.ParseParams(params))
+			return dbm, status
+		},
+	}
+}
+
+// Gets the classes of tkrzw.DBM.
+//
+// @return The classes of HashDBM, TreeDBM, SkipDBM, TinyDBM, BabyDBM, CacheDBM, StdHashDBM, and StdTreeDBM, each of which is unsharded and sharded into 3 shards.
+func DBMClasses() []Class {
+	specs := []struct {
+		dbmClass string
+		ext      string
+		ordered  bool
+	}{
+		{"HashDBM", ".tkh", false},
+		{"TreeDBM", ".tkt", true},
+		{"SkipDBM", ".tks", true},
+		{"TinyDBM", ".tkmt", false},
+		{"BabyDBM", ".tkmb", true},
+		{"CacheDBM", ".tkmc", false},
+		{"StdHashDBM", ".tksh", false},
+		{"StdTreeDBM", ".tkst", true},
+	}
+	classes := make([]Class, 0, len(specs)*2)
+	for _, numShards := range []int{0, 3} {
+		for _, spec := range specs {
+			classes = append(classes, NewDBMClass(spec.dbmClass, spec.ext, spec.ordered, numShards))
+		}
+	}
+	return classes
+}
+
+// Gets the classes of tkrzw.MemoryDBM.
+//
+// @return The classes of the unordered and ordered MemoryDBM.
+func MemoryDBMClasses() []Class {
+	classes := make([]Class, 0, 2)
+	for _, ordered := range []bool{false, true} {
+		ordered := ordered
+		name := "MemoryDBM"
+		if ordered {
+			name += "-ordered"
+		}
+		classes = append(classes, Class{
+			Name:    name,
+			Ordered: ordered,
+			Open: func(dir string) (tkrzw.Storage, *tkrzw.Status) {
+				return tkrzw.NewMemoryDBM(ordered), tkrzw.NewStatus1(tkrzw.StatusSuccess)
+			},
+		})
+	}
+	return classes
+}
+
+// A failure of the differential test.
+type Failure struct {
+	// The name of the class.
+	Class string
+	// The operations applied to the database.
+	Ops []Op
+	// The index of the failing operation, or len(Ops) if the failure is at the final check.
+	Index int
+	// The expected result.
+	Want Result
+	// The actual result.
+	Got Result
+}
+
+// Makes a string representing the failure.
+//
+// @return The message including the operations to reproduce the failure.
+func (self *Failure) Error() string {
+	lines := make([]string, 0, len(self.Ops)+2)
+	if self.Index < len(self.Ops) {
+		lines = append(lines, fmt.Sprintf("%s: op #%d %s: want=%s, got=%s",
+			self.Class, self.Index, self.Ops[self.Index], self.Want, self.Got))
+	} else {
+		lines = append(lines, fmt.Sprintf("%s: final check: want=%s, got=%s",
+			self.Class, self.Want, self.Got))
+	}
+	lines = append(lines, "reproduction: []dbmtest.Op{")
+	for _, op := range self.Ops {
+		lines = append(lines, "\t"+op.String()+",")
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n")
+}
+
+// Applies an operation to a database and gets the actual result.
+func apply(class Class, dbm tkrzw.Storage, op Op) Result {
+	switch op.Kind {
+	case OpGet:
+		value, status := dbm.GetStr(op.Key)
+		return Result{Code: status.GetCode(), Value: value}
+	case OpSet:
+		return Result{Code: dbm.Set(op.Key, op.Value, true).GetCode()}
+	case OpAdd:
+		return Result{Code: dbm.Set(op.Key, op.Value, false).GetCode()}
+	case OpRemove:
+		return Result{Code: dbm.Remove(op.Key).GetCode()}
+	case OpAppend:
+		return Result{Code: dbm.Append(op.Key, op.Value, ":").GetCode()}
+	case OpCompareExchange:
+		var expected, desired interface{}
+		if op.Aux != "" {
+			expected = op.Aux
+		}
+		if op.Value != "" {
+			desired = op.Value
+		}
+		return Result{Code: dbm.CompareExchange(op.Key, expected, desired).GetCode()}
+	case OpIncrement:
+		num, status := dbm.Increment(op.Key, tkrzw.ToInt(op.Value), 0)
+		if !status.IsOK() {
+			return Result{Code: status.GetCode()}
+		}
+		return Result{Code: status.GetCode(), Value: fmt.Sprintf("%d", num)}
+	case OpRekey:
+		return Result{Code: dbm.Rekey(op.Key, op.Aux, true, false).GetCode()}
+	case OpProcess:
+		proc := func(key []byte, value []byte) interface{} {
+			if value == nil {
+				return nil
+			}
+			if op.Value == "" {
+				return tkrzw.RemoveBytes
+			}
+			return string(value) + op.Value
+		}
+		return Result{Code: dbm.Process(op.Key, proc, true).GetCode()}
+	case OpPopFirst:
+		key, value, status := dbm.PopFirstStr()
+		if !status.IsOK() {
+			return Result{Code: status.GetCode()}
+		}
+		return Result{Code: status.GetCode(), Value: encodeRecord(key, value)}
+	case OpCount:
+		count, status := dbm.Count()
+		return Result{Code: status.GetCode(), Value: fmt.Sprintf("%d", count)}
+	case OpScan:
+		records := make([]string, 0)
+		for record := range dbm.EachStr() {
+			records = append(records, encodeRecord(record.Key, record.Value))
+		}
+		if !class.Ordered {
+			sort.Strings(records)
+		}
+		return Result{Code: tkrzw.StatusSuccess, Value: strings.Join(records, ",")}
+	case OpClear:
+		return Result{Code: dbm.Clear().GetCode()}
+	case OpSynchronize:
+		if syncer, ok := dbm.(synchronizer); ok {
+			return Result{Code: syncer.Synchronize(false, nil).GetCode()}
+		}
+		return Result{Code: tkrzw.StatusSuccess}
+	case OpRebuild:
+		if builder, ok := dbm.(rebuilder); ok {
+			return Result{Code: builder.Rebuild(nil).GetCode()}
+		}
+		return Result{Code: tkrzw.StatusSuccess}
+	}
+	return Result{Code: tkrzw.StatusNotImplementedError, Value: op.Kind.String()}
+}
+
+// Checks whether an operation updates the database.
+func isUpdate(kind OpKind) bool {
+	switch kind {
+	case OpGet, OpCount, OpScan, OpSynchronize, OpRebuild:
+		return false
+	}
+	return true
+}
+
+// Runs a sequence of operations on a new database and compares the results with the model.
+//
+// @param class The database class.
+// @param dir The directory to store database files.
+// @param ops The operations.
+// @return The failure, or nil if all results match the model.  If the database cannot be opened, the status is returned as the error.
+//
+// After the last operation, all records are scanned and compared, and then the database is closed.  A failure there is reported as the final check.
+func Run(class Class, dir string, ops []Op) (*Failure, *tkrzw.Status) {
+	dbm, status := class.Open(dir)
+	if !status.IsOK() {
+		return nil, status
+	}
+	model := NewModel(class.Ordered)
+	var failure *Failure
+	allOps := append(append(make([]Op, 0, len(ops)+1), ops...), Op{Kind: OpScan})
+	for i, op := range allOps {
+		got := apply(class, dbm, op)
+		if class.SyncEachUpdate && isUpdate(op.Kind) && got.Code == tkrzw.StatusSuccess {
+			if syncer, ok := dbm.(synchronizer); ok {
+				syncer.Synchronize(false, nil)
+			}
+		}
+		want := model.Apply(op, got)
+		if got != want {
+			end := i + 1
+			if end > len(ops) {
+				end = len(ops)
+			}
+			failure = &Failure{Class: class.Name, Ops: ops[:end], Index: i, Want: want, Got: got}
+			break
+		}
+	}
+	closeStatus := dbm.Close()
+	if failure == nil && !closeStatus.IsOK() {
+		failure = &Failure{Class: class.Name, Ops: ops, Index: len(ops),
+			Want: Result{Code: tkrzw.StatusSuccess}, Got: Result{Code: closeStatus.GetCode()}}
+	}
+	return failure, tkrzw.NewStatus1(tkrzw.StatusSuccess)
+}
+
+// Shrinks a failing sequence of operations into a minimal one which still fails.
+//
+// @param class The database class.
+// @param dir The directory to store database files.
+// @param failure The failure to shrink.
+// @param maxRuns The maximum number of runs to try.
+// @return The failure of the shrunk sequence.
+//
+// Chunks of operations are removed while the failure is reproduced, halving the chunk size down to one operation.  The reproduced failure can be different from the original one.
+func Shrink(class Class, dir string, failure *Failure, maxRuns int) *Failure {
+	numRuns := 0
+	chunk := len(failure.Ops) / 2
+	if chunk < 1 {
+		chunk = 1
+	}
+	for numRuns < maxRuns {
+		removed := false
+		for start := 0; start < len(failure.Ops) && numRuns < maxRuns; {
+			end := start + chunk
+			if end > len(failure.Ops) {
+				end = len(failure.Ops)
+			}
+			candidate := append(append(make([]Op, 0, len(failure.Ops)), failure.Ops[:start]...),
+				failure.Ops[end:]...)
+			numRuns++
+			shrunk, status := Run(class, dir, candidate)
+			if status.IsOK() && shrunk != nil {
+				failure = shrunk
+				removed = true
+				continue
+			}
+			start = end
+		}
+		if chunk > 1 {
+			chunk /= 2
+		} else if !removed {
+			break
+		}
+	}
+	return failure
+}
+
+// Runs the differential test on database classes as subtests.
+//
+// @param t The test object.
+// @param classes The database classes.
+// @param params Optional parameters.  If it is nil, it is ignored.
+//
+// The optional parameter "num_rounds" specifies the number of random sequences for each class, which is 10 by default.  "num_ops" specifies the number of operations of each sequence, which is 1000 by default.  "num_keys" specifies the number of distinct keys, which is 50 by default.  "seed" specifies the seed of the random generator, which is 1 by default.  "max_shrink_runs" specifies the maximum number of runs to shrink a failing sequence, which is 1000 by default.  A class is skipped if it is not implemented in the build, as tkrzw.DBM without cgo.
+func Test(t *testing.T, classes []Class, params map[string]string) {
+	numRounds := 10
+	if num := tkrzw.ToInt(params["num_rounds"]); num > 0 {
+		numRounds = int(num)
+	}
+	numOps := 1000
+	if num := tkrzw.ToInt(params["num_ops"]); num > 0 {
+		numOps = int(num)
+	}
+	numKeys := 50
+	if num := tkrzw.ToInt(params["num_keys"]); num > 0 {
+		numKeys = int(num)
+	}
+	seed := int64(1)
+	if expr, ok := params["seed"]; ok {
+		seed = tkrzw.ToInt(expr)
+	}
+	maxShrinkRuns := 1000
+	if num := tkrzw.ToInt(params["max_shrink_runs"]); num > 0 {
+		maxShrinkRuns = int(num)
+	}
+	for _, class := range classes {
+		class := class
+		t.Run(class.Name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "tkrzw-dbmtest-")
+			if err != nil {
+				t.Fatalf("cannot create directory: %s", err)
+			}
+			defer os.RemoveAll(dir)
+			random := rand.New(rand.NewSource(seed))
+			for round := 0; round < numRounds; round++ {
+				ops := GenerateOps(random, numOps, numKeys)
+				failure, status := Run(class, dir, ops)
+				if status.Equals(tkrzw.StatusNotImplementedError) {
+					t.Skipf("not implemented: %s", status)
+				}
+				if !status.IsOK() {
+					t.Fatalf("cannot open the database: %s", status)
+				}
+				if failure != nil {
+					failure = Shrink(class, dir, failure, maxShrinkRuns)
+					t.Fatalf("round %d: %s", round, failure.Error())
+				}
+			}
+		})
+	}
+}
+
+// END OF FILE
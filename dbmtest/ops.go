@@ -0,0 +1,344 @@
+/*************************************************************************************************
+ * Operations of the differential test and the model to check them
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+// Package dbmtest provides a randomized differential test driver for database managers.
+//
+// The same sequence of random operations is applied to each database class and to a model made of a Go map.  The result of every operation, the status code and the returned value, is compared with the result of the model.  If they differ, the sequence is shrunk by removing operations while the failure is reproduced, so that a minimal reproduction is reported.  The driver works on any tkrzw.Storage, including tkrzw.MemoryDBM.  Classes of tkrzw.DBM need cgo and they are skipped if cgo is disabled.
+package dbmtest
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/estraier/tkrzw-go"
+)
+
+// Kind of an operation.
+type OpKind int
+
+// Enumeration of the kinds of operations.
+const (
+	// Gets the value of the key.
+	OpGet = OpKind(iota)
+	// Sets the value of the key, overwriting the existing value.
+	OpSet
+	// Sets the value of the key, without overwriting the existing value.
+	OpAdd
+	// Removes the record of the key.
+	OpRemove
+	// Appends the value to the existing value with the delimiter ":".
+	OpAppend
+	// Replaces the value with the value from Aux.  An empty Aux expects no record and an empty Value removes the record.
+	OpCompareExchange
+	// Increments the counter of the key by the decimal integer of Value, from the initial value 0.
+	OpIncrement
+	// Changes the key into the key of Aux, overwriting the existing record.
+	OpRekey
+	// Processes the record by appending Value, or removes it if Value is empty.  Nothing is done if the record doesn't exist.
+	OpProcess
+	// Gets the first record and removes it.
+	OpPopFirst
+	// Gets the number of records.
+	OpCount
+	// Gets all records by iteration.
+	OpScan
+	// Removes all records.
+	OpClear
+	// Synchronizes the database if it supports the operation.
+	OpSynchronize
+	// Rebuilds the database if it supports the operation.
+	OpRebuild
+)
+
+// Names of the kinds of operations.
+var opKindNames = []string{
+	"Get", "Set", "Add", "Remove", "Append", "CompareExchange", "Increment", "Rekey",
+	"Process", "PopFirst", "Count", "Scan", "Clear", "Synchronize", "Rebuild",
+}
+
+// Makes a string representing the kind.
+//
+// @return The name of the kind.
+func (self OpKind) String() string {
+	if self < 0 || int(self) >= len(opKindNames) {
+		return fmt.Sprintf("OpKind(%d)", int(self))
+	}
+	return opKindNames[self]
+}
+
+// An operation on a database.
+type Op struct {
+	// The kind of the operation.
+	Kind OpKind
+	// The key of the record.
+	Key string
+	// The value of the record.
+	Value string
+	// The auxiliary argument, like the expected value or the new key.
+	Aux string
+}
+
+// Makes a string representing the operation.
+//
+// @return The string in the form of a Go expression of the structure.
+func (self Op) String() string {
+	return fmt.Sprintf("{dbmtest.Op%s, %q, %q, %q}", self.Kind, self.Key, self.Value, self.Aux)
+}
+
+// A result of an operation.
+type Result struct {
+	// The status code.
+	Code tkrzw.StatusCode
+	// The returned value, encoded as a string.
+	Value string
+}
+
+// Makes a string representing the result.
+//
+// @return The string of the status code name and the value.
+func (self Result) String() string {
+	return fmt.Sprintf("%s:%q", tkrzw.StatusCodeName(self.Code), self.Value)
+}
+
+// The prefix of keys of counters, which are updated only by OpIncrement.
+const counterPrefix = "#"
+
+// Generates a random sequence of operations.
+//
+// @param random The random generator.
+// @param numOps The number of operations.
+// @param numKeys The number of distinct keys.  A small number makes more conflicts.
+// @return The list of the operations.
+//
+// Counters updated by OpIncrement use keys starting with "#" so that they are not mixed with textual values.
+func GenerateOps(random *rand.Rand, numOps int, numKeys int) []Op {
+	if numKeys < 1 {
+		numKeys = 1
+	}
+	makeKey := func() string {
+		return fmt.Sprintf("%d", random.Intn(numKeys))
+	}
+	makeValue := func() string {
+		return fmt.Sprintf("v%d", random.Intn(numKeys*10))
+	}
+	ops := make([]Op, 0, numOps)
+	for len(ops) < numOps {
+		op := Op{Key: makeKey()}
+		dice := random.Intn(100)
+		switch {
+		case dice < 20:
+			op.Kind = OpGet
+			if random.Intn(4) == 0 {
+				op.Key = counterPrefix + op.Key
+			}
+		case dice < 40:
+			op.Kind = OpSet
+			op.Value = makeValue()
+		case dice < 48:
+			op.Kind = OpAdd
+			op.Value = makeValue()
+		case dice < 58:
+			op.Kind = OpRemove
+			if random.Intn(4) == 0 {
+				op.Key = counterPrefix + op.Key
+			}
+		case dice < 64:
+			op.Kind = OpAppend
+			op.Value = makeValue()
+		case dice < 72:
+			op.Kind = OpCompareExchange
+			if random.Intn(3) > 0 {
+				op.Aux = makeValue()
+			}
+			if random.Intn(4) > 0 {
+				op.Value = makeValue()
+			}
+		case dice < 79:
+			op.Kind = OpIncrement
+			op.Key = counterPrefix + op.Key
+			op.Value = fmt.Sprintf("%d", random.Intn(21)-10)
+		case dice < 83:
+			op.Kind = OpRekey
+			op.Aux = makeKey()
+			if op.Aux == op.Key {
+				continue
+			}
+		case dice < 88:
+			op.Kind = OpProcess
+			if random.Intn(3) > 0 {
+				op.Value = makeValue()
+			}
+		case dice < 91:
+			op.Kind = OpPopFirst
+			op.Key = ""
+		case dice < 94:
+			op.Kind = OpCount
+			op.Key = ""
+		case dice < 97:
+			op.Kind = OpScan
+			op.Key = ""
+		case dice < 98:
+			op.Kind = OpClear
+			op.Key = ""
+		case dice < 99:
+			op.Kind = OpSynchronize
+			op.Key = ""
+		default:
+			op.Kind = OpRebuild
+			op.Key = ""
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// Encodes a record into a string.
+func encodeRecord(key string, value string) string {
+	return fmt.Sprintf("%q=%q", key, value)
+}
+
+// The model of a database, made of a Go map.
+type Model struct {
+	// Whether the database is ordered.
+	ordered bool
+	// The records.
+	records map[string]string
+}
+
+// Makes a new empty model.
+//
+// @param ordered True if the database is ordered.
+// @return The new model.
+func NewModel(ordered bool) *Model {
+	return &Model{ordered: ordered, records: make(map[string]string)}
+}
+
+// Gets the keys in ascending order.
+func (self *Model) sortedKeys() []string {
+	keys := make([]string, 0, len(self.records))
+	for key := range self.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Applies an operation to the model and gets the expected result.
+//
+// @param op The operation.
+// @param got The actual result of the database.  It is used for operations whose results are not determined uniquely, like OpPopFirst on unordered databases.
+// @return The expected result.
+func (self *Model) Apply(op Op, got Result) Result {
+	success := Result{Code: tkrzw.StatusSuccess}
+	value, exists := self.records[op.Key]
+	switch op.Kind {
+	case OpGet:
+		if !exists {
+			return Result{Code: tkrzw.StatusNotFoundError}
+		}
+		return Result{Code: tkrzw.StatusSuccess, Value: value}
+	case OpSet:
+		self.records[op.Key] = op.Value
+		return success
+	case OpAdd:
+		if exists {
+			return Result{Code: tkrzw.StatusDuplicationError}
+		}
+		self.records[op.Key] = op.Value
+		return success
+	case OpRemove:
+		if !exists {
+			return Result{Code: tkrzw.StatusNotFoundError}
+		}
+		delete(self.records, op.Key)
+		return success
+	case OpAppend:
+		if exists {
+			self.records[op.Key] = value + ":" + op.Value
+		} else {
+			self.records[op.Key] = op.Value
+		}
+		return success
+	case OpCompareExchange:
+		if (op.Aux == "") == exists || (exists && value != op.Aux) {
+			return Result{Code: tkrzw.StatusInfeasibleError}
+		}
+		if op.Value == "" {
+			delete(self.records, op.Key)
+		} else {
+			self.records[op.Key] = op.Value
+		}
+		return success
+	case OpIncrement:
+		num := int64(0)
+		if exists {
+			num = tkrzw.DeserializeInt([]byte(value))
+		}
+		num += tkrzw.ToInt(op.Value)
+		self.records[op.Key] = string(tkrzw.SerializeInt(num))
+		return Result{Code: tkrzw.StatusSuccess, Value: fmt.Sprintf("%d", num)}
+	case OpRekey:
+		if !exists {
+			return Result{Code: tkrzw.StatusNotFoundError}
+		}
+		self.records[op.Aux] = value
+		delete(self.records, op.Key)
+		return success
+	case OpProcess:
+		if exists {
+			if op.Value == "" {
+				delete(self.records, op.Key)
+			} else {
+				self.records[op.Key] = value + op.Value
+			}
+		}
+		return success
+	case OpPopFirst:
+		if len(self.records) == 0 {
+			return Result{Code: tkrzw.StatusNotFoundError}
+		}
+		key := self.sortedKeys()[0]
+		if !self.ordered {
+			for candidate, candidateValue := range self.records {
+				if got.Value == encodeRecord(candidate, candidateValue) {
+					key = candidate
+					break
+				}
+			}
+		}
+		record := encodeRecord(key, self.records[key])
+		delete(self.records, key)
+		return Result{Code: tkrzw.StatusSuccess, Value: record}
+	case OpCount:
+		return Result{Code: tkrzw.StatusSuccess, Value: fmt.Sprintf("%d", len(self.records))}
+	case OpScan:
+		records := make([]string, 0, len(self.records))
+		for _, key := range self.sortedKeys() {
+			records = append(records, encodeRecord(key, self.records[key]))
+		}
+		if !self.ordered {
+			sort.Strings(records)
+		}
+		return Result{Code: tkrzw.StatusSuccess, Value: strings.Join(records, ",")}
+	case OpClear:
+		self.records = make(map[string]string)
+		return success
+	case OpSynchronize, OpRebuild:
+		return success
+	}
+	return Result{Code: tkrzw.StatusNotImplementedError, Value: op.Kind.String()}
+}
+
+// END OF FILE
@@ -39,6 +39,8 @@ The key and the value of the records are stored as byte arrays.  However, you ca
 
 Install the latest version of Tkrzw beforehand.  If you write the above import directive and prepare the "go.mod" file, the Go module for Tkrzw is installed implicitly when you run "go get".  Go 1.14 or later is required to use this package.
 
+Code which depends on the interface "Storage" instead of the struct "DBM" can be tested with "MemoryDBM", an on-memory implementation in pure Go with the same semantics.  If cgo is disabled by "CGO_ENABLED=0", the package is still built but the methods of "DBM" and the other native structs fail with StatusNotImplementedError, while "MemoryDBM" works as usual.
+
 The following code is a simple example to use a database, without checking errors.  Many methods accept both byte arrays and strings.  If strings are given, they are converted implicitly into byte arrays.
 
  package main
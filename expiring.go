@@ -0,0 +1,361 @@
+/*************************************************************************************************
+ * Database with expiration of records
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// The size of the deadline prefixed to each value.
+const expiringDeadlineSize = 8
+
+// The default interval in seconds of sweeping.
+const expiringSweepInterval = 1.0
+
+// The default maximum number of records removed by one sweep.
+const expiringSweepBatch = 1000
+
+// Database wrapper which supports expiration of records.
+//
+// Each value in the main database is prefixed with the deadline of the record, which is the UNIX time in seconds serialized by SerializeFloat.  The deadline is zero if the record doesn't expire.  Records whose deadlines have passed are treated as missing on reading.  The index database, which should be a TreeDBM, has the keys made of the serialized deadline and the record key.  As the serialized non-negative floating-point numbers are ordered as bytes, expired records are found by iterating the index from the first record.  A sweeper goroutine removes expired records periodically.
+type ExpiringDBM struct {
+	// The main database.
+	dbm *DBM
+	// The index database.
+	index *DBM
+	// The maximum number of records removed by one sweep.
+	sweepBatch int
+	// The channel to stop the sweeper.
+	stop chan struct{}
+	// The wait group of the sweeper.
+	wg sync.WaitGroup
+}
+
+// Makes a database wrapper which supports expiration of records.
+//
+// @param dbm The main database, which can be of any class.
+// @param index The index database, which should be a TreeDBM opened in the writable mode.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The new database wrapper.
+//
+// The optional parameter "sweep_interval" specifies the interval in seconds of sweeping.  By default, it is 1.  If it is zero or negative, no sweeper goroutine runs and the "Sweep" method should be called explicitly.  The optional parameter "sweep_batch" specifies the maximum number of records removed by one sweep.  By default, it is 1000.  Records of the main database must be accessed only through the wrapper.
+func NewExpiringDBM(dbm *DBM, index *DBM, params map[string]string) *ExpiringDBM {
+	expDBM := &ExpiringDBM{
+		dbm:        dbm,
+		index:      index,
+		sweepBatch: expiringSweepBatch,
+	}
+	if batch := ToInt(params["sweep_batch"]); batch > 0 {
+		expDBM.sweepBatch = int(batch)
+	}
+	interval := expiringSweepInterval
+	if expr, ok := params["sweep_interval"]; ok {
+		interval = ToFloat(expr)
+	}
+	if interval > 0 {
+		expDBM.stop = make(chan struct{})
+		expDBM.wg.Add(1)
+		go expDBM.runSweeper(interval)
+	}
+	return expDBM
+}
+
+// Makes a string representing the database wrapper.
+//
+// @return The string representing the database wrapper.
+func (self *ExpiringDBM) String() string {
+	return fmt.Sprintf("#<tkrzw.ExpiringDBM:%p:%s>", &self, self.dbm.String())
+}
+
+// Runs the sweeper until it is stopped.
+func (self *ExpiringDBM) runSweeper(interval float64) {
+	defer self.wg.Done()
+	ticker := time.NewTicker(time.Duration(interval * float64(time.Second)))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+			for {
+				numRemoved, status := self.Sweep()
+				if !status.IsOK() || numRemoved < int64(self.sweepBatch) {
+					break
+				}
+			}
+		}
+	}
+}
+
+// Stops the sweeper.
+//
+// @return The result status.
+//
+// The databases are not closed by this method.
+func (self *ExpiringDBM) Close() *Status {
+	if self.stop == nil {
+		return NewStatus1(StatusSuccess)
+	}
+	close(self.stop)
+	self.wg.Wait()
+	self.stop = nil
+	return NewStatus1(StatusSuccess)
+}
+
+// Gets the current UNIX time in seconds.
+func expiringNow() float64 {
+	return float64(time.Now().UnixNano()) / float64(time.Second)
+}
+
+// Makes the key of an index record.
+func expiringIndexKey(deadline float64, key []byte) []byte {
+	return append(SerializeFloat(deadline), key...)
+}
+
+// Splits a stored value into the deadline and the value.
+func expiringSplitValue(data []byte) (float64, []byte, *Status) {
+	if len(data) < expiringDeadlineSize {
+		return 0, nil, NewStatus2(StatusBrokenDataError, "too short value")
+	}
+	return DeserializeFloat(data[:expiringDeadlineSize]), data[expiringDeadlineSize:],
+		NewStatus1(StatusSuccess)
+}
+
+// Checks whether a deadline has passed.
+func expiringIsExpired(deadline float64, now float64) bool {
+	return deadline > 0 && deadline <= now
+}
+
+// Gets the stored value and the deadline of a live record.
+func (self *ExpiringDBM) getLive(key []byte) ([]byte, float64, []byte, *Status) {
+	data, status := self.dbm.Get(key)
+	if !status.IsOK() {
+		return nil, 0, nil, status
+	}
+	deadline, value, status := expiringSplitValue(data)
+	if !status.IsOK() {
+		return nil, 0, nil, status
+	}
+	if expiringIsExpired(deadline, expiringNow()) {
+		return data, deadline, nil, NewStatus2(StatusNotFoundError, "expired")
+	}
+	return data, deadline, value, status
+}
+
+// Stores a record with a deadline.
+func (self *ExpiringDBM) store(key []byte, value []byte, deadline float64, overwrite bool) *Status {
+	data := append(SerializeFloat(deadline), value...)
+	if deadline > 0 {
+		status := self.index.Set(expiringIndexKey(deadline, key), "", true)
+		if !status.IsOK() {
+			return status
+		}
+	}
+	for {
+		oldData, oldDeadline, _, status := self.getLive(key)
+		if status.IsOK() && !overwrite {
+			status = NewStatus2(StatusDuplicationError, "record exists")
+		} else if status.Equals(StatusNotFoundError) || status.IsOK() {
+			status = self.dbm.CompareExchange(key, oldData, data)
+			if status.Equals(StatusInfeasibleError) {
+				continue
+			}
+		}
+		if !status.IsOK() {
+			if deadline > 0 {
+				self.index.Remove(expiringIndexKey(deadline, key))
+			}
+			return status
+		}
+		if oldDeadline > 0 && oldDeadline != deadline {
+			self.index.Remove(expiringIndexKey(oldDeadline, key))
+		}
+		return status
+	}
+}
+
+// Sets a record which doesn't expire.
+//
+// @param key The key of the record.
+// @param value The value of the record.
+// @param overwrite Whether to overwrite the existing value.  Expired records are always overwritten.
+// @return The result status.  If overwriting is abandoned, StatusDuplicationError is returned.
+func (self *ExpiringDBM) Set(key interface{}, value interface{}, overwrite bool) *Status {
+	return self.store(ToByteArray(key), ToByteArray(value), 0, overwrite)
+}
+
+// Sets a record which expires after a period.
+//
+// @param key The key of the record.
+// @param value The value of the record.
+// @param ttl The time to live in seconds.  If it is zero or negative, the record doesn't expire.
+// @param overwrite Whether to overwrite the existing value.  Expired records are always overwritten.
+// @return The result status.  If overwriting is abandoned, StatusDuplicationError is returned.
+func (self *ExpiringDBM) SetWithTTL(
+	key interface{}, value interface{}, ttl float64, overwrite bool) *Status {
+	deadline := 0.0
+	if ttl > 0 {
+		deadline = expiringNow() + ttl
+	}
+	return self.store(ToByteArray(key), ToByteArray(value), deadline, overwrite)
+}
+
+// Gets the value of a record.
+//
+// @param key The key of the record.
+// @return The value of the matching record and the result status.  If there's no matching record or the record has expired, StatusNotFoundError is returned.
+func (self *ExpiringDBM) Get(key interface{}) ([]byte, *Status) {
+	_, _, value, status := self.getLive(ToByteArray(key))
+	if !status.IsOK() {
+		return nil, status
+	}
+	return value, status
+}
+
+// Gets the value of a record, as a string.
+//
+// @param key The key of the record.
+// @return The value of the matching record and the result status.
+func (self *ExpiringDBM) GetStr(key interface{}) (string, *Status) {
+	value, status := self.Get(key)
+	return string(value), status
+}
+
+// Removes a record.
+//
+// @param key The key of the record.
+// @return The result status.  If there's no matching record or the record has expired, StatusNotFoundError is returned.
+func (self *ExpiringDBM) Remove(key interface{}) *Status {
+	rawKey := ToByteArray(key)
+	for {
+		data, deadline, _, status := self.getLive(rawKey)
+		if !status.IsOK() {
+			return status
+		}
+		status = self.dbm.CompareExchange(rawKey, data, nil)
+		if status.Equals(StatusInfeasibleError) {
+			continue
+		}
+		if status.IsOK() && deadline > 0 {
+			self.index.Remove(expiringIndexKey(deadline, rawKey))
+		}
+		return status
+	}
+}
+
+// Sets the expiration of an existing record.
+//
+// @param key The key of the record.
+// @param ttl The time to live in seconds from now.  If it is zero or negative, the record doesn't expire.
+// @return The result status.  If there's no matching record or the record has expired, StatusNotFoundError is returned.
+func (self *ExpiringDBM) Expire(key interface{}, ttl float64) *Status {
+	rawKey := ToByteArray(key)
+	deadline := 0.0
+	if ttl > 0 {
+		deadline = expiringNow() + ttl
+	}
+	if deadline > 0 {
+		status := self.index.Set(expiringIndexKey(deadline, rawKey), "", true)
+		if !status.IsOK() {
+			return status
+		}
+	}
+	for {
+		data, oldDeadline, value, status := self.getLive(rawKey)
+		if !status.IsOK() {
+			if deadline > 0 {
+				self.index.Remove(expiringIndexKey(deadline, rawKey))
+			}
+			return status
+		}
+		status = self.dbm.CompareExchange(rawKey, data, append(SerializeFloat(deadline), value...))
+		if status.Equals(StatusInfeasibleError) {
+			continue
+		}
+		if status.IsOK() && oldDeadline > 0 && oldDeadline != deadline {
+			self.index.Remove(expiringIndexKey(oldDeadline, rawKey))
+		}
+		return status
+	}
+}
+
+// Gets the remaining time to live of a record.
+//
+// @param key The key of the record.
+// @return The remaining time in seconds and the result status.  If the record doesn't expire, the time is positive infinity.  If there's no matching record or the record has expired, StatusNotFoundError is returned.
+func (self *ExpiringDBM) TTL(key interface{}) (float64, *Status) {
+	_, deadline, _, status := self.getLive(ToByteArray(key))
+	if !status.IsOK() {
+		return 0, status
+	}
+	if deadline == 0 {
+		return math.Inf(1), status
+	}
+	return deadline - expiringNow(), status
+}
+
+// Removes expired records.
+//
+// @return The number of index records processed and the result status.
+//
+// At most as many index records as the "sweep_batch" parameter are processed.  Each expired record is removed by CompareExchange on condition that its deadline is not changed after the index was read.  Index records which don't match the deadlines of the main records are removed as stale.
+func (self *ExpiringDBM) Sweep() (int64, *Status) {
+	now := expiringNow()
+	var indexKeys [][]byte
+	iter := self.index.MakeIterator()
+	status := iter.First()
+	for status.IsOK() && len(indexKeys) < self.sweepBatch {
+		var indexKey []byte
+		indexKey, status = iter.GetKey()
+		if !status.IsOK() {
+			break
+		}
+		if len(indexKey) < expiringDeadlineSize ||
+			DeserializeFloat(indexKey[:expiringDeadlineSize]) > now {
+			break
+		}
+		indexKeys = append(indexKeys, indexKey)
+		status = iter.Next()
+	}
+	iter.Destruct()
+	if !status.IsOK() && !status.Equals(StatusNotFoundError) {
+		return 0, status
+	}
+	for _, indexKey := range indexKeys {
+		deadline := DeserializeFloat(indexKey[:expiringDeadlineSize])
+		key := indexKey[expiringDeadlineSize:]
+		data, status := self.dbm.Get(key)
+		if status.IsOK() {
+			dataDeadline, _, splitStatus := expiringSplitValue(data)
+			if splitStatus.IsOK() && dataDeadline == deadline {
+				status = self.dbm.CompareExchange(key, data, nil)
+				if !status.IsOK() && !status.Equals(StatusInfeasibleError) {
+					return 0, status
+				}
+			}
+		} else if !status.Equals(StatusNotFoundError) {
+			return 0, status
+		}
+		status = self.index.Remove(indexKey)
+		if !status.IsOK() && !status.Equals(StatusNotFoundError) {
+			return 0, status
+		}
+	}
+	return int64(len(indexKeys)), NewStatus1(StatusSuccess)
+}
+
+// END OF FILE
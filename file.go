@@ -14,9 +14,24 @@
 package tkrzw
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"regexp"
+	"strings"
 )
 
+// A line of a file with its position.
+type FileLine struct {
+	// The offset of the beginning of the line.
+	Offset int64
+	// The content of the line without the line feed.
+	Line string
+	// The error status if reading fails, or nil for a line.  The value with the error status is the last one sent to the channel and its offset is where reading failed.
+	Status *Status
+}
+
 // Generic file implementation.
 //
 // All operations except for "Open" and "Close" are thread-safe; Multiple threads can access the same file concurrently.  You can specify a concrete class when you call the "Open" method.  Every opened file must be closed explicitly by the "Close" method to avoid data corruption.
@@ -210,3 +225,145 @@ func (self *File) Search(mode string, pattern string, capacity int) []string {
 	}
 	return file_search(self.file, mode, pattern, capacity)
 }
+
+// Makes a channel to read each line.
+//
+// @param ctx The context to stop reading.  If it is nil, the reading is not stoppable.
+// @return the channel to read each line with its offset.  All values should be read from the channel or the context should be canceled to avoid resource leak.
+//
+// Lines are read sequentially with a buffer so that the whole file is not loaded into memory.  The offset of each line can be given to the "Read" method to read the line again.  If reading fails, a value whose Status field is the error status is sent at last.  If the context is canceled, the channel is closed without sending the rest.
+func (self *File) Lines(ctx context.Context) <-chan FileLine {
+	return self.scanLines(ctx, nil)
+}
+
+// Searches the file and makes a channel to read each matching line.
+//
+// @param ctx The context to stop reading.  If it is nil, the reading is not stoppable.
+// @param mode The search mode.  "contain" extracts lines containing the pattern.  "begin" extracts lines beginning with the pattern.  "end" extracts lines ending with the pattern.  "regex" extracts lines partially matches the pattern of a regular expression.  "containcase", "containword", and "containcaseword" extract lines considering case and word boundary.  The edit distance modes are not supported because they require all lines to be compared.
+// @param pattern The pattern for matching.
+// @return The channel to read each matching line with its offset and the result status.  If the mode or the pattern is invalid, the channel is nil.  All values should be read from the channel or the context should be canceled to avoid resource leak.
+//
+// Unlike the "Search" method, matching lines are yielded incrementally without limit.  If reading fails, a value whose Status field is the error status is sent at last and the context stops reading, as with the "Lines" method.
+func (self *File) SearchStream(
+	ctx context.Context, mode string, pattern string) (<-chan FileLine, *Status) {
+	if self.file == 0 {
+		return nil, NewStatus2(StatusPreconditionError, "not opened file")
+	}
+	match, status := makeLineMatcher(mode, pattern)
+	if !status.IsOK() {
+		return nil, status
+	}
+	return self.scanLines(ctx, match), status
+}
+
+// Makes a function to match a line.
+func makeLineMatcher(mode string, pattern string) (func(line string) bool, *Status) {
+	switch mode {
+	case "contain":
+		return func(line string) bool {
+			return strings.Contains(line, pattern)
+		}, NewStatus1(StatusSuccess)
+	case "begin":
+		return func(line string) bool {
+			return strings.HasPrefix(line, pattern)
+		}, NewStatus1(StatusSuccess)
+	case "end":
+		return func(line string) bool {
+			return strings.HasSuffix(line, pattern)
+		}, NewStatus1(StatusSuccess)
+	case "regex":
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, NewStatus2(StatusInvalidArgumentError, err.Error())
+		}
+		return regex.MatchString, NewStatus1(StatusSuccess)
+	case "containcase":
+		lowerPattern := strings.ToLower(pattern)
+		return func(line string) bool {
+			return strings.Contains(strings.ToLower(line), lowerPattern)
+		}, NewStatus1(StatusSuccess)
+	case "containword":
+		return func(line string) bool {
+			return containsWord(line, pattern)
+		}, NewStatus1(StatusSuccess)
+	case "containcaseword":
+		lowerPattern := strings.ToLower(pattern)
+		return func(line string) bool {
+			return containsWord(strings.ToLower(line), lowerPattern)
+		}, NewStatus1(StatusSuccess)
+	}
+	return nil, NewStatus2(StatusInvalidArgumentError, "unsupported mode: "+mode)
+}
+
+// Checks whether a byte is a part of a word.
+func isWordByte(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || c >= 0x80
+}
+
+// Checks whether a text contains a pattern as a word.
+func containsWord(text string, pattern string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+	for start := 0; start <= len(text)-len(pattern); {
+		pos := strings.Index(text[start:], pattern)
+		if pos < 0 {
+			return false
+		}
+		begin := start + pos
+		end := begin + len(pattern)
+		if (begin == 0 || !isWordByte(text[begin-1])) && (end == len(text) || !isWordByte(text[end])) {
+			return true
+		}
+		start = begin + 1
+	}
+	return false
+}
+
+// Makes a channel to read each line which matches a function.
+func (self *File) scanLines(ctx context.Context, match func(line string) bool) <-chan FileLine {
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	chanLine := make(chan FileLine)
+	send := func(line FileLine) bool {
+		select {
+		case chanLine <- line:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	reader := func() {
+		defer close(chanLine)
+		if self.file == 0 {
+			send(FileLine{0, "", NewStatus2(StatusPreconditionError, "not opened file")})
+			return
+		}
+		size, status := self.GetSize()
+		if !status.IsOK() {
+			send(FileLine{0, "", status})
+			return
+		}
+		bufReader := bufio.NewReader(io.NewSectionReader(NewFileStream(self), 0, size))
+		offset := int64(0)
+		for {
+			line, err := bufReader.ReadString('\n')
+			if len(line) == 0 && err != nil {
+				if err != io.EOF {
+					send(FileLine{offset, "", errorToStatus(err)})
+				}
+				return
+			}
+			lineOffset := offset
+			offset += int64(len(line))
+			line = strings.TrimSuffix(line, "\n")
+			if (match == nil || match(line)) && !send(FileLine{lineOffset, line, nil}) {
+				return
+			}
+		}
+	}
+	go reader()
+	return chanLine
+}
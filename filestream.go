@@ -0,0 +1,165 @@
+/*************************************************************************************************
+ * Stream interface of files
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"fmt"
+	"io"
+)
+
+// Stream to access a file through the standard interfaces.
+//
+// FileStream implements io.Reader, io.Writer, io.ReaderAt, io.WriterAt, io.Seeker, and io.Closer.  The sequential methods share a cursor which is initially at the beginning of the file.  Errors are returned as *Status objects, except that io.EOF is returned at the end of the file.  FileStream objects shouldn't be used by multiple threads concurrently although the underlying file can be.
+type FileStream struct {
+	// The underlying file.
+	file *File
+	// The current offset.
+	offset int64
+}
+
+// Makes a stream of a file.
+//
+// @param file The file object, which should be opened.
+// @return The new stream object.
+func NewFileStream(file *File) *FileStream {
+	return &FileStream{file, 0}
+}
+
+// Makes a string representing the stream.
+//
+// @return The string representing the stream.
+func (self *FileStream) String() string {
+	return fmt.Sprintf("#<tkrzw.FileStream:%s:%d>", self.file.String(), self.offset)
+}
+
+// Gets the underlying file.
+//
+// @return The underlying file object.
+func (self *FileStream) File() *File {
+	return self.file
+}
+
+// Reads data at the cursor and advances the cursor.
+//
+// @param p The buffer to store the read data.
+// @return The number of bytes read and the error or nil.  io.EOF is returned if the cursor is at the end of the file.
+func (self *FileStream) Read(p []byte) (int, error) {
+	n, err := self.ReadAt(p, self.offset)
+	self.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Reads data at a position.
+//
+// @param p The buffer to store the read data.
+// @param off The offset of the position.
+// @return The number of bytes read and the error or nil.  If the number is less than the buffer size, io.EOF or another error is returned.
+func (self *FileStream) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, NewStatus2(StatusInvalidArgumentError, "negative offset")
+	}
+	size, status := self.file.GetSize()
+	if !status.IsOK() {
+		return 0, status
+	}
+	if off >= size {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	readSize := int64(len(p))
+	if readSize > size-off {
+		readSize = size - off
+	}
+	data, status := self.file.Read(off, readSize)
+	if !status.IsOK() {
+		return 0, status
+	}
+	n := copy(p, data)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Writes data at the cursor and advances the cursor.
+//
+// @param p The data to write.
+// @return The number of bytes written and the error or nil.
+func (self *FileStream) Write(p []byte) (int, error) {
+	n, err := self.WriteAt(p, self.offset)
+	self.offset += int64(n)
+	return n, err
+}
+
+// Writes data at a position.
+//
+// @param p The data to write.
+// @param off The offset of the position.  If it is beyond the end of the file, the gap is filled with zeros.
+// @return The number of bytes written and the error or nil.
+func (self *FileStream) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, NewStatus2(StatusInvalidArgumentError, "negative offset")
+	}
+	status := self.file.Write(off, p)
+	if !status.IsOK() {
+		return 0, status
+	}
+	return len(p), nil
+}
+
+// Sets the cursor.
+//
+// @param offset The offset relative to the origin.
+// @param whence The origin: io.SeekStart, io.SeekCurrent, or io.SeekEnd.
+// @return The new offset from the beginning of the file and the error or nil.
+//
+// Setting the cursor beyond the end of the file is allowed.  The following Read returns io.EOF and the following Write extends the file.
+func (self *FileStream) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += self.offset
+	case io.SeekEnd:
+		size, status := self.file.GetSize()
+		if !status.IsOK() {
+			return self.offset, status
+		}
+		offset += size
+	default:
+		return self.offset, NewStatus2(StatusInvalidArgumentError, "invalid whence")
+	}
+	if offset < 0 {
+		return self.offset, NewStatus2(StatusInvalidArgumentError, "negative offset")
+	}
+	self.offset = offset
+	return offset, nil
+}
+
+// Closes the underlying file.
+//
+// @return The error or nil.
+func (self *FileStream) Close() error {
+	status := self.file.Close()
+	if !status.IsOK() {
+		return status
+	}
+	return nil
+}
+
+// END OF FILE
@@ -0,0 +1,212 @@
+/*************************************************************************************************
+ * Pure-Go reader and writer of flat records
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+// Package flatrec reads and writes the flat record format without cgo.
+//
+// The flat record format is used by the ExportToFlatRecords and ImportFromFlatRecords methods of tkrzw.DBM.  Each record consists of a magic byte, the size of the data as a variable-length big-endian integer whose bytes except for the last one have the highest bit set, and the data.  The magic byte is 0xFF for normal records and 0xFE for metadata records.  Exported databases are sequences of normal records where keys and values alternate.
+//
+// This package doesn't depend on the native library of Tkrzw so that programs built without cgo can consume and produce flat record files.
+package flatrec
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Magic bytes of flat records.
+const (
+	// The magic byte of normal records.
+	MagicNormal = 0xFF
+	// The magic byte of metadata records.
+	MagicMetadata = 0xFE
+)
+
+// The maximum number of bytes of the size field.
+const maxSizeBytes = 10
+
+// The default maximum size of the data of a record which the reader accepts.
+const DefaultMaxRecordSize = 1 << 30
+
+// The maximum size of the buffer allocated before the data of a record is read.
+const initialBufferSize = 1 << 16
+
+// Error for invalid magic bytes.
+var ErrInvalidMagic = errors.New("flatrec: invalid record magic data")
+
+// Error for invalid size fields.
+var ErrInvalidSize = errors.New("flatrec: invalid record size")
+
+// Writer of flat records into an io.Writer.
+type FlatRecordWriter struct {
+	w    io.Writer
+	head [maxSizeBytes + 1]byte
+}
+
+// Makes a writer of flat records.
+//
+// @param w The writer to write records in.  It is not buffered by this object.
+// @return The new writer.
+func NewFlatRecordWriter(w io.Writer) *FlatRecordWriter {
+	return &FlatRecordWriter{w: w}
+}
+
+// Writes a record with a magic byte.
+func (self *FlatRecordWriter) writeRecord(magic byte, data []byte) error {
+	self.head[0] = magic
+	size := uint64(len(data))
+	numBytes := 1
+	for rest := size >> 7; rest > 0; rest >>= 7 {
+		numBytes++
+	}
+	for i := numBytes; i > 0; i-- {
+		self.head[i] = byte(size & 0x7f)
+		if i < numBytes {
+			self.head[i] |= 0x80
+		}
+		size >>= 7
+	}
+	if _, err := self.w.Write(self.head[:numBytes+1]); err != nil {
+		return err
+	}
+	_, err := self.w.Write(data)
+	return err
+}
+
+// Writes a normal record.
+//
+// @param data The data of the record.
+// @return The error or nil on success.
+func (self *FlatRecordWriter) Write(data []byte) error {
+	return self.writeRecord(MagicNormal, data)
+}
+
+// Writes a metadata record.
+//
+// @param data The data of the record.
+// @return The error or nil on success.
+func (self *FlatRecordWriter) WriteMetadata(data []byte) error {
+	return self.writeRecord(MagicMetadata, data)
+}
+
+// Writes a key and a value as two normal records.
+//
+// @param key The key of the record.
+// @param value The value of the record.
+// @return The error or nil on success.
+func (self *FlatRecordWriter) WriteKeyValue(key []byte, value []byte) error {
+	if err := self.writeRecord(MagicNormal, key); err != nil {
+		return err
+	}
+	return self.writeRecord(MagicNormal, value)
+}
+
+// Reader of flat records from an io.Reader.
+type FlatRecordReader struct {
+	r       *bufio.Reader
+	offset  int64
+	maxSize uint64
+}
+
+// Makes a reader of flat records.
+//
+// @param r The reader to read records from.  If it is not a bufio.Reader, it is buffered by this object.
+// @return The new reader.
+func NewFlatRecordReader(r io.Reader) *FlatRecordReader {
+	return &FlatRecordReader{r: bufio.NewReader(r), maxSize: DefaultMaxRecordSize}
+}
+
+// Sets the maximum size of the data of a record.
+//
+// @param size The maximum size.  Records whose size fields exceed it cause ErrInvalidSize.  The default is DefaultMaxRecordSize.
+func (self *FlatRecordReader) SetMaxRecordSize(size int64) {
+	self.maxSize = uint64(size)
+}
+
+// Reads a record.
+//
+// @return The data of the record, whether the record is metadata, and the error or nil on success.  io.EOF is returned at the end of the stream.  io.ErrUnexpectedEOF is returned if the stream ends in the middle of a record.  ErrInvalidSize is returned if the size field is broken or exceeds the maximum record size.
+//
+// The buffer for the data grows as the data is read so that a broken size field doesn't make a huge allocation.
+func (self *FlatRecordReader) Read() ([]byte, bool, error) {
+	magic, err := self.r.ReadByte()
+	if err != nil {
+		return nil, false, err
+	}
+	if magic != MagicNormal && magic != MagicMetadata {
+		return nil, false, ErrInvalidMagic
+	}
+	size := uint64(0)
+	numBytes := 1
+	for ; ; numBytes++ {
+		if numBytes > maxSizeBytes {
+			return nil, false, ErrInvalidSize
+		}
+		c, err := self.r.ReadByte()
+		if err != nil {
+			return nil, false, io.ErrUnexpectedEOF
+		}
+		size = (size << 7) | uint64(c&0x7f)
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	if size > self.maxSize {
+		return nil, false, ErrInvalidSize
+	}
+	bufSize := size
+	if bufSize > initialBufferSize {
+		bufSize = initialBufferSize
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, bufSize))
+	if _, err := io.CopyN(buf, self.r, int64(size)); err != nil {
+		return nil, false, io.ErrUnexpectedEOF
+	}
+	data := buf.Bytes()
+	self.offset += int64(1+numBytes) + int64(size)
+	return data, magic == MagicMetadata, nil
+}
+
+// Reads a key and a value, skipping metadata records.
+//
+// @return The key, the value, and the error or nil on success.  io.EOF is returned at the end of the stream.  io.ErrUnexpectedEOF is returned if the stream ends after a key.
+func (self *FlatRecordReader) ReadKeyValue() ([]byte, []byte, error) {
+	var key []byte
+	for {
+		data, isMetadata, err := self.Read()
+		if err != nil {
+			if err == io.EOF && key != nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, nil, err
+		}
+		if isMetadata {
+			continue
+		}
+		if key == nil {
+			key = data
+			continue
+		}
+		return key, data, nil
+	}
+}
+
+// Gets the number of bytes of the records read so far.
+//
+// @return The offset of the next record from the beginning of the stream.
+func (self *FlatRecordReader) Offset() int64 {
+	return self.offset
+}
+
+// END OF FILE
@@ -0,0 +1,112 @@
+/*************************************************************************************************
+ * Test cases
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package flatrec
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFlatRecordFormat(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewFlatRecordWriter(&buf)
+	if err := writer.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteMetadata([]byte(strings.Repeat("x", 200))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if !bytes.Equal(data[:5], []byte{0xFF, 0x03, 'a', 'b', 'c'}) {
+		t.Errorf("unexpected normal record: %x", data[:5])
+	}
+	if !bytes.Equal(data[5:8], []byte{0xFE, 0x81, 0x48}) {
+		t.Errorf("unexpected metadata header: %x", data[5:8])
+	}
+	if len(data) != 208 {
+		t.Errorf("unexpected size: %d", len(data))
+	}
+}
+
+func TestFlatRecordRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewFlatRecordWriter(&buf)
+	writer.WriteMetadata([]byte("class=HashDBM"))
+	sizes := []int{0, 1, 127, 128, 16383, 16384, 100000}
+	for _, size := range sizes {
+		key := []byte(strings.Repeat("k", size))
+		value := []byte(strings.Repeat("v", size))
+		if err := writer.WriteKeyValue(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	total := int64(buf.Len())
+	reader := NewFlatRecordReader(bytes.NewReader(buf.Bytes()))
+	data, isMetadata, err := reader.Read()
+	if err != nil || !isMetadata || string(data) != "class=HashDBM" {
+		t.Fatalf("unexpected metadata: %q, %v, %v", data, isMetadata, err)
+	}
+	for _, size := range sizes {
+		key, value, err := reader.ReadKeyValue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(key) != size || len(value) != size || (size > 0 && value[0] != 'v') {
+			t.Errorf("unexpected record: size=%d, key=%d, value=%d", size, len(key), len(value))
+		}
+	}
+	if _, _, err := reader.ReadKeyValue(); err != io.EOF {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if reader.Offset() != total {
+		t.Errorf("unexpected offset: %d, %d", reader.Offset(), total)
+	}
+}
+
+func TestFlatRecordBroken(t *testing.T) {
+	reader := NewFlatRecordReader(bytes.NewReader([]byte{0x01, 0x00}))
+	if _, _, err := reader.Read(); err != ErrInvalidMagic {
+		t.Errorf("unexpected error: %v", err)
+	}
+	reader = NewFlatRecordReader(bytes.NewReader([]byte{0xFF, 0x05, 'a'}))
+	if _, _, err := reader.Read(); err != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected error: %v", err)
+	}
+	reader = NewFlatRecordReader(bytes.NewReader(bytes.Repeat([]byte{0xFF}, 16)))
+	if _, _, err := reader.Read(); err != ErrInvalidSize {
+		t.Errorf("unexpected error: %v", err)
+	}
+	corrupt := append(bytes.Repeat([]byte{0xFF}, 9), 0x7F)
+	reader = NewFlatRecordReader(bytes.NewReader(corrupt))
+	if _, _, err := reader.Read(); err != ErrInvalidSize {
+		t.Errorf("unexpected error: %v", err)
+	}
+	reader = NewFlatRecordReader(bytes.NewReader([]byte{0xFF, 0x84, 0x80, 0x80, 0x80, 0x00, 'a'}))
+	if _, _, err := reader.Read(); err != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected error: %v", err)
+	}
+	reader = NewFlatRecordReader(bytes.NewReader([]byte{0xFF, 0x03, 'a', 'b', 'c'}))
+	reader.SetMaxRecordSize(2)
+	if _, _, err := reader.Read(); err != ErrInvalidSize {
+		t.Errorf("unexpected error: %v", err)
+	}
+	reader = NewFlatRecordReader(bytes.NewReader([]byte{0xFF, 0x01, 'k'}))
+	if _, _, err := reader.ReadKeyValue(); err != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// END OF FILE
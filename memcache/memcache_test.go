@@ -0,0 +1,192 @@
+//go:build cgo
+// +build cgo
+
+/*************************************************************************************************
+ * Test cases
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package memcache
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/estraier/tkrzw-go"
+)
+
+// Client for testing.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t, conn, bufio.NewReader(conn)}
+}
+
+// Sends a request and reads the given number of reply lines.
+func (self *testClient) do(request string, numLines int) string {
+	self.t.Helper()
+	if _, err := self.conn.Write([]byte(request)); err != nil {
+		self.t.Fatal(err)
+	}
+	lines := make([]string, 0, numLines)
+	for i := 0; i < numLines; i++ {
+		line, err := self.reader.ReadString('\n')
+		if err != nil {
+			self.t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+	return strings.Join(lines, "|")
+}
+
+func (self *testClient) check(expected string, request string) {
+	self.t.Helper()
+	actual := self.do(request, strings.Count(expected, "|")+1)
+	if actual != expected {
+		self.t.Errorf("%q: expected=%q, actual=%q", request, expected, actual)
+	}
+}
+
+func TestServer(t *testing.T) {
+	dbm := tkrzw.NewDBM()
+	status := dbm.Open("", true, map[string]string{"dbm": "BabyDBM"})
+	if !status.IsOK() {
+		t.Fatal(status)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(dbm, nil)
+	go server.Serve(listener)
+	client := newTestClient(t, listener.Addr().String())
+	client.check("ERROR", "nosuch\r\n")
+	client.check("END", "get one\r\n")
+	client.check("STORED", "set one 5 0 5\r\nfirst\r\n")
+	client.check("VALUE one 5 5|first|END", "get one two\r\n")
+	client.check("NOT_STORED", "add one 0 0 3\r\nxyz\r\n")
+	client.check("STORED", "add two 0 0 6\r\nsecond\r\n")
+	client.check("NOT_STORED", "replace three 0 0 5\r\nthird\r\n")
+	client.check("STORED", "replace two 7 0 3\r\n2nd\r\n")
+	client.check("STORED", "append one 0 0 2\r\n-a\r\n")
+	client.check("STORED", "prepend one 0 0 2\r\nb-\r\n")
+	client.check("NOT_STORED", "append three 0 0 1\r\nx\r\n")
+	client.check("VALUE one 5 9|b-first-a|VALUE two 7 3|2nd|END", "get one two\r\n")
+	line := client.do("gets one\r\n", 3)
+	fields := strings.Fields(strings.Split(line, "|")[0])
+	if len(fields) != 5 {
+		t.Fatalf("unexpected gets reply: %q", line)
+	}
+	casUnique := fields[4]
+	client.check("NOT_FOUND", "cas three 0 0 1 "+casUnique+"\r\nx\r\n")
+	client.check("EXISTS", "cas one 0 0 1 1\r\nx\r\n")
+	client.check("STORED", "cas one 1 0 3 "+casUnique+"\r\nnew\r\n")
+	client.check("EXISTS", "cas one 1 0 3 "+casUnique+"\r\nold\r\n")
+	client.check("VALUE one 1 3|new|END", "get one\r\n")
+	client.check("STORED", "set num 0 0 2\r\n10\r\n")
+	client.check("15", "incr num 5\r\n")
+	client.check("12", "decr num 3\r\n")
+	client.check("0", "decr num 100\r\n")
+	client.check("18446744073709551615", "incr num 18446744073709551615\r\n")
+	client.check("0", "incr num 1\r\n")
+	client.check("NOT_FOUND", "incr three 1\r\n")
+	client.check("CLIENT_ERROR cannot increment or decrement non-numeric value", "incr one 1\r\n")
+	client.check("CLIENT_ERROR invalid numeric delta argument", "incr num x\r\n")
+	client.check("DELETED", "delete two\r\n")
+	client.check("NOT_FOUND", "delete two\r\n")
+	client.check("STORED", "set gone 0 -1 1\r\nx\r\n")
+	client.check("END", "get gone\r\n")
+	client.check("NOT_FOUND", "delete gone\r\n")
+	client.check("STORED", "set soon 0 1 1\r\nx\r\n")
+	client.check("TOUCHED", "touch soon 0\r\n")
+	client.check("NOT_FOUND", "touch gone 0\r\n")
+	future := strconv.FormatInt(time.Now().Unix()+3600, 10)
+	client.check("STORED", "set future 0 "+future+" 1\r\nx\r\n")
+	client.check("STORED", "set past 0 1000000000 1\r\nx\r\n")
+	client.check("VALUE future 0 1|x|END", "get future past\r\n")
+	client.check("CLIENT_ERROR bad command line format", "set bad\x01key 0 0 1\r\nx\r\n")
+	client.check("CLIENT_ERROR bad command line format", "set key x 0 1\r\nx\r\n")
+	client.check("CLIENT_ERROR bad data chunk|ERROR", "set key 0 0 1\r\nxyz\r\n")
+	client.check("ERROR", "\r\n")
+	longKey := strings.Repeat("k", maxKeySize+1)
+	client.check("CLIENT_ERROR bad command line format", "get "+longKey+"\r\n")
+	client.check("CLIENT_ERROR bad command line format", "delete "+longKey+"\r\n")
+	client.check("CLIENT_ERROR bad command line format", "incr "+longKey+" 1\r\n")
+	client.check("VERSION "+serverVersion, "version\r\n")
+	client.check("VALUE quiet 0 1|q|END", "set quiet 0 0 1 noreply\r\nq\r\nget quiet\r\n")
+	stats := client.do("stats\r\n", 14)
+	if !strings.Contains(stats, "|STAT curr_items ") || !strings.HasSuffix(stats, "|END") {
+		t.Errorf("unexpected stats: %q", stats)
+	}
+	client.check("OK", "flush_all\r\n")
+	client.check("END", "get one num\r\n")
+	client.conn.Write([]byte("quit\r\n"))
+	if _, err := client.reader.ReadString('\n'); err == nil {
+		t.Errorf("connection is not closed")
+	}
+	other := newTestClient(t, listener.Addr().String())
+	other.check("END", "get one\r\n")
+	long := newTestClient(t, listener.Addr().String())
+	long.check("CLIENT_ERROR line too long", "get "+strings.Repeat("k ", maxLineSize/2+10)+"\r\n")
+	if _, err := long.reader.ReadString('\n'); err == nil {
+		t.Errorf("connection is not closed")
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.reader.ReadString('\n'); err == nil {
+		t.Errorf("connection is not closed")
+	}
+	dbm.Close()
+}
+
+func TestServerIncrementCounter(t *testing.T) {
+	dbm := tkrzw.NewDBM()
+	status := dbm.Open("", true, map[string]string{"dbm": "BabyDBM"})
+	if !status.IsOK() {
+		t.Fatal(status)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(dbm, map[string]string{"counter_mode": "increment"})
+	go server.Serve(listener)
+	client := newTestClient(t, listener.Addr().String())
+	client.check("5", "incr num 5\r\n")
+	client.check("-3", "decr num 8\r\n")
+	client.check("VALUE num 0 2|-3|END", "get num\r\n")
+	if num, status := dbm.Increment("num", 10, 0); !status.IsOK() || num != 7 {
+		t.Errorf("unexpected counter: %d, %v", num, status)
+	}
+	client.check("8", "incr num 1\r\n")
+	client.check("CLIENT_ERROR invalid numeric delta argument", "incr num 18446744073709551615\r\n")
+	client.check("DELETED", "delete num\r\n")
+	client.check("END", "get num\r\n")
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dbm.Close()
+}
+
+// END OF FILE
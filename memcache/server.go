@@ -0,0 +1,718 @@
+/*************************************************************************************************
+ * Server of the memcached text protocol
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+// Package memcache provides a TCP server speaking the memcached text protocol on a database.
+//
+// The server supports get, gets, set, add, replace, append, prepend, cas, incr, decr, delete, touch, flush_all, stats, version, and quit.  Each value is stored with a 20-byte header of the 4-byte flags, the 8-byte expiration time in UNIX seconds, and the 8-byte CAS unique, all in big-endian.  Expired items are treated as missing and removed when they are accessed.  With CacheDBM, the memory usage is bounded by the capacity of the database.  With HashDBM, items persist across restarts.  By default, incr and decr update values of decimal text as memcached does.  If the "counter_mode" parameter is "increment", they are done by the "Increment" method of tkrzw.DBM on counters of 8-byte big-endian integers, which are shared with other users of the method.
+package memcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/estraier/tkrzw-go"
+)
+
+// The size of the header of each stored value.
+const headerSize = 20
+
+// The maximum size of a key.
+const maxKeySize = 250
+
+// The maximum size of a command line, including the line terminator.
+const maxLineSize = 2048
+
+// The maximum size of a data block.
+const maxDataSize = 64 << 20
+
+// The threshold of expiration times in seconds to be regarded as relative.
+const maxRelativeExpiration = 60 * 60 * 24 * 30
+
+// The version reported to clients.
+const serverVersion = "1.6.0-tkrzw"
+
+// The error returned when a command line is too long.
+var errLineTooLong = errors.New("line too long")
+
+// The error returned by the "Serve" method after the server is closed.
+var ErrServerClosed = errors.New("server closed")
+
+// Statistics of a server.
+type serverStats struct {
+	cmdGet           int64
+	cmdSet           int64
+	cmdTouch         int64
+	getHits          int64
+	getMisses        int64
+	currConnections  int64
+	totalConnections int64
+}
+
+// Server of the memcached text protocol.
+type Server struct {
+	// The last issued CAS unique, placed first for 64-bit alignment of atomic operations.
+	casSeq uint64
+	// The statistics.
+	stats serverStats
+	// The database.
+	dbm *tkrzw.DBM
+	// Whether incr and decr are done by the "Increment" method.
+	binaryCounter bool
+	// The time when the server started.
+	startTime time.Time
+	// The mutex for the state.
+	mutex sync.Mutex
+	// The listeners being served.
+	listeners map[net.Listener]bool
+	// The active connections.
+	conns map[net.Conn]bool
+	// The wait group of the connections.
+	wg sync.WaitGroup
+	// Whether the server is closed.
+	closed bool
+}
+
+// Makes a server.
+//
+// @param dbm The database, which should be opened.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The new server.
+//
+// CAS uniques are issued in ascending order from the current time in nanoseconds so that they don't collide with those issued before restarting.  The optional parameter "counter_mode" specifies how incr and decr work, which is "text" by default.  With "text", the value of the item is decimal text which is read and written atomically by the "Process" method, missing items are NOT_FOUND, decr stops at 0, and incr wraps around at 2^64, as memcached does.  With "increment", the value is an 8-byte big-endian integer updated by the "Increment" method, missing counters start from 0, and the result is a signed 64-bit integer which can be negative.  As the "Increment" method reads the first 8 bytes of any value, keys of counters should not be used by set and other storage commands.  Counters are read by get and gets as decimal text without flags and expiration.
+func NewServer(dbm *tkrzw.DBM, params map[string]string) *Server {
+	return &Server{
+		dbm:           dbm,
+		binaryCounter: params["counter_mode"] == "increment",
+		casSeq:        uint64(time.Now().UnixNano()),
+		startTime:     time.Now(),
+		listeners:     make(map[net.Listener]bool),
+		conns:         make(map[net.Conn]bool),
+	}
+}
+
+// Makes a string representing the server.
+//
+// @return The string representing the server.
+func (self *Server) String() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return fmt.Sprintf("#<memcache.Server:%p:listeners=%d,conns=%d>",
+		&self, len(self.listeners), len(self.conns))
+}
+
+// Listens on a TCP address and serves connections.
+//
+// @param addr The address, like "localhost:11211".
+// @return The error.  After the "Close" method is called, ErrServerClosed is returned.
+func (self *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return self.Serve(listener)
+}
+
+// Serves connections accepted by a listener.
+//
+// @param listener The listener, which is closed when this method returns.
+// @return The error.  After the "Close" method is called, ErrServerClosed is returned.
+func (self *Server) Serve(listener net.Listener) error {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	self.listeners[listener] = true
+	self.mutex.Unlock()
+	defer func() {
+		self.mutex.Lock()
+		delete(self.listeners, listener)
+		self.mutex.Unlock()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			self.mutex.Lock()
+			closed := self.closed
+			self.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		self.mutex.Lock()
+		if self.closed {
+			self.mutex.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		self.conns[conn] = true
+		self.wg.Add(1)
+		self.mutex.Unlock()
+		go self.handle(conn)
+	}
+}
+
+// Closes all listeners and connections.
+//
+// @return The error or nil.
+//
+// This method waits until all connections are finished.  The database is not closed.
+func (self *Server) Close() error {
+	self.mutex.Lock()
+	self.closed = true
+	for listener := range self.listeners {
+		listener.Close()
+	}
+	for conn := range self.conns {
+		conn.Close()
+	}
+	self.mutex.Unlock()
+	self.wg.Wait()
+	return nil
+}
+
+// Stored item.
+type item struct {
+	flags   uint32
+	exptime int64
+	cas     uint64
+	data    []byte
+}
+
+// Serializes an item.
+func (self *item) serialize() []byte {
+	buf := make([]byte, headerSize+len(self.data))
+	binary.BigEndian.PutUint32(buf[0:4], self.flags)
+	binary.BigEndian.PutUint64(buf[4:12], uint64(self.exptime))
+	binary.BigEndian.PutUint64(buf[12:20], self.cas)
+	copy(buf[headerSize:], self.data)
+	return buf
+}
+
+// Deserializes an item, or returns nil if the data is broken.
+func deserializeItem(data []byte) *item {
+	if len(data) == 8 {
+		num := tkrzw.DeserializeInt(data)
+		return &item{data: []byte(strconv.FormatInt(num, 10))}
+	}
+	if len(data) < headerSize {
+		return nil
+	}
+	return &item{
+		flags:   binary.BigEndian.Uint32(data[0:4]),
+		exptime: int64(binary.BigEndian.Uint64(data[4:12])),
+		cas:     binary.BigEndian.Uint64(data[12:20]),
+		data:    data[headerSize:],
+	}
+}
+
+// Checks whether an item has expired.
+func (self *item) isExpired(now int64) bool {
+	return self.exptime != 0 && self.exptime <= now
+}
+
+// Converts an expiration time of the protocol into an absolute time.
+func absoluteExptime(exptime int64) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return 1
+	case exptime <= maxRelativeExpiration:
+		return time.Now().Unix() + exptime
+	}
+	return exptime
+}
+
+// Issues a new CAS unique.
+func (self *Server) nextCAS() uint64 {
+	return atomic.AddUint64(&self.casSeq, 1)
+}
+
+// Gets a live item, removing it if it has expired.
+func (self *Server) getItem(key []byte) (*item, []byte, *tkrzw.Status) {
+	data, status := self.dbm.Get(key)
+	if !status.IsOK() {
+		return nil, nil, status
+	}
+	it := deserializeItem(data)
+	if it == nil {
+		return nil, nil, tkrzw.NewStatus2(tkrzw.StatusBrokenDataError, "broken item")
+	}
+	if it.isExpired(time.Now().Unix()) {
+		self.dbm.CompareExchange(key, data, nil)
+		return nil, nil, tkrzw.NewStatus1(tkrzw.StatusNotFoundError)
+	}
+	return it, data, status
+}
+
+// Updates an item atomically.
+//
+// The function gets the live item or nil, and returns the new item or nil to keep the record, and the reply.  Expired items are removed even if the record is kept.
+func (self *Server) updateItem(key []byte, proc func(it *item) (*item, string)) (string, *tkrzw.Status) {
+	var reply string
+	now := time.Now().Unix()
+	status := self.dbm.Process(key, func(k []byte, v []byte) interface{} {
+		var current *item
+		if v != nil {
+			current = deserializeItem(v)
+			if current != nil && current.isExpired(now) {
+				current = nil
+			}
+		}
+		var newItem *item
+		newItem, reply = proc(current)
+		if newItem != nil {
+			return newItem.serialize()
+		}
+		if v != nil && current == nil {
+			return tkrzw.RemoveBytes
+		}
+		return nil
+	}, true)
+	return reply, status
+}
+
+// State of a connection.
+type session struct {
+	server *Server
+	reader *bufio.Reader
+	writer *bufio.Writer
+	quit   bool
+}
+
+// Handles a connection.
+func (self *Server) handle(conn net.Conn) {
+	atomic.AddInt64(&self.stats.currConnections, 1)
+	atomic.AddInt64(&self.stats.totalConnections, 1)
+	sess := &session{
+		server: self,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+	}
+	defer func() {
+		conn.Close()
+		self.mutex.Lock()
+		delete(self.conns, conn)
+		self.mutex.Unlock()
+		atomic.AddInt64(&self.stats.currConnections, -1)
+		self.wg.Done()
+	}()
+	for !sess.quit {
+		line, err := sess.readLine()
+		if err == errLineTooLong {
+			sess.reply(false, "CLIENT_ERROR line too long")
+			sess.writer.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if !sess.dispatch(strings.Fields(line)) {
+			sess.writer.Flush()
+			return
+		}
+		if sess.reader.Buffered() == 0 || sess.quit {
+			if err := sess.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Reads a command line without the line terminator, up to the maximum size.
+func (self *session) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := self.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineSize {
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// Writes a reply line unless it is suppressed.
+func (self *session) reply(noreply bool, text string) {
+	if !noreply {
+		self.writer.WriteString(text)
+		self.writer.WriteString("\r\n")
+	}
+}
+
+// Writes a server error of a status.
+func (self *session) replyStatus(status *tkrzw.Status) {
+	self.writer.WriteString("SERVER_ERROR " + strings.Replace(status.String(), "\n", " ", -1))
+	self.writer.WriteString("\r\n")
+}
+
+// Checks whether a key is valid.
+func isValidKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeySize {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Dispatches a command.  It returns false if the connection should be closed.
+func (self *session) dispatch(fields []string) bool {
+	if len(fields) == 0 {
+		self.reply(false, "ERROR")
+		return true
+	}
+	var keys []string
+	switch fields[0] {
+	case "get", "gets":
+		keys = fields[1:]
+	case "incr", "decr", "delete", "touch":
+		if len(fields) > 1 {
+			keys = fields[1:2]
+		}
+	}
+	for _, key := range keys {
+		if len(key) > maxKeySize {
+			self.reply(false, "CLIENT_ERROR bad command line format")
+			return true
+		}
+	}
+	switch fields[0] {
+	case "get", "gets":
+		self.cmdGet(fields)
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return self.cmdStore(fields)
+	case "incr", "decr":
+		self.cmdIncr(fields)
+	case "delete":
+		self.cmdDelete(fields)
+	case "touch":
+		self.cmdTouch(fields)
+	case "flush_all":
+		self.cmdFlushAll(fields)
+	case "stats":
+		self.cmdStats(fields)
+	case "version":
+		self.reply(false, "VERSION "+serverVersion)
+	case "quit":
+		self.quit = true
+	default:
+		self.reply(false, "ERROR")
+	}
+	return true
+}
+
+func (self *session) cmdGet(fields []string) {
+	if len(fields) < 2 {
+		self.reply(false, "ERROR")
+		return
+	}
+	withCAS := fields[0] == "gets"
+	for _, key := range fields[1:] {
+		atomic.AddInt64(&self.server.stats.cmdGet, 1)
+		it, _, status := self.server.getItem([]byte(key))
+		if status.Equals(tkrzw.StatusNotFoundError) {
+			atomic.AddInt64(&self.server.stats.getMisses, 1)
+			continue
+		}
+		if !status.IsOK() {
+			self.replyStatus(status)
+			return
+		}
+		atomic.AddInt64(&self.server.stats.getHits, 1)
+		if withCAS {
+			fmt.Fprintf(self.writer, "VALUE %s %d %d %d\r\n", key, it.flags, len(it.data), it.cas)
+		} else {
+			fmt.Fprintf(self.writer, "VALUE %s %d %d\r\n", key, it.flags, len(it.data))
+		}
+		self.writer.Write(it.data)
+		self.writer.WriteString("\r\n")
+	}
+	self.reply(false, "END")
+}
+
+func (self *session) cmdStore(fields []string) bool {
+	name := fields[0]
+	numFields := 5
+	if name == "cas" {
+		numFields = 6
+	}
+	if len(fields) != numFields && len(fields) != numFields+1 {
+		self.reply(false, "ERROR")
+		return true
+	}
+	noreply := len(fields) == numFields+1 && fields[numFields] == "noreply"
+	key := fields[1]
+	flags, flagsErr := strconv.ParseUint(fields[2], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(fields[3], 10, 64)
+	size, sizeErr := strconv.Atoi(fields[4])
+	var casUnique uint64
+	var casErr error
+	if name == "cas" {
+		casUnique, casErr = strconv.ParseUint(fields[5], 10, 64)
+	}
+	if sizeErr != nil || size < 0 || size > maxDataSize {
+		self.reply(false, "CLIENT_ERROR bad data chunk")
+		return false
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(self.reader, data); err != nil {
+		return false
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		self.reply(false, "CLIENT_ERROR bad data chunk")
+		return true
+	}
+	data = data[:size]
+	if !isValidKey(key) || flagsErr != nil || exptimeErr != nil || casErr != nil ||
+		(len(fields) == numFields+1 && !noreply) {
+		self.reply(false, "CLIENT_ERROR bad command line format")
+		return true
+	}
+	atomic.AddInt64(&self.server.stats.cmdSet, 1)
+	newItem := &item{uint32(flags), absoluteExptime(exptime), self.server.nextCAS(), data}
+	rawKey := []byte(key)
+	if name == "cas" {
+		self.reply(noreply, self.server.compareAndSwap(rawKey, casUnique, newItem))
+		return true
+	}
+	reply, status := self.server.updateItem(rawKey, func(current *item) (*item, string) {
+		switch name {
+		case "add":
+			if current != nil {
+				return nil, "NOT_STORED"
+			}
+		case "replace":
+			if current == nil {
+				return nil, "NOT_STORED"
+			}
+		case "append", "prepend":
+			if current == nil {
+				return nil, "NOT_STORED"
+			}
+			combined := make([]byte, 0, len(current.data)+len(data))
+			if name == "append" {
+				combined = append(append(combined, current.data...), data...)
+			} else {
+				combined = append(append(combined, data...), current.data...)
+			}
+			return &item{current.flags, current.exptime, newItem.cas, combined}, "STORED"
+		}
+		return newItem, "STORED"
+	})
+	if !status.IsOK() {
+		self.replyStatus(status)
+		return true
+	}
+	self.reply(noreply, reply)
+	return true
+}
+
+// Stores an item on condition that its CAS unique matches.
+func (self *Server) compareAndSwap(key []byte, casUnique uint64, newItem *item) string {
+	it, data, status := self.getItem(key)
+	if status.Equals(tkrzw.StatusNotFoundError) {
+		return "NOT_FOUND"
+	}
+	if !status.IsOK() {
+		return "SERVER_ERROR " + status.String()
+	}
+	if it.cas != casUnique {
+		return "EXISTS"
+	}
+	status = self.dbm.CompareExchange(key, data, newItem.serialize())
+	if status.Equals(tkrzw.StatusInfeasibleError) {
+		return "EXISTS"
+	}
+	if !status.IsOK() {
+		return "SERVER_ERROR " + status.String()
+	}
+	return "STORED"
+}
+
+// Increments or decrements a numeric item.
+//
+// By default, as values are stored as decimal text after the header so that clients can read them with get, this is done by the "Process" method rather than the "Increment" method, with the same atomicity.
+func (self *session) cmdIncr(fields []string) {
+	if len(fields) != 3 && len(fields) != 4 {
+		self.reply(false, "ERROR")
+		return
+	}
+	noreply := len(fields) == 4 && fields[3] == "noreply"
+	delta, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		self.reply(false, "CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+	incr := fields[0] == "incr"
+	if self.server.binaryCounter {
+		self.incrementCounter(fields[1], delta, incr, noreply)
+		return
+	}
+	reply, status := self.server.updateItem([]byte(fields[1]), func(current *item) (*item, string) {
+		if current == nil {
+			return nil, "NOT_FOUND"
+		}
+		num, err := strconv.ParseUint(strings.TrimRight(string(current.data), " "), 10, 64)
+		if err != nil {
+			return nil, "CLIENT_ERROR cannot increment or decrement non-numeric value"
+		}
+		if incr {
+			num += delta
+		} else if delta > num {
+			num = 0
+		} else {
+			num -= delta
+		}
+		text := strconv.FormatUint(num, 10)
+		return &item{current.flags, current.exptime, self.server.nextCAS(), []byte(text)}, text
+	})
+	if !status.IsOK() {
+		self.replyStatus(status)
+		return
+	}
+	self.reply(noreply, reply)
+}
+
+// Increments or decrements a counter by the "Increment" method.
+func (self *session) incrementCounter(key string, delta uint64, incr bool, noreply bool) {
+	if delta > math.MaxInt64 {
+		self.reply(false, "CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+	inc := int64(delta)
+	if !incr {
+		inc = -inc
+	}
+	num, status := self.server.dbm.Increment(key, inc, 0)
+	if !status.IsOK() {
+		self.replyStatus(status)
+		return
+	}
+	self.reply(noreply, strconv.FormatInt(num, 10))
+}
+
+func (self *session) cmdDelete(fields []string) {
+	if len(fields) < 2 || len(fields) > 3 {
+		self.reply(false, "ERROR")
+		return
+	}
+	noreply := len(fields) == 3 && fields[2] == "noreply"
+	reply := "NOT_FOUND"
+	now := time.Now().Unix()
+	status := self.server.dbm.Process(fields[1], func(k []byte, v []byte) interface{} {
+		if v == nil {
+			return nil
+		}
+		if it := deserializeItem(v); it != nil && !it.isExpired(now) {
+			reply = "DELETED"
+		}
+		return tkrzw.RemoveBytes
+	}, true)
+	if !status.IsOK() {
+		self.replyStatus(status)
+		return
+	}
+	self.reply(noreply, reply)
+}
+
+func (self *session) cmdTouch(fields []string) {
+	if len(fields) != 3 && len(fields) != 4 {
+		self.reply(false, "ERROR")
+		return
+	}
+	noreply := len(fields) == 4 && fields[3] == "noreply"
+	exptime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		self.reply(false, "CLIENT_ERROR invalid exptime argument")
+		return
+	}
+	atomic.AddInt64(&self.server.stats.cmdTouch, 1)
+	reply, status := self.server.updateItem([]byte(fields[1]), func(current *item) (*item, string) {
+		if current == nil {
+			return nil, "NOT_FOUND"
+		}
+		return &item{current.flags, absoluteExptime(exptime), current.cas, current.data}, "TOUCHED"
+	})
+	if !status.IsOK() {
+		self.replyStatus(status)
+		return
+	}
+	self.reply(noreply, reply)
+}
+
+func (self *session) cmdFlushAll(fields []string) {
+	noreply := len(fields) > 1 && fields[len(fields)-1] == "noreply"
+	if status := self.server.dbm.Clear(); !status.IsOK() {
+		self.replyStatus(status)
+		return
+	}
+	self.reply(noreply, "OK")
+}
+
+func (self *session) cmdStats(fields []string) {
+	if len(fields) > 1 {
+		self.reply(false, "END")
+		return
+	}
+	server := self.server
+	now := time.Now()
+	stats := []struct {
+		name  string
+		value interface{}
+	}{
+		{"pid", os.Getpid()},
+		{"uptime", int64(now.Sub(server.startTime).Seconds())},
+		{"time", now.Unix()},
+		{"version", serverVersion},
+		{"curr_connections", atomic.LoadInt64(&server.stats.currConnections)},
+		{"total_connections", atomic.LoadInt64(&server.stats.totalConnections)},
+		{"cmd_get", atomic.LoadInt64(&server.stats.cmdGet)},
+		{"cmd_set", atomic.LoadInt64(&server.stats.cmdSet)},
+		{"cmd_touch", atomic.LoadInt64(&server.stats.cmdTouch)},
+		{"get_hits", atomic.LoadInt64(&server.stats.getHits)},
+		{"get_misses", atomic.LoadInt64(&server.stats.getMisses)},
+		{"curr_items", server.dbm.CountSimple()},
+		{"bytes", server.dbm.GetFileSizeSimple()},
+	}
+	for _, stat := range stats {
+		fmt.Fprintf(self.writer, "STAT %s %v\r\n", stat.name, stat.value)
+	}
+	self.reply(false, "END")
+}
+
+// END OF FILE
@@ -0,0 +1,963 @@
+/*************************************************************************************************
+ * On-memory database manager in pure Go
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// On-memory database manager implemented in pure Go, mainly as a fake of DBM for testing.
+//
+// The semantics of the methods, including the status codes and the special values like AnyBytes and RemoveBytes, are the same as DBM.  An ordered database behaves like BabyDBM and iterates records in ascending order of the keys.  An unordered database behaves like TinyDBM and iterates records in an unspecified order.  All operations are thread-safe and each of them is atomic.  A processor function must not call methods of the same database, as the database is locked while it runs.  MemoryDBM doesn't depend on the native library so it works even if cgo is disabled.
+type MemoryDBM struct {
+	// The mutex for the records.
+	mutex sync.RWMutex
+	// Whether the database is open.
+	open bool
+	// Whether the keys are ordered.
+	ordered bool
+	// The map of the records.
+	records map[string][]byte
+	// The sorted keys, only for ordered databases.
+	keys []string
+}
+
+// Checks that MemoryDBM implements the interface.
+var _ Storage = (*MemoryDBM)(nil)
+
+// Makes a new on-memory database, which is open and writable.
+//
+// @param ordered True to make an ordered database, or false to make an unordered database.
+// @return The pointer to the created database object.
+func NewMemoryDBM(ordered bool) *MemoryDBM {
+	return &MemoryDBM{
+		open:    true,
+		ordered: ordered,
+		records: make(map[string][]byte),
+	}
+}
+
+// Makes a string representing the database.
+//
+// @return The string representing the database.
+func (self *MemoryDBM) String() string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if !self.open {
+		return fmt.Sprintf("#<tkrzw.MemoryDBM:%p:unopened>", &self)
+	}
+	return fmt.Sprintf("#<tkrzw.MemoryDBM:%p:ordered=%v:num_records=%d>",
+		&self, self.ordered, len(self.records))
+}
+
+// Copies bytes not to share the memory with the caller.
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(data)), data...)
+}
+
+// Converts an expected or desired value into bytes with nil and AnyBytes kept.
+func toRawCondition(data interface{}) []byte {
+	if IsNilData(data) {
+		return nil
+	}
+	if IsAnyData(data) {
+		return AnyBytes
+	}
+	return ToByteArray(data)
+}
+
+// Gets the status of a closed database.
+func closedStatus() *Status {
+	return NewStatus2(StatusPreconditionError, "not opened database")
+}
+
+// Stores a record.  The caller must hold the write lock.
+func (self *MemoryDBM) put(key string, value []byte) {
+	if _, ok := self.records[key]; !ok && self.ordered {
+		pos := sort.SearchStrings(self.keys, key)
+		self.keys = append(self.keys, "")
+		copy(self.keys[pos+1:], self.keys[pos:])
+		self.keys[pos] = key
+	}
+	self.records[key] = copyBytes(value)
+}
+
+// Removes a record.  The caller must hold the write lock.
+func (self *MemoryDBM) del(key string) bool {
+	if _, ok := self.records[key]; !ok {
+		return false
+	}
+	delete(self.records, key)
+	if self.ordered {
+		pos := sort.SearchStrings(self.keys, key)
+		self.keys = append(self.keys[:pos], self.keys[pos+1:]...)
+	}
+	return true
+}
+
+// Gets the keys in the iteration order.  The caller must hold the lock.
+func (self *MemoryDBM) keyList() []string {
+	if self.ordered {
+		return append(make([]string, 0, len(self.keys)), self.keys...)
+	}
+	keys := make([]string, 0, len(self.records))
+	for key := range self.records {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Applies the return value of a processor.  The caller must hold the write lock.
+func (self *MemoryDBM) applyResult(key string, rv interface{}) {
+	if IsNilData(rv) {
+		return
+	}
+	if IsRemoveData(rv) {
+		self.del(key)
+		return
+	}
+	self.put(key, ToByteArray(rv))
+}
+
+// Calls a processor on a record.  The caller must hold the lock.
+func (self *MemoryDBM) processRecord(key string, proc RecordProcessor, writable bool) {
+	value := copyBytes(self.records[key])
+	rv := proc([]byte(key), value)
+	if writable {
+		self.applyResult(key, rv)
+	}
+}
+
+// Locks the database for reading or writing.
+func (self *MemoryDBM) lock(writable bool) func() {
+	if writable {
+		self.mutex.Lock()
+		return self.mutex.Unlock
+	}
+	self.mutex.RLock()
+	return self.mutex.RUnlock
+}
+
+// Does compare-and-exchange.  The caller must hold the write lock.
+func (self *MemoryDBM) compareExchange(key string, expected []byte, desired []byte) ([]byte, *Status) {
+	current, ok := self.records[key]
+	actual := copyBytes(current)
+	if expected == nil {
+		if ok {
+			return actual, NewStatus1(StatusInfeasibleError)
+		}
+	} else if IsAnyBytes(expected) {
+		if !ok {
+			return actual, NewStatus1(StatusInfeasibleError)
+		}
+	} else if !ok || !bytes.Equal(current, expected) {
+		return actual, NewStatus1(StatusInfeasibleError)
+	}
+	if desired == nil {
+		self.del(key)
+	} else if !IsAnyBytes(desired) {
+		self.put(key, desired)
+	}
+	return actual, NewStatus1(StatusSuccess)
+}
+
+// Closes the database.
+//
+// @return The result status.
+//
+// All records are discarded.
+func (self *MemoryDBM) Close() *Status {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return closedStatus()
+	}
+	self.open = false
+	self.records = make(map[string][]byte)
+	self.keys = nil
+	return NewStatus1(StatusSuccess)
+}
+
+// Processes a record with an arbitrary function.
+//
+// @param key The key of the record.
+// @param proc The function to process a record.  The first parameter is the key bytes of the record.  The second parameter is the value bytes of the existing record, or nil if it the record doesn't exist.  The return value is bytes or a string to update the record value.  If the return value is nil or NilString, the record is not modified.  If the return value is RemoveBytes or RemoveString, the record is removed.
+// @param writable True if the processor can edit the record.
+// @return The result status.
+func (self *MemoryDBM) Process(key interface{}, proc RecordProcessor, writable bool) *Status {
+	defer self.lock(writable)()
+	if !self.open {
+		return closedStatus()
+	}
+	self.processRecord(string(ToByteArray(key)), proc, writable)
+	return NewStatus1(StatusSuccess)
+}
+
+// Checks if a record exists or not.
+//
+// @param key The key of the record.
+// @return True if the record exists, or false if not.
+func (self *MemoryDBM) Check(key interface{}) bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	_, ok := self.records[string(ToByteArray(key))]
+	return ok
+}
+
+// Gets the value of a record of a key.
+//
+// @param key The key of the record.
+// @return The bytes value of the matching record and the result status.  If there's no matching record, the status is StatusNotFoundError.
+func (self *MemoryDBM) Get(key interface{}) ([]byte, *Status) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if !self.open {
+		return nil, closedStatus()
+	}
+	value, ok := self.records[string(ToByteArray(key))]
+	if !ok {
+		return nil, NewStatus1(StatusNotFoundError)
+	}
+	return copyBytes(value), NewStatus1(StatusSuccess)
+}
+
+// Gets the value of a record of a key, as a string.
+//
+// @param key The key of the record.
+// @return The string value of the matching record and the result status.  If there's no matching record, the status is StatusNotFoundError.
+func (self *MemoryDBM) GetStr(key interface{}) (string, *Status) {
+	value, status := self.Get(key)
+	return string(value), status
+}
+
+// Gets the value of a record of a key, in a simple way.
+//
+// @param key The key of the record.
+// @param defaultValue The value to be returned on failure.
+// @return The value of the matching record on success, or the default value on failure.
+func (self *MemoryDBM) GetSimple(key interface{}, defaultValue interface{}) []byte {
+	value, status := self.Get(key)
+	if status.IsOK() {
+		return value
+	}
+	return ToByteArray(defaultValue)
+}
+
+// Gets the value of a record of a key, in a simple way, as a string.
+//
+// @param key The key of the record.
+// @param defaultValue The value to be returned on failure.
+// @return The value of the matching record on success, or the default value on failure.
+func (self *MemoryDBM) GetStrSimple(key interface{}, defaultValue interface{}) string {
+	value, status := self.Get(key)
+	if status.IsOK() {
+		return string(value)
+	}
+	return ToString(defaultValue)
+}
+
+// Gets the values of multiple records of keys.
+//
+// @param keys The keys of records to retrieve.
+// @return A map of retrieved records.  Keys which don't match existing records are ignored.
+func (self *MemoryDBM) GetMulti(keys []string) map[string][]byte {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	records := make(map[string][]byte)
+	for _, key := range keys {
+		if value, ok := self.records[key]; ok {
+			records[key] = copyBytes(value)
+		}
+	}
+	return records
+}
+
+// Gets the values of multiple records of keys, as strings.
+//
+// @param keys The keys of records to retrieve.
+// @return A map of retrieved records.  Keys which don't match existing records are ignored.
+func (self *MemoryDBM) GetMultiStr(keys []string) map[string]string {
+	records := make(map[string]string)
+	for key, value := range self.GetMulti(keys) {
+		records[key] = string(value)
+	}
+	return records
+}
+
+// Sets a record of a key and a value.
+//
+// @param key The key of the record.
+// @param value The value of the record.
+// @param overwrite Whether to overwrite the existing value.
+// @return The result status.  If overwriting is abandoned, StatusDuplicationError is returned.
+func (self *MemoryDBM) Set(key interface{}, value interface{}, overwrite bool) *Status {
+	_, status := self.SetAndGet(key, value, overwrite)
+	return status
+}
+
+// Sets a record and get the old value.
+//
+// @param key: The key of the record.
+// @param value The value of the record.
+// @param overwrite Whether to overwrite the existing value.
+// @return The old value and the result status.
+func (self *MemoryDBM) SetAndGet(key interface{}, value interface{}, overwrite bool) ([]byte, *Status) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return nil, closedStatus()
+	}
+	return self.set(string(ToByteArray(key)), ToByteArray(value), overwrite)
+}
+
+// Sets a record.  The caller must hold the write lock.
+func (self *MemoryDBM) set(key string, value []byte, overwrite bool) ([]byte, *Status) {
+	old, ok := self.records[key]
+	if ok && !overwrite {
+		return copyBytes(old), NewStatus1(StatusDuplicationError)
+	}
+	old = copyBytes(old)
+	self.put(key, value)
+	return old, NewStatus1(StatusSuccess)
+}
+
+// Sets a record and get the old value, as a string.
+//
+// @param key: The key of the record.
+// @param value The value of the record.
+// @param overwrite Whether to overwrite the existing value.
+// @return The old value and the result status.  If there's no existing record, the old value is nil.
+func (self *MemoryDBM) SetAndGetStr(key interface{}, value interface{},
+	overwrite bool) (*string, *Status) {
+	old, status := self.SetAndGet(key, value, overwrite)
+	if old != nil {
+		oldStr := string(old)
+		return &oldStr, status
+	}
+	return nil, status
+}
+
+// Sets multiple records.
+//
+// @param records Records to store.
+// @param overwrite Whether to overwrite the existing value if there's a record with the same key.  If true, the existing value is overwritten by the new value.  If false, the operation is given up and an error status is returned.
+// @return The result status.  If there are records avoiding overwriting, StatusDuplicationError is returned.
+func (self *MemoryDBM) SetMulti(records map[string][]byte, overwrite bool) *Status {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return closedStatus()
+	}
+	status := NewStatus1(StatusSuccess)
+	for key, value := range records {
+		_, setStatus := self.set(key, value, overwrite)
+		status.Join(setStatus)
+	}
+	return status
+}
+
+// Sets multiple records, with string data.
+//
+// @param records Records to store.
+// @param overwrite Whether to overwrite the existing value if there's a record with the same key.  If true, the existing value is overwritten by the new value.  If false, the operation is given up and an error status is returned.
+// @return The result status.  If there are records avoiding overwriting, StatusDuplicationError is set.
+func (self *MemoryDBM) SetMultiStr(records map[string]string, overwrite bool) *Status {
+	rawRecords := make(map[string][]byte)
+	for key, value := range records {
+		rawRecords[key] = []byte(value)
+	}
+	return self.SetMulti(rawRecords, overwrite)
+}
+
+// Removes a record of a key.
+//
+// @param key The key of the record.
+// @return The result status.  If there's no matching record, StatusNotFoundError is returned.
+func (self *MemoryDBM) Remove(key interface{}) *Status {
+	_, status := self.RemoveAndGet(key)
+	return status
+}
+
+// Removes a record and get the value.
+//
+// @param key The key of the record.
+// @return The old value and the result status.
+func (self *MemoryDBM) RemoveAndGet(key interface{}) ([]byte, *Status) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return nil, closedStatus()
+	}
+	rawKey := string(ToByteArray(key))
+	old, ok := self.records[rawKey]
+	if !ok {
+		return nil, NewStatus1(StatusNotFoundError)
+	}
+	self.del(rawKey)
+	return old, NewStatus1(StatusSuccess)
+}
+
+// Removes a record and get the value, as a string.
+//
+// @param key The key of the record.
+// @return The old value and the result status.
+func (self *MemoryDBM) RemoveAndGetStr(key interface{}) (*string, *Status) {
+	old, status := self.RemoveAndGet(key)
+	if old != nil {
+		oldStr := string(old)
+		return &oldStr, status
+	}
+	return nil, status
+}
+
+// Removes records of keys.
+//
+// @param key The keys of the records.
+// @return The result status.  If there are missing records, StatusNotFoundError is returned.
+func (self *MemoryDBM) RemoveMulti(keys []string) *Status {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return closedStatus()
+	}
+	status := NewStatus1(StatusSuccess)
+	for _, key := range keys {
+		if !self.del(key) {
+			status.Join(NewStatus1(StatusNotFoundError))
+		}
+	}
+	return status
+}
+
+// Appends data at the end of a record of a key.
+//
+// @param key The key of the record.
+// @param value The value to append.
+// @param delim The delimiter to put after the existing record.
+// @return The result status.
+//
+// If there's no existing record, the value is set without the delimiter.
+func (self *MemoryDBM) Append(key interface{}, value interface{}, delim interface{}) *Status {
+	return self.AppendMulti(
+		map[string][]byte{string(ToByteArray(key)): ToByteArray(value)}, delim)
+}
+
+// Appends data to multiple records.
+//
+// @param records Records to append.
+// @param delim The delimiter to put after the existing record.
+// @return The result status.
+//
+// If there's no existing record, the value is set without the delimiter.
+func (self *MemoryDBM) AppendMulti(records map[string][]byte, delim interface{}) *Status {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return closedStatus()
+	}
+	rawDelim := ToByteArray(delim)
+	for key, value := range records {
+		if old, ok := self.records[key]; ok {
+			newValue := make([]byte, 0, len(old)+len(rawDelim)+len(value))
+			newValue = append(append(append(newValue, old...), rawDelim...), value...)
+			self.records[key] = newValue
+		} else {
+			self.put(key, value)
+		}
+	}
+	return NewStatus1(StatusSuccess)
+}
+
+// Appends data to multiple records, with string data.
+//
+// @param records Records to append.
+// @param delim The delimiter to put after the existing record.
+// @return The result status.
+//
+// If there's no existing record, the value is set without the delimiter.
+func (self *MemoryDBM) AppendMultiStr(records map[string]string, delim interface{}) *Status {
+	rawRecords := make(map[string][]byte)
+	for key, value := range records {
+		rawRecords[key] = []byte(value)
+	}
+	return self.AppendMulti(rawRecords, delim)
+}
+
+// Compares the value of a record and exchanges if the condition meets.
+//
+// @param key The key of the record.
+// @param expected The expected value.  If it is nil or NilString, no existing record is expected.  If it is AnyBytes or AnyString, an existing record with any value is expacted.
+// @param desired The desired value.  If it is nil or NilString, the record is to be removed.  If it is AnyBytes or AnyString, no update is done.
+// @return The result status.  If the condition doesn't meet, StatusInfeasibleError is returned.
+func (self *MemoryDBM) CompareExchange(
+	key interface{}, expected interface{}, desired interface{}) *Status {
+	_, status := self.CompareExchangeAndGet(key, expected, desired)
+	return status
+}
+
+// Does compare-and-exchange and/or gets the old value of the record.
+//
+// @param key The key of the record.
+// @param expected The expected value.  If it is nil or NilString, no existing record is expected.  If it is AnyBytes or AnyString, an existing record with any value is expacted.
+// @param desired The desired value.  If it is nil or NilString, the record is to be removed.  If it is AnyBytes or AnyString, no update is done.
+// @return The old value and the result status.  If the condition doesn't meet, the state is INFEASIBLE_ERROR.  If there's no existing record, the value is nil.
+func (self *MemoryDBM) CompareExchangeAndGet(
+	key interface{}, expected interface{}, desired interface{}) ([]byte, *Status) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return nil, closedStatus()
+	}
+	return self.compareExchange(
+		string(ToByteArray(key)), toRawCondition(expected), toRawCondition(desired))
+}
+
+// Does compare-and-exchange and/or gets the old value of the record, as a string.
+//
+// @param key The key of the record.
+// @param expected The expected value.  If it is nil or NilString, no existing record is expected.  If it is AnyBytes or AnyString, an existing record with any value is expacted.
+// @param desired The desired value.  If it is nil or NilString, the record is to be removed.  If it is AnyBytes or AnyString, no update is done.
+// @return The old value and the result status.  If the condition doesn't meet, the state is INFEASIBLE_ERROR.  If there's no existing record, the value is NilString.
+func (self *MemoryDBM) CompareExchangeAndGetStr(
+	key interface{}, expected interface{}, desired interface{}) (string, *Status) {
+	rawActual, status := self.CompareExchangeAndGet(key, expected, desired)
+	actual := NilString
+	if rawActual != nil {
+		actual = string(rawActual)
+	}
+	return actual, status
+}
+
+// Increments the numeric value of a record.
+//
+// @param key The key of the record.
+// @param inc The incremental value.  If it is Int64Min, the current value is not changed and a new record is not created.
+// @param init The initial value.
+// @return The current value and the result status.
+func (self *MemoryDBM) Increment(key interface{}, inc interface{}, init interface{}) (int64, *Status) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return 0, closedStatus()
+	}
+	rawKey := string(ToByteArray(key))
+	num := ToInt(init)
+	if value, ok := self.records[rawKey]; ok {
+		num = DeserializeInt(value)
+	}
+	numInc := ToInt(inc)
+	if numInc == Int64Min {
+		return num, NewStatus1(StatusSuccess)
+	}
+	num += numInc
+	self.put(rawKey, SerializeInt(num))
+	return num, NewStatus1(StatusSuccess)
+}
+
+// Processes multiple records with arbitrary functions.
+//
+// @param keyProcPairs A list of pairs of keys and their functions.  The first parameter is the key bytes of the record.  The second parameter is the value bytes of the existing record, or nil if it the record doesn't exist.  The return value is bytes or a string to update the record value.  If the return value is nil or NilString, the record is not modified.  If the return value is RemoveBytes or RemoveString, the record is removed.
+// @param writable True if the processor can edit the record.
+// @return The result status.
+func (self *MemoryDBM) ProcessMulti(keyProcPairs []KeyProcPair, writable bool) *Status {
+	defer self.lock(writable)()
+	if !self.open {
+		return closedStatus()
+	}
+	for _, pair := range keyProcPairs {
+		self.processRecord(string(ToByteArray(pair.Key)), pair.Proc, writable)
+	}
+	return NewStatus1(StatusSuccess)
+}
+
+// Compares the values of records and exchanges if the condition meets.
+//
+// @param expected A sequence of pairs of the record keys and their expected values.  If the value is nil, no existing record is expected.  If the value is AnyBytes, an existing record with any value is expacted.
+// @param desired A sequence of pairs of the record keys and their desired values.  If the value is nil, the record is to be removed.
+// @return The result status.  If the condition doesn't meet, StatusInfeasibleError is returned.
+func (self *MemoryDBM) CompareExchangeMulti(expected []KeyValuePair, desired []KeyValuePair) *Status {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return closedStatus()
+	}
+	for _, record := range expected {
+		current, ok := self.records[string(record.Key)]
+		switch {
+		case record.Value == nil:
+			if ok {
+				return NewStatus1(StatusInfeasibleError)
+			}
+		case IsAnyBytes(record.Value):
+			if !ok {
+				return NewStatus1(StatusInfeasibleError)
+			}
+		case !ok || !bytes.Equal(current, record.Value):
+			return NewStatus1(StatusInfeasibleError)
+		}
+	}
+	for _, record := range desired {
+		if record.Value == nil {
+			self.del(string(record.Key))
+		} else {
+			self.put(string(record.Key), record.Value)
+		}
+	}
+	return NewStatus1(StatusSuccess)
+}
+
+// Compares the values of records and exchanges if the condition meets, using string data.
+//
+// @param expected A sequence of pairs of the record keys and their expected values.  If the value is NilString, no existing record is expected.  If the value is AnyString, an existing record with any value is expacted.
+// @param desired A sequence of pairs of the record keys and their desired values.  If the value is NilString, the record is to be removed.
+// @return The result status.  If the condition doesn't meet, StatusInfeasibleError is returned.
+func (self *MemoryDBM) CompareExchangeMultiStr(
+	expected []KeyValueStrPair, desired []KeyValueStrPair) *Status {
+	rawExpected := make([]KeyValuePair, 0, len(expected))
+	for _, record := range expected {
+		var value []byte
+		if !IsNilString(record.Value) {
+			if IsAnyString(record.Value) {
+				value = AnyBytes
+			} else {
+				value = []byte(record.Value)
+			}
+		}
+		rawExpected = append(rawExpected, KeyValuePair{[]byte(record.Key), value})
+	}
+	rawDesired := make([]KeyValuePair, 0, len(desired))
+	for _, record := range desired {
+		var value []byte
+		if !IsNilString(record.Value) {
+			value = []byte(record.Value)
+		}
+		rawDesired = append(rawDesired, KeyValuePair{[]byte(record.Key), value})
+	}
+	return self.CompareExchangeMulti(rawExpected, rawDesired)
+}
+
+// Changes the key of a record.
+//
+// @param old_key The old key of the record.
+// @param new_key The new key of the record.
+// @param overwrite Whether to overwrite the existing record of the new key.
+// @param copying Whether to retain the record of the old key.
+// @return The result status.  If there's no matching record to the old key, NOT_FOUND_ERROR is returned.  If the overwrite flag is false and there is an existing record of the new key, DUPLICATION ERROR is returned.
+func (self *MemoryDBM) Rekey(oldKey interface{}, newKey interface{},
+	overwrite bool, copying bool) *Status {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return closedStatus()
+	}
+	rawOldKey := string(ToByteArray(oldKey))
+	rawNewKey := string(ToByteArray(newKey))
+	value, ok := self.records[rawOldKey]
+	if !ok {
+		return NewStatus1(StatusNotFoundError)
+	}
+	if _, ok := self.records[rawNewKey]; ok && !overwrite {
+		return NewStatus1(StatusDuplicationError)
+	}
+	if rawNewKey == rawOldKey {
+		return NewStatus1(StatusSuccess)
+	}
+	self.put(rawNewKey, value)
+	if !copying {
+		self.del(rawOldKey)
+	}
+	return NewStatus1(StatusSuccess)
+}
+
+// Gets the first record and removes it.
+//
+// @return The key and the value of the first record, and the result status.
+func (self *MemoryDBM) PopFirst() ([]byte, []byte, *Status) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return nil, nil, closedStatus()
+	}
+	var key string
+	if self.ordered {
+		if len(self.keys) == 0 {
+			return nil, nil, NewStatus1(StatusNotFoundError)
+		}
+		key = self.keys[0]
+	} else {
+		found := false
+		for key = range self.records {
+			found = true
+			break
+		}
+		if !found {
+			return nil, nil, NewStatus1(StatusNotFoundError)
+		}
+	}
+	value := self.records[key]
+	self.del(key)
+	return []byte(key), value, NewStatus1(StatusSuccess)
+}
+
+// Gets the first record as strings and removes it.
+//
+// @return The key and the value of the first record, and the result status.
+func (self *MemoryDBM) PopFirstStr() (string, string, *Status) {
+	key, value, status := self.PopFirst()
+	if status.IsOK() {
+		return string(key), string(value), status
+	}
+	return "", "", status
+}
+
+// Adds a record with a key of the current timestamp.
+//
+// @param value The value of the record.
+// @param wtime The current wall time used to generate the key.  If it is negative, the system clock is used.
+// @return The result status.
+//
+// The key is generated as an 8-bite big-endian binary string of the timestamp.  If there is an existing record matching the generated key, the key is regenerated and the attempt is repeated until it succeeds.
+func (self *MemoryDBM) PushLast(value interface{}, wtime float64) *Status {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return closedStatus()
+	}
+	if wtime < 0 {
+		wtime = float64(time.Now().UnixNano()) / float64(time.Second)
+	}
+	rawValue := ToByteArray(value)
+	for seq := int64(0); ; seq++ {
+		key := string(SerializeInt(int64(wtime*100000000) + seq))
+		if _, ok := self.records[key]; !ok {
+			self.put(key, rawValue)
+			return NewStatus1(StatusSuccess)
+		}
+	}
+}
+
+// Processes each and every record in the database with an arbitrary function.
+//
+// @param proc The function to process a record.  The first parameter is the key bytes of the record.  The second parameter is the value bytes of the existing record, or nil if it the record doesn't exist.  The return value is bytes or a string to update the record value.  If the return value is nil or NilString, the record is not modified.  If the return value is RemoveBytes or RemoveString, the record is removed.
+// @param writable True if the processor can edit the record.
+// @return The result status.
+//
+// The given function is called repeatedly for each record.  It is also called once before the iteration and once after the iteration with both the key and the value being nil.
+func (self *MemoryDBM) ProcessEach(proc RecordProcessor, writable bool) *Status {
+	defer self.lock(writable)()
+	if !self.open {
+		return closedStatus()
+	}
+	proc(nil, nil)
+	for _, key := range self.keyList() {
+		if _, ok := self.records[key]; ok {
+			self.processRecord(key, proc, writable)
+		}
+	}
+	proc(nil, nil)
+	return NewStatus1(StatusSuccess)
+}
+
+// Gets the number of records.
+//
+// @return The number of records and the result status.
+func (self *MemoryDBM) Count() (int64, *Status) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if !self.open {
+		return -1, closedStatus()
+	}
+	return int64(len(self.records)), NewStatus1(StatusSuccess)
+}
+
+// Gets the number of records, in a simple way.
+//
+// @return The number of records or -1 on failure.
+func (self *MemoryDBM) CountSimple() int64 {
+	count, _ := self.Count()
+	return count
+}
+
+// Removes all records.
+//
+// @return The result status.
+func (self *MemoryDBM) Clear() *Status {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !self.open {
+		return closedStatus()
+	}
+	self.records = make(map[string][]byte)
+	self.keys = nil
+	return NewStatus1(StatusSuccess)
+}
+
+// Inspects the database.
+//
+// return A map of property names and their values.  If the database is not open, nil is returned.
+func (self *MemoryDBM) Inspect() map[string]string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	if !self.open {
+		return nil
+	}
+	return map[string]string{
+		"class":       "MemoryDBM",
+		"num_records": fmt.Sprintf("%d", len(self.records)),
+		"ordered":     fmt.Sprintf("%v", self.ordered),
+	}
+}
+
+// Checks whether the database is open.
+//
+// @return True if the database is open, or false if not.
+func (self *MemoryDBM) IsOpen() bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.open
+}
+
+// Checks whether the database is writable.
+//
+// @return True if the database is writable, or false if not.
+func (self *MemoryDBM) IsWritable() bool {
+	return self.IsOpen()
+}
+
+// Checks whether the database condition is healthy.
+//
+// @return True if the database condition is healthy, or false if not.
+func (self *MemoryDBM) IsHealthy() bool {
+	return self.IsOpen()
+}
+
+// Checks whether ordered operations are supported.
+//
+// @return True if ordered operations are supported, or false if not.
+func (self *MemoryDBM) IsOrdered() bool {
+	return self.ordered
+}
+
+// Searches the database and get keys which match a pattern.
+//
+// @param mode The search mode.  "contain" extracts keys containing the pattern.  "begin" extracts keys beginning with the pattern.  "end" extracts keys ending with the pattern.  "regex" extracts keys partially matches the pattern of a regular expression.  "edit" extracts keys whose edit distance to the UTF-8 pattern is the least.  "editbin" extracts keys whose edit distance to the binary pattern is the least.  "containcase", "containword", and "containcaseword" extract keys considering case and word boundary.  Ordered databases support "upper" and "lower" which extract keys whose positions are upper/lower than the pattern. "upperinc" and "lowerinc" are their inclusive versions.
+// @param pattern The pattern for matching.
+// @param capacity The maximum records to obtain.  0 means unlimited.
+// @return A list of keys matching the condition.
+//
+// Regular expressions follow the syntax of the "regexp" package.
+func (self *MemoryDBM) Search(mode string, pattern string, capacity int) []string {
+	self.mutex.RLock()
+	keys := self.keyList()
+	self.mutex.RUnlock()
+	result := make([]string, 0)
+	var match func(key string) bool
+	switch mode {
+	case "upper", "upperinc":
+		if !self.ordered {
+			return result
+		}
+		inclusive := mode == "upperinc"
+		match = func(key string) bool { return key > pattern || (inclusive && key == pattern) }
+	case "lower", "lowerinc":
+		if !self.ordered {
+			return result
+		}
+		inclusive := mode == "lowerinc"
+		for i := len(keys) - 1; i >= 0 && (capacity <= 0 || len(result) < capacity); i-- {
+			if keys[i] < pattern || (inclusive && keys[i] == pattern) {
+				result = append(result, keys[i])
+			}
+		}
+		return result
+	case "edit", "editbin":
+		utf := mode == "edit"
+		distances := make(map[string]int, len(keys))
+		for _, key := range keys {
+			distances[key] = EditDistanceLev(key, pattern, utf)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if distances[keys[i]] != distances[keys[j]] {
+				return distances[keys[i]] < distances[keys[j]]
+			}
+			return keys[i] < keys[j]
+		})
+		if capacity > 0 && len(keys) > capacity {
+			keys = keys[:capacity]
+		}
+		return append(result, keys...)
+	default:
+		var status *Status
+		match, status = makeLineMatcher(mode, pattern)
+		if !status.IsOK() {
+			return result
+		}
+	}
+	for _, key := range keys {
+		if capacity > 0 && len(result) >= capacity {
+			break
+		}
+		if match(key) {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// Makes a channel to read each records.
+//
+// @return the channel to read each records.  All values should be read from the channel to avoid resource leak.
+//
+// The records are read from a snapshot taken when this method is called.
+func (self *MemoryDBM) Each() <-chan KeyValuePair {
+	self.mutex.RLock()
+	records := make([]KeyValuePair, 0, len(self.records))
+	for _, key := range self.keyList() {
+		records = append(records, KeyValuePair{[]byte(key), copyBytes(self.records[key])})
+	}
+	self.mutex.RUnlock()
+	chanRecord := make(chan KeyValuePair)
+	go func() {
+		defer close(chanRecord)
+		for _, record := range records {
+			chanRecord <- record
+		}
+	}()
+	return chanRecord
+}
+
+// Makes a channel to read each records, as strings.
+//
+// @return the channel to read each records.  All values should be read from the channel to avoid resource leak.
+//
+// The records are read from a snapshot taken when this method is called.
+func (self *MemoryDBM) EachStr() <-chan KeyValueStrPair {
+	chanRecord := make(chan KeyValueStrPair)
+	go func() {
+		defer close(chanRecord)
+		for record := range self.Each() {
+			chanRecord <- KeyValueStrPair{string(record.Key), string(record.Value)}
+		}
+	}()
+	return chanRecord
+}
+
+// END OF FILE
@@ -0,0 +1,231 @@
+/*************************************************************************************************
+ * Test cases of the on-memory database manager in pure Go
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemoryDBMBasic(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		dbm := NewMemoryDBM(ordered)
+		CheckTrue(t, dbm.IsOpen())
+		CheckTrue(t, dbm.IsWritable())
+		CheckTrue(t, dbm.IsHealthy())
+		CheckEq(t, ordered, dbm.IsOrdered())
+		CheckEq(t, StatusSuccess, dbm.Set("one", "first", false))
+		CheckEq(t, StatusDuplicationError, dbm.Set("one", "uno", false))
+		CheckEq(t, StatusSuccess, dbm.Set([]byte("two"), []byte("second"), true))
+		CheckEq(t, StatusSuccess, dbm.Append("three", "third", ":"))
+		CheckEq(t, StatusSuccess, dbm.Append("three", "3", ":"))
+		CheckTrue(t, dbm.Check("one"))
+		CheckFalse(t, dbm.Check("four"))
+		CheckEq(t, 3, dbm.CountSimple())
+		value, status := dbm.Get("one")
+		CheckEq(t, StatusSuccess, status)
+		CheckEq(t, "first", value)
+		value[0] = 'F'
+		CheckEq(t, "first", dbm.GetSimple("one", "*"))
+		strValue, status := dbm.GetStr("four")
+		CheckEq(t, StatusNotFoundError, status)
+		CheckEq(t, "", strValue)
+		CheckEq(t, "third:3", dbm.GetStrSimple("three", "*"))
+		CheckEq(t, "*", dbm.GetStrSimple("four", "*"))
+		CheckEq(t, StatusSuccess, dbm.CompareExchange("num", nil, "first"))
+		CheckEq(t, StatusInfeasibleError, dbm.CompareExchange("num", nil, "first"))
+		CheckEq(t, StatusSuccess, dbm.CompareExchange("num", "first", "second"))
+		CheckEq(t, StatusSuccess, dbm.CompareExchange("num", AnyString, AnyBytes))
+		CheckEq(t, "second", dbm.GetSimple("num", "*"))
+		CheckEq(t, StatusSuccess, dbm.CompareExchange("num", AnyBytes, nil))
+		CheckEq(t, StatusInfeasibleError, dbm.CompareExchange("num", AnyBytes, "x"))
+		actual, status := dbm.CompareExchangeAndGetStr("num", nil, "123")
+		CheckEq(t, StatusSuccess, status)
+		CheckTrue(t, IsNilString(actual))
+		actual, status = dbm.CompareExchangeAndGetStr("num", AnyString, NilString)
+		CheckEq(t, StatusSuccess, status)
+		CheckEq(t, "123", actual)
+		incValue, status := dbm.Increment("num", 2, 100)
+		CheckEq(t, StatusSuccess, status)
+		CheckEq(t, 102, incValue)
+		incValue, status = dbm.Increment("num", Int64Min, 0)
+		CheckEq(t, StatusSuccess, status)
+		CheckEq(t, 102, incValue)
+		CheckEq(t, SerializeInt(102), dbm.GetSimple("num", "*"))
+		incValue, status = dbm.Increment("void", Int64Min, 5)
+		CheckEq(t, 5, incValue)
+		CheckFalse(t, dbm.Check("void"))
+		CheckEq(t, StatusSuccess, dbm.Remove("num"))
+		CheckEq(t, StatusNotFoundError, dbm.Remove("num"))
+		oldValue, status := dbm.SetAndGet("zero", "nil", false)
+		CheckEq(t, StatusSuccess, status)
+		CheckEq(t, nil, oldValue)
+		oldStrValue, status := dbm.SetAndGetStr("zero", "void", false)
+		CheckEq(t, StatusDuplicationError, status)
+		CheckEq(t, "nil", *oldStrValue)
+		oldStrValue, status = dbm.RemoveAndGetStr("zero")
+		CheckEq(t, StatusSuccess, status)
+		CheckEq(t, "nil", *oldStrValue)
+		oldStrValue, status = dbm.RemoveAndGetStr("zero")
+		CheckEq(t, StatusNotFoundError, status)
+		CheckTrue(t, oldStrValue == nil)
+		records := map[string]string{"one": "uno", "four": "fourth"}
+		CheckEq(t, StatusDuplicationError, dbm.SetMultiStr(records, false))
+		CheckEq(t, "first", dbm.GetSimple("one", "*"))
+		CheckEq(t, "fourth", dbm.GetSimple("four", "*"))
+		records = dbm.GetMultiStr([]string{"one", "four", "five"})
+		CheckEq(t, 2, len(records))
+		CheckEq(t, "fourth", records["four"])
+		CheckEq(t, StatusNotFoundError, dbm.RemoveMulti([]string{"four", "five"}))
+		CheckEq(t, 3, dbm.CountSimple())
+		set1 := []KeyValueStrPair{{"one", AnyString}, {"ten", NilString}}
+		set2 := []KeyValueStrPair{{"one", NilString}, {"ten", "tenth"}}
+		CheckEq(t, StatusSuccess, dbm.CompareExchangeMultiStr(set1, set2))
+		CheckFalse(t, dbm.Check("one"))
+		CheckEq(t, "tenth", dbm.GetSimple("ten", "*"))
+		CheckEq(t, StatusInfeasibleError, dbm.CompareExchangeMultiStr(set1, set2))
+		CheckEq(t, StatusSuccess, dbm.Rekey("ten", "eleven", false, false))
+		CheckFalse(t, dbm.Check("ten"))
+		CheckEq(t, StatusNotFoundError, dbm.Rekey("ten", "eleven", false, false))
+		CheckEq(t, StatusDuplicationError, dbm.Rekey("two", "eleven", false, true))
+		CheckEq(t, StatusSuccess, dbm.Rekey("two", "eleven", true, true))
+		CheckEq(t, "second", dbm.GetSimple("two", "*"))
+		CheckEq(t, "second", dbm.GetSimple("eleven", "*"))
+		inspRecords := dbm.Inspect()
+		CheckEq(t, "MemoryDBM", inspRecords["class"])
+		CheckEq(t, "3", inspRecords["num_records"])
+		CheckEq(t, StatusSuccess, dbm.Clear())
+		CheckEq(t, 0, dbm.CountSimple())
+		CheckEq(t, StatusSuccess, dbm.Close())
+		CheckFalse(t, dbm.IsOpen())
+		CheckEq(t, StatusPreconditionError, dbm.Set("one", "first", true))
+		CheckEq(t, StatusPreconditionError, dbm.Close())
+		CheckTrue(t, dbm.Inspect() == nil)
+		CheckEq(t, -1, dbm.CountSimple())
+	}
+}
+
+func TestMemoryDBMProcess(t *testing.T) {
+	dbm := NewMemoryDBM(false)
+	CheckEq(t, StatusSuccess,
+		dbm.Process("abc", func(k []byte, v []byte) interface{} { return nil }, true))
+	CheckEq(t, "*", dbm.GetStrSimple("abc", "*"))
+	CheckEq(t, StatusSuccess,
+		dbm.Process("abc", func(k []byte, v []byte) interface{} { return "ABC" }, true))
+	CheckEq(t, "ABC", dbm.GetStrSimple("abc", "*"))
+	CheckEq(t, StatusSuccess,
+		dbm.Process("abc", func(k []byte, v []byte) interface{} { return "XYZ" }, false))
+	CheckEq(t, "ABC", dbm.GetStrSimple("abc", "*"))
+	CheckEq(t, StatusSuccess,
+		dbm.Process("abc", func(k []byte, v []byte) interface{} { return NilString }, true))
+	CheckEq(t, "ABC", dbm.GetStrSimple("abc", "*"))
+	CheckEq(t, StatusSuccess,
+		dbm.Process("abc", func(k []byte, v []byte) interface{} { return RemoveString }, true))
+	CheckFalse(t, dbm.Check("abc"))
+	for i := 0; i < 10; i++ {
+		CheckEq(t, StatusSuccess, dbm.Set(i, i*i, false))
+	}
+	countFull := 0
+	countEmpty := 0
+	proc := func(k []byte, v []byte) interface{} {
+		if k == nil {
+			countEmpty++
+			return nil
+		}
+		countFull++
+		num := ToInt(k)
+		CheckEq(t, num*num, ToInt(v))
+		if num%2 == 0 {
+			return RemoveBytes
+		}
+		return ToString(num)
+	}
+	CheckEq(t, StatusSuccess, dbm.ProcessEach(proc, true))
+	CheckEq(t, 2, countEmpty)
+	CheckEq(t, 10, countFull)
+	CheckEq(t, 5, dbm.CountSimple())
+	CheckEq(t, "3", dbm.GetStrSimple("3", "*"))
+	CheckFalse(t, dbm.Check("4"))
+	pairs := []KeyProcPair{
+		{"3", func(k []byte, v []byte) interface{} { return RemoveBytes }},
+		{"4", func(k []byte, v []byte) interface{} {
+			CheckTrue(t, v == nil)
+			return "four"
+		}},
+	}
+	CheckEq(t, StatusSuccess, dbm.ProcessMulti(pairs, true))
+	CheckFalse(t, dbm.Check("3"))
+	CheckEq(t, "four", dbm.GetStrSimple("4", "*"))
+}
+
+func TestMemoryDBMOrdered(t *testing.T) {
+	dbm := NewMemoryDBM(true)
+	for _, key := range []string{"c", "a", "e", "b", "d"} {
+		CheckEq(t, StatusSuccess, dbm.Set(key, key+key, false))
+	}
+	keys := []string{}
+	for record := range dbm.EachStr() {
+		keys = append(keys, record.Key)
+		CheckEq(t, record.Key+record.Key, record.Value)
+	}
+	CheckEq(t, "a,b,c,d,e", strings.Join(keys, ","))
+	CheckEq(t, "c,d", strings.Join(dbm.Search("upper", "b", 2), ","))
+	CheckEq(t, "b,c", strings.Join(dbm.Search("upperinc", "b", 2), ","))
+	CheckEq(t, "b,a", strings.Join(dbm.Search("lower", "c", 0), ","))
+	CheckEq(t, "c,b,a", strings.Join(dbm.Search("lowerinc", "c", 0), ","))
+	CheckEq(t, "c", strings.Join(dbm.Search("regex", "^[cx]", 0), ","))
+	CheckEq(t, "a,b", strings.Join(dbm.Search("edit", "a", 2), ","))
+	CheckEq(t, 0, len(NewMemoryDBM(false).Search("upper", "", 0)))
+	key, value, status := dbm.PopFirstStr()
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "a", key)
+	CheckEq(t, "aa", value)
+	for dbm.CountSimple() > 0 {
+		_, _, status = dbm.PopFirst()
+		CheckEq(t, StatusSuccess, status)
+	}
+	_, _, status = dbm.PopFirst()
+	CheckEq(t, StatusNotFoundError, status)
+	CheckEq(t, StatusSuccess, dbm.PushLast("one", 1))
+	CheckEq(t, StatusSuccess, dbm.PushLast("two", 1))
+	CheckEq(t, StatusSuccess, dbm.PushLast("zero", 0))
+	CheckEq(t, "zero", dbm.GetStrSimple(SerializeInt(0), "*"))
+	CheckEq(t, "one", dbm.GetStrSimple(SerializeInt(100000000), "*"))
+	CheckEq(t, "two", dbm.GetStrSimple(SerializeInt(100000001), "*"))
+	CheckEq(t, StatusSuccess, dbm.PushLast("now", -1))
+	for _, value := range []string{"zero", "one", "two", "now"} {
+		_, popValue, status := dbm.PopFirstStr()
+		CheckEq(t, StatusSuccess, status)
+		CheckEq(t, value, popValue)
+	}
+}
+
+func TestMemoryDBMStorage(t *testing.T) {
+	var storage Storage = NewMemoryDBM(false)
+	CheckEq(t, StatusSuccess, storage.SetMulti(
+		map[string][]byte{"one": []byte("1"), "two": []byte("2")}, false))
+	records := map[string]string{}
+	for record := range storage.Each() {
+		records[string(record.Key)] = string(record.Value)
+	}
+	CheckEq(t, 2, len(records))
+	CheckEq(t, "1", records["one"])
+	CheckEq(t, "two", strings.Join(storage.Search("begin", "t", 0), ","))
+	CheckEq(t, "one", strings.Join(storage.Search("containword", "one", 0), ","))
+	CheckEq(t, 0, len(storage.Search("regex", "[", 0)))
+	CheckEq(t, 0, len(storage.Search("unknown", "", 0)))
+	CheckEq(t, StatusSuccess, storage.Close())
+}
+
+// END OF FILE
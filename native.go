@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 /*************************************************************************************************
  * Bridging code to C native functions
  *
@@ -1191,6 +1194,23 @@ func dbm_get(dbm uintptr, key []byte) ([]byte, *Status) {
 	return value, status
 }
 
+func dbm_view(dbm uintptr, key []byte, proc func(value []byte)) *Status {
+	xdbm := (*C.TkrzwDBM)(unsafe.Pointer(dbm))
+	xkey_ptr := (*C.char)(C.CBytes(key))
+	defer C.free(unsafe.Pointer(xkey_ptr))
+	res := C.do_dbm_get(xdbm, xkey_ptr, C.int32_t(len(key)))
+	status := convert_status(res.status)
+	if res.value_ptr != nil {
+		defer C.free(unsafe.Pointer(res.value_ptr))
+		if res.value_size > 0 {
+			proc((*[0x7fffffff]byte)(unsafe.Pointer(res.value_ptr))[:res.value_size:res.value_size])
+		} else {
+			proc([]byte{})
+		}
+	}
+	return status
+}
+
 func dbm_get_str(dbm uintptr, key []byte) (string, *Status) {
 	xdbm := (*C.TkrzwDBM)(unsafe.Pointer(dbm))
 	xkey_ptr := (*C.char)(C.CBytes(key))
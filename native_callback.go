@@ -0,0 +1,98 @@
+//go:build cgo
+// +build cgo
+
+/*************************************************************************************************
+ * Bridge of record processors called by the C code
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// Storage to make RecordProcessor accessible to the C code.
+type RecordProcessorPool struct {
+	data  map[unsafe.Pointer]RecordProcessor
+	mutex sync.Mutex
+}
+
+var recordProcessorPools = []RecordProcessorPool{
+	{data: make(map[unsafe.Pointer]RecordProcessor)},
+	{data: make(map[unsafe.Pointer]RecordProcessor)},
+	{data: make(map[unsafe.Pointer]RecordProcessor)},
+}
+
+// Register a Go function to the storage.
+func registerRecordProcessor(proc RecordProcessor) unsafe.Pointer {
+	var up unsafe.Pointer = C.malloc(C.size_t(1))
+	if up == nil {
+		panic("memory allocation failed")
+	}
+	procPool := recordProcessorPools[int(uintptr(up)>>3)%len(recordProcessorPools)]
+	procPool.mutex.Lock()
+	procPool.data[up] = proc
+	procPool.mutex.Unlock()
+	return up
+}
+
+// Deregister a Go function from the storage.
+func deregisterRecordProcessor(up unsafe.Pointer) {
+	procPool := recordProcessorPools[int(uintptr(up)>>3)%len(recordProcessorPools)]
+	procPool.mutex.Lock()
+	delete(procPool.data, up)
+	procPool.mutex.Unlock()
+	C.free(up)
+}
+
+// Call a Go function in the storage.
+//export callRecordProcessor
+func callRecordProcessor(up unsafe.Pointer, keyPtr unsafe.Pointer, keySize C.int32_t,
+	valuePtr unsafe.Pointer, valueSize C.int32_t) (unsafe.Pointer, int32) {
+	procPool := recordProcessorPools[int(uintptr(up)>>3)%len(recordProcessorPools)]
+	procPool.mutex.Lock()
+	proc := procPool.data[up]
+	procPool.mutex.Unlock()
+	var key []byte
+	if keyPtr == nil {
+		key = nil
+	} else {
+		key = C.GoBytes(keyPtr, keySize)
+	}
+	var value []byte
+	if valuePtr == nil {
+		value = nil
+	} else {
+		value = C.GoBytes(valuePtr, valueSize)
+	}
+	rv := proc(key, value)
+	var retPtr unsafe.Pointer
+	var retSize int32
+	if IsNilData(rv) {
+		retPtr = nil
+		retSize = 0
+	} else if IsRemoveData(rv) {
+		retPtr = unsafe.Pointer(uintptr(1))
+		retSize = 0
+	} else {
+		rv_bytes := ToByteArray(rv)
+		retPtr = C.CBytes(rv_bytes)
+		retSize = int32(len(rv_bytes))
+	}
+	return retPtr, retSize
+}
+
+// END OF FILE
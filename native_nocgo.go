@@ -0,0 +1,693 @@
+//go:build !cgo
+// +build !cgo
+
+/*************************************************************************************************
+ * Fallback of the native interface without cgo
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+// This file is used when cgo is disabled, as with CGO_ENABLED=0.  Opening DBM, File, and Index
+// fails with StatusNotImplementedError and the other native operations are never reached.
+// Serialization, the hash functions, and the edit distance are implemented in Go so that
+// MemoryDBM works as is and the hash values are the same as those of the native library.
+
+package tkrzw
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"runtime"
+)
+
+// The package version numbers.
+var Version string
+
+// The recognized OS name.
+var OSName string
+
+// The recognized OS name.
+var PageSize int
+
+// The minimum value of int64. */
+var Int64Min int64
+
+// The minimum value of int64. */
+var Int64Max int64
+
+func init() {
+	Version = "0.0.0-nocgo"
+	OSName = runtime.GOOS
+	PageSize = os.Getpagesize()
+	Int64Min = math.MinInt64
+	Int64Max = math.MaxInt64
+}
+
+func newCgoDisabledStatus() *Status {
+	return NewStatus2(StatusNotImplementedError, "cgo is disabled")
+}
+
+func get_memory_capacity() int64 {
+	return -1
+}
+
+func get_memory_usage() int64 {
+	return -1
+}
+
+// Folds a 64-bit hash value into 32 bits, as the native library does for small moduli.
+func fold_hash(hash uint64, modulus uint64) uint64 {
+	if modulus <= math.MaxUint32 {
+		hash = (((hash & 0xffff000000000000) >> 48) | ((hash & 0x0000ffff00000000) >> 16)) ^
+			(((hash & 0x000000000000ffff) << 16) | ((hash & 0x00000000ffff0000) >> 16))
+	}
+	return hash % modulus
+}
+
+func primary_hash(data []byte, num_buckets uint64) uint64 {
+	const mul = 0xc6a4a7935bd1e995
+	const rtt = 47
+	hash := uint64(19780211) ^ (uint64(len(data)) * mul)
+	for ; len(data) >= 8; data = data[8:] {
+		num := binary.LittleEndian.Uint64(data) * mul
+		num ^= num >> rtt
+		hash = (hash * mul) ^ (num * mul)
+	}
+	if len(data) > 0 {
+		for i, c := range data {
+			hash ^= uint64(c) << (8 * uint(i))
+		}
+		hash *= mul
+	}
+	hash ^= hash >> rtt
+	hash *= mul
+	hash ^= hash >> rtt
+	return fold_hash(hash, num_buckets)
+}
+
+func secondary_hash(data []byte, num_shards uint64) uint64 {
+	hash := uint64(14695981039346656037)
+	for _, c := range data {
+		hash = (hash ^ uint64(c)) * 109951162811
+	}
+	return fold_hash(hash, num_shards)
+}
+
+func edit_distance_lev(a string, b string, utf bool) int {
+	var xa, xb []rune
+	if utf {
+		xa = []rune(a)
+		xb = []rune(b)
+	} else {
+		xa = make([]rune, 0, len(a))
+		for i := 0; i < len(a); i++ {
+			xa = append(xa, rune(a[i]))
+		}
+		xb = make([]rune, 0, len(b))
+		for i := 0; i < len(b); i++ {
+			xb = append(xb, rune(b[i]))
+		}
+	}
+	row := make([]int, len(xb)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(xa); i++ {
+		diag := row[0]
+		row[0] = i
+		for j := 1; j <= len(xb); j++ {
+			cost := 1
+			if xa[i-1] == xb[j-1] {
+				cost = 0
+			}
+			next := diag + cost
+			if row[j]+1 < next {
+				next = row[j] + 1
+			}
+			if row[j-1]+1 < next {
+				next = row[j-1] + 1
+			}
+			diag = row[j]
+			row[j] = next
+		}
+	}
+	return row[len(xb)]
+}
+
+func serialize_int(num int64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(num))
+	return data
+}
+
+func deserialize_int(data []byte) int64 {
+	if len(data) > 8 {
+		data = data[:8]
+	}
+	var num uint64
+	for _, c := range data {
+		num = num<<8 | uint64(c)
+	}
+	return int64(num)
+}
+
+func serialize_float(num float64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, math.Float64bits(num))
+	return data
+}
+
+func deserialize_float(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return math.NaN()
+}
+
+func future_free(future uintptr) {
+}
+
+func future_wait(future uintptr, timeout float64) bool {
+	return false
+}
+
+func future_get(future uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func future_get_bytes(future uintptr) ([]byte, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func future_get_str(future uintptr) (string, *Status) {
+	return "", newCgoDisabledStatus()
+}
+
+func future_get_pair(future uintptr) ([]byte, []byte, *Status) {
+	return nil, nil, newCgoDisabledStatus()
+}
+
+func future_get_pair_str(future uintptr) (string, string, *Status) {
+	return "", "", newCgoDisabledStatus()
+}
+
+func future_get_array(future uintptr) ([][]byte, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func future_get_array_str(future uintptr) ([]string, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func future_get_map(future uintptr) (map[string][]byte, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func future_get_map_str(future uintptr) (map[string]string, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func future_get_int(future uintptr) (int64, *Status) {
+	return 0, newCgoDisabledStatus()
+}
+
+func dbm_open(path string, writable bool, params map[string]string) (uintptr, *Status) {
+	return 0, newCgoDisabledStatus()
+}
+
+func dbm_close(dbm uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_process(dbm uintptr, key []byte, proc RecordProcessor, writable bool) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_check(dbm uintptr, key []byte) bool {
+	return false
+}
+
+func dbm_get(dbm uintptr, key []byte) ([]byte, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func dbm_view(dbm uintptr, key []byte, proc func(value []byte)) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_get_str(dbm uintptr, key []byte) (string, *Status) {
+	return "", newCgoDisabledStatus()
+}
+
+func dbm_get_multi(dbm uintptr, keys []string) map[string][]byte {
+	return nil
+}
+
+func dbm_get_multi_str(dbm uintptr, keys []string) map[string]string {
+	return nil
+}
+
+func dbm_set(dbm uintptr, key []byte, value []byte, overwrite bool) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_set_and_get(dbm uintptr, key []byte, value []byte, overwrite bool) ([]byte, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func dbm_set_multi(dbm uintptr, records map[string][]byte, overwrite bool) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_remove(dbm uintptr, key []byte) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_remove_and_get(dbm uintptr, key []byte) ([]byte, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func dbm_remove_multi(dbm uintptr, keys []string) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_append(dbm uintptr, key []byte, value []byte, delim []byte) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_append_multi(dbm uintptr, records map[string][]byte, delim []byte) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_compare_exchange(dbm uintptr, key []byte, expected []byte, desired []byte) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_compare_exchange_and_get(
+	dbm uintptr, key []byte, expected []byte, desired []byte) ([]byte, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func dbm_increment(dbm uintptr, key []byte, inc int64, init int64) (int64, *Status) {
+	return 0, newCgoDisabledStatus()
+}
+
+func dbm_process_multi(dbm uintptr, pairs []KeyBytesProcPair, writable bool) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_compare_exchange_multi(
+	dbm uintptr, expected []KeyValuePair, desired []KeyValuePair) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_rekey(dbm uintptr, old_key []byte, new_key []byte,
+	overwrite bool, copying bool) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_pop_first(dbm uintptr) ([]byte, []byte, *Status) {
+	return nil, nil, newCgoDisabledStatus()
+}
+
+func dbm_push_last(dbm uintptr, value []byte, wtime float64) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_process_each(dbm uintptr, proc RecordProcessor, writable bool) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_count(dbm uintptr) (int64, *Status) {
+	return 0, newCgoDisabledStatus()
+}
+
+func dbm_get_file_size(dbm uintptr) (int64, *Status) {
+	return 0, newCgoDisabledStatus()
+}
+
+func dbm_get_file_path(dbm uintptr) (string, *Status) {
+	return "", newCgoDisabledStatus()
+}
+
+func dbm_get_timestamp(dbm uintptr) (float64, *Status) {
+	return 0, newCgoDisabledStatus()
+}
+
+func dbm_clear(dbm uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_rebuild(dbm uintptr, params map[string]string) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_should_be_rebuilt(dbm uintptr) (bool, *Status) {
+	return false, newCgoDisabledStatus()
+}
+
+func dbm_synchronize(dbm uintptr, hard bool, params map[string]string) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_copy_file_data(dbm uintptr, dest_path string, sync_hard bool) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_export(dbm uintptr, dest_dbm uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_export_to_flat_records(dbm uintptr, dest_file uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_import_from_flat_records(dbm uintptr, src_file uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_export_keys_as_lines(dbm uintptr, dest_file uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_inspect(dbm uintptr) map[string]string {
+	return nil
+}
+
+func dbm_is_writable(dbm uintptr) bool {
+	return false
+}
+
+func dbm_is_healthy(dbm uintptr) bool {
+	return false
+}
+
+func dbm_is_ordered(dbm uintptr) bool {
+	return false
+}
+
+func dbm_search(dbm uintptr, mode string, pattern string, capacity int) []string {
+	return nil
+}
+
+func dbm_make_iterator(dbm uintptr) uintptr {
+	return 0
+}
+
+func dbm_restore_database(
+	old_file_path string, new_file_path string, class_name string,
+	end_offset int64, cipher_key string) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_iter_free(iter uintptr) {
+}
+
+func dbm_iter_first(iter uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_iter_last(iter uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_iter_jump(iter uintptr, key []byte) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_iter_jump_lower(iter uintptr, key []byte, inclusive bool) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_iter_jump_upper(iter uintptr, key []byte, inclusive bool) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_iter_next(iter uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_iter_previous(iter uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_iter_get_key_esc(iter uintptr) (string, *Status) {
+	return "", newCgoDisabledStatus()
+}
+
+func dbm_iter_get(iter uintptr) ([]byte, []byte, *Status) {
+	return nil, nil, newCgoDisabledStatus()
+}
+
+func dbm_iter_get_key(iter uintptr) ([]byte, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func dbm_iter_get_value(iter uintptr) ([]byte, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func dbm_iter_set(iter uintptr, value []byte) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_iter_remove(iter uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func dbm_iter_step(iter uintptr) ([]byte, []byte, *Status) {
+	return nil, nil, newCgoDisabledStatus()
+}
+
+func async_dbm_new(dbm uintptr, num_worker_threads int) uintptr {
+	return 0
+}
+
+func async_dbm_free(async uintptr) {
+}
+
+func async_dbm_get(async uintptr, key []byte) *Future {
+	return nil
+}
+
+func async_dbm_get_multi(async uintptr, keys []string) *Future {
+	return nil
+}
+
+func async_dbm_set(async uintptr, key []byte, value []byte, overwrite bool) *Future {
+	return nil
+}
+
+func async_dbm_set_multi(async uintptr, records map[string][]byte, overwrite bool) *Future {
+	return nil
+}
+
+func async_dbm_remove(async uintptr, key []byte) *Future {
+	return nil
+}
+
+func async_dbm_remove_multi(async uintptr, keys []string) *Future {
+	return nil
+}
+
+func async_dbm_append(async uintptr, key []byte, value []byte, delim []byte) *Future {
+	return nil
+}
+
+func async_dbm_append_multi(async uintptr, records map[string][]byte, delim []byte) *Future {
+	return nil
+}
+
+func async_dbm_compare_exchange(
+	async uintptr, key []byte, expected []byte, desired []byte) *Future {
+	return nil
+}
+
+func async_dbm_increment(async uintptr, key []byte, inc int64, init int64) *Future {
+	return nil
+}
+
+func async_dbm_compare_exchange_multi(
+	async uintptr, expected []KeyValuePair, desired []KeyValuePair) *Future {
+	return nil
+}
+
+func async_dbm_rekey(async uintptr, old_key []byte, new_key []byte,
+	overwrite bool, copying bool) *Future {
+	return nil
+}
+
+func async_dbm_pop_first(async uintptr) *Future {
+	return nil
+}
+
+func async_dbm_push_last(async uintptr, value []byte, wtime float64) *Future {
+	return nil
+}
+
+func async_dbm_clear(async uintptr) *Future {
+	return nil
+}
+
+func async_dbm_rebuild(async uintptr, params map[string]string) *Future {
+	return nil
+}
+
+func async_dbm_synchronize(async uintptr, hard bool, params map[string]string) *Future {
+	return nil
+}
+
+func async_dbm_copy_file_data(async uintptr, dest_path string, sync_hard bool) *Future {
+	return nil
+}
+
+func async_dbm_export(async uintptr, dest_dbm uintptr) *Future {
+	return nil
+}
+
+func async_dbm_export_to_flat_records(async uintptr, dest_file uintptr) *Future {
+	return nil
+}
+
+func async_dbm_import_from_flat_records(async uintptr, src_file uintptr) *Future {
+	return nil
+}
+
+func async_dbm_search(async uintptr, mode string, pattern string, capacity int) *Future {
+	return nil
+}
+
+func file_open(path string, writable bool, params map[string]string) (uintptr, *Status) {
+	return 0, newCgoDisabledStatus()
+}
+
+func file_close(file uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func file_read(file uintptr, off int64, size int64) ([]byte, *Status) {
+	return nil, newCgoDisabledStatus()
+}
+
+func file_write(file uintptr, off int64, data []byte) *Status {
+	return newCgoDisabledStatus()
+}
+
+func file_append(file uintptr, data []byte) (int64, *Status) {
+	return 0, newCgoDisabledStatus()
+}
+
+func file_truncate(file uintptr, size int64) *Status {
+	return newCgoDisabledStatus()
+}
+
+func file_synchronize(file uintptr, hard bool, off int64, size int64) *Status {
+	return newCgoDisabledStatus()
+}
+
+func file_get_size(file uintptr) (int64, *Status) {
+	return 0, newCgoDisabledStatus()
+}
+
+func file_get_path(file uintptr) (string, *Status) {
+	return "", newCgoDisabledStatus()
+}
+
+func file_search(file uintptr, mode string, pattern string, capacity int) []string {
+	return nil
+}
+
+func index_open(path string, writable bool, params map[string]string) (uintptr, *Status) {
+	return 0, newCgoDisabledStatus()
+}
+
+func index_close(index uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func index_check(index uintptr, key []byte, value []byte) bool {
+	return false
+}
+
+func index_get_values(index uintptr, key []byte, max int) [][]byte {
+	return nil
+}
+
+func index_get_values_str(index uintptr, key []byte, max int) []string {
+	return nil
+}
+
+func index_add(index uintptr, key []byte, value []byte) *Status {
+	return newCgoDisabledStatus()
+}
+
+func index_remove(index uintptr, key []byte, value []byte) *Status {
+	return newCgoDisabledStatus()
+}
+
+func index_count(index uintptr) int64 {
+	return 0
+}
+
+func index_get_file_path(index uintptr) string {
+	return ""
+}
+
+func index_clear(index uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func index_rebuild(index uintptr) *Status {
+	return newCgoDisabledStatus()
+}
+
+func index_synchronize(index uintptr, hard bool) *Status {
+	return newCgoDisabledStatus()
+}
+
+func index_is_writable(index uintptr) bool {
+	return false
+}
+
+func index_make_iterator(index uintptr) uintptr {
+	return 0
+}
+
+func index_iter_free(iter uintptr) {
+}
+
+func index_iter_first(iter uintptr) {
+}
+
+func index_iter_last(iter uintptr) {
+}
+
+func index_iter_jump(iter uintptr, key []byte, value []byte) {
+}
+
+func index_iter_next(iter uintptr) {
+}
+
+func index_iter_previous(iter uintptr) {
+}
+
+func index_iter_get(iter uintptr) ([]byte, []byte, bool) {
+	return nil, nil, false
+}
+
+func index_iter_get_key_esc(iter uintptr) (string, bool) {
+	return "", false
+}
+
+// END OF FILE
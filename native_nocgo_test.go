@@ -0,0 +1,33 @@
+//go:build !cgo
+// +build !cgo
+
+/*************************************************************************************************
+ * Test cases of the fallback of the native interface without cgo
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"testing"
+)
+
+func TestNoCgoHash(t *testing.T) {
+	CheckEq(t, 3042090208, PrimaryHash([]byte("abc"), (1<<32)-1))
+	CheckEq(t, uint64(16973900370012003622), PrimaryHash([]byte("abc"), ^uint64(0)))
+	CheckEq(t, 702176507, SecondaryHash([]byte("abc"), (1<<32)-1))
+	CheckEq(t, uint64(1765794342254572867), SecondaryHash([]byte("abc"), ^uint64(0)))
+	CheckTrue(t, PrimaryHash([]byte("0123456789abcdef"), 100) < 100)
+	CheckTrue(t, SecondaryHash([]byte("0123456789abcdef"), 100) < 100)
+	CheckEq(t, StatusNotImplementedError, NewDBM().Open("casket.tkh", false, nil))
+}
+
+// END OF FILE
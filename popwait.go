@@ -0,0 +1,170 @@
+/*************************************************************************************************
+ * Blocking retrieval of the first record
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// Notifier to wake up goroutines waiting for pushed records.
+type pushNotifier struct {
+	// The channel which is closed on the next push.
+	ch chan struct{}
+}
+
+// Notifiers of opened databases, keyed by the native pointers.
+var pushNotifiers = struct {
+	data  map[uintptr]*pushNotifier
+	mutex sync.Mutex
+}{data: make(map[uintptr]*pushNotifier)}
+
+// Gets the channel which is closed on the next push to a database.
+func waitPush(dbm uintptr) <-chan struct{} {
+	pushNotifiers.mutex.Lock()
+	defer pushNotifiers.mutex.Unlock()
+	notifier, ok := pushNotifiers.data[dbm]
+	if !ok {
+		notifier = &pushNotifier{ch: make(chan struct{})}
+		pushNotifiers.data[dbm] = notifier
+	}
+	return notifier.ch
+}
+
+// Wakes up all goroutines waiting for pushes to a database.
+func notifyPush(dbm uintptr) {
+	pushNotifiers.mutex.Lock()
+	defer pushNotifiers.mutex.Unlock()
+	if notifier, ok := pushNotifiers.data[dbm]; ok {
+		close(notifier.ch)
+		notifier.ch = make(chan struct{})
+	}
+}
+
+// Wakes up all goroutines waiting for pushes to a database and discards the notifier.
+func releasePush(dbm uintptr) {
+	pushNotifiers.mutex.Lock()
+	defer pushNotifiers.mutex.Unlock()
+	if notifier, ok := pushNotifiers.data[dbm]; ok {
+		close(notifier.ch)
+		delete(pushNotifiers.data, dbm)
+	}
+}
+
+// Gets the modification signature of a file, or nil if it is not available.
+func statSignature(path string) []int64 {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	return []int64{info.ModTime().UnixNano(), info.Size()}
+}
+
+// Gets the first record and removes it, waiting until a record is available.
+//
+// @param ctx The context to cancel waiting.  If it is nil, it waits without limit.
+// @return The key and the value of the first record, and the result status.  If the context ends, StatusCanceledError is returned.  If the database is closed while waiting, StatusPreconditionError is returned.
+//
+// Waiting goroutines are woken up by the "PushLast" method of the same process.  To notice records added by other methods or other processes, use the "PopFirstWaitWatching" method.
+func (self *DBM) PopFirstWait(ctx context.Context) ([]byte, []byte, *Status) {
+	return self.PopFirstWaitWatching(ctx, 0)
+}
+
+// Gets the first record and removes it, waiting until a record is available or the database file is modified.
+//
+// @param ctx The context to cancel waiting.  If it is nil, it waits without limit.
+// @param watchInterval The interval in seconds to watch the database file for records added by other processes.  If it is zero or negative, the file is not watched.
+// @return The key and the value of the first record, and the result status.  If the context ends, StatusCanceledError is returned.  If the database is closed while waiting, StatusPreconditionError is returned.
+//
+// Waiting goroutines are woken up by the "PushLast" method of the same process.  Records added by other methods or other processes are noticed only by watching the file.  When the modification time or the size of the file changes, or when the database has no file, retrieval is retried at each interval.
+func (self *DBM) PopFirstWaitWatching(
+	ctx context.Context, watchInterval float64) ([]byte, []byte, *Status) {
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	var tick <-chan time.Time
+	var signature []int64
+	path := ""
+	if watchInterval > 0 {
+		ticker := time.NewTicker(time.Duration(watchInterval * float64(time.Second)))
+		defer ticker.Stop()
+		tick = ticker.C
+		path = self.GetFilePathSimple()
+		signature = statSignature(path)
+	}
+	for {
+		pushed, key, value, status := self.tryPopFirst()
+		if !status.Equals(StatusNotFoundError) {
+			return key, value, status
+		}
+	Wait:
+		for {
+			select {
+			case <-done:
+				return nil, nil, NewStatus2(StatusCanceledError, ctx.Err().Error())
+			case <-pushed:
+				break Wait
+			case <-tick:
+				newSignature := statSignature(path)
+				if newSignature == nil || signature == nil ||
+					newSignature[0] != signature[0] || newSignature[1] != signature[1] {
+					signature = newSignature
+					break Wait
+				}
+			}
+		}
+	}
+}
+
+// Registers the notifier and tries to get the first record, excluding closing.
+func (self *DBM) tryPopFirst() (<-chan struct{}, []byte, []byte, *Status) {
+	self.waitMutex.RLock()
+	defer self.waitMutex.RUnlock()
+	if self.dbm == 0 {
+		return nil, nil, nil, NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	pushed := waitPush(self.dbm)
+	key, value, status := dbm_pop_first(self.dbm)
+	return pushed, key, value, status
+}
+
+// Gets the first record as strings and removes it, waiting until a record is available.
+//
+// @param ctx The context to cancel waiting.  If it is nil, it waits without limit.
+// @return The key and the value of the first record, and the result status.
+func (self *DBM) PopFirstStrWait(ctx context.Context) (string, string, *Status) {
+	return self.PopFirstStrWaitWatching(ctx, 0)
+}
+
+// Gets the first record as strings and removes it, waiting until a record is available or the database file is modified.
+//
+// @param ctx The context to cancel waiting.  If it is nil, it waits without limit.
+// @param watchInterval The interval in seconds to watch the database file for records added by other processes.  If it is zero or negative, the file is not watched.
+// @return The key and the value of the first record, and the result status.
+func (self *DBM) PopFirstStrWaitWatching(
+	ctx context.Context, watchInterval float64) (string, string, *Status) {
+	key, value, status := self.PopFirstWaitWatching(ctx, watchInterval)
+	if status.code == StatusSuccess {
+		return string(key), string(value), status
+	}
+	return "", "", status
+}
+
+// END OF FILE
@@ -0,0 +1,314 @@
+/*************************************************************************************************
+ * Progress reporting of long-running operations
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"fmt"
+	"github.com/estraier/tkrzw-go/flatrec"
+	"io"
+	"os"
+	"time"
+)
+
+// Progress of a long-running operation.
+type Progress struct {
+	// The number of processed records.  Operations done inside the underlying library report only bytes while running and this is set when they are done.
+	NumRecords int64
+	// The number of processed bytes.
+	NumBytes int64
+	// The estimated total number of records, or -1 if unknown.
+	EstimatedRecords int64
+	// The estimated total number of bytes, or -1 if unknown.
+	EstimatedBytes int64
+	// The elapsed time in seconds.
+	Elapsed float64
+}
+
+// Function to receive the progress of a long-running operation.
+type ProgressFunc func(progress *Progress)
+
+// Makes a string representing the progress.
+//
+// @return The string representing the progress.
+func (self *Progress) String() string {
+	return fmt.Sprintf("#<tkrzw.Progress:records=%d/%d,bytes=%d/%d,elapsed=%.3f>",
+		self.NumRecords, self.EstimatedRecords, self.NumBytes, self.EstimatedBytes, self.Elapsed)
+}
+
+// Gets the ratio of the processed amount to the estimated total amount.
+//
+// @return The ratio between 0.0 and 1.0, or -1 if the total amount is unknown.
+//
+// The number of bytes is used if its total is known.  Otherwise, the number of records is used.
+func (self *Progress) Ratio() float64 {
+	var ratio float64
+	if self.EstimatedBytes > 0 {
+		ratio = float64(self.NumBytes) / float64(self.EstimatedBytes)
+	} else if self.EstimatedRecords > 0 {
+		ratio = float64(self.NumRecords) / float64(self.EstimatedRecords)
+	} else {
+		return -1
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	return ratio
+}
+
+// Gets the estimated remaining time.
+//
+// @return The estimated remaining time in seconds, or -1 if it is unknown.
+func (self *Progress) RemainingTime() float64 {
+	ratio := self.Ratio()
+	if ratio <= 0 {
+		return -1
+	}
+	return self.Elapsed * (1 - ratio) / ratio
+}
+
+// Tracker to call a progress function periodically.
+type progressTracker struct {
+	progress   Progress
+	proc       ProgressFunc
+	startTime  time.Time
+	interval   float64
+	lastReport float64
+}
+
+// Makes a progress tracker.
+func newProgressTracker(proc ProgressFunc, interval float64) *progressTracker {
+	return &progressTracker{
+		progress:  Progress{EstimatedRecords: -1, EstimatedBytes: -1},
+		proc:      proc,
+		startTime: time.Now(),
+		interval:  interval,
+	}
+}
+
+// Adds the amount of processed data and calls the function if the interval has passed.
+func (self *progressTracker) add(numRecords int64, numBytes int64) {
+	self.progress.NumRecords += numRecords
+	self.progress.NumBytes += numBytes
+	self.progress.Elapsed = time.Since(self.startTime).Seconds()
+	if self.proc != nil && self.progress.Elapsed-self.lastReport >= self.interval {
+		self.lastReport = self.progress.Elapsed
+		progress := self.progress
+		self.proc(&progress)
+	}
+}
+
+// Calls the function for the last time.
+func (self *progressTracker) finish() {
+	self.progress.Elapsed = time.Since(self.startTime).Seconds()
+	if self.proc != nil {
+		progress := self.progress
+		self.proc(&progress)
+	}
+}
+
+// Runs an operation in the background while sampling its progress periodically.
+func watchProgress(op func() *Status, sample func(progress *Progress, done bool),
+	estimatedRecords int64, estimatedBytes int64,
+	interval float64, proc ProgressFunc) *Status {
+	tracker := newProgressTracker(proc, 0)
+	tracker.progress.EstimatedRecords = estimatedRecords
+	tracker.progress.EstimatedBytes = estimatedBytes
+	result := make(chan *Status, 1)
+	go func() {
+		result <- op()
+	}()
+	if interval <= 0 {
+		interval = 1.0
+	}
+	ticker := time.NewTicker(time.Duration(interval * float64(time.Second)))
+	defer ticker.Stop()
+	for {
+		select {
+		case status := <-result:
+			if status.IsOK() {
+				sample(&tracker.progress, true)
+				tracker.finish()
+			}
+			return status
+		case <-ticker.C:
+			sample(&tracker.progress, false)
+			tracker.add(0, 0)
+		}
+	}
+}
+
+// Gets the size of a file, or -1 on failure.
+func getFileSizeOrUnknown(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+// Gets the number of records in a closed database file, or -1 on failure.
+func countRecordsInFile(path string, className string, cipherKey string) int64 {
+	params := map[string]string{}
+	if className != "" {
+		params["dbm"] = className
+	}
+	if cipherKey != "" {
+		params["cipher_key"] = cipherKey
+	}
+	dbm := NewDBM()
+	if !dbm.Open(path, false, params).IsOK() {
+		return -1
+	}
+	numRecords := dbm.CountSimple()
+	dbm.Close()
+	dbm.Destruct()
+	return numRecords
+}
+
+// Rebuilds the entire database, with progress reporting.
+//
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @param interval The interval in seconds to call the progress function.
+// @param progress The function to receive the progress.
+// @return The result status.
+//
+// The optional parameters are the same as the Rebuild method.  While the database is rebuilt, only the progress in bytes is available: the number of bytes is the size of the temporary file written by the rebuilding operation and the estimated total is the size of the database file.  The number of records stays 0 until the operation is done, because the temporary file is owned by the underlying library and cannot be opened to count records while it is written.  The estimated total number of records is the number of records before rebuilding.  At the end, the number of records and the estimated totals are replaced with the actual amounts.
+func (self *DBM) RebuildWithProgress(
+	params map[string]string, interval float64, progress ProgressFunc) *Status {
+	if self.dbm == 0 {
+		return NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	tmpPath := self.GetFilePathSimple() + ".tmp.rebuild"
+	sample := func(progress *Progress, done bool) {
+		if done {
+			progress.NumRecords = self.CountSimple()
+			progress.NumBytes = self.GetFileSizeSimple()
+			progress.EstimatedRecords = progress.NumRecords
+			progress.EstimatedBytes = progress.NumBytes
+		} else if size := getFileSizeOrUnknown(tmpPath); size >= 0 {
+			progress.NumBytes = size
+		}
+	}
+	op := func() *Status {
+		return self.Rebuild(params)
+	}
+	return watchProgress(op, sample, self.CountSimple(), self.GetFileSizeSimple(),
+		interval, progress)
+}
+
+// Exports all records to another database, with progress reporting.
+//
+// @param destDBM The destination database.
+// @param interval The interval in seconds to call the progress function.
+// @param progress The function to receive the progress.
+// @return The result status.
+//
+// This is the same as ExportThrottled without any limit.  The estimated total number of records is the number of records in the source database.
+func (self *DBM) ExportWithProgress(
+	destDBM *DBM, interval float64, progress ProgressFunc) *Status {
+	params := map[string]string{"progress_interval": ToString(interval)}
+	return self.ExportThrottled(nil, destDBM, params, progress)
+}
+
+// Imports records to a database from a flat record file, with progress reporting.
+//
+// @param srcFile The file object to read records from.
+// @param interval The interval in seconds to call the progress function.
+// @param progress The function to receive the progress.
+// @return The result status.
+//
+// The records are read by this package and stored by the SetMulti method in batches.  The number of bytes is the offset in the file and the estimated total is the size of the file.
+func (self *DBM) ImportFromFlatRecordsWithProgress(
+	srcFile *File, interval float64, progress ProgressFunc) *Status {
+	if self.dbm == 0 {
+		return NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	if srcFile.file == 0 {
+		return NewStatus2(StatusPreconditionError, "not opened file")
+	}
+	fileSize, status := srcFile.GetSize()
+	if !status.IsOK() {
+		return status
+	}
+	tracker := newProgressTracker(progress, interval)
+	tracker.progress.EstimatedBytes = fileSize
+	reader := flatrec.NewFlatRecordReader(io.NewSectionReader(NewFileStream(srcFile), 0, fileSize))
+	batch := make(map[string][]byte)
+	flush := func() *Status {
+		numRecords := int64(len(batch))
+		if numRecords == 0 {
+			return NewStatus1(StatusSuccess)
+		}
+		status := self.SetMulti(batch, true)
+		batch = make(map[string][]byte)
+		tracker.add(numRecords, reader.Offset()-tracker.progress.NumBytes)
+		return status
+	}
+	for {
+		key, value, err := reader.ReadKeyValue()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errorToStatus(err)
+		}
+		batch[string(key)] = value
+		if len(batch) >= defaultBatchSize {
+			status := flush()
+			if !status.IsOK() {
+				return status
+			}
+		}
+	}
+	status = flush()
+	if status.IsOK() {
+		tracker.finish()
+	}
+	return status
+}
+
+// Restores a broken database as a new healthy database, with progress reporting.
+//
+// @param oldFilePath The path of the broken database.
+// @param newFilePath The path of the new database to be created.
+// @param className The name of the database class.  If it is nil or empty, the class is guessed from the file extension.
+// @param endOffset The exclusive end offset of records to read.  Negative means unlimited.  0 means the size when the database is synched or closed properly.  Using a positive value is not meaningful if the number of shards is more than one.
+// @param cipherKey The encryption key for cipher compressors.
+// @param interval The interval in seconds to call the progress function.
+// @param progress The function to receive the progress.
+// @return The result status.
+//
+// While the database is restored, only the progress in bytes is available: the number of bytes is the size of the new database file and the estimated total is the size of the old database file.  The number of records stays 0 and its estimated total is -1 while running, because the new file is owned by the underlying library until the operation is done.  At the end, the new database is opened to count the records, and the estimated totals are replaced with the actual amounts.
+func RestoreDatabaseWithProgress(
+	oldFilePath string, newFilePath string, className string,
+	endOffset int64, cipherKey string, interval float64, progress ProgressFunc) *Status {
+	sample := func(progress *Progress, done bool) {
+		if size := getFileSizeOrUnknown(newFilePath); size >= 0 {
+			progress.NumBytes = size
+		}
+		if done {
+			progress.EstimatedBytes = progress.NumBytes
+			if numRecords := countRecordsInFile(newFilePath, className, cipherKey); numRecords >= 0 {
+				progress.NumRecords = numRecords
+				progress.EstimatedRecords = numRecords
+			}
+		}
+	}
+	op := func() *Status {
+		return RestoreDatabase(oldFilePath, newFilePath, className, endOffset, cipherKey)
+	}
+	return watchProgress(op, sample, -1, getFileSizeOrUnknown(oldFilePath), interval, progress)
+}
+
+// END OF FILE
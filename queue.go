@@ -0,0 +1,322 @@
+/*************************************************************************************************
+ * Persistent job queue with acknowledgements
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// The default maximum number of deliveries of a job.
+const queueMaxAttempts = 5
+
+// The size of the number of attempts prefixed to each job value.
+const queueAttemptsSize = 8
+
+// Job delivered from a queue.
+type QueueJob struct {
+	// The ID of the job.
+	ID int64
+	// The body of the job.
+	Body []byte
+	// The number of deliveries including this one.
+	Attempts int64
+	// The key of the schedule record of the lease.
+	scheduleKey []byte
+	// The stored value of the job record at the delivery.
+	jobValue []byte
+}
+
+// Makes a string representing the job.
+//
+// @return The string representing the job.
+func (self *QueueJob) String() string {
+	return fmt.Sprintf("#<tkrzw.QueueJob:id=%d,attempts=%d,size=%d>",
+		self.ID, self.Attempts, len(self.Body))
+}
+
+// Persistent job queue with acknowledgements.
+//
+// The queue is built on an ordered database such as TreeDBM.  Each job has a job record and a schedule record.  The job record has the key made of the prefix, "J", and the 8-byte big-endian ID.  Its value is the 8-byte big-endian number of deliveries followed by the body.  The schedule record has the key made of the prefix, "T", the 8-byte big-endian time in microseconds when the job becomes visible, and the ID.  Dequeuing a job moves its schedule record forward by the visibility timeout, so the job is delivered again unless it is acknowledged before the timeout.  Jobs delivered as many times as the maximum attempts are moved to dead letter records, whose keys are made of the prefix, "D", and the ID.  Every state transition is done atomically by CompareExchangeMulti, so the queue is safe for many goroutines sharing the database object.  As a database file is locked by the process which opens it for writing, only one process can use the queue at a time.
+//
+// The queue doesn't use PushLast and its wall time for delayed delivery.  PushLast makes the key of the whole timestamp without the prefix and retries with another timestamp on collision, so the caller cannot know the key in advance.  Leases need the time and the ID in the key of the schedule record so that the record is moved together with the job record by a single CompareExchangeMulti.
+type Queue struct {
+	// The underlying database.
+	dbm *DBM
+	// The prefix of the keys.
+	prefix string
+	// The maximum number of deliveries of a job.
+	maxAttempts int64
+}
+
+// Makes a persistent job queue.
+//
+// @param dbm The underlying database, which should be ordered.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The new queue.
+//
+// The optional parameter "prefix" specifies the prefix of the keys of the records so that the queue can share the database with other records.  The optional parameter "max_attempts" specifies the maximum number of deliveries of a job before it is moved to the dead letters.  By default, it is 5.
+func NewQueue(dbm *DBM, params map[string]string) *Queue {
+	queue := &Queue{
+		dbm:         dbm,
+		prefix:      params["prefix"],
+		maxAttempts: queueMaxAttempts,
+	}
+	if attempts := ToInt(params["max_attempts"]); attempts > 0 {
+		queue.maxAttempts = attempts
+	}
+	return queue
+}
+
+// Makes a string representing the queue.
+//
+// @return The string representing the queue.
+func (self *Queue) String() string {
+	return fmt.Sprintf("#<tkrzw.Queue:%p:prefix=%q,max_attempts=%d>",
+		&self, self.prefix, self.maxAttempts)
+}
+
+// Gets the current time in microseconds.
+func queueNow() int64 {
+	return time.Now().UnixNano() / int64(time.Microsecond)
+}
+
+// Converts a wall time in seconds into microseconds, or gets the current time if it is negative.
+func queueTime(wtime float64) int64 {
+	if wtime < 0 {
+		return queueNow()
+	}
+	return int64(wtime * float64(time.Second/time.Microsecond))
+}
+
+// Makes the key of a job record.
+func (self *Queue) jobKey(id int64) []byte {
+	return append([]byte(self.prefix+"J"), SerializeInt(id)...)
+}
+
+// Makes the key of a schedule record.
+func (self *Queue) scheduleKey(visibleTime int64, id int64) []byte {
+	key := append([]byte(self.prefix+"T"), SerializeInt(visibleTime)...)
+	return append(key, SerializeInt(id)...)
+}
+
+// Makes the key of a dead letter record.
+func (self *Queue) deadKey(id int64) []byte {
+	return append([]byte(self.prefix+"D"), SerializeInt(id)...)
+}
+
+// Makes the value of a job record.
+func queueJobValue(attempts int64, body []byte) []byte {
+	return append(SerializeInt(attempts), body...)
+}
+
+// Adds a job.
+//
+// @param body The body of the job.
+// @param wtime The wall time in seconds when the job becomes visible.  If it is negative, the current time is used.
+// @return The ID of the job and the result status.
+func (self *Queue) Enqueue(body interface{}, wtime float64) (int64, *Status) {
+	id, status := self.dbm.Increment(self.prefix+"S", 1, 0)
+	if !status.IsOK() {
+		return 0, status
+	}
+	desired := []KeyValuePair{
+		{self.jobKey(id), queueJobValue(0, ToByteArray(body))},
+		{self.scheduleKey(queueTime(wtime), id), []byte{}},
+	}
+	return id, self.dbm.CompareExchangeMulti(nil, desired)
+}
+
+// Takes the first visible job and hides it for a period.
+//
+// @param visibilityTimeout The period in seconds while the job is hidden from other workers.
+// @return The job and the result status.  If there's no visible job, StatusNotFoundError is returned.
+//
+// The job should be acknowledged by the "Ack" method or returned by the "Nack" method before the timeout.  Otherwise, it is delivered again.  Jobs which have been delivered as many times as the maximum attempts are moved to the dead letters and skipped.
+func (self *Queue) Dequeue(visibilityTimeout float64) (*QueueJob, *Status) {
+	if !self.dbm.IsOrdered() {
+		return nil, NewStatus2(StatusPreconditionError, "unordered database")
+	}
+	schedulePrefix := []byte(self.prefix + "T")
+	prefixSize := len(schedulePrefix)
+	iter := self.dbm.MakeIterator()
+	defer iter.Destruct()
+	status := iter.Jump(schedulePrefix)
+	for status.IsOK() {
+		var scheduleKey []byte
+		scheduleKey, status = iter.GetKey()
+		if !status.IsOK() {
+			break
+		}
+		if !bytes.HasPrefix(scheduleKey, schedulePrefix) || len(scheduleKey) != prefixSize+16 {
+			break
+		}
+		now := queueNow()
+		if DeserializeInt(scheduleKey[prefixSize:prefixSize+8]) > now {
+			break
+		}
+		id := DeserializeInt(scheduleKey[prefixSize+8:])
+		job, takeStatus := self.take(scheduleKey, id, now, visibilityTimeout)
+		if takeStatus.IsOK() {
+			return job, takeStatus
+		}
+		if !takeStatus.Equals(StatusInfeasibleError) && !takeStatus.Equals(StatusNotFoundError) {
+			return nil, takeStatus
+		}
+		status = iter.Next()
+	}
+	if !status.IsOK() && !status.Equals(StatusNotFoundError) {
+		return nil, status
+	}
+	return nil, NewStatus2(StatusNotFoundError, "no visible job")
+}
+
+// Takes a job of a schedule record.
+func (self *Queue) take(
+	scheduleKey []byte, id int64, now int64, visibilityTimeout float64) (*QueueJob, *Status) {
+	jobKey := self.jobKey(id)
+	jobValue, status := self.dbm.Get(jobKey)
+	if status.Equals(StatusNotFoundError) {
+		self.dbm.CompareExchange(scheduleKey, AnyBytes, nil)
+		return nil, status
+	}
+	if !status.IsOK() {
+		return nil, status
+	}
+	if len(jobValue) < queueAttemptsSize {
+		return nil, NewStatus2(StatusBrokenDataError, "too short job value")
+	}
+	attempts := DeserializeInt(jobValue[:queueAttemptsSize])
+	body := jobValue[queueAttemptsSize:]
+	expected := []KeyValuePair{{scheduleKey, AnyBytes}, {jobKey, jobValue}}
+	if attempts >= self.maxAttempts {
+		desired := []KeyValuePair{{scheduleKey, nil}, {jobKey, nil}, {self.deadKey(id), jobValue}}
+		status = self.dbm.CompareExchangeMulti(expected, desired)
+		if status.IsOK() {
+			status = NewStatus2(StatusNotFoundError, "dead letter")
+		}
+		return nil, status
+	}
+	attempts++
+	leaseKey := self.scheduleKey(now+int64(visibilityTimeout*float64(time.Second/time.Microsecond)), id)
+	newJobValue := queueJobValue(attempts, body)
+	desired := []KeyValuePair{{scheduleKey, nil}, {leaseKey, []byte{}}, {jobKey, newJobValue}}
+	status = self.dbm.CompareExchangeMulti(expected, desired)
+	if !status.IsOK() {
+		return nil, status
+	}
+	job := &QueueJob{
+		ID:          id,
+		Body:        body,
+		Attempts:    attempts,
+		scheduleKey: leaseKey,
+		jobValue:    newJobValue,
+	}
+	return job, status
+}
+
+// Acknowledges a job and removes it.
+//
+// @param job The job delivered by the "Dequeue" method.
+// @return The result status.  If the job has been delivered again after the timeout or has been acknowledged already, StatusInfeasibleError is returned.
+func (self *Queue) Ack(job *QueueJob) *Status {
+	jobKey := self.jobKey(job.ID)
+	expected := []KeyValuePair{{job.scheduleKey, AnyBytes}, {jobKey, job.jobValue}}
+	desired := []KeyValuePair{{job.scheduleKey, nil}, {jobKey, nil}}
+	return self.dbm.CompareExchangeMulti(expected, desired)
+}
+
+// Returns a job to the queue without acknowledgement.
+//
+// @param job The job delivered by the "Dequeue" method.
+// @param delay The period in seconds before the job becomes visible again.
+// @return The result status.  If the job has been delivered again after the timeout, StatusInfeasibleError is returned.
+//
+// The job counts as delivered, so it is moved to the dead letters when it is dequeued after reaching the maximum attempts.
+func (self *Queue) Nack(job *QueueJob, delay float64) *Status {
+	jobKey := self.jobKey(job.ID)
+	visibleTime := queueNow() + int64(delay*float64(time.Second/time.Microsecond))
+	expected := []KeyValuePair{{job.scheduleKey, AnyBytes}, {jobKey, job.jobValue}}
+	desired := []KeyValuePair{{job.scheduleKey, nil}, {self.scheduleKey(visibleTime, job.ID), []byte{}}}
+	return self.dbm.CompareExchangeMulti(expected, desired)
+}
+
+// Gets dead letters.
+//
+// @param max The maximum number of jobs to get.  If it is negative, no limit is applied.
+// @return A list of dead jobs and the result status.
+func (self *Queue) DeadLetters(max int) ([]*QueueJob, *Status) {
+	deadPrefix := []byte(self.prefix + "D")
+	jobs := make([]*QueueJob, 0)
+	iter := self.dbm.MakeIterator()
+	defer iter.Destruct()
+	status := iter.Jump(deadPrefix)
+	for status.IsOK() && (max < 0 || len(jobs) < max) {
+		var key, value []byte
+		key, value, status = iter.Get()
+		if !status.IsOK() {
+			break
+		}
+		if !bytes.HasPrefix(key, deadPrefix) {
+			break
+		}
+		if len(key) == len(deadPrefix)+8 && len(value) >= queueAttemptsSize {
+			jobs = append(jobs, &QueueJob{
+				ID:       DeserializeInt(key[len(deadPrefix):]),
+				Body:     value[queueAttemptsSize:],
+				Attempts: DeserializeInt(value[:queueAttemptsSize]),
+			})
+		}
+		status = iter.Next()
+	}
+	if !status.IsOK() && !status.Equals(StatusNotFoundError) {
+		return nil, status
+	}
+	return jobs, NewStatus1(StatusSuccess)
+}
+
+// Moves a dead letter back to the queue.
+//
+// @param id The ID of the job.
+// @return The result status.  If there's no matching dead letter, StatusNotFoundError is returned.
+//
+// The number of deliveries of the job is reset to zero and the job becomes visible immediately.
+func (self *Queue) Requeue(id int64) *Status {
+	deadKey := self.deadKey(id)
+	value, status := self.dbm.Get(deadKey)
+	if !status.IsOK() {
+		return status
+	}
+	if len(value) < queueAttemptsSize {
+		return NewStatus2(StatusBrokenDataError, "too short job value")
+	}
+	expected := []KeyValuePair{{deadKey, value}}
+	desired := []KeyValuePair{
+		{deadKey, nil},
+		{self.jobKey(id), queueJobValue(0, value[queueAttemptsSize:])},
+		{self.scheduleKey(queueNow(), id), []byte{}},
+	}
+	return self.dbm.CompareExchangeMulti(expected, desired)
+}
+
+// Removes a dead letter.
+//
+// @param id The ID of the job.
+// @return The result status.  If there's no matching dead letter, StatusNotFoundError is returned.
+func (self *Queue) RemoveDeadLetter(id int64) *Status {
+	return self.dbm.Remove(self.deadKey(id))
+}
+
+// END OF FILE
@@ -0,0 +1,328 @@
+/*************************************************************************************************
+ * Reader and writer of the Redis serialization protocol
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits on values read from the peer, which are the same as the ones of Redis.
+const (
+	// The maximum size of a bulk string.
+	maxLength = 512 << 20
+	// The maximum number of elements of an array.
+	maxArrayLength = 1 << 20
+	// The maximum length of a line, including header lines and inline commands.
+	maxLineLength = 64 << 10
+	// The maximum depth of nested arrays.
+	maxDepth = 32
+	// The initial buffer size to read a bulk string, which grows as data arrives.
+	initialBulkSize = 64 << 10
+	// The initial capacity of an array, which grows as elements arrive.
+	initialArrayLength = 1 << 10
+)
+
+// Errors on parsing the protocol.
+var (
+	// The data doesn't follow the protocol.
+	ErrProtocol = errors.New("protocol error")
+)
+
+// Error reply sent by the peer.
+type ErrorReply string
+
+// Gets the message of the error reply.
+//
+// @return The message of the error reply.
+func (self ErrorReply) Error() string {
+	return string(self)
+}
+
+// Reader of values of the Redis serialization protocol.
+type Reader struct {
+	reader *bufio.Reader
+}
+
+// Makes a reader of values.
+//
+// @param r The underlying reader.
+// @return The new reader.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{reader: bufio.NewReader(r)}
+}
+
+// Reads a line without the line terminator.
+func (self *Reader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := self.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineLength+2 {
+			return nil, ErrProtocol
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		break
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// Parses a length in a header line.
+func parseLength(data []byte, limit int) (int, error) {
+	length, err := strconv.Atoi(string(data))
+	if err != nil || length < -1 || length > limit {
+		return 0, ErrProtocol
+	}
+	return length, nil
+}
+
+// Reads a value.
+//
+// @return The value and the error or nil.  A simple string is a string.  An error is an ErrorReply.  An integer is an int64.  A bulk string is a byte slice.  A null is nil.  An array is a slice of values.
+//
+// ErrProtocol is returned if a line is longer than 64KiB, a bulk string is larger than 512MiB, an array has more than 1M elements, or arrays are nested deeper than 32 levels.  Memory for a bulk string is allocated as the data arrives, not in advance by the declared size.
+func (self *Reader) ReadValue() (interface{}, error) {
+	return self.readValue(0)
+}
+
+// Reads a value at the given depth of nesting.
+func (self *Reader) readValue(depth int) (interface{}, error) {
+	line, err := self.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, ErrProtocol
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return ErrorReply(line[1:]), nil
+	case ':':
+		num, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, ErrProtocol
+		}
+		return num, nil
+	case '$':
+		length, err := parseLength(line[1:], maxLength)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		size := length + 2
+		if size > initialBulkSize {
+			size = initialBulkSize
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, size))
+		if _, err := io.CopyN(buf, self.reader, int64(length+2)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		data := buf.Bytes()
+		if data[length] != '\r' || data[length+1] != '\n' {
+			return nil, ErrProtocol
+		}
+		return data[:length], nil
+	case '*':
+		if depth >= maxDepth {
+			return nil, ErrProtocol
+		}
+		length, err := parseLength(line[1:], maxArrayLength)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		size := length
+		if size > initialArrayLength {
+			size = initialArrayLength
+		}
+		values := make([]interface{}, 0, size)
+		for i := 0; i < length; i++ {
+			value, err := self.readValue(depth + 1)
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	return nil, ErrProtocol
+}
+
+// Reads a command.
+//
+// @return The arguments of the command including the name, and the error or nil.
+//
+// Commands are arrays of bulk strings.  Inline commands, which are lines of arguments separated by spaces, are also accepted so that the server can be used with telnet.
+func (self *Reader) ReadCommand() ([][]byte, error) {
+	for {
+		first, err := self.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] != '*' {
+			line, err := self.readLine()
+			if err != nil {
+				return nil, err
+			}
+			fields := strings.Fields(string(line))
+			if len(fields) == 0 {
+				continue
+			}
+			args := make([][]byte, 0, len(fields))
+			for _, field := range fields {
+				args = append(args, []byte(field))
+			}
+			return args, nil
+		}
+		value, err := self.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		elems, ok := value.([]interface{})
+		if !ok {
+			return nil, ErrProtocol
+		}
+		if len(elems) == 0 {
+			continue
+		}
+		args := make([][]byte, 0, len(elems))
+		for _, elem := range elems {
+			arg, ok := elem.([]byte)
+			if !ok {
+				return nil, ErrProtocol
+			}
+			args = append(args, arg)
+		}
+		return args, nil
+	}
+}
+
+// Writer of values of the Redis serialization protocol.
+//
+// Values are buffered until the "Flush" method is called.
+type Writer struct {
+	writer *bufio.Writer
+}
+
+// Makes a writer of values.
+//
+// @param w The underlying writer.
+// @return The new writer.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{writer: bufio.NewWriter(w)}
+}
+
+// Writes a line with a type character.
+func (self *Writer) writeLine(kind byte, text string) error {
+	self.writer.WriteByte(kind)
+	self.writer.WriteString(text)
+	_, err := self.writer.WriteString("\r\n")
+	return err
+}
+
+// Writes a simple string.
+//
+// @param text The string, which must not contain CR or LF.
+// @return The error or nil.
+func (self *Writer) WriteSimple(text string) error {
+	return self.writeLine('+', text)
+}
+
+// Writes an error.
+//
+// @param message The message, which must not contain CR or LF.
+// @return The error or nil.
+func (self *Writer) WriteError(message string) error {
+	return self.writeLine('-', message)
+}
+
+// Writes an integer.
+//
+// @param num The integer.
+// @return The error or nil.
+func (self *Writer) WriteInt(num int64) error {
+	return self.writeLine(':', strconv.FormatInt(num, 10))
+}
+
+// Writes a bulk string.
+//
+// @param data The data.  If it is nil, a null is written.
+// @return The error or nil.
+func (self *Writer) WriteBulk(data []byte) error {
+	if data == nil {
+		return self.WriteNull()
+	}
+	self.writeLine('$', strconv.Itoa(len(data)))
+	self.writer.Write(data)
+	_, err := self.writer.WriteString("\r\n")
+	return err
+}
+
+// Writes a null bulk string.
+//
+// @return The error or nil.
+func (self *Writer) WriteNull() error {
+	return self.writeLine('$', "-1")
+}
+
+// Writes the header of an array.
+//
+// @param length The number of elements, which should be written after the header.
+// @return The error or nil.
+func (self *Writer) WriteArrayHeader(length int) error {
+	return self.writeLine('*', strconv.Itoa(length))
+}
+
+// Writes a command as an array of bulk strings.
+//
+// @param args The arguments of the command including the name.
+// @return The error or nil.
+func (self *Writer) WriteCommand(args ...string) error {
+	err := self.WriteArrayHeader(len(args))
+	for _, arg := range args {
+		err = self.WriteBulk([]byte(arg))
+	}
+	return err
+}
+
+// Sends the buffered data to the underlying writer.
+//
+// @return The error or nil.
+func (self *Writer) Flush() error {
+	return self.writer.Flush()
+}
+
+// END OF FILE
@@ -0,0 +1,341 @@
+//go:build cgo
+// +build cgo
+
+/*************************************************************************************************
+ * Test cases
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package resp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/estraier/tkrzw-go"
+)
+
+// Client for testing.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *Reader
+	writer *Writer
+}
+
+func newTestClient(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t, conn, NewReader(conn), NewWriter(conn)}
+}
+
+// Sends a command and gets the reply, with byte slices converted into strings.
+func (self *testClient) do(args ...string) interface{} {
+	self.writer.WriteCommand(args...)
+	if err := self.writer.Flush(); err != nil {
+		self.t.Fatal(err)
+	}
+	value, err := self.reader.ReadValue()
+	if err != nil {
+		self.t.Fatal(err)
+	}
+	return normalize(value)
+}
+
+func normalize(value interface{}) interface{} {
+	switch value := value.(type) {
+	case []byte:
+		return string(value)
+	case []interface{}:
+		list := make([]interface{}, 0, len(value))
+		for _, elem := range value {
+			list = append(list, normalize(elem))
+		}
+		return list
+	}
+	return value
+}
+
+func (self *testClient) check(expected interface{}, args ...string) {
+	self.t.Helper()
+	actual := self.do(args...)
+	if !reflect.DeepEqual(expected, actual) {
+		self.t.Errorf("%v: expected=%#v, actual=%#v", args, expected, actual)
+	}
+}
+
+func list(elems ...interface{}) []interface{} {
+	return elems
+}
+
+func startServer(t *testing.T, params map[string]string) (*Server, string, *tkrzw.DBM) {
+	dbm := tkrzw.NewDBM()
+	status := dbm.Open("", true, map[string]string{"dbm": "BabyDBM"})
+	if !status.IsOK() {
+		t.Fatal(status)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(dbm, params)
+	go server.Serve(listener)
+	return server, listener.Addr().String(), dbm
+}
+
+func TestProtocol(t *testing.T) {
+	var buf bytes.Buffer
+	writer := NewWriter(&buf)
+	writer.WriteSimple("OK")
+	writer.WriteError("ERR oops")
+	writer.WriteInt(-12)
+	writer.WriteBulk([]byte("a\r\nb"))
+	writer.WriteNull()
+	writer.WriteArrayHeader(2)
+	writer.WriteInt(1)
+	writer.WriteBulk([]byte{})
+	writer.Flush()
+	expected := "+OK\r\n-ERR oops\r\n:-12\r\n$4\r\na\r\nb\r\n$-1\r\n*2\r\n:1\r\n$0\r\n\r\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+	reader := NewReader(&buf)
+	expectedValues := []interface{}{
+		"OK", ErrorReply("ERR oops"), int64(-12), "a\r\nb", nil, list(int64(1), "")}
+	for _, expectedValue := range expectedValues {
+		value, err := reader.ReadValue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expectedValue, normalize(value)) {
+			t.Errorf("expected=%#v, actual=%#v", expectedValue, value)
+		}
+	}
+	reader = NewReader(strings.NewReader("\r\nset  foo bar\r\n*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n*1\r\n:1\r\n"))
+	args, err := reader.ReadCommand()
+	if err != nil || fmt.Sprintf("%q", args) != `["set" "foo" "bar"]` {
+		t.Errorf("unexpected inline command: %q, %v", args, err)
+	}
+	args, err = reader.ReadCommand()
+	if err != nil || fmt.Sprintf("%q", args) != `["GET" "foo"]` {
+		t.Errorf("unexpected command: %q, %v", args, err)
+	}
+	if _, err = reader.ReadCommand(); err != ErrProtocol {
+		t.Errorf("unexpected error: %v", err)
+	}
+	reader = NewReader(strings.NewReader("$100000000\r\nabc"))
+	if _, err = reader.ReadValue(); err != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected error: %v", err)
+	}
+	reader = NewReader(strings.NewReader("$536870912\r\nabc"))
+	if _, err = reader.ReadValue(); err != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected error: %v", err)
+	}
+	reader = NewReader(strings.NewReader("$536870913\r\nabc"))
+	if _, err = reader.ReadValue(); err != ErrProtocol {
+		t.Errorf("unexpected error: %v", err)
+	}
+	reader = NewReader(strings.NewReader("*1048577\r\n"))
+	if _, err = reader.ReadValue(); err != ErrProtocol {
+		t.Errorf("unexpected error: %v", err)
+	}
+	reader = NewReader(strings.NewReader("*1048576\r\n:1\r\n"))
+	if _, err = reader.ReadValue(); err != io.ErrUnexpectedEOF {
+		t.Errorf("unexpected error: %v", err)
+	}
+	reader = NewReader(strings.NewReader(strings.Repeat("*1\r\n", 32) + ":1\r\n"))
+	value, err := reader.ReadValue()
+	for i := 0; i < 32 && err == nil; i++ {
+		value = value.([]interface{})[0]
+	}
+	if err != nil || value != int64(1) {
+		t.Errorf("unexpected nested value: %v, %v", value, err)
+	}
+	reader = NewReader(strings.NewReader(strings.Repeat("*1\r\n", 33) + ":1\r\n"))
+	if _, err = reader.ReadValue(); err != ErrProtocol {
+		t.Errorf("unexpected error: %v", err)
+	}
+	longArg := strings.Repeat("x", 64<<10-4)
+	reader = NewReader(strings.NewReader("get " + longArg + "\r\nget " + longArg + "x\r\n"))
+	args, err = reader.ReadCommand()
+	if err != nil || len(args) != 2 || string(args[1]) != longArg {
+		t.Errorf("unexpected long command: %d, %v", len(args), err)
+	}
+	if _, err = reader.ReadCommand(); err != ErrProtocol {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestGlobToRegex(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "heello", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a.b", "axb", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"user:*", "user:1\n2", true},
+	}
+	for _, c := range cases {
+		matcher := regexp.MustCompile(globToRegex(c.pattern))
+		if matcher.MatchString(c.key) != c.match {
+			t.Errorf("%q vs %q: expected=%v", c.pattern, c.key, c.match)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	server, addr, dbm := startServer(t, nil)
+	client := newTestClient(t, addr)
+	client.check("PONG", "PING")
+	client.check("hi", "PING", "hi")
+	client.check("hello", "ECHO", "hello")
+	client.check("OK", "SELECT", "0")
+	client.check(ErrorReply("ERR DB index is out of range"), "SELECT", "1")
+	client.check(list(), "COMMAND", "DOCS")
+	client.check(ErrorReply("ERR unknown command 'NOSUCH'"), "NOSUCH")
+	client.check(ErrorReply("ERR wrong number of arguments for 'get' command"), "GET")
+	client.check(ErrorReply("ERR unknown command 'HSET'"), "HSET", "h", "f", "v")
+	client.check(nil, "GET", "one")
+	client.check("OK", "SET", "one", "first")
+	client.check("first", "GET", "one")
+	client.check(nil, "SET", "one", "again", "NX")
+	client.check("OK", "SET", "one", "second", "XX")
+	client.check(nil, "SET", "two", "second", "XX")
+	client.check(ErrorReply("ERR expiration is not supported"), "SET", "two", "x", "EX", "10")
+	client.check(int64(1), "SETNX", "two", "step")
+	client.check(int64(0), "SETNX", "two", "step")
+	client.check(int64(2), "EXISTS", "one", "two", "three")
+	client.check(int64(10), "INCRBY", "num", "10")
+	client.check(int64(11), "INCR", "num")
+	client.check(int64(8), "DECRBY", "num", "3")
+	client.check(int64(7), "DECR", "num")
+	client.check("7", "GET", "num")
+	client.check(ErrorReply("ERR value is not an integer or out of range"), "INCR", "one")
+	client.check(ErrorReply("ERR value is not an integer or out of range"), "INCRBY", "num", "x")
+	client.check(int64(3), "APPEND", "str", "abc")
+	client.check(int64(6), "APPEND", "str", "def")
+	client.check(int64(6), "STRLEN", "str")
+	client.check(int64(4), "DBSIZE")
+	client.check(list("num"), "KEYS", "n*")
+	keys := client.do("KEYS", "*").([]interface{})
+	if len(keys) != 4 {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+	scanned := make([]string, 0)
+	cursor := "0"
+	for {
+		reply := client.do("SCAN", cursor, "COUNT", "3").([]interface{})
+		cursor = reply[0].(string)
+		for _, key := range reply[1].([]interface{}) {
+			scanned = append(scanned, key.(string))
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(scanned)
+	if fmt.Sprint(scanned) != "[num one str two]" {
+		t.Errorf("unexpected scanned keys: %v", scanned)
+	}
+	client.check(list("0", list("one")), "SCAN", "0", "MATCH", "o*", "COUNT", "100")
+	client.check(ErrorReply("ERR invalid cursor"), "SCAN", "12345")
+	openCursors := make([]string, 0)
+	for i := 0; i <= maxScanCursors; i++ {
+		reply := client.do("SCAN", "0", "COUNT", "1").([]interface{})
+		openCursors = append(openCursors, reply[0].(string))
+	}
+	client.check(ErrorReply("ERR invalid cursor"), "SCAN", openCursors[0])
+	reply := client.do("SCAN", openCursors[maxScanCursors], "COUNT", "1").([]interface{})
+	if len(reply[1].([]interface{})) != 1 {
+		t.Errorf("unexpected reply: %v", reply)
+	}
+	client.check(int64(2), "DEL", "one", "two", "three")
+	client.check(int64(2), "DBSIZE")
+	client.check("OK", "FLUSHDB")
+	client.check(int64(0), "DBSIZE")
+	client.writer.writer.WriteString("PING\r\nECHO inline\r\n")
+	client.writer.Flush()
+	for _, expected := range []string{"PONG", "inline"} {
+		value, err := client.reader.ReadValue()
+		if err != nil || normalize(value) != expected {
+			t.Errorf("unexpected pipelined reply: %v, %v", value, err)
+		}
+	}
+	client.check("OK", "QUIT")
+	if _, err := client.reader.ReadValue(); err == nil {
+		t.Errorf("connection is not closed")
+	}
+	other := newTestClient(t, addr)
+	other.check("PONG", "PING")
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.reader.ReadValue(); err == nil {
+		t.Errorf("connection is not closed")
+	}
+	dbm.Close()
+}
+
+func TestServerCollections(t *testing.T) {
+	server, addr, dbm := startServer(t, map[string]string{"collection_prefix": "\x00"})
+	client := newTestClient(t, addr)
+	client.check(int64(2), "HSET", "user", "name", "john", "age", "23")
+	client.check(int64(0), "HSET", "user", "name", "paul")
+	client.check("paul", "HGET", "user", "name")
+	client.check(nil, "HGET", "user", "email")
+	client.check(list("age", "23", "name", "paul"), "HGETALL", "user")
+	client.check(int64(1), "HDEL", "user", "age", "email")
+	client.check(int64(1), "HLEN", "user")
+	client.check(int64(2), "RPUSH", "list", "c", "d")
+	client.check(int64(4), "LPUSH", "list", "b", "a")
+	client.check(list("a", "b", "c", "d"), "LRANGE", "list", "0", "-1")
+	client.check("a", "LPOP", "list")
+	client.check("d", "RPOP", "list")
+	client.check(int64(2), "LLEN", "list")
+	client.check(int64(2), "SADD", "tags", "x", "y", "x")
+	client.check(int64(1), "SISMEMBER", "tags", "x")
+	client.check(int64(0), "SISMEMBER", "tags", "z")
+	client.check(list("x", "y"), "SMEMBERS", "tags")
+	client.check(int64(1), "SREM", "tags", "x")
+	client.check(int64(1), "SCARD", "tags")
+	client.check(int64(3), "ZADD", "scores", "1.5", "a", "-2", "b", "10", "c")
+	client.check(int64(0), "ZADD", "scores", "3", "a")
+	client.check("3", "ZSCORE", "scores", "a")
+	client.check(list("b", "a", "c"), "ZRANGEBYSCORE", "scores", "-inf", "+inf")
+	client.check(list("a", "3", "c", "10"),
+		"ZRANGEBYSCORE", "scores", "(-2", "10", "WITHSCORES")
+	client.check(list("a"), "ZRANGEBYSCORE", "scores", "-inf", "(10", "LIMIT", "1", "5")
+	client.check(int64(1), "ZREM", "scores", "b", "x")
+	client.check(int64(2), "ZCARD", "scores")
+	server.Close()
+	dbm.Close()
+}
+
+// END OF FILE
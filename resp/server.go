@@ -0,0 +1,1047 @@
+/*************************************************************************************************
+ * Server of the Redis serialization protocol
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+// Package resp provides a TCP server speaking the Redis serialization protocol on a database.
+//
+// The server supports enough commands for redis-cli and common client libraries: PING, ECHO, QUIT, SELECT, COMMAND, CLIENT, INFO, FLUSHDB, DBSIZE, GET, SET, SETNX, DEL, EXISTS, INCR, INCRBY, DECR, DECRBY, APPEND, STRLEN, KEYS, and SCAN.  Integers are stored as decimal strings as Redis does.  As clients take cursors of SCAN as integers, each cursor refers to an iterator held by the connection.  A connection holds up to 16 cursors: a cursor unused for 5 minutes is discarded, and the least recently used one is discarded when a new one exceeds the limit.  Resuming a discarded cursor fails with "ERR invalid cursor", so a scan should be resumed without a long pause.  If the "collection_prefix" parameter is given, commands of hashes, lists, sets, and sorted sets are also supported by tkrzw.Collections.  Every connection shares the same database.
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/estraier/tkrzw-go"
+)
+
+// The error returned by the "Serve" method after the server is closed.
+var ErrServerClosed = errors.New("server closed")
+
+// Server of the Redis serialization protocol.
+type Server struct {
+	// The database.
+	dbm *tkrzw.DBM
+	// The collections, or nil if they are disabled.
+	colls *tkrzw.Collections
+	// The mutex for the state.
+	mutex sync.Mutex
+	// The listeners being served.
+	listeners map[net.Listener]bool
+	// The active connections.
+	conns map[net.Conn]bool
+	// The wait group of the connections.
+	wg sync.WaitGroup
+	// Whether the server is closed.
+	closed bool
+}
+
+// Makes a server.
+//
+// @param dbm The database, which should be opened.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The new server.
+//
+// The optional parameter "collection_prefix" specifies the prefix of the keys of the records of hashes, lists, sets, and sorted sets.  If it is empty, commands of them are disabled.  The records of them are visible to KEYS and SCAN.  Collections need an ordered database such as TreeDBM.
+func NewServer(dbm *tkrzw.DBM, params map[string]string) *Server {
+	server := &Server{
+		dbm:       dbm,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+	if prefix := params["collection_prefix"]; prefix != "" {
+		server.colls = tkrzw.NewCollections(dbm, map[string]string{"prefix": prefix})
+	}
+	return server
+}
+
+// Makes a string representing the server.
+//
+// @return The string representing the server.
+func (self *Server) String() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return fmt.Sprintf("#<resp.Server:%p:listeners=%d,conns=%d>",
+		&self, len(self.listeners), len(self.conns))
+}
+
+// Listens on a TCP address and serves connections.
+//
+// @param addr The address, like "localhost:6379".
+// @return The error.  After the "Close" method is called, ErrServerClosed is returned.
+func (self *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return self.Serve(listener)
+}
+
+// Serves connections accepted by a listener.
+//
+// @param listener The listener, which is closed when this method returns.
+// @return The error.  After the "Close" method is called, ErrServerClosed is returned.
+func (self *Server) Serve(listener net.Listener) error {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	self.listeners[listener] = true
+	self.mutex.Unlock()
+	defer func() {
+		self.mutex.Lock()
+		delete(self.listeners, listener)
+		self.mutex.Unlock()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			self.mutex.Lock()
+			closed := self.closed
+			self.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		self.mutex.Lock()
+		if self.closed {
+			self.mutex.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		self.conns[conn] = true
+		self.wg.Add(1)
+		self.mutex.Unlock()
+		go self.handle(conn)
+	}
+}
+
+// Closes all listeners and connections.
+//
+// @return The error or nil.
+//
+// This method waits until all connections are finished.  The database is not closed.
+func (self *Server) Close() error {
+	self.mutex.Lock()
+	self.closed = true
+	for listener := range self.listeners {
+		listener.Close()
+	}
+	for conn := range self.conns {
+		conn.Close()
+	}
+	self.mutex.Unlock()
+	self.wg.Wait()
+	return nil
+}
+
+// The maximum number of cursors of SCAN held by a connection.
+const maxScanCursors = 16
+
+// The time in seconds after which an unused cursor of SCAN is discarded.
+const scanCursorTimeout = 300
+
+// Iterator of a cursor of SCAN.
+type scanCursor struct {
+	iter     *tkrzw.Iterator
+	lastUsed time.Time
+}
+
+// State of a connection.
+type session struct {
+	server     *Server
+	reader     *Reader
+	writer     *Writer
+	cursors    map[int64]*scanCursor
+	nextCursor int64
+	quit       bool
+}
+
+// Handles a connection.
+func (self *Server) handle(conn net.Conn) {
+	sess := &session{
+		server:     self,
+		reader:     NewReader(conn),
+		writer:     NewWriter(conn),
+		cursors:    make(map[int64]*scanCursor),
+		nextCursor: 1,
+	}
+	defer func() {
+		for _, cur := range sess.cursors {
+			cur.iter.Destruct()
+		}
+		conn.Close()
+		self.mutex.Lock()
+		delete(self.conns, conn)
+		self.mutex.Unlock()
+		self.wg.Done()
+	}()
+	for !sess.quit {
+		args, err := sess.reader.ReadCommand()
+		if err != nil {
+			if err == ErrProtocol {
+				sess.writer.WriteError("ERR Protocol error")
+				sess.writer.Flush()
+			}
+			return
+		}
+		sess.dispatch(args)
+		if sess.reader.reader.Buffered() == 0 || sess.quit {
+			if err := sess.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Specification of a command.
+type command struct {
+	// The number of arguments including the name, or the negated minimum number.
+	arity int
+	// Whether the command operates on collections.
+	collection bool
+	// The handler of the command.
+	run func(sess *session, args [][]byte)
+}
+
+// Commands by the names in lowercase.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":          {-1, false, cmdPing},
+		"echo":          {2, false, cmdEcho},
+		"quit":          {1, false, cmdQuit},
+		"select":        {2, false, cmdSelect},
+		"command":       {-1, false, cmdCommand},
+		"client":        {-2, false, cmdClient},
+		"info":          {-1, false, cmdInfo},
+		"flushdb":       {-1, false, cmdFlushDB},
+		"dbsize":        {1, false, cmdDBSize},
+		"get":           {2, false, cmdGet},
+		"set":           {-3, false, cmdSet},
+		"setnx":         {3, false, cmdSetNX},
+		"del":           {-2, false, cmdDel},
+		"exists":        {-2, false, cmdExists},
+		"incr":          {2, false, cmdIncr},
+		"incrby":        {3, false, cmdIncr},
+		"decr":          {2, false, cmdIncr},
+		"decrby":        {3, false, cmdIncr},
+		"append":        {3, false, cmdAppend},
+		"strlen":        {2, false, cmdStrLen},
+		"keys":          {2, false, cmdKeys},
+		"scan":          {-2, false, cmdScan},
+		"hset":          {-4, true, cmdHSet},
+		"hget":          {3, true, cmdHGet},
+		"hdel":          {-3, true, cmdHDel},
+		"hgetall":       {2, true, cmdHGetAll},
+		"hlen":          {2, true, cmdHLen},
+		"lpush":         {-3, true, cmdPush},
+		"rpush":         {-3, true, cmdPush},
+		"lpop":          {2, true, cmdPop},
+		"rpop":          {2, true, cmdPop},
+		"lrange":        {4, true, cmdLRange},
+		"llen":          {2, true, cmdLLen},
+		"sadd":          {-3, true, cmdSAdd},
+		"srem":          {-3, true, cmdSRem},
+		"sismember":     {3, true, cmdSIsMember},
+		"smembers":      {2, true, cmdSMembers},
+		"scard":         {2, true, cmdSCard},
+		"zadd":          {-4, true, cmdZAdd},
+		"zscore":        {3, true, cmdZScore},
+		"zrem":          {-3, true, cmdZRem},
+		"zrangebyscore": {-4, true, cmdZRangeByScore},
+		"zcard":         {2, true, cmdZCard},
+	}
+}
+
+// Dispatches a command to its handler.
+func (self *session) dispatch(args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok || (cmd.collection && self.server.colls == nil) {
+		self.writer.WriteError(fmt.Sprintf("ERR unknown command '%s'", quoteName(args[0])))
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		self.writer.WriteError(
+			fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	cmd.run(self, args)
+}
+
+// Makes a printable command name for error messages.
+func quoteName(name []byte) string {
+	quoted := strconv.Quote(string(name))
+	if len(quoted) > 66 {
+		quoted = quoted[:63] + "..."
+	}
+	return quoted[1 : len(quoted)-1]
+}
+
+// Writes an error of a status.
+func (self *session) writeStatus(status *tkrzw.Status) {
+	self.writer.WriteError("ERR " + strings.Replace(status.String(), "\n", " ", -1))
+}
+
+// Writes an array of bulk strings.
+func (self *session) writeBulks(elems [][]byte) {
+	self.writer.WriteArrayHeader(len(elems))
+	for _, elem := range elems {
+		self.writer.WriteBulk(elem)
+	}
+}
+
+// Writes a syntax error.
+func (self *session) writeSyntaxError() {
+	self.writer.WriteError("ERR syntax error")
+}
+
+// Writes an error of an invalid integer.
+func (self *session) writeNotInteger() {
+	self.writer.WriteError("ERR value is not an integer or out of range")
+}
+
+// Converts arguments into a list of interfaces.
+func toInterfaces(args [][]byte) []interface{} {
+	list := make([]interface{}, 0, len(args))
+	for _, arg := range args {
+		list = append(list, arg)
+	}
+	return list
+}
+
+// Converts a glob pattern of Redis into a regular expression.
+func globToRegex(pattern string) string {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			expr.WriteString(`[\s\S]*`)
+		case '?':
+			expr.WriteString(`[\s\S]`)
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				break
+			}
+			class := pattern[i+1 : i+1+end]
+			expr.WriteString("[")
+			if strings.HasPrefix(class, "^") {
+				expr.WriteString("^")
+				class = class[1:]
+			}
+			for j := 0; j < len(class); j++ {
+				if class[j] == '-' && j > 0 && j < len(class)-1 {
+					expr.WriteByte('-')
+				} else {
+					fmt.Fprintf(&expr, `\x%02x`, class[j])
+				}
+			}
+			expr.WriteString("]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String()
+}
+
+func cmdPing(sess *session, args [][]byte) {
+	if len(args) > 1 {
+		sess.writer.WriteBulk(args[1])
+		return
+	}
+	sess.writer.WriteSimple("PONG")
+}
+
+func cmdEcho(sess *session, args [][]byte) {
+	sess.writer.WriteBulk(args[1])
+}
+
+func cmdQuit(sess *session, args [][]byte) {
+	sess.writer.WriteSimple("OK")
+	sess.quit = true
+}
+
+func cmdSelect(sess *session, args [][]byte) {
+	if string(args[1]) != "0" {
+		sess.writer.WriteError("ERR DB index is out of range")
+		return
+	}
+	sess.writer.WriteSimple("OK")
+}
+
+func cmdCommand(sess *session, args [][]byte) {
+	if len(args) > 1 && strings.ToLower(string(args[1])) == "count" {
+		sess.writer.WriteInt(int64(len(commands)))
+		return
+	}
+	sess.writer.WriteArrayHeader(0)
+}
+
+func cmdClient(sess *session, args [][]byte) {
+	switch strings.ToLower(string(args[1])) {
+	case "getname":
+		sess.writer.WriteNull()
+	case "id":
+		sess.writer.WriteInt(0)
+	default:
+		sess.writer.WriteSimple("OK")
+	}
+}
+
+func cmdInfo(sess *session, args [][]byte) {
+	var info strings.Builder
+	info.WriteString("# Server\r\n")
+	info.WriteString("redis_version:6.0.0\r\n")
+	fmt.Fprintf(&info, "tkrzw_version:%s\r\n", tkrzw.Version)
+	info.WriteString("# Keyspace\r\n")
+	fmt.Fprintf(&info, "db0:keys=%d,expires=0,avg_ttl=0\r\n", sess.server.dbm.CountSimple())
+	sess.writer.WriteBulk([]byte(info.String()))
+}
+
+func cmdFlushDB(sess *session, args [][]byte) {
+	if status := sess.server.dbm.Clear(); !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteSimple("OK")
+}
+
+func cmdDBSize(sess *session, args [][]byte) {
+	count, status := sess.server.dbm.Count()
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(count)
+}
+
+func cmdGet(sess *session, args [][]byte) {
+	value, status := sess.server.dbm.Get(args[1])
+	if status.Equals(tkrzw.StatusNotFoundError) {
+		sess.writer.WriteNull()
+		return
+	}
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteBulk(value)
+}
+
+func cmdSet(sess *session, args [][]byte) {
+	mode := ""
+	for _, arg := range args[3:] {
+		switch option := strings.ToLower(string(arg)); option {
+		case "nx", "xx":
+			if mode != "" && mode != option {
+				sess.writeSyntaxError()
+				return
+			}
+			mode = option
+		case "ex", "px", "exat", "pxat", "keepttl":
+			sess.writer.WriteError("ERR expiration is not supported")
+			return
+		default:
+			sess.writeSyntaxError()
+			return
+		}
+	}
+	dbm := sess.server.dbm
+	var status *tkrzw.Status
+	switch mode {
+	case "nx":
+		status = dbm.Set(args[1], args[2], false)
+	case "xx":
+		found := false
+		status = dbm.Process(args[1], func(k []byte, v []byte) interface{} {
+			if v == nil {
+				return nil
+			}
+			found = true
+			return args[2]
+		}, true)
+		if status.IsOK() && !found {
+			status = tkrzw.NewStatus1(tkrzw.StatusNotFoundError)
+		}
+	default:
+		status = dbm.Set(args[1], args[2], true)
+	}
+	if status.Equals(tkrzw.StatusDuplicationError) || status.Equals(tkrzw.StatusNotFoundError) {
+		sess.writer.WriteNull()
+		return
+	}
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteSimple("OK")
+}
+
+func cmdSetNX(sess *session, args [][]byte) {
+	status := sess.server.dbm.Set(args[1], args[2], false)
+	if status.Equals(tkrzw.StatusDuplicationError) {
+		sess.writer.WriteInt(0)
+		return
+	}
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(1)
+}
+
+func cmdDel(sess *session, args [][]byte) {
+	count := int64(0)
+	for _, key := range args[1:] {
+		status := sess.server.dbm.Remove(key)
+		if status.IsOK() {
+			count++
+		} else if !status.Equals(tkrzw.StatusNotFoundError) {
+			sess.writeStatus(status)
+			return
+		}
+	}
+	sess.writer.WriteInt(count)
+}
+
+func cmdExists(sess *session, args [][]byte) {
+	count := int64(0)
+	for _, key := range args[1:] {
+		if sess.server.dbm.Check(key) {
+			count++
+		}
+	}
+	sess.writer.WriteInt(count)
+}
+
+func cmdIncr(sess *session, args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	inc := int64(1)
+	if len(args) > 2 {
+		var err error
+		inc, err = strconv.ParseInt(string(args[2]), 10, 64)
+		if err != nil {
+			sess.writeNotInteger()
+			return
+		}
+	}
+	if strings.HasPrefix(name, "decr") {
+		inc = -inc
+	}
+	var result int64
+	valid := true
+	status := sess.server.dbm.Process(args[1], func(k []byte, v []byte) interface{} {
+		current := int64(0)
+		if v != nil {
+			num, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				valid = false
+				return nil
+			}
+			current = num
+		}
+		result = current + inc
+		if (inc > 0 && result < current) || (inc < 0 && result > current) {
+			valid = false
+			return nil
+		}
+		return strconv.FormatInt(result, 10)
+	}, true)
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	if !valid {
+		sess.writeNotInteger()
+		return
+	}
+	sess.writer.WriteInt(result)
+}
+
+func cmdAppend(sess *session, args [][]byte) {
+	var length int
+	status := sess.server.dbm.Process(args[1], func(k []byte, v []byte) interface{} {
+		value := append(v[:len(v):len(v)], args[2]...)
+		length = len(value)
+		return value
+	}, true)
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(int64(length))
+}
+
+func cmdStrLen(sess *session, args [][]byte) {
+	value, status := sess.server.dbm.Get(args[1])
+	if !status.IsOK() && !status.Equals(tkrzw.StatusNotFoundError) {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(int64(len(value)))
+}
+
+func cmdKeys(sess *session, args [][]byte) {
+	keys := sess.server.dbm.Search("regex", globToRegex(string(args[1])), 0)
+	sess.writer.WriteArrayHeader(len(keys))
+	for _, key := range keys {
+		sess.writer.WriteBulk([]byte(key))
+	}
+}
+
+// Discards cursors of SCAN which have not been used for the timeout.
+func (self *session) expireCursors(now time.Time) {
+	for cursor, cur := range self.cursors {
+		if now.Sub(cur.lastUsed).Seconds() >= scanCursorTimeout {
+			cur.iter.Destruct()
+			delete(self.cursors, cursor)
+		}
+	}
+}
+
+// Discards the least recently used cursor of SCAN.
+func (self *session) discardLeastRecentCursor() {
+	oldest := int64(-1)
+	for cursor, cur := range self.cursors {
+		if oldest < 0 || cur.lastUsed.Before(self.cursors[oldest].lastUsed) {
+			oldest = cursor
+		}
+	}
+	if oldest >= 0 {
+		self.cursors[oldest].iter.Destruct()
+		delete(self.cursors, oldest)
+	}
+}
+
+func cmdScan(sess *session, args [][]byte) {
+	cursor, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil || cursor < 0 {
+		sess.writer.WriteError("ERR invalid cursor")
+		return
+	}
+	count := 10
+	var matcher *regexp.Regexp
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			sess.writeSyntaxError()
+			return
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			matcher, err = regexp.Compile(globToRegex(string(args[i+1])))
+			if err != nil {
+				sess.writeSyntaxError()
+				return
+			}
+		case "count":
+			num, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || num < 1 {
+				sess.writeNotInteger()
+				return
+			}
+			count = num
+		default:
+			sess.writeSyntaxError()
+			return
+		}
+	}
+	now := time.Now()
+	sess.expireCursors(now)
+	var cur *scanCursor
+	if cursor == 0 {
+		if len(sess.cursors) >= maxScanCursors {
+			sess.discardLeastRecentCursor()
+		}
+		cur = &scanCursor{iter: sess.server.dbm.MakeIterator()}
+		cur.iter.First()
+		cursor = sess.nextCursor
+		sess.nextCursor++
+		sess.cursors[cursor] = cur
+	} else {
+		cur = sess.cursors[cursor]
+		if cur == nil {
+			sess.writer.WriteError("ERR invalid cursor")
+			return
+		}
+	}
+	cur.lastUsed = now
+	iter := cur.iter
+	keys := make([][]byte, 0, count)
+	done := false
+	for i := 0; i < count; i++ {
+		key, status := iter.GetKey()
+		if !status.IsOK() {
+			done = true
+			break
+		}
+		if matcher == nil || matcher.Match(key) {
+			keys = append(keys, key)
+		}
+		if !iter.Next().IsOK() {
+			done = true
+			break
+		}
+	}
+	if done {
+		iter.Destruct()
+		delete(sess.cursors, cursor)
+		cursor = 0
+	}
+	sess.writer.WriteArrayHeader(2)
+	sess.writer.WriteBulk([]byte(strconv.FormatInt(cursor, 10)))
+	sess.writeBulks(keys)
+}
+
+func cmdHSet(sess *session, args [][]byte) {
+	if len(args)%2 != 0 {
+		sess.writer.WriteError("ERR wrong number of arguments for 'hset' command")
+		return
+	}
+	count := int64(0)
+	for i := 2; i < len(args); i += 2 {
+		created, status := sess.server.colls.HSet(args[1], args[i], args[i+1])
+		if !status.IsOK() {
+			sess.writeStatus(status)
+			return
+		}
+		if created {
+			count++
+		}
+	}
+	sess.writer.WriteInt(count)
+}
+
+func cmdHGet(sess *session, args [][]byte) {
+	value, status := sess.server.colls.HGet(args[1], args[2])
+	if status.Equals(tkrzw.StatusNotFoundError) {
+		sess.writer.WriteNull()
+		return
+	}
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteBulk(value)
+}
+
+func cmdHDel(sess *session, args [][]byte) {
+	count, status := sess.server.colls.HDel(args[1], toInterfaces(args[2:])...)
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(count)
+}
+
+func cmdHGetAll(sess *session, args [][]byte) {
+	fields, status := sess.server.colls.HGetAll(args[1])
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteArrayHeader(len(fields) * 2)
+	for _, field := range fields {
+		sess.writer.WriteBulk(field.Key)
+		sess.writer.WriteBulk(field.Value)
+	}
+}
+
+func cmdHLen(sess *session, args [][]byte) {
+	count, status := sess.server.colls.HLen(args[1])
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(count)
+}
+
+func cmdPush(sess *session, args [][]byte) {
+	var length int64
+	var status *tkrzw.Status
+	if strings.ToLower(string(args[0])) == "lpush" {
+		length, status = sess.server.colls.LPush(args[1], toInterfaces(args[2:])...)
+	} else {
+		length, status = sess.server.colls.RPush(args[1], toInterfaces(args[2:])...)
+	}
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(length)
+}
+
+func cmdPop(sess *session, args [][]byte) {
+	var value []byte
+	var status *tkrzw.Status
+	if strings.ToLower(string(args[0])) == "lpop" {
+		value, status = sess.server.colls.LPop(args[1])
+	} else {
+		value, status = sess.server.colls.RPop(args[1])
+	}
+	if status.Equals(tkrzw.StatusNotFoundError) {
+		sess.writer.WriteNull()
+		return
+	}
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteBulk(value)
+}
+
+func cmdLRange(sess *session, args [][]byte) {
+	start, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		sess.writeNotInteger()
+		return
+	}
+	stop, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		sess.writeNotInteger()
+		return
+	}
+	values, status := sess.server.colls.LRange(args[1], start, stop)
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writeBulks(values)
+}
+
+func cmdLLen(sess *session, args [][]byte) {
+	length, status := sess.server.colls.LLen(args[1])
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(length)
+}
+
+func cmdSAdd(sess *session, args [][]byte) {
+	count, status := sess.server.colls.SAdd(args[1], toInterfaces(args[2:])...)
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(count)
+}
+
+func cmdSRem(sess *session, args [][]byte) {
+	count, status := sess.server.colls.SRem(args[1], toInterfaces(args[2:])...)
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(count)
+}
+
+func cmdSIsMember(sess *session, args [][]byte) {
+	if sess.server.colls.SIsMember(args[1], args[2]) {
+		sess.writer.WriteInt(1)
+	} else {
+		sess.writer.WriteInt(0)
+	}
+}
+
+func cmdSMembers(sess *session, args [][]byte) {
+	members, status := sess.server.colls.SMembers(args[1])
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writeBulks(members)
+}
+
+func cmdSCard(sess *session, args [][]byte) {
+	count, status := sess.server.colls.SCard(args[1])
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(count)
+}
+
+// Formats a score as Redis does.
+func formatScore(score float64) []byte {
+	if math.IsInf(score, 1) {
+		return []byte("inf")
+	}
+	if math.IsInf(score, -1) {
+		return []byte("-inf")
+	}
+	return []byte(strconv.FormatFloat(score, 'g', -1, 64))
+}
+
+// Parses a score boundary, which can be exclusive with a leading parenthesis.
+func parseScoreBound(expr string) (float64, bool, error) {
+	exclusive := false
+	if strings.HasPrefix(expr, "(") {
+		exclusive = true
+		expr = expr[1:]
+	}
+	score, err := strconv.ParseFloat(expr, 64)
+	return score, exclusive, err
+}
+
+func cmdZAdd(sess *session, args [][]byte) {
+	if len(args)%2 != 0 {
+		sess.writeSyntaxError()
+		return
+	}
+	scores := make([]float64, 0, len(args)/2)
+	for i := 2; i < len(args); i += 2 {
+		score, err := strconv.ParseFloat(string(args[i]), 64)
+		if err != nil {
+			sess.writer.WriteError("ERR value is not a valid float")
+			return
+		}
+		scores = append(scores, score)
+	}
+	count := int64(0)
+	for i, score := range scores {
+		created, status := sess.server.colls.ZAdd(args[1], score, args[3+i*2])
+		if !status.IsOK() {
+			sess.writeStatus(status)
+			return
+		}
+		if created {
+			count++
+		}
+	}
+	sess.writer.WriteInt(count)
+}
+
+func cmdZScore(sess *session, args [][]byte) {
+	score, status := sess.server.colls.ZScore(args[1], args[2])
+	if status.Equals(tkrzw.StatusNotFoundError) {
+		sess.writer.WriteNull()
+		return
+	}
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteBulk(formatScore(score))
+}
+
+func cmdZRem(sess *session, args [][]byte) {
+	count, status := sess.server.colls.ZRem(args[1], toInterfaces(args[2:])...)
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(count)
+}
+
+func cmdZRangeByScore(sess *session, args [][]byte) {
+	min, minExclusive, err := parseScoreBound(string(args[2]))
+	if err != nil {
+		sess.writer.WriteError("ERR min or max is not a float")
+		return
+	}
+	max, maxExclusive, err := parseScoreBound(string(args[3]))
+	if err != nil {
+		sess.writer.WriteError("ERR min or max is not a float")
+		return
+	}
+	withScores := false
+	offset, limit := 0, -1
+	for i := 4; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "withscores":
+			withScores = true
+		case "limit":
+			if i+2 >= len(args) {
+				sess.writeSyntaxError()
+				return
+			}
+			offset, err = strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				sess.writeNotInteger()
+				return
+			}
+			limit, err = strconv.Atoi(string(args[i+2]))
+			if err != nil {
+				sess.writeNotInteger()
+				return
+			}
+			i += 2
+		default:
+			sess.writeSyntaxError()
+			return
+		}
+	}
+	members, status := sess.server.colls.ZRangeByScore(args[1], min, max, -1)
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	results := make([]tkrzw.ScoredMember, 0, len(members))
+	for _, member := range members {
+		if (minExclusive && member.Score == min) || (maxExclusive && member.Score == max) {
+			continue
+		}
+		results = append(results, member)
+	}
+	if offset < 0 || offset > len(results) {
+		offset = len(results)
+	}
+	results = results[offset:]
+	if limit >= 0 && limit < len(results) {
+		results = results[:limit]
+	}
+	if withScores {
+		sess.writer.WriteArrayHeader(len(results) * 2)
+	} else {
+		sess.writer.WriteArrayHeader(len(results))
+	}
+	for _, member := range results {
+		sess.writer.WriteBulk(member.Member)
+		if withScores {
+			sess.writer.WriteBulk(formatScore(member.Score))
+		}
+	}
+}
+
+func cmdZCard(sess *session, args [][]byte) {
+	count, status := sess.server.colls.ZCard(args[1])
+	if !status.IsOK() {
+		sess.writeStatus(status)
+		return
+	}
+	sess.writer.WriteInt(count)
+}
+
+// END OF FILE
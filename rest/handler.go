@@ -0,0 +1,637 @@
+/*************************************************************************************************
+ * HTTP handler of databases
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+// Package rest provides an HTTP handler exposing databases as resources with JSON responses.
+//
+// The handler serves the following endpoints under the path prefix, which is "/db/" by default.
+//
+//	GET    /db/                       Lists the names of the databases.
+//	GET    /db/{name}                 Gets the properties by the "Inspect" method.
+//	GET    /db/{name}?op=list         Lists records.  Parameters: prefix, start, end, cursor, limit, keys_only.
+//	GET    /db/{name}?op=search       Searches keys.  Parameters: mode, pattern, limit.
+//	POST   /db/{name}?op=set_multi    Sets records by a JSON object {"records":{...},"overwrite":bool}.
+//	POST   /db/{name}?op=remove_multi Removes records by a JSON object {"keys":[...]}.
+//	POST   /db/{name}?op=increment    Increments a counter by a JSON object {"key":...,"inc":int,"init":int}, returning {"value":int}.
+//	GET    /db/{name}/{key}           Gets the value as the body, with the ETag header.
+//	PUT    /db/{name}/{key}           Sets the body as the value.
+//	DELETE /db/{name}/{key}           Removes the record.
+//
+// Keys in the path are percent-decoded and may contain slashes.  Keys and values in JSON are strings as they are, or Base64 strings if the parameter "encoding=base64" is given.  Without Base64, listing or searching keys or values which are not valid UTF-8 fails with 400 Bad Request, as JSON strings cannot represent them.  Listing of an ordered database follows the order of its key comparator: "start" and "end" are located by the "Jump" method, and keys with the prefix are expected to be contiguous, which is true for the default lexical comparator.  The ETag of a record is derived from the hash of its value.  PUT and DELETE with the If-Match header are done by the "CompareExchange" method only if the current ETag matches, and PUT with "If-None-Match: *" is done only if the record doesn't exist.  Otherwise, 412 Precondition Failed is returned.  Errors are returned as JSON objects {"code":...,"message":...} where the code is the name of the status code.
+package rest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/estraier/tkrzw-go"
+)
+
+// The default number of records listed at once.
+const defaultListLimit = 100
+
+// The default maximum number of records listed or searched at once.
+const defaultMaxLimit = 10000
+
+// The default maximum size of a request body.
+const defaultMaxBodySize = 64 << 20
+
+// HTTP handler exposing databases in a registry.
+type Handler struct {
+	// The registry of the databases.
+	registry *Registry
+	// The prefix of the paths.
+	prefix string
+	// Whether updating operations are forbidden.
+	readOnly bool
+	// The maximum number of records listed or searched at once.
+	maxLimit int
+	// The maximum size of a request body.
+	maxBodySize int64
+}
+
+// A record in JSON.
+type jsonRecord struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+}
+
+// A reply of listing records.
+type listReply struct {
+	Records []jsonRecord `json:"records"`
+	Cursor  *string      `json:"cursor,omitempty"`
+}
+
+// A request of setting records.
+type setMultiRequest struct {
+	Records   map[string]string `json:"records"`
+	Overwrite *bool             `json:"overwrite"`
+}
+
+// A request of removing records.
+type removeMultiRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// A request of incrementing a counter.
+type incrementRequest struct {
+	Key  string `json:"key"`
+	Inc  int64  `json:"inc"`
+	Init int64  `json:"init"`
+}
+
+// A reply of incrementing a counter.
+type incrementReply struct {
+	Value int64 `json:"value"`
+}
+
+// An error reply.
+type errorReply struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Makes a handler.
+//
+// @param registry The registry of the databases.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The new handler.
+//
+// The optional parameter "prefix" specifies the prefix of the paths, which is "/db/" by default.  "read_only" is "true" to forbid updating operations.  "max_limit" specifies the maximum number of records listed or searched at once, which is 10000 by default.  "max_body_size" specifies the maximum size of a request body, which is 64MiB by default.  Databases opened without the writable mode are read-only anyway.  The handler can be mounted on an http.ServeMux with the prefix, but the mux redirects paths containing double slashes or dot segments.  To use such keys, serve the handler directly.
+func NewHandler(registry *Registry, params map[string]string) *Handler {
+	handler := &Handler{
+		registry:    registry,
+		prefix:      "/db/",
+		readOnly:    params["read_only"] == "true",
+		maxLimit:    defaultMaxLimit,
+		maxBodySize: defaultMaxBodySize,
+	}
+	if prefix, ok := params["prefix"]; ok {
+		handler.prefix = prefix
+	}
+	if limit := tkrzw.ToInt(params["max_limit"]); limit > 0 {
+		handler.maxLimit = int(limit)
+	}
+	if size := tkrzw.ToInt(params["max_body_size"]); size > 0 {
+		handler.maxBodySize = size
+	}
+	return handler
+}
+
+// Computes the ETag of a value.
+//
+// @param value The value of a record.
+// @return The ETag, which is a quoted hexadecimal string of the first 16 bytes of the SHA-256 hash.
+func ETag(value []byte) string {
+	digest := sha256.Sum256(value)
+	return `"` + hex.EncodeToString(digest[:16]) + `"`
+}
+
+// Checks whether an ETag matches a list of entity tags in a header.
+func matchETag(header string, etag string) bool {
+	for _, token := range strings.Split(header, ",") {
+		token = strings.TrimSpace(token)
+		if token == "*" || token == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Gets the HTTP status code corresponding to a status.
+func httpStatusOf(status *tkrzw.Status) int {
+	switch status.GetCode() {
+	case tkrzw.StatusSuccess:
+		return http.StatusOK
+	case tkrzw.StatusNotImplementedError:
+		return http.StatusNotImplemented
+	case tkrzw.StatusInvalidArgumentError:
+		return http.StatusBadRequest
+	case tkrzw.StatusNotFoundError:
+		return http.StatusNotFound
+	case tkrzw.StatusPermissionError:
+		return http.StatusForbidden
+	case tkrzw.StatusInfeasibleError:
+		return http.StatusPreconditionFailed
+	case tkrzw.StatusDuplicationError, tkrzw.StatusPreconditionError:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// Writes a JSON reply.
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Writes an error reply of a status.
+func writeStatus(w http.ResponseWriter, status *tkrzw.Status) {
+	writeJSON(w, httpStatusOf(status), &errorReply{
+		Code:    tkrzw.StatusCodeName(status.GetCode()),
+		Message: status.GetMessage(),
+	})
+}
+
+// Writes an error reply of an invalid argument.
+func writeInvalid(w http.ResponseWriter, message string) {
+	writeStatus(w, tkrzw.NewStatus2(tkrzw.StatusInvalidArgumentError, message))
+}
+
+// Writes an error reply of a disallowed method.
+func writeMethodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeJSON(w, http.StatusMethodNotAllowed, &errorReply{
+		Code:    tkrzw.StatusCodeName(tkrzw.StatusNotImplementedError),
+		Message: "method not allowed",
+	})
+}
+
+// Codec of keys and values in JSON and parameters.
+type codec bool
+
+// Gets the codec specified by the "encoding" parameter.
+func codecOf(r *http.Request) (codec, bool) {
+	switch r.URL.Query().Get("encoding") {
+	case "":
+		return codec(false), true
+	case "base64":
+		return codec(true), true
+	}
+	return codec(false), false
+}
+
+func (self codec) encode(data []byte) string {
+	if self {
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return string(data)
+}
+
+// Checks whether data can be encoded, which is false for non-UTF-8 data without Base64.
+func (self codec) canEncode(data []byte) bool {
+	return bool(self) || utf8.Valid(data)
+}
+
+func (self codec) decode(expr string) ([]byte, bool) {
+	if self {
+		data, err := base64.StdEncoding.DecodeString(expr)
+		return data, err == nil
+	}
+	return []byte(expr), true
+}
+
+// Serves an HTTP request.
+//
+// @param w The response writer.
+// @param r The request.
+func (self *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, self.prefix) {
+		writeStatus(w, tkrzw.NewStatus2(tkrzw.StatusNotFoundError, "unknown path"))
+		return
+	}
+	path := r.URL.Path[len(self.prefix):]
+	if path == "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeMethodNotAllowed(w, "GET, HEAD")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string][]string{"databases": self.registry.Names()})
+		return
+	}
+	name := path
+	key := ""
+	hasKey := false
+	if pos := strings.IndexByte(path, '/'); pos >= 0 {
+		name = path[:pos]
+		key = path[pos+1:]
+		hasKey = true
+	}
+	dbm := self.registry.Get(name)
+	if dbm == nil {
+		writeStatus(w, tkrzw.NewStatus2(tkrzw.StatusNotFoundError, "unknown database"))
+		return
+	}
+	writable := !self.readOnly && dbm.IsWritable()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !writable {
+		writeStatus(w, tkrzw.NewStatus2(tkrzw.StatusPermissionError, "read-only database"))
+		return
+	}
+	if hasKey {
+		self.serveRecord(w, r, dbm, []byte(key))
+		return
+	}
+	op := r.URL.Query().Get("op")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		switch op {
+		case "", "inspect":
+			writeJSON(w, http.StatusOK, dbm.Inspect())
+		case "list":
+			self.serveList(w, r, dbm)
+		case "search":
+			self.serveSearch(w, r, dbm)
+		default:
+			writeInvalid(w, "unknown operation")
+		}
+	case http.MethodPost:
+		switch op {
+		case "set_multi":
+			self.serveSetMulti(w, r, dbm)
+		case "remove_multi":
+			self.serveRemoveMulti(w, r, dbm)
+		case "increment":
+			self.serveIncrement(w, r, dbm)
+		default:
+			writeInvalid(w, "unknown operation")
+		}
+	default:
+		writeMethodNotAllowed(w, "GET, HEAD, POST")
+	}
+}
+
+// Serves a request on a record.
+func (self *Handler) serveRecord(w http.ResponseWriter, r *http.Request, dbm *tkrzw.DBM, key []byte) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		value, status := dbm.Get(key)
+		if !status.IsOK() {
+			writeStatus(w, status)
+			return
+		}
+		etag := ETag(value)
+		w.Header().Set("ETag", etag)
+		if header := r.Header.Get("If-None-Match"); header != "" && matchETag(header, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(value)
+	case http.MethodPut:
+		value, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, self.maxBodySize))
+		if err != nil {
+			writeInvalid(w, err.Error())
+			return
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		if status := self.update(r, dbm, key, value); !status.IsOK() {
+			writeStatus(w, status)
+			return
+		}
+		w.Header().Set("ETag", ETag(value))
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if status := self.update(r, dbm, key, nil); !status.IsOK() {
+			writeStatus(w, status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, "GET, HEAD, PUT, DELETE")
+	}
+}
+
+// Sets or removes a record, on condition of the If-Match or If-None-Match header.
+func (self *Handler) update(r *http.Request, dbm *tkrzw.DBM, key []byte, value []byte) *tkrzw.Status {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch != "" {
+		if strings.TrimSpace(ifNoneMatch) != "*" {
+			return tkrzw.NewStatus2(tkrzw.StatusInvalidArgumentError, "unsupported If-None-Match")
+		}
+		return dbm.CompareExchange(key, nil, value)
+	}
+	if ifMatch != "" {
+		current, status := dbm.Get(key)
+		if status.Equals(tkrzw.StatusNotFoundError) {
+			return tkrzw.NewStatus2(tkrzw.StatusInfeasibleError, "no existing record")
+		}
+		if !status.IsOK() {
+			return status
+		}
+		if !matchETag(ifMatch, ETag(current)) {
+			return tkrzw.NewStatus2(tkrzw.StatusInfeasibleError, "mismatching ETag")
+		}
+		return dbm.CompareExchange(key, current, value)
+	}
+	if value == nil {
+		return dbm.Remove(key)
+	}
+	return dbm.Set(key, value, true)
+}
+
+// Gets the limit parameter.
+func (self *Handler) getLimit(r *http.Request) int {
+	limit := defaultListLimit
+	if expr := r.URL.Query().Get("limit"); expr != "" {
+		limit = int(tkrzw.ToInt(expr))
+	}
+	if limit <= 0 || limit > self.maxLimit {
+		limit = self.maxLimit
+	}
+	return limit
+}
+
+// Serves a request of listing records.
+func (self *Handler) serveList(w http.ResponseWriter, r *http.Request, dbm *tkrzw.DBM) {
+	cdc, ok := codecOf(r)
+	if !ok {
+		writeInvalid(w, "unknown encoding")
+		return
+	}
+	query := r.URL.Query()
+	params := make(map[string][]byte)
+	for _, name := range []string{"prefix", "start", "end", "cursor"} {
+		if _, ok := query[name]; !ok {
+			continue
+		}
+		value, ok := cdc.decode(query.Get(name))
+		if !ok {
+			writeInvalid(w, "invalid "+name)
+			return
+		}
+		params[name] = value
+	}
+	prefix := params["prefix"]
+	start, hasStart := params["start"]
+	end, hasEnd := params["end"]
+	cursor, hasCursor := params["cursor"]
+	keysOnly := query.Get("keys_only") == "true"
+	limit := self.getLimit(r)
+	ordered := dbm.IsOrdered()
+	if (hasStart || hasEnd) && !ordered {
+		writeInvalid(w, "range listing needs an ordered database")
+		return
+	}
+	iter := dbm.MakeIterator()
+	defer iter.Destruct()
+	var stopKey []byte
+	hasStop := false
+	if hasEnd {
+		status := iter.Jump(end)
+		if status.IsOK() {
+			stopKey, status = iter.GetKey()
+			hasStop = status.IsOK()
+		}
+		if !status.IsOK() && !status.Equals(tkrzw.StatusNotFoundError) {
+			writeStatus(w, status)
+			return
+		}
+	}
+	inPrefix := false
+	var status *tkrzw.Status
+	switch {
+	case hasCursor:
+		status = iter.Jump(cursor)
+		if status.Equals(tkrzw.StatusNotFoundError) {
+			writeInvalid(w, "invalid cursor")
+			return
+		}
+		if key, keyStatus := iter.GetKey(); keyStatus.IsOK() && bytes.Equal(key, cursor) {
+			status = iter.Next()
+		}
+		inPrefix = ordered && bytes.HasPrefix(cursor, prefix)
+	case hasStart:
+		status = iter.Jump(start)
+		inPrefix = bytes.HasPrefix(start, prefix)
+	case ordered && len(prefix) > 0:
+		status = iter.Jump(prefix)
+		inPrefix = true
+	default:
+		status = iter.First()
+	}
+	if !status.IsOK() {
+		writeStatus(w, status)
+		return
+	}
+	reply := &listReply{Records: make([]jsonRecord, 0)}
+	var lastKey []byte
+	for {
+		var key, value []byte
+		if keysOnly {
+			key, status = iter.GetKey()
+		} else {
+			key, value, status = iter.Get()
+		}
+		if status.Equals(tkrzw.StatusNotFoundError) {
+			break
+		}
+		if !status.IsOK() {
+			writeStatus(w, status)
+			return
+		}
+		if hasStop && bytes.Equal(key, stopKey) {
+			break
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			if inPrefix {
+				break
+			}
+			if status = iter.Next(); !status.IsOK() {
+				writeStatus(w, status)
+				return
+			}
+			continue
+		}
+		inPrefix = ordered
+		if len(reply.Records) >= limit {
+			nextCursor := cdc.encode(lastKey)
+			reply.Cursor = &nextCursor
+			break
+		}
+		if !cdc.canEncode(key) || !cdc.canEncode(value) {
+			writeInvalid(w, "non-UTF-8 data needs encoding=base64")
+			return
+		}
+		record := jsonRecord{Key: cdc.encode(key)}
+		if !keysOnly {
+			encodedValue := cdc.encode(value)
+			record.Value = &encodedValue
+		}
+		reply.Records = append(reply.Records, record)
+		lastKey = key
+		if status = iter.Next(); !status.IsOK() {
+			writeStatus(w, status)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, reply)
+}
+
+// Serves a request of searching keys.
+func (self *Handler) serveSearch(w http.ResponseWriter, r *http.Request, dbm *tkrzw.DBM) {
+	cdc, ok := codecOf(r)
+	if !ok {
+		writeInvalid(w, "unknown encoding")
+		return
+	}
+	query := r.URL.Query()
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = "contain"
+	}
+	pattern, ok := cdc.decode(query.Get("pattern"))
+	if !ok {
+		writeInvalid(w, "invalid pattern")
+		return
+	}
+	keys := make([]string, 0)
+	for _, key := range dbm.Search(mode, string(pattern), self.getLimit(r)) {
+		if !cdc.canEncode([]byte(key)) {
+			writeInvalid(w, "non-UTF-8 data needs encoding=base64")
+			return
+		}
+		keys = append(keys, cdc.encode([]byte(key)))
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"keys": keys})
+}
+
+// Serves a request of setting records.
+func (self *Handler) serveSetMulti(w http.ResponseWriter, r *http.Request, dbm *tkrzw.DBM) {
+	cdc, ok := codecOf(r)
+	if !ok {
+		writeInvalid(w, "unknown encoding")
+		return
+	}
+	var req setMultiRequest
+	body := http.MaxBytesReader(w, r.Body, self.maxBodySize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeInvalid(w, "invalid JSON: "+err.Error())
+		return
+	}
+	records := make(map[string][]byte, len(req.Records))
+	for key, value := range req.Records {
+		rawKey, keyOK := cdc.decode(key)
+		rawValue, valueOK := cdc.decode(value)
+		if !keyOK || !valueOK {
+			writeInvalid(w, "invalid record")
+			return
+		}
+		records[string(rawKey)] = rawValue
+	}
+	overwrite := req.Overwrite == nil || *req.Overwrite
+	if status := dbm.SetMulti(records, overwrite); !status.IsOK() {
+		writeStatus(w, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Serves a request of removing records.
+func (self *Handler) serveRemoveMulti(w http.ResponseWriter, r *http.Request, dbm *tkrzw.DBM) {
+	cdc, ok := codecOf(r)
+	if !ok {
+		writeInvalid(w, "unknown encoding")
+		return
+	}
+	var req removeMultiRequest
+	body := http.MaxBytesReader(w, r.Body, self.maxBodySize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeInvalid(w, "invalid JSON: "+err.Error())
+		return
+	}
+	keys := make([]string, 0, len(req.Keys))
+	for _, key := range req.Keys {
+		rawKey, ok := cdc.decode(key)
+		if !ok {
+			writeInvalid(w, "invalid key")
+			return
+		}
+		keys = append(keys, string(rawKey))
+	}
+	if status := dbm.RemoveMulti(keys); !status.IsOK() {
+		writeStatus(w, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Serves a request of incrementing a counter.
+func (self *Handler) serveIncrement(w http.ResponseWriter, r *http.Request, dbm *tkrzw.DBM) {
+	cdc, ok := codecOf(r)
+	if !ok {
+		writeInvalid(w, "unknown encoding")
+		return
+	}
+	var req incrementRequest
+	body := http.MaxBytesReader(w, r.Body, self.maxBodySize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		writeInvalid(w, "invalid JSON: "+err.Error())
+		return
+	}
+	key, ok := cdc.decode(req.Key)
+	if !ok {
+		writeInvalid(w, "invalid key")
+		return
+	}
+	num, status := dbm.Increment(key, req.Inc, req.Init)
+	if !status.IsOK() {
+		writeStatus(w, status)
+		return
+	}
+	writeJSON(w, http.StatusOK, &incrementReply{Value: num})
+}
+
+// END OF FILE
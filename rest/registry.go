@@ -0,0 +1,97 @@
+/*************************************************************************************************
+ * Registry of named databases
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package rest
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/estraier/tkrzw-go"
+)
+
+// Registry of databases identified by names.
+//
+// The registry is safe for concurrent use.  Databases are neither opened nor closed by the registry.
+type Registry struct {
+	// The mutex for the map.
+	mutex sync.RWMutex
+	// The map of names to databases.
+	dbms map[string]*tkrzw.DBM
+}
+
+// Makes an empty registry.
+//
+// @return The new registry.
+func NewRegistry() *Registry {
+	return &Registry{dbms: make(map[string]*tkrzw.DBM)}
+}
+
+// Registers a database.
+//
+// @param name The name of the database, which must not be empty nor contain a slash.
+// @param dbm The database, which should be opened.
+// @return The result status.  If the name is already used, StatusDuplicationError is returned.
+func (self *Registry) Register(name string, dbm *tkrzw.DBM) *tkrzw.Status {
+	if len(name) == 0 || strings.Contains(name, "/") {
+		return tkrzw.NewStatus2(tkrzw.StatusInvalidArgumentError, "invalid name")
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if _, ok := self.dbms[name]; ok {
+		return tkrzw.NewStatus2(tkrzw.StatusDuplicationError, "duplicated name")
+	}
+	self.dbms[name] = dbm
+	return tkrzw.NewStatus1(tkrzw.StatusSuccess)
+}
+
+// Unregisters a database.
+//
+// @param name The name of the database.
+// @return The result status.  If there's no such database, StatusNotFoundError is returned.
+func (self *Registry) Unregister(name string) *tkrzw.Status {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if _, ok := self.dbms[name]; !ok {
+		return tkrzw.NewStatus1(tkrzw.StatusNotFoundError)
+	}
+	delete(self.dbms, name)
+	return tkrzw.NewStatus1(tkrzw.StatusSuccess)
+}
+
+// Gets a database.
+//
+// @param name The name of the database.
+// @return The database or nil if there's no such database.
+func (self *Registry) Get(name string) *tkrzw.DBM {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.dbms[name]
+}
+
+// Gets the names of all databases.
+//
+// @return The names in ascending order.
+func (self *Registry) Names() []string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	names := make([]string, 0, len(self.dbms))
+	for name := range self.dbms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// END OF FILE
@@ -0,0 +1,461 @@
+/*************************************************************************************************
+ * Client of databases served by the HTTP handler
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package rest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/estraier/tkrzw-go"
+)
+
+// The number of records fetched at once by the "Each" method.
+const eachPageSize = 1000
+
+// Client of a database served by the HTTP handler, implementing DBMInterface.
+//
+// The client is safe for concurrent use.  Connections are pooled and reused.  Requests failing with StatusNetworkError are retried.  As retries can repeat updates whose replies were lost, a conditional update can fail with StatusInfeasibleError even if it has been done.  The "Increment" method is not retried because it is not idempotent.
+type RemoteDBM struct {
+	// The URL of the database.
+	baseURL string
+	// The HTTP client.
+	client *http.Client
+	// The maximum number of retries.
+	maxRetries int
+	// The interval between retries.
+	retryInterval time.Duration
+}
+
+// Checks that RemoteDBM implements the interface.
+var _ tkrzw.DBMInterface = (*RemoteDBM)(nil)
+
+// Makes a client of a remote database.
+//
+// @param baseURL The URL of the database, like "http://localhost:8080/db/casket".
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The new client.
+//
+// The optional parameter "timeout" specifies the timeout of each request in seconds, which is 10 by default.  "max_retries" specifies the maximum number of retries on network errors, which is 3 by default.  "retry_interval" specifies the interval between retries in seconds, which is 0.1 by default.  "max_idle_conns" specifies the maximum number of pooled idle connections, which is 16 by default.
+func NewRemoteDBM(baseURL string, params map[string]string) *RemoteDBM {
+	timeout := 10.0
+	if expr, ok := params["timeout"]; ok {
+		timeout = tkrzw.ToFloat(expr)
+	}
+	maxRetries := 3
+	if expr, ok := params["max_retries"]; ok {
+		maxRetries = int(tkrzw.ToInt(expr))
+	}
+	retryInterval := 0.1
+	if expr, ok := params["retry_interval"]; ok {
+		retryInterval = tkrzw.ToFloat(expr)
+	}
+	maxIdleConns := 16
+	if num := tkrzw.ToInt(params["max_idle_conns"]); num > 0 {
+		maxIdleConns = int(num)
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &RemoteDBM{
+		baseURL:       strings.TrimRight(baseURL, "/"),
+		client:        &http.Client{Transport: transport, Timeout: time.Duration(timeout * float64(time.Second))},
+		maxRetries:    maxRetries,
+		retryInterval: time.Duration(retryInterval * float64(time.Second)),
+	}
+}
+
+// Makes a string representing the client.
+//
+// @return The string representing the client.
+func (self *RemoteDBM) String() string {
+	return fmt.Sprintf("#<rest.RemoteDBM:%p:%s>", &self, strconv.Quote(self.baseURL))
+}
+
+// Gets the status of an error reply.
+func statusOfReply(code int, body []byte) *tkrzw.Status {
+	var reply errorReply
+	if json.Unmarshal(body, &reply) == nil {
+		for statusCode := tkrzw.StatusSuccess; statusCode <= tkrzw.StatusApplicationError; statusCode++ {
+			if tkrzw.StatusCodeName(statusCode) == reply.Code {
+				return tkrzw.NewStatus2(statusCode, reply.Message)
+			}
+		}
+	}
+	statusCode := tkrzw.StatusApplicationError
+	switch code {
+	case http.StatusNotFound:
+		statusCode = tkrzw.StatusNotFoundError
+	case http.StatusPreconditionFailed:
+		statusCode = tkrzw.StatusInfeasibleError
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		statusCode = tkrzw.StatusNetworkError
+	}
+	return tkrzw.NewStatus2(statusCode, http.StatusText(code))
+}
+
+// Sends a request with retries.
+func (self *RemoteDBM) do(method string, target string, header map[string]string,
+	body []byte) (http.Header, []byte, *tkrzw.Status) {
+	var status *tkrzw.Status
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			time.Sleep(self.retryInterval)
+		}
+		var respHeader http.Header
+		var respBody []byte
+		respHeader, respBody, status = self.doOnce(method, target, header, body)
+		if !status.Equals(tkrzw.StatusNetworkError) || attempt >= self.maxRetries {
+			return respHeader, respBody, status
+		}
+	}
+}
+
+// Sends a request once.
+func (self *RemoteDBM) doOnce(method string, target string, header map[string]string,
+	body []byte) (http.Header, []byte, *tkrzw.Status) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, tkrzw.NewStatus2(tkrzw.StatusInvalidArgumentError, err.Error())
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return nil, nil, tkrzw.NewStatus2(tkrzw.StatusNetworkError, err.Error())
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, tkrzw.NewStatus2(tkrzw.StatusNetworkError, err.Error())
+	}
+	if resp.StatusCode >= 400 {
+		return resp.Header, respBody, statusOfReply(resp.StatusCode, respBody)
+	}
+	return resp.Header, respBody, tkrzw.NewStatus1(tkrzw.StatusSuccess)
+}
+
+// Makes the URL of a record.
+func (self *RemoteDBM) recordURL(key interface{}) string {
+	return self.baseURL + "/" + url.PathEscape(string(tkrzw.ToByteArray(key)))
+}
+
+// Makes the URL of an operation on the database.
+func (self *RemoteDBM) opURL(op string, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("op", op)
+	query.Set("encoding", "base64")
+	return self.baseURL + "?" + query.Encode()
+}
+
+// Gets the value of a record of a key.
+//
+// @param key The key of the record.
+// @return The bytes value of the matching record and the result status.  If there's no matching record, the status is StatusNotFoundError.
+func (self *RemoteDBM) Get(key interface{}) ([]byte, *tkrzw.Status) {
+	_, body, status := self.do(http.MethodGet, self.recordURL(key), nil, nil)
+	if !status.IsOK() {
+		return nil, status
+	}
+	if body == nil {
+		body = []byte{}
+	}
+	return body, status
+}
+
+// Gets the value of a record of a key, as a string.
+//
+// @param key The key of the record.
+// @return The string value of the matching record and the result status.  If there's no matching record, the status is StatusNotFoundError.
+func (self *RemoteDBM) GetStr(key interface{}) (string, *tkrzw.Status) {
+	value, status := self.Get(key)
+	return string(value), status
+}
+
+// Gets the values of multiple records of keys.
+//
+// @param keys The keys of records to retrieve.
+// @return A map of retrieved records.  Keys which don't match existing records are ignored.
+func (self *RemoteDBM) GetMulti(keys []string) map[string][]byte {
+	records := make(map[string][]byte)
+	for _, key := range keys {
+		if value, status := self.Get(key); status.IsOK() {
+			records[key] = value
+		}
+	}
+	return records
+}
+
+// Sets a record of a key and a value.
+//
+// @param key The key of the record.
+// @param value The value of the record.
+// @param overwrite Whether to overwrite the existing value if there's a record with the same key.  If true, the existing value is overwritten by the new value.  If false, the operation is given up and an error status is returned.
+// @return The result status.  If overwriting is abandoned, StatusDuplicationError is returned.
+func (self *RemoteDBM) Set(key interface{}, value interface{}, overwrite bool) *tkrzw.Status {
+	var header map[string]string
+	if !overwrite {
+		header = map[string]string{"If-None-Match": "*"}
+	}
+	_, _, status := self.do(http.MethodPut, self.recordURL(key), header, tkrzw.ToByteArray(value))
+	if !overwrite && status.Equals(tkrzw.StatusInfeasibleError) {
+		return tkrzw.NewStatus2(tkrzw.StatusDuplicationError, "the record exists")
+	}
+	return status
+}
+
+// Sets multiple records.
+//
+// @param records Records to store.
+// @param overwrite Whether to overwrite the existing value if there's a record with the same key.  If true, the existing value is overwritten by the new value.  If false, the operation is given up and an error status is returned.
+// @return The result status.  If there are records avoiding overwriting, StatusDuplicationError is returned.
+func (self *RemoteDBM) SetMulti(records map[string][]byte, overwrite bool) *tkrzw.Status {
+	req := setMultiRequest{Records: make(map[string]string, len(records)), Overwrite: &overwrite}
+	for key, value := range records {
+		req.Records[base64.StdEncoding.EncodeToString([]byte(key))] =
+			base64.StdEncoding.EncodeToString(value)
+	}
+	body, _ := json.Marshal(&req)
+	_, _, status := self.do(http.MethodPost, self.opURL("set_multi", nil), nil, body)
+	return status
+}
+
+// Removes a record of a key.
+//
+// @param key The key of the record.
+// @return The result status.  If there's no matching record, StatusNotFoundError is returned.
+func (self *RemoteDBM) Remove(key interface{}) *tkrzw.Status {
+	_, _, status := self.do(http.MethodDelete, self.recordURL(key), nil, nil)
+	return status
+}
+
+// Removes records of keys.
+//
+// @param keys The keys of the records.
+// @return The result status.  If there are missing records, StatusNotFoundError is returned.
+func (self *RemoteDBM) RemoveMulti(keys []string) *tkrzw.Status {
+	req := removeMultiRequest{Keys: make([]string, 0, len(keys))}
+	for _, key := range keys {
+		req.Keys = append(req.Keys, base64.StdEncoding.EncodeToString([]byte(key)))
+	}
+	body, _ := json.Marshal(&req)
+	_, _, status := self.do(http.MethodPost, self.opURL("remove_multi", nil), nil, body)
+	return status
+}
+
+// Compares the value of a record and exchanges if the condition meets.
+//
+// @param key The key of the record.
+// @param expected The expected value.  If it is nil or NilString, no existing record is expected.  If it is AnyBytes or AnyString, an existing record with any value is expacted.
+// @param desired The desired value.  If it is nil or NilString, the record is to be removed.  If it is AnyBytes or AnyString, no update is done.
+// @return The result status.  If the condition doesn't meet, StatusInfeasibleError is returned.
+//
+// The expected value is compared with the current value by their ETags, which are hash values.
+func (self *RemoteDBM) CompareExchange(
+	key interface{}, expected interface{}, desired interface{}) *tkrzw.Status {
+	header := make(map[string]string)
+	switch {
+	case tkrzw.IsNilData(expected):
+		header["If-None-Match"] = "*"
+	case tkrzw.IsAnyData(expected):
+		header["If-Match"] = "*"
+	default:
+		header["If-Match"] = ETag(tkrzw.ToByteArray(expected))
+	}
+	if tkrzw.IsAnyData(desired) {
+		respHeader, _, status := self.do(http.MethodGet, self.recordURL(key), nil, nil)
+		switch {
+		case status.Equals(tkrzw.StatusNotFoundError):
+			if header["If-None-Match"] == "*" {
+				return tkrzw.NewStatus1(tkrzw.StatusSuccess)
+			}
+		case !status.IsOK():
+			return status
+		case header["If-Match"] == "*" || header["If-Match"] == respHeader.Get("ETag"):
+			return status
+		}
+		return tkrzw.NewStatus2(tkrzw.StatusInfeasibleError, "unmatching condition")
+	}
+	var status *tkrzw.Status
+	if tkrzw.IsNilData(desired) {
+		_, _, status = self.do(http.MethodDelete, self.recordURL(key), header, nil)
+	} else {
+		_, _, status = self.do(http.MethodPut, self.recordURL(key), header, tkrzw.ToByteArray(desired))
+	}
+	return status
+}
+
+// Increments the numeric value of a record.
+//
+// @param key The key of the record.
+// @param inc The incremental value.  If it is Int64Min, the current value is not changed and a new record is not created.
+// @param init The initial value.
+// @return The current value and the result status.
+//
+// The value is updated atomically by the "Increment" method on the server.  As applying the same increment twice is not acceptable, the request is not retried.  If StatusNetworkError is returned, the increment may or may not have been done.
+func (self *RemoteDBM) Increment(
+	key interface{}, inc interface{}, init interface{}) (int64, *tkrzw.Status) {
+	req := incrementRequest{
+		Key:  base64.StdEncoding.EncodeToString(tkrzw.ToByteArray(key)),
+		Inc:  tkrzw.ToInt(inc),
+		Init: tkrzw.ToInt(init),
+	}
+	body, _ := json.Marshal(&req)
+	_, respBody, status := self.doOnce(http.MethodPost, self.opURL("increment", nil), nil, body)
+	if !status.IsOK() {
+		return 0, status
+	}
+	var reply incrementReply
+	if err := json.Unmarshal(respBody, &reply); err != nil {
+		return 0, tkrzw.NewStatus2(tkrzw.StatusBrokenDataError, "invalid reply")
+	}
+	return reply.Value, status
+}
+
+// Gets the number of records.
+//
+// @return The number of records and the result status.
+func (self *RemoteDBM) Count() (int64, *tkrzw.Status) {
+	props, status := self.inspect()
+	if !status.IsOK() {
+		return -1, status
+	}
+	num, err := strconv.ParseInt(props["num_records"], 10, 64)
+	if err != nil {
+		return -1, tkrzw.NewStatus2(tkrzw.StatusBrokenDataError, "invalid number of records")
+	}
+	return num, status
+}
+
+// Searches the database and get keys which match a pattern.
+//
+// @param mode The search mode.  See the "Search" method of DBM for details.
+// @param pattern The pattern for matching.
+// @param capacity The maximum records to obtain.  0 means the maximum of the server.
+// @return A list of keys matching the condition.
+func (self *RemoteDBM) Search(mode string, pattern string, capacity int) []string {
+	query := url.Values{}
+	query.Set("mode", mode)
+	query.Set("pattern", base64.StdEncoding.EncodeToString([]byte(pattern)))
+	query.Set("limit", strconv.Itoa(capacity))
+	_, body, status := self.do(http.MethodGet, self.opURL("search", query), nil, nil)
+	keys := make([]string, 0)
+	if !status.IsOK() {
+		return keys
+	}
+	var reply map[string][]string
+	if json.Unmarshal(body, &reply) != nil {
+		return keys
+	}
+	for _, key := range reply["keys"] {
+		if rawKey, err := base64.StdEncoding.DecodeString(key); err == nil {
+			keys = append(keys, string(rawKey))
+		}
+	}
+	return keys
+}
+
+// Gets the properties of the database.
+func (self *RemoteDBM) inspect() (map[string]string, *tkrzw.Status) {
+	_, body, status := self.do(http.MethodGet, self.baseURL, nil, nil)
+	if !status.IsOK() {
+		return nil, status
+	}
+	props := make(map[string]string)
+	if err := json.Unmarshal(body, &props); err != nil {
+		return nil, tkrzw.NewStatus2(tkrzw.StatusBrokenDataError, err.Error())
+	}
+	return props, status
+}
+
+// Inspects the database.
+//
+// @return A map of property names and their values.  On failure, the map is empty.
+func (self *RemoteDBM) Inspect() map[string]string {
+	props, status := self.inspect()
+	if !status.IsOK() {
+		return make(map[string]string)
+	}
+	return props
+}
+
+// Makes a channel to read each records.
+//
+// @return the channel to read each records.  All values should be read from the channel to avoid resource leak.
+//
+// Records are fetched page by page with a cursor.  The channel is closed at the end or on failure.
+func (self *RemoteDBM) Each() <-chan tkrzw.KeyValuePair {
+	chanRecord := make(chan tkrzw.KeyValuePair)
+	reader := func(chanSend chan<- tkrzw.KeyValuePair) {
+		defer close(chanRecord)
+		var cursor *string
+		for {
+			query := url.Values{}
+			query.Set("limit", strconv.Itoa(eachPageSize))
+			if cursor != nil {
+				query.Set("cursor", *cursor)
+			}
+			_, body, status := self.do(http.MethodGet, self.opURL("list", query), nil, nil)
+			if !status.IsOK() {
+				return
+			}
+			var reply listReply
+			if json.Unmarshal(body, &reply) != nil {
+				return
+			}
+			for _, record := range reply.Records {
+				if record.Value == nil {
+					return
+				}
+				key, keyErr := base64.StdEncoding.DecodeString(record.Key)
+				value, valueErr := base64.StdEncoding.DecodeString(*record.Value)
+				if keyErr != nil || valueErr != nil {
+					return
+				}
+				chanSend <- tkrzw.KeyValuePair{Key: key, Value: value}
+			}
+			if reply.Cursor == nil {
+				return
+			}
+			cursor = reply.Cursor
+		}
+	}
+	go reader(chanRecord)
+	return chanRecord
+}
+
+// Closes the client.
+//
+// @return The result status.
+//
+// Pooled idle connections are closed.  The remote database is not closed.
+func (self *RemoteDBM) Close() *tkrzw.Status {
+	self.client.CloseIdleConnections()
+	return tkrzw.NewStatus1(tkrzw.StatusSuccess)
+}
+
+// END OF FILE
@@ -0,0 +1,376 @@
+//go:build cgo
+// +build cgo
+
+/*************************************************************************************************
+ * Test cases
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/estraier/tkrzw-go"
+)
+
+// Client for testing.
+type testClient struct {
+	t    *testing.T
+	base string
+}
+
+// Sends a request and gets the status code, the ETag, and the body.
+func (self *testClient) do(method string, path string, body string,
+	header map[string]string) (int, string, string) {
+	self.t.Helper()
+	req, err := http.NewRequest(method, self.base+path, strings.NewReader(body))
+	if err != nil {
+		self.t.Fatal(err)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		self.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		self.t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header.Get("ETag"), strings.TrimSpace(string(content))
+}
+
+func (self *testClient) check(expectedCode int, expectedBody string,
+	method string, path string, body string, header map[string]string) string {
+	self.t.Helper()
+	code, etag, content := self.do(method, path, body, header)
+	if code != expectedCode || (expectedBody != "*" && content != expectedBody) {
+		self.t.Errorf("%s %s: expected=%d %q, actual=%d %q",
+			method, path, expectedCode, expectedBody, code, content)
+	}
+	return etag
+}
+
+func openDBM(t *testing.T, class string) *tkrzw.DBM {
+	dbm := tkrzw.NewDBM()
+	if status := dbm.Open("", true, map[string]string{"dbm": class}); !status.IsOK() {
+		t.Fatal(status)
+	}
+	return dbm
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	dbm := tkrzw.NewDBM()
+	if status := registry.Register("b", dbm); !status.IsOK() {
+		t.Fatal(status)
+	}
+	registry.Register("a", dbm)
+	if status := registry.Register("a", dbm); !status.Equals(tkrzw.StatusDuplicationError) {
+		t.Errorf("unexpected status: %v", status)
+	}
+	if status := registry.Register("x/y", dbm); !status.Equals(tkrzw.StatusInvalidArgumentError) {
+		t.Errorf("unexpected status: %v", status)
+	}
+	if registry.Get("a") != dbm || registry.Get("c") != nil {
+		t.Errorf("unexpected lookup")
+	}
+	if strings.Join(registry.Names(), ",") != "a,b" {
+		t.Errorf("unexpected names: %v", registry.Names())
+	}
+	if status := registry.Unregister("a"); !status.IsOK() {
+		t.Fatal(status)
+	}
+	if status := registry.Unregister("a"); !status.Equals(tkrzw.StatusNotFoundError) {
+		t.Errorf("unexpected status: %v", status)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ordered := openDBM(t, "BabyDBM")
+	unordered := openDBM(t, "TinyDBM")
+	registry := NewRegistry()
+	registry.Register("ordered", ordered)
+	registry.Register("unordered", unordered)
+	server := httptest.NewServer(NewHandler(registry, nil))
+	defer server.Close()
+	client := &testClient{t, server.URL}
+	client.check(200, `{"databases":["ordered","unordered"]}`, "GET", "/db/", "", nil)
+	client.check(404, `{"code":"NOT_FOUND_ERROR","message":"unknown path"}`, "GET", "/x", "", nil)
+	client.check(404, "*", "GET", "/db/nosuch/key", "", nil)
+	client.check(404, "*", "GET", "/db/ordered/one", "", nil)
+	client.check(204, "", "PUT", "/db/ordered/one", "first", nil)
+	etag := client.check(200, "first", "GET", "/db/ordered/one", "", nil)
+	if etag != ETag([]byte("first")) {
+		t.Errorf("unexpected ETag: %s", etag)
+	}
+	client.check(304, "", "GET", "/db/ordered/one", "", map[string]string{"If-None-Match": etag})
+	client.check(412, "*", "PUT", "/db/ordered/one", "x", map[string]string{"If-None-Match": "*"})
+	client.check(412, "*", "PUT", "/db/ordered/one", "x", map[string]string{"If-Match": `"abc"`})
+	client.check(412, "*", "PUT", "/db/ordered/two", "x", map[string]string{"If-Match": "*"})
+	client.check(204, "", "PUT", "/db/ordered/two", "second", map[string]string{"If-None-Match": "*"})
+	newETag := client.check(204, "", "PUT", "/db/ordered/one", "1st",
+		map[string]string{"If-Match": `"abc", ` + etag})
+	if newETag != ETag([]byte("1st")) {
+		t.Errorf("unexpected ETag: %s", newETag)
+	}
+	client.check(412, "*", "DELETE", "/db/ordered/one", "", map[string]string{"If-Match": etag})
+	client.check(204, "", "DELETE", "/db/ordered/one", "", map[string]string{"If-Match": newETag})
+	client.check(404, "*", "DELETE", "/db/ordered/one", "", nil)
+	client.check(204, "", "PUT", "/db/ordered/a%2Fb", "slash", nil)
+	client.check(200, "slash", "GET", "/db/ordered/a%2Fb", "", nil)
+	client.check(204, "", "POST", "/db/ordered?op=set_multi",
+		`{"records":{"k1":"v1","k2":"v2","k3":"v3","j1":"w1"}}`, nil)
+	client.check(409, "*", "POST", "/db/ordered?op=set_multi",
+		`{"records":{"k1":"x"},"overwrite":false}`, nil)
+	client.check(200, "v1", "GET", "/db/ordered/k1", "", nil)
+	client.check(200, `{"records":[{"key":"k1","value":"v1"},{"key":"k2","value":"v2"}],"cursor":"k2"}`,
+		"GET", "/db/ordered?op=list&prefix=k&limit=2", "", nil)
+	client.check(200, `{"records":[{"key":"k3","value":"v3"}]}`,
+		"GET", "/db/ordered?op=list&prefix=k&limit=2&cursor=k2", "", nil)
+	client.check(200, `{"records":[{"key":"j1"},{"key":"k1"}]}`,
+		"GET", "/db/ordered?op=list&start=b&end=k2&keys_only=true", "", nil)
+	client.check(200, `{"records":[{"key":"azE=","value":"djE="}],"cursor":"azE="}`,
+		"GET", "/db/ordered?op=list&start=azE%3D&limit=1&encoding=base64", "", nil)
+	client.check(200, `{"keys":["k2"]}`, "GET", "/db/ordered?op=search&pattern=2", "", nil)
+	client.check(400, "*", "GET", "/db/ordered?op=nosuch", "", nil)
+	client.check(400, "*", "GET", "/db/ordered?op=list&encoding=nosuch", "", nil)
+	client.check(204, "", "POST", "/db/ordered?op=remove_multi", `{"keys":["k1","k2"]}`, nil)
+	client.check(404, "*", "POST", "/db/ordered?op=remove_multi", `{"keys":["k1"]}`, nil)
+	client.check(400, "*", "POST", "/db/ordered?op=remove_multi", `{"keys":`, nil)
+	code, _, body := client.do("GET", "/db/ordered", "", nil)
+	var props map[string]string
+	if code != 200 || json.Unmarshal([]byte(body), &props) != nil || props["num_records"] != "4" {
+		t.Errorf("unexpected inspection: %d %s", code, body)
+	}
+	for i := 0; i < 5; i++ {
+		unordered.Set("key"+string(rune('a'+i)), "value", true)
+	}
+	unordered.Set("other", "value", true)
+	client.check(400, "*", "GET", "/db/unordered?op=list&start=a", "", nil)
+	keys := make([]string, 0)
+	cursor := ""
+	for {
+		path := "/db/unordered?op=list&prefix=key&limit=2&keys_only=true"
+		if cursor != "" {
+			path += "&cursor=" + url.QueryEscape(cursor)
+		}
+		_, _, body := client.do("GET", path, "", nil)
+		var reply listReply
+		if err := json.Unmarshal([]byte(body), &reply); err != nil {
+			t.Fatal(err)
+		}
+		for _, record := range reply.Records {
+			keys = append(keys, record.Key)
+		}
+		if reply.Cursor == nil {
+			break
+		}
+		cursor = *reply.Cursor
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "keya,keyb,keyc,keyd,keye" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+	readOnly := httptest.NewServer(NewHandler(registry, map[string]string{
+		"prefix": "/", "read_only": "true"}))
+	defer readOnly.Close()
+	other := &testClient{t, readOnly.URL}
+	other.check(200, "value", "GET", "/unordered/other", "", nil)
+	other.check(403, `{"code":"PERMISSION_ERROR","message":"read-only database"}`,
+		"PUT", "/unordered/other", "x", nil)
+	other.check(405, "*", "PATCH", "/", "", nil)
+	ordered.Close()
+	unordered.Close()
+}
+
+func TestHandlerDataAndOrder(t *testing.T) {
+	decimal := tkrzw.NewDBM()
+	status := decimal.Open("", true, map[string]string{"dbm": "BabyDBM", "key_comparator": "Decimal"})
+	if !status.IsOK() {
+		t.Fatal(status)
+	}
+	registry := NewRegistry()
+	registry.Register("decimal", decimal)
+	server := httptest.NewServer(NewHandler(registry, map[string]string{"max_body_size": "4"}))
+	defer server.Close()
+	client := &testClient{t, server.URL}
+	for _, key := range []string{"1", "2", "9", "10", "11", "20"} {
+		client.check(204, "", "PUT", "/db/decimal/"+key, "v"+key, nil)
+	}
+	client.check(200, `{"records":[{"key":"2"},{"key":"9"},{"key":"10"}]}`,
+		"GET", "/db/decimal?op=list&start=2&end=11&keys_only=true", "", nil)
+	client.check(200, `{"records":[{"key":"9"},{"key":"10"},{"key":"11"},{"key":"20"}]}`,
+		"GET", "/db/decimal?op=list&start=3&end=100&keys_only=true", "", nil)
+	client.check(200, `{"records":[{"key":"10"},{"key":"11"}]}`,
+		"GET", "/db/decimal?op=list&start=10&prefix=1&keys_only=true", "", nil)
+	client.check(200, `{"records":[{"key":"20"}]}`,
+		"GET", "/db/decimal?op=list&start=3&prefix=2&keys_only=true", "", nil)
+	client.check(400, "*", "PUT", "/db/decimal/30", "12345", nil)
+	client.check(400, "*", "POST", "/db/decimal?op=remove_multi", `{"keys":["1"]}`, nil)
+	decimal.Set("30", "\xff", true)
+	client.check(400, `{"code":"INVALID_ARGUMENT_ERROR","message":"non-UTF-8 data needs encoding=base64"}`,
+		"GET", "/db/decimal?op=list&start=30", "", nil)
+	client.check(200, `{"records":[{"key":"MzA=","value":"/w=="}]}`,
+		"GET", "/db/decimal?op=list&start=MzA%3D&encoding=base64", "", nil)
+	decimal.Set("\xfe", "x", true)
+	client.check(400, "*", "GET", "/db/decimal?op=search&pattern=", "", nil)
+	client.check(200, `{"keys":["/g=="]}`,
+		"GET", "/db/decimal?op=search&mode=end&pattern=%2Fg%3D%3D&encoding=base64", "", nil)
+	decimal.Close()
+}
+
+func checkStatus(t *testing.T, expected tkrzw.StatusCode, status *tkrzw.Status) {
+	t.Helper()
+	if !status.Equals(expected) {
+		t.Errorf("expected=%s, actual=%s", tkrzw.StatusCodeName(expected), status)
+	}
+}
+
+func checkDBMInterface(t *testing.T, dbm tkrzw.DBMInterface) {
+	checkStatus(t, tkrzw.StatusSuccess, dbm.Set("a", "1", true))
+	checkStatus(t, tkrzw.StatusDuplicationError, dbm.Set("a", "x", false))
+	if value, status := dbm.GetStr("a"); !status.IsOK() || value != "1" {
+		t.Errorf("unexpected value: %q, %v", value, status)
+	}
+	_, status := dbm.Get("z")
+	checkStatus(t, tkrzw.StatusNotFoundError, status)
+	checkStatus(t, tkrzw.StatusSuccess,
+		dbm.SetMulti(map[string][]byte{"b": []byte("2"), "c/d": []byte("3")}, true))
+	if records := dbm.GetMulti([]string{"a", "c/d", "z"}); len(records) != 2 ||
+		string(records["c/d"]) != "3" {
+		t.Errorf("unexpected records: %v", records)
+	}
+	checkStatus(t, tkrzw.StatusSuccess, dbm.CompareExchange("a", "1", "11"))
+	checkStatus(t, tkrzw.StatusInfeasibleError, dbm.CompareExchange("a", "1", "x"))
+	checkStatus(t, tkrzw.StatusSuccess, dbm.CompareExchange("n", nil, "new"))
+	checkStatus(t, tkrzw.StatusInfeasibleError, dbm.CompareExchange("n", nil, "x"))
+	checkStatus(t, tkrzw.StatusSuccess, dbm.CompareExchange("n", tkrzw.AnyBytes, tkrzw.AnyBytes))
+	checkStatus(t, tkrzw.StatusInfeasibleError,
+		dbm.CompareExchange("z", tkrzw.AnyBytes, tkrzw.AnyBytes))
+	checkStatus(t, tkrzw.StatusSuccess, dbm.CompareExchange("n", "new", nil))
+	for _, c := range []struct{ inc, init, expected int64 }{
+		{5, 100, 105}, {tkrzw.Int64Min, 0, 105}, {-5, 0, 100}} {
+		if num, status := dbm.Increment("cnt", c.inc, c.init); !status.IsOK() || num != c.expected {
+			t.Errorf("unexpected increment: %d, %v", num, status)
+		}
+	}
+	if num, status := dbm.Count(); !status.IsOK() || num != 4 {
+		t.Errorf("unexpected count: %d, %v", num, status)
+	}
+	if keys := dbm.Search("contain", "/", 0); fmt.Sprint(keys) != "[c/d]" {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+	numRecords := 0
+	for record := range dbm.Each() {
+		if len(record.Key) == 0 || len(record.Value) == 0 {
+			t.Errorf("unexpected record: %v", record)
+		}
+		numRecords++
+	}
+	if numRecords != 4 {
+		t.Errorf("unexpected number of records: %d", numRecords)
+	}
+	checkStatus(t, tkrzw.StatusSuccess, dbm.Remove("b"))
+	checkStatus(t, tkrzw.StatusNotFoundError, dbm.Remove("b"))
+	checkStatus(t, tkrzw.StatusSuccess, dbm.RemoveMulti([]string{"a", "c/d"}))
+	if props := dbm.Inspect(); props["num_records"] != "1" {
+		t.Errorf("unexpected properties: %v", props)
+	}
+}
+
+func TestRemoteDBM(t *testing.T) {
+	local := openDBM(t, "BabyDBM")
+	checkDBMInterface(t, local)
+	local.Clear()
+	registry := NewRegistry()
+	registry.Register("test", local)
+	server := httptest.NewServer(NewHandler(registry, nil))
+	remote := NewRemoteDBM(server.URL+"/db/test/", nil)
+	checkDBMInterface(t, remote)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, status := remote.Increment("counter", 1, 0); !status.IsOK() {
+					t.Errorf("increment failed: %v", status)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if num, _ := local.Increment("counter", 0, 0); num != 40 {
+		t.Errorf("unexpected counter: %d", num)
+	}
+	checkStatus(t, tkrzw.StatusSuccess, remote.Close())
+	server.Close()
+	broken := NewRemoteDBM(server.URL+"/db/test", map[string]string{
+		"max_retries": "2", "retry_interval": "0.001", "timeout": "1"})
+	_, status := broken.Get("a")
+	checkStatus(t, tkrzw.StatusNetworkError, status)
+	if props := broken.Inspect(); len(props) != 0 {
+		t.Errorf("unexpected properties: %v", props)
+	}
+	local.Close()
+}
+
+func TestRemoteIncrementNotRetried(t *testing.T) {
+	local := openDBM(t, "BabyDBM")
+	registry := NewRegistry()
+	registry.Register("test", local)
+	handler := NewHandler(registry, nil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	client := &testClient{t, server.URL}
+	client.check(200, `{"value":15}`, "POST", "/db/test?op=increment",
+		`{"key":"a","inc":5,"init":10}`, nil)
+	client.check(200, `{"value":15}`, "POST", "/db/test?op=increment",
+		`{"key":"a","inc":-9223372036854775808}`, nil)
+	client.check(400, "*", "POST", "/db/test?op=increment", `{"key":`, nil)
+	var numRequests int
+	var mutex sync.Mutex
+	lossy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		numRequests++
+		mutex.Unlock()
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+		}
+	}))
+	defer lossy.Close()
+	remote := NewRemoteDBM(lossy.URL+"/db/test", map[string]string{"retry_interval": "0"})
+	_, status := remote.Increment("b", 1, 0)
+	checkStatus(t, tkrzw.StatusNetworkError, status)
+	if numRequests != 1 {
+		t.Errorf("unexpected number of requests: %d", numRequests)
+	}
+	if num, _ := local.Increment("b", 0, 0); num != 1 {
+		t.Errorf("unexpected counter: %d", num)
+	}
+	local.Close()
+}
+
+// END OF FILE
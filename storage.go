@@ -0,0 +1,86 @@
+/*************************************************************************************************
+ * Interface of the whole database manager API
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+// Interface of the record operations of database managers, implemented by DBM and MemoryDBM.
+//
+// Each method has the same semantics as the method of the same name of DBM.  Code depending on this interface instead of DBM can be tested with MemoryDBM, which works without cgo.  Methods about files, such as "Open", "Rebuild", and "Synchronize", and "MakeIterator" are not included.  Use "Each" or "ProcessEach" to scan records.
+type Storage interface {
+	DBMInterface
+	// Processes a record with an arbitrary function.
+	Process(key interface{}, proc RecordProcessor, writable bool) *Status
+	// Checks if a record exists or not.
+	Check(key interface{}) bool
+	// Gets the value of a record of a key, in a simple way.
+	GetSimple(key interface{}, defaultValue interface{}) []byte
+	// Gets the value of a record of a key, in a simple way, as a string.
+	GetStrSimple(key interface{}, defaultValue interface{}) string
+	// Gets the values of multiple records of keys, as strings.
+	GetMultiStr(keys []string) map[string]string
+	// Sets a record and get the old value.
+	SetAndGet(key interface{}, value interface{}, overwrite bool) ([]byte, *Status)
+	// Sets a record and get the old value, as a string.
+	SetAndGetStr(key interface{}, value interface{}, overwrite bool) (*string, *Status)
+	// Sets multiple records, with string data.
+	SetMultiStr(records map[string]string, overwrite bool) *Status
+	// Removes a record and get the value.
+	RemoveAndGet(key interface{}) ([]byte, *Status)
+	// Removes a record and get the value, as a string.
+	RemoveAndGetStr(key interface{}) (*string, *Status)
+	// Appends data at the end of a record of a key.
+	Append(key interface{}, value interface{}, delim interface{}) *Status
+	// Appends data to multiple records.
+	AppendMulti(records map[string][]byte, delim interface{}) *Status
+	// Appends data to multiple records, with string data.
+	AppendMultiStr(records map[string]string, delim interface{}) *Status
+	// Does compare-and-exchange and/or gets the old value of the record.
+	CompareExchangeAndGet(key interface{}, expected interface{}, desired interface{}) ([]byte, *Status)
+	// Does compare-and-exchange and/or gets the old value of the record, as a string.
+	CompareExchangeAndGetStr(key interface{}, expected interface{}, desired interface{}) (string, *Status)
+	// Processes multiple records with arbitrary functions.
+	ProcessMulti(keyProcPairs []KeyProcPair, writable bool) *Status
+	// Compares the values of records and exchanges if the condition meets.
+	CompareExchangeMulti(expected []KeyValuePair, desired []KeyValuePair) *Status
+	// Compares the values of records and exchanges if the condition meets, using string data.
+	CompareExchangeMultiStr(expected []KeyValueStrPair, desired []KeyValueStrPair) *Status
+	// Changes the key of a record.
+	Rekey(oldKey interface{}, newKey interface{}, overwrite bool, copying bool) *Status
+	// Gets the first record and removes it.
+	PopFirst() ([]byte, []byte, *Status)
+	// Gets the first record as strings and removes it.
+	PopFirstStr() (string, string, *Status)
+	// Adds a record with a key of the current timestamp.
+	PushLast(value interface{}, wtime float64) *Status
+	// Processes each and every record in the database with an arbitrary function.
+	ProcessEach(proc RecordProcessor, writable bool) *Status
+	// Gets the number of records, in a simple way.
+	CountSimple() int64
+	// Removes all records.
+	Clear() *Status
+	// Checks whether the database is open.
+	IsOpen() bool
+	// Checks whether the database is writable.
+	IsWritable() bool
+	// Checks whether the database condition is healthy.
+	IsHealthy() bool
+	// Checks whether ordered operations are supported.
+	IsOrdered() bool
+	// Makes a channel to read each records, as strings.
+	EachStr() <-chan KeyValueStrPair
+}
+
+// Checks that DBM implements the interface.
+var _ Storage = (*DBM)(nil)
+
+// END OF FILE
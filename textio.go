@@ -0,0 +1,459 @@
+/*************************************************************************************************
+ * Import and export of records in text formats
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Record in JSON Lines.
+type jsonLineRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Options of text import and export.
+type textOptions struct {
+	escape     string
+	duplicate  string
+	delim      []byte
+	numThreads int
+	batchSize  int
+}
+
+// Parses optional parameters of text import and export.
+func parseTextOptions(params map[string]string, defaultEscape string) (*textOptions, *Status) {
+	opts := &textOptions{
+		escape:     defaultEscape,
+		duplicate:  "overwrite",
+		numThreads: 1,
+		batchSize:  defaultBatchSize,
+	}
+	if expr, ok := params["escape"]; ok {
+		opts.escape = expr
+	}
+	if expr, ok := params["duplicate"]; ok {
+		opts.duplicate = expr
+	}
+	opts.delim = []byte(params["append_delim"])
+	if num := ToInt(params["num_threads"]); num > 0 {
+		opts.numThreads = int(num)
+	}
+	if num := ToInt(params["batch_size"]); num > 0 {
+		opts.batchSize = int(num)
+	}
+	switch opts.escape {
+	case "none", "c", "base64":
+	default:
+		return nil, NewStatus2(StatusInvalidArgumentError, "unknown escape: "+opts.escape)
+	}
+	switch opts.duplicate {
+	case "overwrite", "append", "skip":
+	default:
+		return nil, NewStatus2(StatusInvalidArgumentError, "unknown duplicate: "+opts.duplicate)
+	}
+	return opts, NewStatus1(StatusSuccess)
+}
+
+// Escapes data in the C style.
+//
+// @param data The data to escape.
+// @return The escaped string, where tab, line feed, carriage return, and backslash are represented as "\t", "\n", "\r", and "\\", and other control characters are represented as "\xNN".
+//
+// The result fits in a field of TSV.  Bytes of 0x80 or more are kept as they are.
+func EscapeCStyle(data []byte) string {
+	var buf strings.Builder
+	for _, c := range data {
+		switch c {
+		case '\t':
+			buf.WriteString("\\t")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\\':
+			buf.WriteString("\\\\")
+		default:
+			if c < 0x20 || c == 0x7f {
+				fmt.Fprintf(&buf, "\\x%02x", c)
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	return buf.String()
+}
+
+// Unescapes data escaped in the C style.
+//
+// @param expr The escaped string.
+// @return The original data.
+//
+// A backslash followed by an unknown character is dropped, and "\x" without two hexadecimal digits is kept as it is.
+func UnescapeCStyle(expr string) []byte {
+	data := make([]byte, 0, len(expr))
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		if c != '\\' || i+1 >= len(expr) {
+			data = append(data, c)
+			continue
+		}
+		i++
+		switch expr[i] {
+		case 't':
+			data = append(data, '\t')
+		case 'n':
+			data = append(data, '\n')
+		case 'r':
+			data = append(data, '\r')
+		case 'x':
+			if i+2 < len(expr) {
+				if num, err := strconv.ParseUint(expr[i+1:i+3], 16, 8); err == nil {
+					data = append(data, byte(num))
+					i += 2
+					break
+				}
+			}
+			data = append(data, '\\', 'x')
+		default:
+			data = append(data, expr[i])
+		}
+	}
+	return data
+}
+
+// Encodes a field by the escape mode.
+func (self *textOptions) encode(data []byte) string {
+	switch self.escape {
+	case "c":
+		return EscapeCStyle(data)
+	case "base64":
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return string(data)
+}
+
+// Decodes a field by the escape mode.
+func (self *textOptions) decode(expr string) ([]byte, *Status) {
+	switch self.escape {
+	case "c":
+		return UnescapeCStyle(expr), NewStatus1(StatusSuccess)
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(expr)
+		if err != nil {
+			return nil, NewStatus2(StatusBrokenDataError, err.Error())
+		}
+		return data, NewStatus1(StatusSuccess)
+	}
+	return []byte(expr), NewStatus1(StatusSuccess)
+}
+
+// Exports all records with a function to write each record.
+func (self *DBM) exportText(write func(key []byte, value []byte) error) *Status {
+	if self.dbm == 0 {
+		return NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	iter := self.MakeIterator()
+	defer iter.Destruct()
+	status := iter.First()
+	if !status.IsOK() {
+		return status
+	}
+	for {
+		key, value, status := iter.Step()
+		if status.Equals(StatusNotFoundError) {
+			break
+		}
+		if !status.IsOK() {
+			return status
+		}
+		if err := write(key, value); err != nil {
+			return errorToStatus(err)
+		}
+	}
+	return NewStatus1(StatusSuccess)
+}
+
+// Exports all records to a writer in TSV.
+//
+// @param w The writer to write records in.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The result status.
+//
+// Each line has the key and the value separated by a tab.  The optional parameter "escape" specifies how keys and values are escaped: "c" for C-style escapes of tabs, line feeds, backslashes, and control characters, "base64" for Base64, or "none" for no escaping.  By default, "c" is used.
+func (self *DBM) ExportTSV(w io.Writer, params map[string]string) *Status {
+	opts, status := parseTextOptions(params, "c")
+	if !status.IsOK() {
+		return status
+	}
+	writer := bufio.NewWriter(w)
+	status = self.exportText(func(key []byte, value []byte) error {
+		writer.WriteString(opts.encode(key))
+		writer.WriteByte('\t')
+		writer.WriteString(opts.encode(value))
+		return writer.WriteByte('\n')
+	})
+	if status.IsOK() {
+		status = errorToStatus(writer.Flush())
+	}
+	return status
+}
+
+// Exports all records to a writer in CSV.
+//
+// @param w The writer to write records in.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The result status.
+//
+// Each line has the key and the value as two fields quoted as defined in RFC 4180.  The optional parameter "escape" is the same as the ExportTSV method.  By default, "none" is used because quoting can represent any text.
+func (self *DBM) ExportCSV(w io.Writer, params map[string]string) *Status {
+	opts, status := parseTextOptions(params, "none")
+	if !status.IsOK() {
+		return status
+	}
+	writer := csv.NewWriter(w)
+	status = self.exportText(func(key []byte, value []byte) error {
+		return writer.Write([]string{opts.encode(key), opts.encode(value)})
+	})
+	if status.IsOK() {
+		writer.Flush()
+		status = errorToStatus(writer.Error())
+	}
+	return status
+}
+
+// Exports all records to a writer in JSON Lines.
+//
+// @param w The writer to write records in.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The result status.
+//
+// Each line is a JSON object which has the "key" and "value" properties.  The optional parameter "escape" is the same as the ExportTSV method.  By default, "none" is used.  As JSON strings cannot represent data which is not valid UTF-8, such a key or value with "none" makes the method fail with StatusInvalidArgumentError, in which case "c" or "base64" should be specified.
+func (self *DBM) ExportJSONL(w io.Writer, params map[string]string) *Status {
+	opts, status := parseTextOptions(params, "none")
+	if !status.IsOK() {
+		return status
+	}
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	status = self.exportText(func(key []byte, value []byte) error {
+		if opts.escape == "none" && !(utf8.Valid(key) && utf8.Valid(value)) {
+			return NewStatus2(StatusInvalidArgumentError, "not valid UTF-8: "+EscapeCStyle(key))
+		}
+		return encoder.Encode(jsonLineRecord{opts.encode(key), opts.encode(value)})
+	})
+	if status.IsOK() {
+		status = errorToStatus(writer.Flush())
+	}
+	return status
+}
+
+// Stores a batch of records by the duplication mode.
+func (self *DBM) storeTextBatch(batch map[string][]byte, opts *textOptions) *Status {
+	switch opts.duplicate {
+	case "append":
+		return self.AppendMulti(batch, opts.delim)
+	case "skip":
+		status := self.SetMulti(batch, false)
+		if status.Equals(StatusDuplicationError) {
+			return NewStatus1(StatusSuccess)
+		}
+		return status
+	}
+	return self.SetMulti(batch, true)
+}
+
+// Imports records with a function to read each record.
+//
+// Records are distributed to workers by the hash value of the key so that records of the same key are stored in the input order.
+func (self *DBM) importText(opts *textOptions, read func() ([]byte, []byte, *Status)) *Status {
+	if self.dbm == 0 {
+		return NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	channels := make([]chan map[string][]byte, opts.numThreads)
+	statuses := make([]*Status, opts.numThreads)
+	var wg sync.WaitGroup
+	for i := range channels {
+		channels[i] = make(chan map[string][]byte, 2)
+		statuses[i] = NewStatus1(StatusSuccess)
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for batch := range channels[id] {
+				if statuses[id].IsOK() {
+					statuses[id] = self.storeTextBatch(batch, opts)
+				}
+			}
+		}(i)
+	}
+	batches := make([]map[string][]byte, opts.numThreads)
+	for i := range batches {
+		batches[i] = make(map[string][]byte)
+	}
+	status := NewStatus1(StatusSuccess)
+	for {
+		key, value, readStatus := read()
+		if readStatus.Equals(StatusNotFoundError) {
+			break
+		}
+		if !readStatus.IsOK() {
+			status = readStatus
+			break
+		}
+		id := int(PrimaryHash(key, uint64(opts.numThreads)))
+		batch := batches[id]
+		if old, ok := batch[string(key)]; ok {
+			switch opts.duplicate {
+			case "skip":
+				continue
+			case "append":
+				value = append(append(append([]byte{}, old...), opts.delim...), value...)
+			}
+		}
+		batch[string(key)] = value
+		if len(batch) >= opts.batchSize {
+			channels[id] <- batch
+			batches[id] = make(map[string][]byte)
+		}
+	}
+	for i, batch := range batches {
+		if len(batch) > 0 && status.IsOK() {
+			channels[i] <- batch
+		}
+		close(channels[i])
+	}
+	wg.Wait()
+	for _, workerStatus := range statuses {
+		status.Join(workerStatus)
+	}
+	return status
+}
+
+// Imports records from a reader in TSV.
+//
+// @param r The reader to read records from.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The result status.
+//
+// The optional parameter "escape" is the same as the ExportTSV method.  The optional parameter "duplicate" specifies how to treat existing records of the same key: "overwrite" to overwrite the existing value, "append" to append the value to the existing value, or "skip" to keep the existing value.  By default, "overwrite" is used.  The optional parameter "append_delim" specifies the delimiter for "append".  The optional parameter "num_threads" specifies the number of threads to store records.  The optional parameter "batch_size" specifies the number of records stored by each call of SetMulti or AppendMulti.  Lines without a tab are treated as keys with empty values.
+func (self *DBM) ImportTSV(r io.Reader, params map[string]string) *Status {
+	opts, status := parseTextOptions(params, "c")
+	if !status.IsOK() {
+		return status
+	}
+	reader := bufio.NewReader(r)
+	return self.importText(opts, func() ([]byte, []byte, *Status) {
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				return nil, nil, errorToStatus(err)
+			}
+			line = bytes.TrimRight(line, "\r\n")
+			if len(line) == 0 {
+				if err == io.EOF {
+					return nil, nil, NewStatus1(StatusNotFoundError)
+				}
+				continue
+			}
+			fields := strings.SplitN(string(line), "\t", 2)
+			key, status := opts.decode(fields[0])
+			if !status.IsOK() {
+				return nil, nil, status
+			}
+			value := []byte{}
+			if len(fields) > 1 {
+				value, status = opts.decode(fields[1])
+			}
+			return key, value, status
+		}
+	})
+}
+
+// Imports records from a reader in CSV.
+//
+// @param r The reader to read records from.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The result status.
+//
+// The optional parameters are the same as the ImportTSV method, except that "escape" is "none" by default.  The first field is the key and the second field is the value.  Other fields are ignored.
+func (self *DBM) ImportCSV(r io.Reader, params map[string]string) *Status {
+	opts, status := parseTextOptions(params, "none")
+	if !status.IsOK() {
+		return status
+	}
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	return self.importText(opts, func() ([]byte, []byte, *Status) {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return nil, nil, NewStatus1(StatusNotFoundError)
+		}
+		if err != nil {
+			return nil, nil, NewStatus2(StatusBrokenDataError, err.Error())
+		}
+		key, status := opts.decode(fields[0])
+		if !status.IsOK() {
+			return nil, nil, status
+		}
+		value := []byte{}
+		if len(fields) > 1 {
+			value, status = opts.decode(fields[1])
+		}
+		return key, value, status
+	})
+}
+
+// Imports records from a reader in JSON Lines.
+//
+// @param r The reader to read records from.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @return The result status.
+//
+// The optional parameters are the same as the ImportTSV method, except that "escape" is "none" by default.  Each line must be a JSON object which has the "key" and "value" properties.
+func (self *DBM) ImportJSONL(r io.Reader, params map[string]string) *Status {
+	opts, status := parseTextOptions(params, "none")
+	if !status.IsOK() {
+		return status
+	}
+	decoder := json.NewDecoder(r)
+	return self.importText(opts, func() ([]byte, []byte, *Status) {
+		var record jsonLineRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil, nil, NewStatus1(StatusNotFoundError)
+		}
+		if err != nil {
+			return nil, nil, NewStatus2(StatusBrokenDataError, err.Error())
+		}
+		key, status := opts.decode(record.Key)
+		if !status.IsOK() {
+			return nil, nil, status
+		}
+		value, status := opts.decode(record.Value)
+		return key, value, status
+	})
+}
+
+// END OF FILE
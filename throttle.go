@@ -0,0 +1,333 @@
+/*************************************************************************************************
+ * Throttled copy and export
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"bytes"
+	"context"
+	"github.com/estraier/tkrzw-go/flatrec"
+	"io"
+	"os"
+	"time"
+)
+
+// The size of each chunk to copy file data.
+const throttleChunkSize = 1 << 20
+
+// The size of the buffer to write flat records.
+const throttleBufferSize = 1 << 16
+
+// Limiter of the amount of data per second.
+type rateLimiter struct {
+	rate      float64
+	amount    float64
+	startTime time.Time
+}
+
+// Waits until the given amount of data can be processed under the rate limit.
+func (self *rateLimiter) wait(ctx context.Context, amount float64) *Status {
+	if self.rate <= 0 {
+		return NewStatus1(StatusSuccess)
+	}
+	if self.startTime.IsZero() {
+		self.startTime = time.Now()
+	}
+	self.amount += amount
+	ahead := time.Duration(self.amount/self.rate*float64(time.Second)) - time.Since(self.startTime)
+	if ahead <= 0 {
+		return NewStatus1(StatusSuccess)
+	}
+	if ctx == nil {
+		time.Sleep(ahead)
+		return NewStatus1(StatusSuccess)
+	}
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return NewStatus2(StatusCanceledError, ctx.Err().Error())
+	case <-timer.C:
+	}
+	return NewStatus1(StatusSuccess)
+}
+
+// Throttle of records and bytes, with progress reporting.
+type throttle struct {
+	ctx     context.Context
+	bytes   rateLimiter
+	records rateLimiter
+	tracker *progressTracker
+}
+
+// Makes a throttle from optional parameters.
+func newThrottle(ctx context.Context, params map[string]string, progress ProgressFunc) *throttle {
+	interval := 1.0
+	if expr, ok := params["progress_interval"]; ok {
+		interval = ToFloat(expr)
+	}
+	return &throttle{
+		ctx:     ctx,
+		bytes:   rateLimiter{rate: ToFloat(params["bytes_per_sec"])},
+		records: rateLimiter{rate: ToFloat(params["records_per_sec"])},
+		tracker: newProgressTracker(progress, interval),
+	}
+}
+
+// Checks cancellation and waits until the given amount of data can be processed.
+func (self *throttle) wait(numRecords int64, numBytes int64) *Status {
+	if self.ctx != nil {
+		select {
+		case <-self.ctx.Done():
+			return NewStatus2(StatusCanceledError, self.ctx.Err().Error())
+		default:
+		}
+	}
+	status := self.records.wait(self.ctx, float64(numRecords))
+	if !status.IsOK() {
+		return status
+	}
+	return self.bytes.wait(self.ctx, float64(numBytes))
+}
+
+// Copies the content of the database file to another file, with throttling.
+//
+// @param ctx The context to cancel the operation.  If it is nil, the operation is not cancellable.
+// @param destPath A path to the destination file.
+// @param syncHard True to do physical synchronization with the hardware.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @param progress The function to receive the progress.  If it is nil, it is ignored.
+// @return The result status.  If the operation is canceled, StatusCanceledError is returned.
+//
+// The optional parameter "bytes_per_sec" limits the number of bytes copied per second.  The optional parameter "progress_interval" specifies the interval in seconds to call the progress function.  By default, it is 1.0.  The data is written into a temporary file which is renamed to the destination path only on success.  Thus, the destination is not touched if the operation is canceled or fails.
+//
+// Unlike CopyFileData, the database is not locked during the copy so that foreground updates are not blocked.  As updates done concurrently can make the copy inconsistent, the copy is verified by VerifyDatabase before it is renamed.  If the copy has a broken region or the number of scanned records differs from the metadata, the copy is removed and StatusBrokenDataError is returned.  Then, retry the operation or use CopyFileData.  The optional parameter "cipher_key" is used to open the copy for verification.
+func (self *DBM) CopyFileDataThrottled(ctx context.Context, destPath string, syncHard bool,
+	params map[string]string, progress ProgressFunc) *Status {
+	if self.dbm == 0 {
+		return NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	status := self.Synchronize(false, nil)
+	if !status.IsOK() {
+		return status
+	}
+	className := self.Inspect()["class"]
+	srcPath, status := self.GetFilePath()
+	if !status.IsOK() {
+		return status
+	}
+	fileSize, status := self.GetFileSize()
+	if !status.IsOK() {
+		return status
+	}
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return errorToStatus(err)
+	}
+	defer srcFile.Close()
+	tmpPath := destPath + ".tmp.copy"
+	destFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errorToStatus(err)
+	}
+	thr := newThrottle(ctx, params, progress)
+	thr.tracker.progress.EstimatedBytes = fileSize
+	buf := make([]byte, throttleChunkSize)
+	for offset := int64(0); offset < fileSize && status.IsOK(); {
+		size := fileSize - offset
+		if size > int64(len(buf)) {
+			size = int64(len(buf))
+		}
+		status = thr.wait(0, size)
+		if !status.IsOK() {
+			break
+		}
+		if _, err := srcFile.ReadAt(buf[:size], offset); err != nil && err != io.EOF {
+			status = errorToStatus(err)
+			break
+		}
+		if _, err := destFile.Write(buf[:size]); err != nil {
+			status = errorToStatus(err)
+			break
+		}
+		thr.tracker.add(0, size)
+		offset += size
+	}
+	if status.IsOK() && syncHard {
+		status = errorToStatus(destFile.Sync())
+	}
+	status.Join(errorToStatus(destFile.Close()))
+	if status.IsOK() {
+		status = verifyCopy(tmpPath, className, params["cipher_key"])
+	}
+	if status.IsOK() {
+		status = errorToStatus(os.Rename(tmpPath, destPath))
+	}
+	if !status.IsOK() {
+		os.Remove(tmpPath)
+		return status
+	}
+	thr.tracker.finish()
+	return status
+}
+
+// Verifies a copy of a database file.
+func verifyCopy(path string, className string, cipherKey string) *Status {
+	params := map[string]string{"dbm": className}
+	if cipherKey != "" {
+		params["cipher_key"] = cipherKey
+	}
+	report, status := VerifyDatabase(path, params)
+	if !status.IsOK() {
+		return NewStatus2(StatusBrokenDataError, "inconsistent copy: "+status.String())
+	}
+	if len(report.BrokenRegions) > 0 || report.NumScanned != report.NumRecords {
+		return NewStatus2(StatusBrokenDataError, "inconsistent copy: "+report.String())
+	}
+	return NewStatus1(StatusSuccess)
+}
+
+// Exports all records to another database, with throttling.
+//
+// @param ctx The context to cancel the operation.  If it is nil, the operation is not cancellable.
+// @param destDBM The destination database.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @param progress The function to receive the progress.  If it is nil, it is ignored.
+// @return The result status.  If the operation is canceled, StatusCanceledError is returned.
+//
+// The optional parameter "records_per_sec" limits the number of records exported per second.  The optional parameter "bytes_per_sec" limits the total size of keys and values exported per second.  The optional parameter "progress_interval" specifies the interval in seconds to call the progress function.  By default, it is 1.0.  If the operation is canceled or fails, the records written in the destination database are rolled back to the values before the operation.  The previous values are kept in memory until the operation finishes.
+func (self *DBM) ExportThrottled(ctx context.Context, destDBM *DBM,
+	params map[string]string, progress ProgressFunc) *Status {
+	if self.dbm == 0 || destDBM.dbm == 0 {
+		return NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	thr := newThrottle(ctx, params, progress)
+	thr.tracker.progress.EstimatedRecords = self.CountSimple()
+	undo := make(map[string][]byte)
+	status := self.eachRecordThrottled(thr, func(key []byte, value []byte) *Status {
+		return destDBM.Process(key, func(key []byte, oldValue []byte) interface{} {
+			if _, ok := undo[string(key)]; !ok {
+				if oldValue != nil {
+					oldValue = append([]byte{}, oldValue...)
+				}
+				undo[string(key)] = oldValue
+			}
+			return value
+		}, true)
+	})
+	if !status.IsOK() {
+		status.Join(destDBM.rollbackRecords(undo))
+		return status
+	}
+	thr.tracker.finish()
+	return status
+}
+
+// Restores records to the previous values, removing records which didn't exist.
+func (self *DBM) rollbackRecords(undo map[string][]byte) *Status {
+	status := NewStatus1(StatusSuccess)
+	for key, value := range undo {
+		if value == nil {
+			removeStatus := self.Remove(key)
+			if !removeStatus.Equals(StatusNotFoundError) {
+				status.Join(removeStatus)
+			}
+		} else {
+			status.Join(self.Set(key, value, true))
+		}
+	}
+	return status
+}
+
+// Exports all records of a database to a flat record file, with throttling.
+//
+// @param ctx The context to cancel the operation.  If it is nil, the operation is not cancellable.
+// @param destFile The file object to write records in.
+// @param params Optional parameters.  If it is nil, it is ignored.
+// @param progress The function to receive the progress.  If it is nil, it is ignored.
+// @return The result status.  If the operation is canceled, StatusCanceledError is returned.
+//
+// The optional parameters are the same as the ExportThrottled method.  If the operation is canceled or fails, the file is truncated to the size before the operation.
+func (self *DBM) ExportToFlatRecordsThrottled(ctx context.Context, destFile *File,
+	params map[string]string, progress ProgressFunc) *Status {
+	if self.dbm == 0 {
+		return NewStatus2(StatusPreconditionError, "not opened database")
+	}
+	if destFile.file == 0 {
+		return NewStatus2(StatusPreconditionError, "not opened file")
+	}
+	origSize, status := destFile.GetSize()
+	if !status.IsOK() {
+		return status
+	}
+	thr := newThrottle(ctx, params, progress)
+	thr.tracker.progress.EstimatedRecords = self.CountSimple()
+	var buf bytes.Buffer
+	writer := flatrec.NewFlatRecordWriter(&buf)
+	flush := func() *Status {
+		if buf.Len() == 0 {
+			return NewStatus1(StatusSuccess)
+		}
+		_, status := destFile.Append(buf.Bytes())
+		buf.Reset()
+		return status
+	}
+	status = self.eachRecordThrottled(thr, func(key []byte, value []byte) *Status {
+		writer.WriteKeyValue(key, value)
+		if buf.Len() >= throttleBufferSize {
+			return flush()
+		}
+		return NewStatus1(StatusSuccess)
+	})
+	if status.IsOK() {
+		status = flush()
+	}
+	if !status.IsOK() {
+		destFile.Truncate(origSize)
+		return status
+	}
+	thr.tracker.finish()
+	return status
+}
+
+// Applies a function to each record under a throttle.
+func (self *DBM) eachRecordThrottled(
+	thr *throttle, proc func(key []byte, value []byte) *Status) *Status {
+	iter := self.MakeIterator()
+	defer iter.Destruct()
+	status := iter.First()
+	if !status.IsOK() {
+		return status
+	}
+	for {
+		key, value, status := iter.Step()
+		if status.Equals(StatusNotFoundError) {
+			break
+		}
+		if !status.IsOK() {
+			return status
+		}
+		status = thr.wait(1, int64(len(key)+len(value)))
+		if !status.IsOK() {
+			return status
+		}
+		status = proc(key, value)
+		if !status.IsOK() {
+			return status
+		}
+		thr.tracker.add(1, int64(len(key)+len(value)))
+	}
+	return NewStatus1(StatusSuccess)
+}
+
+// END OF FILE
@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 /*************************************************************************************************
  * Test cases
  *
@@ -14,186 +17,26 @@
 package tkrzw
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math"
 	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
-	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
-func CheckEq(t *testing.T, want interface{}, got interface{}) {
-	_, _, line, _ := runtime.Caller(1)
-	if IsNilData(want) {
-		if !IsNilData(got) {
-			println(got, IsNilData(got), got == nil)
-			t.Errorf("line=%d: not equal: want=%q, got=%q", line, want, got)
-		}
-		return
-	}
-	switch want := want.(type) {
-	case int, uint, int8, uint8, int16, uint16, int32, uint32, int64, uint64:
-		if ToInt(want) != ToInt(got) {
-			t.Errorf("line=%d: not equal: want=%d, got=%d", line, want, got)
-		}
-	case float32, float64, complex64, complex128:
-		if ToFloat(want) != ToFloat(got) {
-			t.Errorf("line=%d: not equal: want=%d, got=%d", line, want, got)
-		}
-	case string:
-		if want != ToString(got) {
-			t.Errorf("line=%d: not equal: want=%s, got=%s", line, want, got)
-		}
-	case []byte:
-		if !reflect.DeepEqual(want, ToByteArray(got)) {
-			t.Errorf("line=%d: not equal: want=%q, got=%q", line, want, got)
-		}
-	case Status:
-		if !want.Equals(got) {
-			t.Errorf("line=%d: not equal: want=%s, got=%s", line, want.String(), got)
-		}
-	case *Status:
-		if !want.Equals(got) {
-			t.Errorf("line=%d: not equal: want=%s, got=%s", line, want.String(), got)
-		}
-	case StatusCode:
-		switch got := got.(type) {
-		case Status:
-			if !got.Equals(want) {
-				t.Errorf("line=%d: not equal: want=%s, got=%s", line, StatusCodeName(want), got.String())
-			}
-		case *Status:
-			if !got.Equals(want) {
-				t.Errorf("line=%d: not equal: want=%s, got=%s", line, StatusCodeName(want), got.String())
-			}
-		case StatusCode:
-			if want != got {
-				t.Errorf("line=%d: not equal: want=%s, got=%s", line,
-					StatusCodeName(want), StatusCodeName(got))
-			}
-		default:
-			t.Errorf("line=%d: not comparable: want=%s, got=%q", line, StatusCodeName(want), got)
-		}
-	default:
-		if want != got {
-			t.Errorf("line=%d: not equal: want=%q, got=%q", line, want, got)
-		}
-	}
-}
-
-func CheckNe(t *testing.T, want interface{}, got interface{}) {
-	_, _, line, _ := runtime.Caller(1)
-	if IsNilData(want) {
-		if IsNilData(got) {
-			t.Errorf("line=%d: equal: want=%q, got=%q", line, want, got)
-		}
-		return
-	}
-	switch want := want.(type) {
-	case int, uint, int8, uint8, int16, uint16, int32, uint32, int64, uint64:
-		if ToInt(want) == ToInt(got) {
-			t.Errorf("line=%d: equal: want=%d, got=%d", line, want, got)
-		}
-	case float32, float64, complex64, complex128:
-		if ToFloat(want) == ToFloat(got) {
-			t.Errorf("line=%d: equal: want=%d, got=%d", line, want, got)
-		}
-	case string:
-		if want == ToString(got) {
-			t.Errorf("line=%d: equal: want=%s, got=%s", line, want, got)
-		}
-	case []byte:
-		if reflect.DeepEqual(want, ToByteArray(got)) {
-			t.Errorf("line=%d: equal: want=%q, got=%q", line, want, got)
-		}
-	case Status:
-		if want.Equals(got) {
-			t.Errorf("line=%d: equal: want=%s, got=%s", line, want.String(), got)
-		}
-	case *Status:
-		if want.Equals(got) {
-			t.Errorf("line=%d: equal: want=%s, got=%s", line, want.String(), got)
-		}
-	case StatusCode:
-		switch got := got.(type) {
-		case Status:
-			if got.Equals(want) {
-				t.Errorf("line=%d: equal: want=%s, got=%s", line, StatusCodeName(want), got.String())
-			}
-		case *Status:
-			if got.Equals(want) {
-				t.Errorf("line=%d: equal: want=%s, got=%s", line, StatusCodeName(want), got.String())
-			}
-		case StatusCode:
-			if want == got {
-				t.Errorf("line=%d: equal: want=%s, got=%s",
-					line, StatusCodeName(want), StatusCodeName(got))
-			}
-		default:
-			t.Errorf("line=%d: not comparable: want=%s, got=%q", line, StatusCodeName(want), got)
-		}
-	default:
-		if want == got {
-			t.Errorf("line=%d: equal: want=%q, got=%q", line, want, got)
-		}
-	}
-}
-
-func CheckTrue(t *testing.T, got bool) {
-	_, _, line, _ := runtime.Caller(1)
-	if !got {
-		t.Errorf("line=%d: not true", line)
-	}
-}
-
-func CheckFalse(t *testing.T, got bool) {
-	_, _, line, _ := runtime.Caller(1)
-	if got {
-		t.Errorf("line=%d: true", line)
-	}
-}
-
-func MakeTempDir() string {
-	tmpPath := path.Join(os.TempDir(), fmt.Sprintf(
-		"tkrzw-test-%04x%08x", os.Getpid()%(1<<16), time.Now().Unix()%(1<<32)))
-	error := os.MkdirAll(tmpPath, 0755)
-	if error != nil {
-		panic(fmt.Sprintf("cannot create directory: %s", error))
-	}
-	return tmpPath
-}
-
-func TestAssertion(t *testing.T) {
-	CheckEq(t, nil, nil)
-	CheckEq(t, interface{}(nil), interface{}(nil))
-	CheckNe(t, nil, 0)
-	CheckEq(t, 2, 2)
-	CheckEq(t, 2.0, 2.0)
-	CheckEq(t, "two", "two")
-	CheckEq(t, []byte("two"), []byte("two"))
-	CheckEq(t, nil, nil)
-	CheckEq(t, 2, 2.0)
-	CheckEq(t, 2, "2")
-	CheckEq(t, 2.0, 2)
-	CheckEq(t, 2.0, "2")
-	CheckEq(t, "2", 2)
-	CheckEq(t, []byte("2"), 2)
-	CheckNe(t, 2, 3)
-	CheckNe(t, 2.0, 3.0)
-	CheckNe(t, "two", "three")
-	CheckNe(t, []byte("two"), []byte("three"))
-	CheckNe(t, nil, 0)
-	CheckTrue(t, true)
-	CheckTrue(t, 1 > 0)
-	CheckFalse(t, false)
-	CheckFalse(t, 1 < 0)
-}
-
 type Person struct {
 	Name string
 }
@@ -732,6 +575,50 @@ func TestDBMProcess(t *testing.T) {
 	CheckEq(t, StatusSuccess, dbm.Close())
 }
 
+func TestDBMView(t *testing.T) {
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(
+		path.Join(tmpDir, "casket.tkh"), true, ParseParams("truncate=true")))
+	largeValue := strings.Repeat("0123456789", 100000)
+	CheckEq(t, StatusSuccess, dbm.Set("large", largeValue, true))
+	CheckEq(t, StatusSuccess, dbm.Set("small", "abc", true))
+	CheckEq(t, StatusSuccess, dbm.Set("empty", "", true))
+	buf := make([]byte, 0, 16)
+	value, status := dbm.GetInto("small", buf)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "abc", value)
+	CheckTrue(t, &value[0] == &buf[:1][0])
+	value, status = dbm.GetInto("large", buf)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, largeValue, value)
+	value, status = dbm.GetInto("empty", value)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 0, len(value))
+	value, status = dbm.GetInto("missing", buf)
+	CheckEq(t, StatusNotFoundError, status)
+	CheckEq(t, 0, len(value))
+	var viewed int
+	var head string
+	CheckEq(t, StatusSuccess, dbm.View("large", func(value []byte) {
+		viewed = len(value)
+		head = string(value[:10])
+	}))
+	CheckEq(t, len(largeValue), viewed)
+	CheckEq(t, "0123456789", head)
+	called := false
+	CheckEq(t, StatusNotFoundError, dbm.View("missing", func(value []byte) {
+		called = true
+	}))
+	CheckFalse(t, called)
+	CheckEq(t, StatusSuccess, dbm.View("empty", func(value []byte) {
+		called = len(value) == 0
+	}))
+	CheckTrue(t, called)
+	CheckEq(t, StatusSuccess, dbm.Close())
+}
+
 func TestDBMIterator(t *testing.T) {
 	tmpDir := MakeTempDir()
 	defer os.RemoveAll(tmpDir)
@@ -943,6 +830,428 @@ func TestDBMExport(t *testing.T) {
 	CheckEq(t, StatusSuccess, dbm.Close())
 }
 
+func TestDBMTextIO(t *testing.T) {
+	CheckEq(t, "a\\tb\\nc\\\\\\x00\\x7f\xff", EscapeCStyle([]byte("a\tb\nc\\\x00\x7f\xff")))
+	CheckEq(t, "a\tb\nc\\\x00\x7f\xff", UnescapeCStyle("a\\tb\\nc\\\\\\x00\\x7f\xff"))
+	CheckEq(t, "\\xz\\q", UnescapeCStyle("\\xz\\\\q"))
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(
+		path.Join(tmpDir, "casket.tkt"), true, ParseParams("truncate=true")))
+	CheckEq(t, StatusSuccess, dbm.Set("one", "first\tline", true))
+	CheckEq(t, StatusSuccess, dbm.Set("two", "second\nline", true))
+	CheckEq(t, StatusSuccess, dbm.Set("three\x00", "\xff\xfe", true))
+	var buf bytes.Buffer
+	CheckEq(t, StatusSuccess, dbm.ExportTSV(&buf, nil))
+	CheckEq(t, "one\tfirst\\tline\nthree\\x00\t\xff\xfe\ntwo\tsecond\\nline\n", buf.String())
+	copyDBM := NewDBM()
+	CheckEq(t, StatusSuccess, copyDBM.Open(
+		path.Join(tmpDir, "casket-copy.tkh"), true, ParseParams("truncate=true")))
+	CheckEq(t, StatusSuccess, copyDBM.ImportTSV(&buf, nil))
+	CheckEq(t, 3, copyDBM.CountSimple())
+	CheckEq(t, "first\tline", copyDBM.GetSimple("one", "*"))
+	CheckEq(t, "\xff\xfe", copyDBM.GetSimple("three\x00", "*"))
+	buf.Reset()
+	CheckEq(t, StatusSuccess, dbm.ExportCSV(&buf, nil))
+	CheckEq(t, "one,first\tline\n", buf.String()[:15])
+	CheckEq(t, StatusSuccess, copyDBM.Clear())
+	CheckEq(t, StatusSuccess, copyDBM.ImportCSV(&buf, nil))
+	CheckEq(t, 3, copyDBM.CountSimple())
+	CheckEq(t, "second\nline", copyDBM.GetSimple("two", "*"))
+	buf.Reset()
+	CheckEq(t, StatusSuccess, dbm.ExportJSONL(&buf, ParseParams("escape=base64")))
+	CheckEq(t, `{"key":"b25l","value":"Zmlyc3QJbGluZQ=="}`+"\n", buf.String()[:42])
+	jsonl := buf.String()
+	CheckEq(t, StatusSuccess, copyDBM.Clear())
+	CheckEq(t, StatusSuccess, copyDBM.ImportJSONL(
+		strings.NewReader(jsonl), ParseParams("escape=base64,num_threads=4,batch_size=1")))
+	CheckEq(t, 3, copyDBM.CountSimple())
+	CheckEq(t, "\xff\xfe", copyDBM.GetSimple("three\x00", "*"))
+	buf.Reset()
+	CheckEq(t, StatusInvalidArgumentError, dbm.ExportJSONL(&buf, nil))
+	buf.Reset()
+	CheckEq(t, StatusSuccess, dbm.ExportJSONL(&buf, ParseParams("escape=c")))
+	CheckEq(t, StatusSuccess, copyDBM.Clear())
+	CheckEq(t, StatusSuccess, copyDBM.ImportJSONL(&buf, ParseParams("escape=c")))
+	CheckEq(t, 3, copyDBM.CountSimple())
+	CheckEq(t, "\xff\xfe", copyDBM.GetSimple("three\x00", "*"))
+	CheckEq(t, "second\nline", copyDBM.GetSimple("two", "*"))
+	input := "one\tfirst\none\tsecond\ntwo\tthird\n"
+	CheckEq(t, StatusSuccess, copyDBM.ImportTSV(
+		strings.NewReader(input), ParseParams("duplicate=skip")))
+	CheckEq(t, "first\tline", copyDBM.GetSimple("one", "*"))
+	CheckEq(t, "second\nline", copyDBM.GetSimple("two", "*"))
+	CheckEq(t, StatusSuccess, copyDBM.ImportTSV(
+		strings.NewReader(input), ParseParams("duplicate=append,append_delim=:")))
+	CheckEq(t, "first\tline:first:second", copyDBM.GetSimple("one", "*"))
+	CheckEq(t, "second\nline:third", copyDBM.GetSimple("two", "*"))
+	CheckEq(t, StatusSuccess, copyDBM.ImportTSV(strings.NewReader(input), nil))
+	CheckEq(t, "second", copyDBM.GetSimple("one", "*"))
+	CheckEq(t, StatusInvalidArgumentError, copyDBM.ImportTSV(
+		strings.NewReader(input), ParseParams("escape=rot13")))
+	CheckEq(t, StatusBrokenDataError, copyDBM.ImportJSONL(strings.NewReader("{"), nil))
+	CheckEq(t, StatusSuccess, copyDBM.Close())
+	CheckEq(t, StatusSuccess, dbm.Close())
+}
+
+func TestBulkLoader(t *testing.T) {
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(
+		path.Join(tmpDir, "casket.tkh"), true, ParseParams("truncate=true,num_buckets=100")))
+	loader := NewBulkLoader(dbm, ParseParams("num_workers=4,batch_size=7"))
+	for i := 1; i <= 100; i++ {
+		CheckEq(t, StatusSuccess, loader.Add(fmt.Sprintf("%08d", i), "old"))
+		CheckEq(t, StatusSuccess, loader.Add(fmt.Sprintf("%08d", i), fmt.Sprintf("%d", i)))
+	}
+	stats, status := loader.Finish()
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 200, stats.NumRecords)
+	CheckEq(t, 0, stats.NumSpills)
+	CheckTrue(t, stats.RecordsPerSec() > 0)
+	CheckEq(t, 100, dbm.CountSimple())
+	CheckEq(t, "50", dbm.GetSimple("00000050", "*"))
+	CheckEq(t, StatusPreconditionError, loader.Add("foo", "bar"))
+	CheckEq(t, StatusSuccess, dbm.Close())
+	CheckEq(t, StatusSuccess, dbm.Open(path.Join(tmpDir, "casket.tks"), true,
+		ParseParams("truncate=true,insert_in_order=true")))
+	loader = NewBulkLoader(dbm, ParseParams("insert_in_order=true,batch_size=10,"+
+		"sort_buffer_size=100,tmp_dir="+tmpDir))
+	for i := 100; i >= 1; i-- {
+		CheckEq(t, StatusSuccess, loader.Add(fmt.Sprintf("%08d", i), fmt.Sprintf("%d", i)))
+	}
+	CheckEq(t, StatusSuccess, loader.Add("00000050", "fifty"))
+	stats, status = loader.Finish()
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 101, stats.NumRecords)
+	CheckTrue(t, stats.NumSpills > 1)
+	CheckEq(t, 100, dbm.CountSimple())
+	CheckEq(t, "fifty", dbm.GetSimple("00000050", "*"))
+	keys := dbm.Search("begin", "", 2)
+	CheckEq(t, 2, len(keys))
+	CheckEq(t, "00000001", keys[0])
+	CheckEq(t, "00000002", keys[1])
+	files, _ := filepath.Glob(path.Join(tmpDir, "tkrzw-bulk-*"))
+	CheckEq(t, 0, len(files))
+	CheckEq(t, StatusSuccess, dbm.Close())
+	CheckEq(t, StatusSuccess, dbm.Open(path.Join(tmpDir, "casket.tks"), true,
+		ParseParams("truncate=true,insert_in_order=true")))
+	loader = NewBulkLoader(dbm, ParseParams("insert_in_order=true,sorted_input=true,batch_size=16"))
+	for i := 1; i <= 100; i++ {
+		CheckEq(t, StatusSuccess, loader.Add(fmt.Sprintf("%08d", i), fmt.Sprintf("%d", i)))
+	}
+	_, status = loader.Finish()
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 100, dbm.CountSimple())
+	iter := dbm.MakeIterator()
+	CheckEq(t, StatusSuccess, iter.First())
+	for i := 1; i <= 100; i++ {
+		key, value, status := iter.Step()
+		CheckEq(t, StatusSuccess, status)
+		CheckEq(t, fmt.Sprintf("%08d", i), key)
+		CheckEq(t, fmt.Sprintf("%d", i), value)
+		CheckEq(t, fmt.Sprintf("%d", i), dbm.GetSimple(key, "*"))
+	}
+	iter.Destruct()
+	CheckEq(t, StatusSuccess, dbm.Close())
+	CheckEq(t, StatusSuccess, dbm.Open(path.Join(tmpDir, "casket.tks"), true,
+		ParseParams("truncate=true,insert_in_order=true")))
+	loader = NewBulkLoader(dbm, ParseParams("insert_in_order=true,sorted_input=true"))
+	CheckEq(t, StatusSuccess, loader.Add("b", "2"))
+	CheckEq(t, StatusInvalidArgumentError, loader.Add("a", "1"))
+	_, status = loader.Finish()
+	CheckEq(t, StatusInvalidArgumentError, status)
+	CheckEq(t, StatusSuccess, dbm.Close())
+}
+
+func TestDBMBackup(t *testing.T) {
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	filePath := path.Join(tmpDir, "casket.tkt")
+	restoredPath := path.Join(tmpDir, "casket-restored.tkt")
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(filePath, true, ParseParams("truncate=true")))
+	for i := 1; i <= 100; i++ {
+		CheckEq(t, StatusSuccess, dbm.Set(fmt.Sprintf("%08d", i), fmt.Sprintf("%d", i*i), false))
+	}
+	CheckEq(t, StatusSuccess, dbm.Set("", "\x00\xFF", false))
+	for _, compress := range []string{"none", "gzip", "zlib"} {
+		var archive bytes.Buffer
+		CheckEq(t, StatusSuccess, dbm.BackupTo(&archive, ParseParams("compress="+compress)))
+		CheckEq(t, StatusSuccess, RestoreFrom(&archive, restoredPath, nil))
+		restoredDBM := NewDBM()
+		CheckEq(t, StatusSuccess, restoredDBM.Open(restoredPath, false, nil))
+		CheckEq(t, 101, restoredDBM.CountSimple())
+		CheckEq(t, "TreeDBM", restoredDBM.Inspect()["class"])
+		CheckEq(t, "2500", restoredDBM.GetSimple("00000050", "*"))
+		CheckEq(t, "\x00\xFF", restoredDBM.GetSimple("", "*"))
+		CheckEq(t, StatusSuccess, restoredDBM.Close())
+	}
+	CheckEq(t, StatusInvalidArgumentError, dbm.BackupTo(&bytes.Buffer{}, ParseParams("compress=foo")))
+	var archive bytes.Buffer
+	CheckEq(t, StatusSuccess, dbm.BackupTo(&archive, nil))
+	broken := archive.Bytes()
+	broken[len(broken)/2] ^= 0x01
+	CheckEq(t, StatusBrokenDataError, RestoreFrom(bytes.NewReader(broken), restoredPath, nil))
+	_, err := os.Stat(restoredPath)
+	CheckTrue(t, os.IsNotExist(err))
+	CheckEq(t, StatusBrokenDataError,
+		RestoreFrom(bytes.NewReader(broken[:len(broken)-3]), restoredPath, nil))
+	CheckEq(t, StatusBrokenDataError, RestoreFrom(bytes.NewReader(nil), restoredPath, nil))
+	hugeHeader := append([]byte{'T', 'K', 'R', 'Z', 'W', 'B', 'A', 'K', 1, 0},
+		append(bytes.Repeat([]byte{0xFF}, 9), 0x7F)...)
+	CheckEq(t, StatusBrokenDataError, RestoreFrom(bytes.NewReader(hugeHeader), restoredPath, nil))
+	CheckEq(t, StatusSuccess, dbm.Close())
+}
+
+func TestDBMIncrementalBackup(t *testing.T) {
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	filePath := path.Join(tmpDir, "casket.tkh")
+	restoredPath := path.Join(tmpDir, "casket-restored.tkh")
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(filePath, true, ParseParams(
+		"truncate=true,update_mode=UPDATE_IN_PLACE")))
+	_, status := dbm.BackupIncrementalTo(&bytes.Buffer{}, 0)
+	CheckEq(t, StatusPreconditionError, status)
+	CheckEq(t, StatusSuccess, dbm.Close())
+	CheckEq(t, StatusSuccess, dbm.Open(filePath, true, ParseParams(
+		"truncate=true,update_mode=UPDATE_APPENDING,num_buckets=1000")))
+	for i := 1; i <= 100; i++ {
+		CheckEq(t, StatusSuccess, dbm.Set(fmt.Sprintf("%08d", i), fmt.Sprintf("%d", i), false))
+	}
+	var fullSegment bytes.Buffer
+	offset, status := dbm.BackupIncrementalTo(&fullSegment, 0)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, dbm.GetFileSizeSimple(), offset)
+	for i := 1; i <= 50; i++ {
+		CheckEq(t, StatusSuccess, dbm.Set(fmt.Sprintf("%08d", i), fmt.Sprintf("%d", i*i), true))
+	}
+	for i := 91; i <= 100; i++ {
+		CheckEq(t, StatusSuccess, dbm.Remove(fmt.Sprintf("%08d", i)))
+	}
+	var incSegment bytes.Buffer
+	newOffset, status := dbm.BackupIncrementalTo(&incSegment, offset)
+	CheckEq(t, StatusSuccess, status)
+	CheckTrue(t, newOffset > offset)
+	CheckTrue(t, incSegment.Len() < fullSegment.Len())
+	CheckEq(t, StatusSuccess, RestoreIncremental([]io.Reader{
+		bytes.NewReader(fullSegment.Bytes()), bytes.NewReader(incSegment.Bytes())},
+		restoredPath, ""))
+	restoredDBM := NewDBM()
+	CheckEq(t, StatusSuccess, restoredDBM.Open(restoredPath, false, nil))
+	CheckEq(t, 90, restoredDBM.CountSimple())
+	CheckEq(t, "2500", restoredDBM.GetSimple("00000050", "*"))
+	CheckEq(t, "51", restoredDBM.GetSimple("00000051", "*"))
+	CheckEq(t, "*", restoredDBM.GetSimple("00000091", "*"))
+	CheckEq(t, StatusSuccess, restoredDBM.Close())
+	CheckTrue(t, os.Remove(restoredPath) == nil)
+	CheckEq(t, StatusBrokenDataError, RestoreIncremental(
+		[]io.Reader{bytes.NewReader(incSegment.Bytes())}, restoredPath, ""))
+	broken := incSegment.Bytes()
+	broken[len(broken)-10] ^= 0x01
+	CheckEq(t, StatusBrokenDataError, RestoreIncremental([]io.Reader{
+		bytes.NewReader(fullSegment.Bytes()), bytes.NewReader(broken)}, restoredPath, ""))
+	CheckEq(t, StatusSuccess, dbm.Rebuild(nil))
+	_, status = dbm.BackupIncrementalTo(&bytes.Buffer{}, newOffset)
+	CheckEq(t, StatusInfeasibleError, status)
+	CheckEq(t, StatusSuccess, dbm.Close())
+}
+
+func TestDBMThrottled(t *testing.T) {
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	filePath := path.Join(tmpDir, "casket.tkh")
+	copyPath := path.Join(tmpDir, "casket-copy.tkh")
+	exportPath := path.Join(tmpDir, "casket-export.tkh")
+	flatPath := path.Join(tmpDir, "casket-flat.dat")
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(filePath, true, ParseParams("truncate=true")))
+	for i := 1; i <= 100; i++ {
+		CheckEq(t, StatusSuccess, dbm.Set(fmt.Sprintf("%08d", i), fmt.Sprintf("%d", i), false))
+	}
+	var lastProgress Progress
+	numCalls := 0
+	recorder := func(progress *Progress) {
+		lastProgress = *progress
+		numCalls++
+	}
+	CheckEq(t, StatusSuccess, dbm.CopyFileDataThrottled(
+		nil, copyPath, false, ParseParams("bytes_per_sec=100000000"), recorder))
+	CheckEq(t, dbm.GetFileSizeSimple(), lastProgress.NumBytes)
+	CheckTrue(t, numCalls > 0)
+	copyDBM := NewDBM()
+	CheckEq(t, StatusSuccess, copyDBM.Open(copyPath, false, nil))
+	CheckEq(t, 100, copyDBM.CountSimple())
+	CheckEq(t, StatusSuccess, copyDBM.Close())
+	exportDBM := NewDBM()
+	CheckEq(t, StatusSuccess, exportDBM.Open(exportPath, true, ParseParams("truncate=true")))
+	startTime := time.Now()
+	CheckEq(t, StatusSuccess, dbm.ExportThrottled(context.Background(), exportDBM,
+		ParseParams("records_per_sec=1000,progress_interval=0"), recorder))
+	CheckTrue(t, time.Since(startTime).Seconds() >= 0.09)
+	CheckEq(t, 100, lastProgress.NumRecords)
+	CheckEq(t, 992, lastProgress.NumBytes)
+	CheckEq(t, 100, exportDBM.CountSimple())
+	CheckEq(t, "50", exportDBM.GetSimple("00000050", "*"))
+	for i := 1; i <= 100; i++ {
+		key := fmt.Sprintf("%08d", i)
+		if i%2 == 0 {
+			CheckEq(t, StatusSuccess, exportDBM.Set(key, "old", true))
+		} else {
+			CheckEq(t, StatusSuccess, exportDBM.Remove(key))
+		}
+	}
+	exportCtx, cancelExport := context.WithCancel(context.Background())
+	canceler := func(progress *Progress) {
+		if progress.NumRecords >= 70 {
+			cancelExport()
+		}
+	}
+	CheckEq(t, StatusCanceledError, dbm.ExportThrottled(exportCtx, exportDBM,
+		ParseParams("progress_interval=0"), canceler))
+	CheckEq(t, 50, exportDBM.CountSimple())
+	for i := 1; i <= 100; i++ {
+		expected := "*"
+		if i%2 == 0 {
+			expected = "old"
+		}
+		CheckEq(t, expected, exportDBM.GetSimple(fmt.Sprintf("%08d", i), "*"))
+	}
+	CheckEq(t, StatusSuccess, exportDBM.Close())
+	flatFile := NewFile()
+	CheckEq(t, StatusSuccess, flatFile.Open(flatPath, true, ParseParams("truncate=true")))
+	CheckEq(t, StatusSuccess, dbm.ExportToFlatRecordsThrottled(nil, flatFile, nil, nil))
+	flatSize, _ := flatFile.GetSize()
+	CheckEq(t, 992+400, flatSize)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	CheckEq(t, StatusCanceledError, dbm.ExportToFlatRecordsThrottled(ctx, flatFile, nil, nil))
+	newFlatSize, _ := flatFile.GetSize()
+	CheckEq(t, flatSize, newFlatSize)
+	CheckEq(t, StatusSuccess, dbm.Clear())
+	CheckEq(t, StatusSuccess, dbm.ImportFromFlatRecords(flatFile))
+	CheckEq(t, 100, dbm.CountSimple())
+	CheckEq(t, StatusSuccess, flatFile.Close())
+	CheckTrue(t, os.Remove(copyPath) == nil)
+	CheckEq(t, StatusCanceledError, dbm.CopyFileDataThrottled(ctx, copyPath, false, nil, nil))
+	_, err := os.Stat(copyPath)
+	CheckTrue(t, os.IsNotExist(err))
+	CheckEq(t, StatusSuccess, dbm.Close())
+}
+
+func TestDBMProgress(t *testing.T) {
+	progress := Progress{NumRecords: 25, NumBytes: 100, EstimatedRecords: 100,
+		EstimatedBytes: -1, Elapsed: 3.0}
+	CheckEq(t, 0.25, progress.Ratio())
+	CheckEq(t, 9.0, progress.RemainingTime())
+	progress.EstimatedBytes = 200
+	CheckEq(t, 0.5, progress.Ratio())
+	CheckEq(t, 3.0, progress.RemainingTime())
+	progress.EstimatedRecords = -1
+	progress.EstimatedBytes = -1
+	CheckEq(t, -1, progress.Ratio())
+	CheckEq(t, -1, progress.RemainingTime())
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	filePath := path.Join(tmpDir, "casket.tkt")
+	flatPath := path.Join(tmpDir, "casket-flat.dat")
+	restoredPath := path.Join(tmpDir, "casket-restored.tkt")
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(filePath, true, ParseParams("truncate=true")))
+	for i := 1; i <= 1000; i++ {
+		CheckEq(t, StatusSuccess, dbm.Set(fmt.Sprintf("%08d", i), fmt.Sprintf("%d", i), false))
+	}
+	var lastProgress Progress
+	recorder := func(progress *Progress) {
+		lastProgress = *progress
+	}
+	CheckEq(t, StatusSuccess, dbm.RebuildWithProgress(nil, 0.01, recorder))
+	CheckEq(t, 1000, lastProgress.NumRecords)
+	CheckEq(t, dbm.GetFileSizeSimple(), lastProgress.NumBytes)
+	CheckEq(t, 1.0, lastProgress.Ratio())
+	flatFile := NewFile()
+	CheckEq(t, StatusSuccess, flatFile.Open(flatPath, true, ParseParams("truncate=true")))
+	CheckEq(t, StatusSuccess, dbm.ExportToFlatRecords(flatFile))
+	CheckEq(t, StatusSuccess, dbm.Clear())
+	CheckEq(t, StatusSuccess, dbm.ImportFromFlatRecordsWithProgress(flatFile, 0, recorder))
+	CheckEq(t, 1000, dbm.CountSimple())
+	CheckEq(t, "500", dbm.GetSimple("00000500", "*"))
+	CheckEq(t, 1000, lastProgress.NumRecords)
+	flatSize, _ := flatFile.GetSize()
+	CheckEq(t, flatSize, lastProgress.NumBytes)
+	CheckEq(t, flatSize, lastProgress.EstimatedBytes)
+	CheckEq(t, StatusSuccess, flatFile.Close())
+	copyDBM := NewDBM()
+	CheckEq(t, StatusSuccess, copyDBM.Open(
+		path.Join(tmpDir, "casket-copy.tkh"), true, ParseParams("truncate=true")))
+	CheckEq(t, StatusSuccess, dbm.ExportWithProgress(copyDBM, 0, recorder))
+	CheckEq(t, 1000, lastProgress.NumRecords)
+	CheckEq(t, 1000, lastProgress.EstimatedRecords)
+	CheckEq(t, 1000, copyDBM.CountSimple())
+	CheckEq(t, StatusSuccess, copyDBM.Close())
+	CheckEq(t, StatusSuccess, dbm.Close())
+	CheckEq(t, StatusSuccess, RestoreDatabaseWithProgress(
+		filePath, restoredPath, "", -1, "", 0.01, recorder))
+	info, err := os.Stat(restoredPath)
+	CheckTrue(t, err == nil)
+	CheckEq(t, info.Size(), lastProgress.NumBytes)
+	CheckEq(t, 1000, lastProgress.NumRecords)
+	CheckEq(t, 1000, lastProgress.EstimatedRecords)
+	CheckEq(t, 1.0, lastProgress.Ratio())
+}
+
+func TestDBMVerify(t *testing.T) {
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	filePath := path.Join(tmpDir, "casket.tkh")
+	repairedPath := path.Join(tmpDir, "casket-repaired.tkh")
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(filePath, true,
+		ParseParams("truncate=true,num_buckets=100,record_crc_mode=crc32")))
+	for i := 1; i <= 100; i++ {
+		CheckEq(t, StatusSuccess, dbm.Set(fmt.Sprintf("%08d", i), fmt.Sprintf("%d", i), false))
+	}
+	CheckEq(t, StatusSuccess, dbm.Close())
+	report, status := VerifyDatabase(filePath, nil)
+	CheckEq(t, StatusSuccess, status)
+	CheckTrue(t, report.IsOK())
+	CheckEq(t, "HashDBM", report.Class)
+	CheckEq(t, "crc32", report.RecordCRCMode)
+	CheckEq(t, 100, report.NumRecords)
+	CheckEq(t, 100, report.NumScanned)
+	CheckEq(t, 0, len(report.BrokenRegions))
+	CheckTrue(t, report.FileSize > 0)
+	repair, status := RepairDatabase(filePath, repairedPath, "", "")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 100, repair.NumExpected)
+	CheckEq(t, 100, repair.NumRecovered)
+	CheckEq(t, 0, repair.NumLost)
+	CheckEq(t, StatusSuccess, dbm.Open(repairedPath, false, nil))
+	CheckEq(t, "50", dbm.GetStrSimple("00000050", "*"))
+	CheckEq(t, StatusSuccess, dbm.Close())
+	_, status = VerifyDatabase(path.Join(tmpDir, "nonexistent.tkh"), nil)
+	CheckFalse(t, status.IsOK())
+	data, err := ioutil.ReadFile(filePath)
+	CheckTrue(t, err == nil)
+	keyOffset := int64(bytes.Index(data, []byte("00000050")))
+	CheckTrue(t, keyOffset > 0)
+	data[keyOffset+8] ^= 0xFF
+	CheckTrue(t, ioutil.WriteFile(filePath, data, 0644) == nil)
+	report, status = VerifyDatabase(filePath, nil)
+	CheckEq(t, StatusSuccess, status)
+	CheckFalse(t, report.IsOK())
+	located := false
+	for _, region := range report.BrokenRegions {
+		if region.Offset > 0 && region.Offset < keyOffset && keyOffset-region.Offset < 32 {
+			located = true
+		}
+	}
+	CheckTrue(t, located)
+}
+
 func TestDBMSearch(t *testing.T) {
 	tmpDir := MakeTempDir()
 	defer os.RemoveAll(tmpDir)
@@ -1175,6 +1484,634 @@ func TestFile(t *testing.T) {
 	file.Destruct()
 }
 
+func TestFileLines(t *testing.T) {
+	CheckTrue(t, containsWord("hello, world", "world"))
+	CheckTrue(t, containsWord("worlds world", "world"))
+	CheckFalse(t, containsWord("hello, worlds", "world"))
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	file := NewFile()
+	CheckEq(t, StatusSuccess, file.Open(
+		path.Join(tmpDir, "casket.txt"), true, ParseParams("truncate=true")))
+	_, status := file.Append("Tokyo is the capital.\nOsaka\n\nKyoto is old")
+	CheckEq(t, StatusSuccess, status)
+	var lines []FileLine
+	for line := range file.Lines(nil) {
+		lines = append(lines, line)
+	}
+	CheckEq(t, 4, len(lines))
+	for _, line := range lines {
+		CheckTrue(t, line.Status == nil)
+	}
+	CheckEq(t, 0, lines[0].Offset)
+	CheckEq(t, "Tokyo is the capital.", lines[0].Line)
+	CheckEq(t, 22, lines[1].Offset)
+	CheckEq(t, "Osaka", lines[1].Line)
+	CheckEq(t, "", lines[2].Line)
+	CheckEq(t, 29, lines[3].Offset)
+	CheckEq(t, "Kyoto is old", lines[3].Line)
+	data, status := file.Read(lines[3].Offset, int64(len(lines[3].Line)))
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "Kyoto is old", data)
+	checkSearch := func(mode string, pattern string, expected []int64) {
+		matches, status := file.SearchStream(nil, mode, pattern)
+		CheckEq(t, StatusSuccess, status)
+		var offsets []int64
+		for match := range matches {
+			offsets = append(offsets, match.Offset)
+		}
+		CheckTrue(t, reflect.DeepEqual(expected, offsets))
+	}
+	checkSearch("contain", " is ", []int64{0, 29})
+	checkSearch("begin", "Osa", []int64{22})
+	checkSearch("end", "old", []int64{29})
+	checkSearch("regex", "^[KO]", []int64{22, 29})
+	checkSearch("containcase", "TOKYO", []int64{0})
+	checkSearch("containword", "capital", []int64{0})
+	checkSearch("containword", "capita", nil)
+	checkSearch("containcaseword", "OSAKA", []int64{22})
+	_, status = file.SearchStream(nil, "edit", "Tokyo")
+	CheckEq(t, StatusInvalidArgumentError, status)
+	_, status = file.SearchStream(nil, "regex", "(")
+	CheckEq(t, StatusInvalidArgumentError, status)
+	CheckEq(t, StatusSuccess, file.Close())
+	_, status = file.SearchStream(nil, "contain", "Tokyo")
+	CheckEq(t, StatusPreconditionError, status)
+	lines = nil
+	for line := range file.Lines(nil) {
+		lines = append(lines, line)
+	}
+	CheckEq(t, 1, len(lines))
+	CheckEq(t, StatusPreconditionError, lines[0].Status)
+	CheckEq(t, StatusSuccess, file.Open(
+		path.Join(tmpDir, "casket.txt"), true, ParseParams("truncate=true")))
+	for i := 0; i < 1000; i++ {
+		_, status = file.Append(fmt.Sprintf("line %d\n", i))
+		CheckEq(t, StatusSuccess, status)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	matches, status := file.SearchStream(ctx, "begin", "line")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "line 0", (<-matches).Line)
+	cancel()
+	stopped := make(chan int)
+	go func() {
+		numRest := 0
+		for range matches {
+			numRest++
+		}
+		stopped <- numRest
+	}()
+	numRest := -1
+	select {
+	case numRest = <-stopped:
+	case <-time.After(10 * time.Second):
+	}
+	CheckTrue(t, numRest >= 0 && numRest < 999)
+	CheckEq(t, StatusSuccess, file.Close())
+}
+
+func TestFileStream(t *testing.T) {
+	var _ io.ReadWriteSeeker = &FileStream{}
+	var _ io.ReaderAt = &FileStream{}
+	var _ io.WriterAt = &FileStream{}
+	var _ io.Closer = &FileStream{}
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	file := NewFile()
+	CheckEq(t, StatusSuccess, file.Open(
+		path.Join(tmpDir, "casket.txt"), true, ParseParams("truncate=true")))
+	stream := NewFileStream(file)
+	n, err := io.Copy(stream, strings.NewReader("abcdefghij"))
+	CheckTrue(t, err == nil)
+	CheckEq(t, 10, n)
+	pos, err := stream.Seek(0, io.SeekCurrent)
+	CheckTrue(t, err == nil)
+	CheckEq(t, 10, pos)
+	buf := make([]byte, 4)
+	readSize, err := stream.Read(buf)
+	CheckEq(t, 0, readSize)
+	CheckTrue(t, err == io.EOF)
+	pos, err = stream.Seek(-3, io.SeekEnd)
+	CheckTrue(t, err == nil)
+	CheckEq(t, 7, pos)
+	readSize, err = stream.Read(buf)
+	CheckTrue(t, err == nil)
+	CheckEq(t, "hij", buf[:readSize])
+	readSize, err = stream.ReadAt(buf, 8)
+	CheckEq(t, 2, readSize)
+	CheckTrue(t, err == io.EOF)
+	readSize, err = stream.ReadAt(buf, 2)
+	CheckTrue(t, err == nil)
+	CheckEq(t, "cdef", buf[:readSize])
+	_, err = stream.Seek(-1, io.SeekStart)
+	CheckFalse(t, err == nil)
+	writeSize, err := stream.WriteAt([]byte("XY"), 12)
+	CheckTrue(t, err == nil)
+	CheckEq(t, 2, writeSize)
+	stream.Seek(0, io.SeekStart)
+	content, err := ioutil.ReadAll(stream)
+	CheckTrue(t, err == nil)
+	CheckEq(t, "abcdefghij\x00\x00XY", content)
+	stream.Seek(0, io.SeekStart)
+	CheckEq(t, StatusSuccess, file.Truncate(0))
+	gzipWriter := gzip.NewWriter(stream)
+	gzipWriter.Write([]byte(strings.Repeat("tokyo", 100)))
+	CheckTrue(t, gzipWriter.Close() == nil)
+	stream.Seek(0, io.SeekStart)
+	gzipReader, err := gzip.NewReader(bufio.NewReader(stream))
+	CheckTrue(t, err == nil)
+	content, err = ioutil.ReadAll(gzipReader)
+	CheckTrue(t, err == nil)
+	CheckEq(t, strings.Repeat("tokyo", 100), content)
+	CheckTrue(t, stream.Close() == nil)
+	CheckFalse(t, stream.Close() == nil)
+}
+
+func TestBlobStore(t *testing.T) {
+	var _ io.WriteCloser = &BlobWriter{}
+	var _ io.ReadSeeker = &BlobReader{}
+	var _ io.ReaderAt = &BlobReader{}
+	var _ io.Closer = &BlobReader{}
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(
+		path.Join(tmpDir, "casket.tkt"), true, ParseParams("truncate=true")))
+	store := NewBlobStore(dbm, ParseParams("prefix=blob:,chunk_size=7"))
+	CheckTrue(t, strings.Index(store.String(), "chunk_size=7") >= 0)
+	content := strings.Repeat("0123456789", 10)
+	writer, status := store.Create("one")
+	CheckEq(t, StatusSuccess, status)
+	n, err := io.Copy(writer, strings.NewReader(content))
+	CheckTrue(t, err == nil)
+	CheckEq(t, 100, n)
+	_, status = store.OpenReader("one")
+	CheckEq(t, StatusNotFoundError, status)
+	CheckTrue(t, writer.Close() == nil)
+	CheckFalse(t, writer.Close() == nil)
+	size, status := store.Size("one")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 100, size)
+	CheckEq(t, 17, dbm.CountSimple())
+	reader, status := store.OpenReader("one")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 100, reader.Size())
+	data, err := ioutil.ReadAll(reader)
+	CheckTrue(t, err == nil)
+	CheckEq(t, content, data)
+	pos, err := reader.Seek(-15, io.SeekEnd)
+	CheckTrue(t, err == nil)
+	CheckEq(t, 85, pos)
+	buf := make([]byte, 10)
+	readSize, err := io.ReadFull(reader, buf)
+	CheckTrue(t, err == nil)
+	CheckEq(t, "5678901234", buf[:readSize])
+	readSize, err = reader.ReadAt(buf, 95)
+	CheckEq(t, 5, readSize)
+	CheckTrue(t, err == io.EOF)
+	CheckEq(t, "56789", buf[:readSize])
+	_, err = reader.Seek(-1, io.SeekStart)
+	CheckFalse(t, err == nil)
+	CheckTrue(t, reader.Close() == nil)
+	writer, status = store.Create("one")
+	CheckEq(t, StatusSuccess, status)
+	writer.Write([]byte("hello"))
+	CheckTrue(t, writer.Close() == nil)
+	CheckEq(t, 3, dbm.CountSimple())
+	reader, status = store.OpenReader("one")
+	CheckEq(t, StatusSuccess, status)
+	data, err = ioutil.ReadAll(reader)
+	CheckTrue(t, err == nil)
+	CheckEq(t, "hello", data)
+	writer, status = store.Create("two")
+	CheckEq(t, StatusSuccess, status)
+	writer.Write([]byte("abcdefghijklmnopqrstuvwxyz"))
+	CheckEq(t, 6, dbm.CountSimple())
+	numRemoved, status := store.CollectGarbage()
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 0, numRemoved)
+	CheckEq(t, StatusSuccess, writer.Abort())
+	CheckEq(t, StatusPreconditionError, writer.Abort())
+	CheckEq(t, 3, dbm.CountSimple())
+	CheckEq(t, StatusSuccess, dbm.Set("blob:Cthree\x0000000000000000630000000000000000", "x", true))
+	CheckEq(t, StatusSuccess, dbm.Set("blob:Cone\x0000000000000000010000000000000000", "y", true))
+	numRemoved, status = store.CollectGarbage()
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, numRemoved)
+	CheckEq(t, 3, dbm.CountSimple())
+	CheckEq(t, StatusSuccess, store.Remove("one"))
+	CheckEq(t, StatusNotFoundError, store.Remove("one"))
+	CheckEq(t, 1, dbm.CountSimple())
+	CheckEq(t, StatusSuccess, dbm.Close())
+}
+
+func TestCAS(t *testing.T) {
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(
+		path.Join(tmpDir, "casket.tkt"), true, ParseParams("truncate=true")))
+	cas := NewCAS(dbm, ParseParams("prefix=cas:"))
+	CheckTrue(t, strings.Index(cas.String(), "cas:") >= 0)
+	appleDigest := "3a7bd3e2360a3d29eea436fcfb7e44c735d117c42d1c1835420b6b9942dd4f1b"
+	CheckEq(t, appleDigest, CASDigest("apple"))
+	digest, status := cas.Put("apple")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, appleDigest, digest)
+	digest, status = cas.Put([]byte("apple"))
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, appleDigest, digest)
+	CheckEq(t, 2, dbm.CountSimple())
+	count, status := cas.RefCount(appleDigest)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, count)
+	data, status := cas.Get(appleDigest)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "apple", data)
+	CheckTrue(t, cas.Contains(appleDigest))
+	_, status = cas.Get("apple")
+	CheckEq(t, StatusInvalidArgumentError, status)
+	bananaDigest := CASDigest("banana")
+	CheckFalse(t, cas.Contains(bananaDigest))
+	_, status = cas.Get(bananaDigest)
+	CheckEq(t, StatusNotFoundError, status)
+	_, status = cas.AddRef(bananaDigest)
+	CheckEq(t, StatusNotFoundError, status)
+	_, status = cas.Release(CASDigest("cherry"))
+	CheckEq(t, StatusNotFoundError, status)
+	count, status = cas.AddRef(appleDigest)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 3, count)
+	for i := 2; i >= 0; i-- {
+		count, status = cas.Release(appleDigest)
+		CheckEq(t, StatusSuccess, status)
+		CheckEq(t, i, count)
+	}
+	_, status = cas.Put("banana")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, StatusSuccess, dbm.Set("cas:O"+bananaDigest, "broken", true))
+	_, status = cas.Get(bananaDigest)
+	CheckEq(t, StatusBrokenDataError, status)
+	cherryDigest := CASDigest("cherry")
+	CheckEq(t, StatusSuccess, dbm.Set("cas:O"+cherryDigest, "cherry", true))
+	numRemoved, status := cas.CollectGarbage()
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, numRemoved)
+	CheckFalse(t, cas.Contains(appleDigest))
+	CheckFalse(t, cas.Contains(cherryDigest))
+	CheckTrue(t, cas.Contains(bananaDigest))
+	CheckEq(t, 2, dbm.CountSimple())
+	durianDigest, status := cas.Put("durian")
+	CheckEq(t, StatusSuccess, status)
+	for i := 0; i < 2; i++ {
+		count, status = cas.Release(durianDigest)
+		CheckEq(t, StatusSuccess, status)
+		CheckEq(t, 0, count)
+	}
+	numRemoved, status = cas.CollectGarbage()
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 1, numRemoved)
+	_, status = cas.Release(durianDigest)
+	CheckEq(t, StatusNotFoundError, status)
+	_, status = cas.RefCount(durianDigest)
+	CheckEq(t, StatusNotFoundError, status)
+	CheckEq(t, 2, dbm.CountSimple())
+	CheckEq(t, StatusSuccess, dbm.Close())
+}
+
+func TestExpiringDBM(t *testing.T) {
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(
+		path.Join(tmpDir, "casket.tkh"), true, ParseParams("truncate=true")))
+	index := NewDBM()
+	CheckEq(t, StatusSuccess, index.Open(
+		path.Join(tmpDir, "expiry.tkt"), true, ParseParams("truncate=true")))
+	expDBM := NewExpiringDBM(dbm, index, ParseParams("sweep_interval=0,sweep_batch=2"))
+	CheckTrue(t, strings.Index(expDBM.String(), "ExpiringDBM") >= 0)
+	CheckEq(t, StatusSuccess, expDBM.Set("one", "hop", false))
+	CheckEq(t, StatusDuplicationError, expDBM.Set("one", "step", false))
+	CheckEq(t, StatusSuccess, expDBM.SetWithTTL("two", "step", 0.05, true))
+	CheckEq(t, StatusSuccess, expDBM.SetWithTTL("three", "jump", 0.05, true))
+	CheckEq(t, StatusSuccess, expDBM.SetWithTTL("four", "fly", 100, true))
+	CheckEq(t, 3, index.CountSimple())
+	value, status := expDBM.GetStr("one")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "hop", value)
+	value, status = expDBM.GetStr("two")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "step", value)
+	ttl, status := expDBM.TTL("one")
+	CheckEq(t, StatusSuccess, status)
+	CheckTrue(t, math.IsInf(ttl, 1))
+	ttl, status = expDBM.TTL("four")
+	CheckEq(t, StatusSuccess, status)
+	CheckTrue(t, ttl > 99 && ttl <= 100)
+	CheckEq(t, StatusSuccess, expDBM.Expire("one", 0.05))
+	CheckEq(t, StatusSuccess, expDBM.Expire("four", 0))
+	CheckEq(t, StatusNotFoundError, expDBM.Expire("five", 10))
+	CheckEq(t, 3, index.CountSimple())
+	time.Sleep(100 * time.Millisecond)
+	_, status = expDBM.Get("one")
+	CheckEq(t, StatusNotFoundError, status)
+	_, status = expDBM.Get("two")
+	CheckEq(t, StatusNotFoundError, status)
+	CheckEq(t, StatusNotFoundError, expDBM.Remove("three"))
+	value, status = expDBM.GetStr("four")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "fly", value)
+	CheckEq(t, 4, dbm.CountSimple())
+	CheckEq(t, StatusSuccess, expDBM.SetWithTTL("three", "dance", 100, false))
+	numRemoved, status := expDBM.Sweep()
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, numRemoved)
+	numRemoved, status = expDBM.Sweep()
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 0, numRemoved)
+	CheckEq(t, 2, dbm.CountSimple())
+	CheckEq(t, 1, index.CountSimple())
+	CheckEq(t, StatusSuccess, expDBM.Remove("three"))
+	CheckEq(t, 0, index.CountSimple())
+	CheckEq(t, StatusSuccess, expDBM.Close())
+	expDBM = NewExpiringDBM(dbm, index, ParseParams("sweep_interval=0.01"))
+	CheckEq(t, StatusSuccess, expDBM.SetWithTTL("five", "sleep", 0.01, true))
+	time.Sleep(100 * time.Millisecond)
+	CheckEq(t, StatusSuccess, expDBM.Close())
+	CheckEq(t, 1, dbm.CountSimple())
+	CheckEq(t, 0, index.CountSimple())
+	CheckEq(t, StatusSuccess, index.Close())
+	CheckEq(t, StatusSuccess, dbm.Close())
+}
+
+func TestQueue(t *testing.T) {
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(
+		path.Join(tmpDir, "casket.tkt"), true, ParseParams("truncate=true")))
+	queue := NewQueue(dbm, ParseParams("prefix=q:,max_attempts=2"))
+	CheckTrue(t, strings.Index(queue.String(), "max_attempts=2") >= 0)
+	_, status := queue.Dequeue(1)
+	CheckEq(t, StatusNotFoundError, status)
+	id, status := queue.Enqueue("one", -1)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 1, id)
+	id, status = queue.Enqueue("two", -1)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, id)
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	id, status = queue.Enqueue("three", now+100)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 3, id)
+	job, status := queue.Dequeue(100)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 1, job.ID)
+	CheckEq(t, "one", job.Body)
+	CheckEq(t, 1, job.Attempts)
+	CheckTrue(t, strings.Index(job.String(), "id=1") >= 0)
+	CheckEq(t, StatusSuccess, queue.Ack(job))
+	CheckEq(t, StatusInfeasibleError, queue.Ack(job))
+	job, status = queue.Dequeue(0.01)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, job.ID)
+	_, status = queue.Dequeue(100)
+	CheckEq(t, StatusNotFoundError, status)
+	time.Sleep(50 * time.Millisecond)
+	staleJob := job
+	job, status = queue.Dequeue(100)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, job.ID)
+	CheckEq(t, "two", job.Body)
+	CheckEq(t, 2, job.Attempts)
+	CheckEq(t, StatusInfeasibleError, queue.Nack(staleJob, 0))
+	CheckEq(t, StatusSuccess, queue.Nack(job, 0))
+	_, status = queue.Dequeue(100)
+	CheckEq(t, StatusNotFoundError, status)
+	deadJobs, status := queue.DeadLetters(-1)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 1, len(deadJobs))
+	CheckEq(t, 2, deadJobs[0].ID)
+	CheckEq(t, "two", deadJobs[0].Body)
+	CheckEq(t, 2, deadJobs[0].Attempts)
+	CheckEq(t, StatusSuccess, queue.Requeue(2))
+	CheckEq(t, StatusNotFoundError, queue.Requeue(2))
+	job, status = queue.Dequeue(100)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, job.ID)
+	CheckEq(t, 1, job.Attempts)
+	CheckEq(t, StatusSuccess, queue.Ack(job))
+	deadJobs, status = queue.DeadLetters(-1)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 0, len(deadJobs))
+	CheckEq(t, 3, dbm.CountSimple())
+	queue = NewQueue(dbm, ParseParams("prefix=mt:"))
+	numJobs := 100
+	for i := 0; i < numJobs; i++ {
+		_, status = queue.Enqueue(ToString(i), -1)
+		CheckEq(t, StatusSuccess, status)
+	}
+	var mutex sync.Mutex
+	seen := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, status := queue.Dequeue(100)
+				if status.Equals(StatusNotFoundError) {
+					return
+				}
+				CheckEq(t, StatusSuccess, status)
+				mutex.Lock()
+				CheckFalse(t, seen[string(job.Body)])
+				seen[string(job.Body)] = true
+				mutex.Unlock()
+				CheckEq(t, StatusSuccess, queue.Ack(job))
+			}
+		}()
+	}
+	wg.Wait()
+	CheckEq(t, numJobs, len(seen))
+	CheckEq(t, StatusSuccess, dbm.Close())
+}
+
+func TestDBMPopFirstWait(t *testing.T) {
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(
+		path.Join(tmpDir, "casket.tkt"), true, ParseParams("truncate=true")))
+	CheckEq(t, StatusSuccess, dbm.PushLast("one", -1))
+	_, value, status := dbm.PopFirstStrWait(nil)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "one", value)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	_, _, status = dbm.PopFirstWait(ctx)
+	cancel()
+	CheckEq(t, StatusCanceledError, status)
+	CheckEq(t, StatusSuccess, dbm.Set("two", "step", true))
+	_, value, status = dbm.PopFirstStrWaitWatching(nil, 0.01)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "step", value)
+	numRecords := 50
+	values := make(chan string, numRecords)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				_, value, status := dbm.PopFirstStrWait(context.Background())
+				if status.Equals(StatusPreconditionError) {
+					return
+				}
+				CheckEq(t, StatusSuccess, status)
+				values <- value
+			}
+		}()
+	}
+	for i := 0; i < numRecords; i++ {
+		CheckEq(t, StatusSuccess, dbm.PushLast(ToString(i), -1))
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < numRecords; i++ {
+		seen[<-values] = true
+	}
+	CheckEq(t, numRecords, len(seen))
+	CheckEq(t, StatusSuccess, dbm.Close())
+	wg.Wait()
+}
+
+func TestCollections(t *testing.T) {
+	tmpDir := MakeTempDir()
+	defer os.RemoveAll(tmpDir)
+	dbm := NewDBM()
+	CheckEq(t, StatusSuccess, dbm.Open(
+		path.Join(tmpDir, "casket.tkt"), true, ParseParams("truncate=true")))
+	colls := NewCollections(dbm, ParseParams("prefix=c:"))
+	CheckTrue(t, strings.Index(colls.String(), "Collections") >= 0)
+	created, status := colls.HSet("user", "name", "john")
+	CheckEq(t, StatusSuccess, status)
+	CheckTrue(t, created)
+	created, status = colls.HSet("user", "age", "23")
+	CheckEq(t, StatusSuccess, status)
+	CheckTrue(t, created)
+	created, status = colls.HSet("user", "name", "paul")
+	CheckEq(t, StatusSuccess, status)
+	CheckFalse(t, created)
+	colls.HSet("users", "name", "george")
+	value, status := colls.HGet("user", "name")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "paul", value)
+	fields, status := colls.HGetAll("user")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, len(fields))
+	CheckEq(t, "age", fields[0].Key)
+	CheckEq(t, "23", fields[0].Value)
+	CheckEq(t, "name", fields[1].Key)
+	CheckEq(t, "paul", fields[1].Value)
+	numRemoved, status := colls.HDel("user", "age", "email")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 1, numRemoved)
+	count, status := colls.HLen("user")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 1, count)
+	numAdded, status := colls.SAdd("tags", "b", "a", "c", "a")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 3, numAdded)
+	CheckTrue(t, colls.SIsMember("tags", "a"))
+	CheckFalse(t, colls.SIsMember("tags", "d"))
+	members, status := colls.SMembers("tags")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, members)
+	numRemoved, status = colls.SRem("tags", "b", "d")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 1, numRemoved)
+	count, status = colls.SCard("tags")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, count)
+	length, status := colls.RPush("list", "c", "d")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, length)
+	length, status = colls.LPush("list", "b", "a")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 4, length)
+	values, status := colls.LRange("list", 0, -1)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}, values)
+	values, status = colls.LRange("list", -3, 1)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, [][]byte{[]byte("b")}, values)
+	values, status = colls.LRange("list", 5, 10)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 0, len(values))
+	value, status = colls.LPop("list")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "a", value)
+	value, status = colls.RPop("list")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, "d", value)
+	colls.LPop("list")
+	colls.LPop("list")
+	_, status = colls.LPop("list")
+	CheckEq(t, StatusNotFoundError, status)
+	length, status = colls.LLen("list")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 0, length)
+	for i, score := range []float64{2.5, -1, 0, 100, -0.5} {
+		created, status = colls.ZAdd("scores", score, ToString(i))
+		CheckEq(t, StatusSuccess, status)
+		CheckTrue(t, created)
+	}
+	created, status = colls.ZAdd("scores", -100, "3")
+	CheckEq(t, StatusSuccess, status)
+	CheckFalse(t, created)
+	score, status := colls.ZScore("scores", "3")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, -100.0, score)
+	scored, status := colls.ZRangeByScore("scores", math.Inf(-1), math.Inf(1), -1)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 5, len(scored))
+	expected := []string{"3", "1", "4", "2", "0"}
+	for i, member := range scored {
+		CheckEq(t, expected[i], member.Member)
+	}
+	CheckEq(t, -100.0, scored[0].Score)
+	CheckEq(t, 2.5, scored[4].Score)
+	scored, status = colls.ZRangeByScore("scores", -1, 0, 2)
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 2, len(scored))
+	CheckEq(t, "1", scored[0].Member)
+	CheckEq(t, "4", scored[1].Member)
+	numRemoved, status = colls.ZRem("scores", "1", "5")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 1, numRemoved)
+	count, status = colls.ZCard("scores")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 4, count)
+	_, status = colls.ZAdd("scores", math.NaN(), "x")
+	CheckEq(t, StatusInvalidArgumentError, status)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, status := colls.RPush("queue", ToString(i*100+j))
+				CheckEq(t, StatusSuccess, status)
+			}
+		}(i)
+	}
+	wg.Wait()
+	length, status = colls.LLen("queue")
+	CheckEq(t, StatusSuccess, status)
+	CheckEq(t, 200, length)
+	CheckEq(t, StatusSuccess, dbm.Close())
+}
+
 func TestIndex(t *testing.T) {
 	tmpDir := MakeTempDir()
 	defer os.RemoveAll(tmpDir)
@@ -13,15 +13,11 @@
 
 package tkrzw
 
-// #include <stdlib.h>
-import "C"
-
 import (
 	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
-	"sync"
 	"unsafe"
 )
 
@@ -393,75 +389,4 @@ func ParseParams(expr string) map[string]string {
 	return params
 }
 
-// Storage to make RecordProcessor accessible to the C code.
-type RecordProcessorPool struct {
-	data  map[unsafe.Pointer]RecordProcessor
-	mutex sync.Mutex
-}
-
-var recordProcessorPools = []RecordProcessorPool{
-	{data: make(map[unsafe.Pointer]RecordProcessor)},
-	{data: make(map[unsafe.Pointer]RecordProcessor)},
-	{data: make(map[unsafe.Pointer]RecordProcessor)},
-}
-
-// Register a Go function to the storage.
-func registerRecordProcessor(proc RecordProcessor) unsafe.Pointer {
-	var up unsafe.Pointer = C.malloc(C.size_t(1))
-	if up == nil {
-		panic("memory allocation failed")
-	}
-	procPool := recordProcessorPools[int(uintptr(up)>>3)%len(recordProcessorPools)]
-	procPool.mutex.Lock()
-	procPool.data[up] = proc
-	procPool.mutex.Unlock()
-	return up
-}
-
-// Deregister a Go function from the storage.
-func deregisterRecordProcessor(up unsafe.Pointer) {
-	procPool := recordProcessorPools[int(uintptr(up)>>3)%len(recordProcessorPools)]
-	procPool.mutex.Lock()
-	delete(procPool.data, up)
-	procPool.mutex.Unlock()
-	C.free(up)
-}
-
-// Call a Go function in the storage.
-//export callRecordProcessor
-func callRecordProcessor(up unsafe.Pointer, keyPtr unsafe.Pointer, keySize C.int32_t,
-	valuePtr unsafe.Pointer, valueSize C.int32_t) (unsafe.Pointer, int32) {
-	procPool := recordProcessorPools[int(uintptr(up)>>3)%len(recordProcessorPools)]
-	procPool.mutex.Lock()
-	proc := procPool.data[up]
-	procPool.mutex.Unlock()
-	var key []byte
-	if keyPtr == nil {
-		key = nil
-	} else {
-		key = C.GoBytes(keyPtr, keySize)
-	}
-	var value []byte
-	if valuePtr == nil {
-		value = nil
-	} else {
-		value = C.GoBytes(valuePtr, valueSize)
-	}
-	rv := proc(key, value)
-	var retPtr unsafe.Pointer
-	var retSize int32
-	if IsNilData(rv) {
-		retPtr = nil
-		retSize = 0
-	} else if IsRemoveData(rv) {
-		retPtr = unsafe.Pointer(uintptr(1))
-		retSize = 0
-	} else {
-		rv_bytes := ToByteArray(rv)
-		retPtr = C.CBytes(rv_bytes)
-		retSize = int32(len(rv_bytes))
-	}
-	return retPtr, retSize
-}
-
 // END OF FILE
@@ -0,0 +1,303 @@
+/*************************************************************************************************
+ * Offline verification and repair of databases
+ *
+ * Copyright 2020 Google LLC
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+ * except in compliance with the License.  You may obtain a copy of the License at
+ *     https://www.apache.org/licenses/LICENSE-2.0
+ * Unless required by applicable law or agreed to in writing, software distributed under the
+ * License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied.  See the License for the specific language governing permissions
+ * and limitations under the License.
+ *************************************************************************************************/
+
+package tkrzw
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The maximum number of broken regions to record in a verification report.
+const verifyMaxBrokenRegions = 1000
+
+// Magic bytes at the top of records of HashDBM.
+const (
+	hashRecordMagicVoid   = 0xFF
+	hashRecordMagicSet    = 0xFE
+	hashRecordMagicRemove = 0xFD
+	hashRecordMagicAdd    = 0xFC
+)
+
+// Widths of the CRC data of records of HashDBM, by the record CRC mode.
+var hashRecordCRCWidths = map[string]int{
+	"": 0, "none": 0, "crc8": 1, "crc16": 2, "crc32": 4,
+}
+
+// Broken region found by verification.
+//
+// For HashDBM, the region is located by the file offset of the broken record and the key of the preceding healthy record in the file.  For the other classes, whose record offsets are not exposed by the underlying library, the offset is -1 and the region is located by the key of the preceding healthy record in the iteration order.
+type BrokenRegion struct {
+	// The file offset of the broken record, or -1 if it is unknown.
+	Offset int64
+	// The key of the last healthy record before the broken region, or nil if there is none.
+	PrevKey []byte
+	// The message of the error.
+	Message string
+}
+
+// Result of verification of a database.
+type VerifyReport struct {
+	// The name of the database class.
+	Class string
+	// Whether the database was closed properly.
+	Healthy bool
+	// The mode of record CRC, or an empty string if the class doesn't support it.
+	RecordCRCMode string
+	// The number of records stored in the metadata.
+	NumRecords int64
+	// The number of records read by the full iteration.
+	NumScanned int64
+	// The size of the database file.
+	FileSize int64
+	// Broken regions found by the full iteration.
+	BrokenRegions []BrokenRegion
+}
+
+// Makes a string representing the report.
+//
+// @return The string representing the report.
+func (self *VerifyReport) String() string {
+	return fmt.Sprintf(
+		"#<tkrzw.VerifyReport:class=%s,healthy=%t,records=%d,scanned=%d,broken=%d>",
+		self.Class, self.Healthy, self.NumRecords, self.NumScanned, len(self.BrokenRegions))
+}
+
+// Checks whether no problem is found.
+//
+// @return True if the database is healthy and no broken region is found.
+func (self *VerifyReport) IsOK() bool {
+	return self.Healthy && len(self.BrokenRegions) == 0
+}
+
+// Result of repair of a database.
+type RepairReport struct {
+	// The number of records stored in the metadata of the broken database.
+	NumExpected int64
+	// The number of records recovered in the new database.
+	NumRecovered int64
+	// The number of records lost, or 0 if more records than expected are recovered.
+	NumLost int64
+}
+
+// Makes a string representing the report.
+//
+// @return The string representing the report.
+func (self *RepairReport) String() string {
+	return fmt.Sprintf("#<tkrzw.RepairReport:expected=%d,recovered=%d,lost=%d>",
+		self.NumExpected, self.NumRecovered, self.NumLost)
+}
+
+// Verifies a database file without modifying it.
+//
+// @param path A path of the database file.
+// @param params Optional parameters to open the database.  If it is nil, it is ignored.
+// @return The report of the verification and the result status.  The status is not success only if the database cannot be opened or closed.
+//
+// The database is opened in the read-only mode and every record is read by a full iteration.  If the record CRC is enabled by the "record_crc_mode" parameter on creation, the checksum of each record is verified by the underlying library as it is read.  Errors on reading records are reported as broken regions, each of which is located by the key of the preceding healthy record.  For HashDBM, the record headers are also walked from the top of the record section of the file, and each record whose header is invalid or whose key cannot be read is reported with its file offset.  If any is found that way, they replace the broken regions found by the iteration.  Otherwise, the offsets of broken regions are -1.
+func VerifyDatabase(path string, params map[string]string) (*VerifyReport, *Status) {
+	dbm := NewDBM()
+	status := dbm.Open(path, false, params)
+	if !status.IsOK() {
+		return nil, status
+	}
+	inspection := dbm.Inspect()
+	report := &VerifyReport{
+		Class:         inspection["class"],
+		Healthy:       dbm.IsHealthy(),
+		RecordCRCMode: inspection["record_crc_mode"],
+		NumRecords:    dbm.CountSimple(),
+		FileSize:      dbm.GetFileSizeSimple(),
+	}
+	iter := dbm.MakeIterator()
+	status = iter.First()
+	if !status.IsOK() {
+		report.BrokenRegions = append(report.BrokenRegions, BrokenRegion{-1, nil, status.String()})
+	}
+	var prevKey []byte
+	for status.IsOK() && len(report.BrokenRegions) < verifyMaxBrokenRegions {
+		key, _, getStatus := iter.Get()
+		if getStatus.Equals(StatusNotFoundError) {
+			break
+		}
+		if getStatus.IsOK() {
+			report.NumScanned++
+			prevKey = key
+		} else {
+			report.BrokenRegions = append(
+				report.BrokenRegions, BrokenRegion{-1, prevKey, getStatus.String()})
+		}
+		status = iter.Next()
+		if !status.IsOK() && !status.Equals(StatusNotFoundError) {
+			report.BrokenRegions = append(
+				report.BrokenRegions, BrokenRegion{-1, prevKey, status.String()})
+		}
+	}
+	iter.Destruct()
+	if report.Class == "HashDBM" {
+		if located := locateHashRecords(dbm, inspection, report.FileSize); len(located) > 0 {
+			report.BrokenRegions = located
+		}
+	}
+	status = dbm.Close()
+	dbm.Destruct()
+	return report, status
+}
+
+// Walks the records of a HashDBM file and locates broken ones by their file offsets.
+//
+// Each record consists of the magic byte, the offset of the child record, the sizes of the key, the value, and the padding as variable-length integers, the CRC data, the key, the value, and the padding.  A record to set a value is checked by reading the value of its key via the database.  As the walk cannot continue after an invalid header, it stops there.
+func locateHashRecords(dbm *DBM, inspection map[string]string, fileSize int64) []BrokenRegion {
+	var regions []BrokenRegion
+	crcWidth, ok := hashRecordCRCWidths[inspection["record_crc_mode"]]
+	offset := ToInt(inspection["record_base"])
+	offsetWidth := ToInt(inspection["offset_width"])
+	if !ok || offset <= 0 || offsetWidth <= 0 {
+		return regions
+	}
+	filePath, status := dbm.GetFilePath()
+	if !status.IsOK() {
+		return regions
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return regions
+	}
+	defer file.Close()
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, fileSize-offset))
+	pos := offset
+	readByte := func() (byte, bool) {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return 0, false
+		}
+		pos++
+		return c, true
+	}
+	readNum := func() (int64, bool) {
+		num := int64(0)
+		for i := 0; i < 9; i++ {
+			c, ok := readByte()
+			if !ok {
+				return 0, false
+			}
+			num = (num << 7) | int64(c&0x7f)
+			if c&0x80 == 0 {
+				return num, true
+			}
+		}
+		return 0, false
+	}
+	skip := func(size int64) bool {
+		for size > 0 {
+			step := size
+			if step > 1<<20 {
+				step = 1 << 20
+			}
+			discarded, err := reader.Discard(int(step))
+			pos += int64(discarded)
+			if err != nil {
+				return false
+			}
+			size -= step
+		}
+		return true
+	}
+	reported := make(map[string]bool)
+	var prevKey []byte
+	for offset < fileSize && len(regions) < verifyMaxBrokenRegions {
+		magic, ok := readByte()
+		if !ok {
+			break
+		}
+		switch magic {
+		case hashRecordMagicVoid, hashRecordMagicSet, hashRecordMagicRemove, hashRecordMagicAdd:
+		default:
+			return append(regions, BrokenRegion{offset, prevKey, "invalid record magic data"})
+		}
+		ok = skip(offsetWidth)
+		keySize, keyOK := readNum()
+		valueSize, valueOK := readNum()
+		paddingSize, paddingOK := readNum()
+		if !ok || !keyOK || !valueOK || !paddingOK || !skip(int64(crcWidth)) ||
+			pos+keySize+valueSize+paddingSize > fileSize {
+			return append(regions, BrokenRegion{offset, prevKey, "invalid record header"})
+		}
+		key := make([]byte, keySize)
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return append(regions, BrokenRegion{offset, prevKey, errorToStatus(err).String()})
+		}
+		pos += keySize
+		if magic == hashRecordMagicSet || magic == hashRecordMagicAdd {
+			_, status := dbm.Get(key)
+			if status.IsOK() || status.Equals(StatusNotFoundError) {
+				prevKey = key
+			} else if !reported[string(key)] {
+				reported[string(key)] = true
+				regions = append(regions, BrokenRegion{offset, prevKey, status.String()})
+			}
+		}
+		if !skip(valueSize + paddingSize) {
+			return append(regions, BrokenRegion{offset, prevKey, "invalid record size"})
+		}
+		offset = pos
+	}
+	return regions
+}
+
+// Repairs a database file by restoring it as a new database.
+//
+// @param oldFilePath The path of the broken database.
+// @param newFilePath The path of the new database to be created.
+// @param className The name of the database class.  If it is empty, the class is guessed from the file extension.
+// @param cipherKey The encryption key for cipher compressors.
+// @return The report of the repair and the result status.
+//
+// The broken database is not modified.  The new database is made by RestoreDatabase with all readable records.  The number of lost records is calculated from the number of records in the metadata of the broken database, which reflects the last synchronization.
+func RepairDatabase(oldFilePath string, newFilePath string, className string,
+	cipherKey string) (*RepairReport, *Status) {
+	report := &RepairReport{}
+	oldDBM := NewDBM()
+	params := map[string]string{}
+	if className != "" {
+		params["dbm"] = className
+	}
+	if cipherKey != "" {
+		params["cipher_key"] = cipherKey
+	}
+	if oldDBM.Open(oldFilePath, false, params).IsOK() {
+		report.NumExpected = ToInt(oldDBM.Inspect()["num_records"])
+		oldDBM.Close()
+	}
+	oldDBM.Destruct()
+	status := RestoreDatabase(oldFilePath, newFilePath, className, -1, cipherKey)
+	if !status.IsOK() {
+		return nil, status
+	}
+	newDBM := NewDBM()
+	status = newDBM.Open(newFilePath, false, params)
+	if !status.IsOK() {
+		return nil, status
+	}
+	report.NumRecovered = newDBM.CountSimple()
+	status = newDBM.Close()
+	newDBM.Destruct()
+	if report.NumExpected > report.NumRecovered {
+		report.NumLost = report.NumExpected - report.NumRecovered
+	}
+	return report, status
+}
+
+// END OF FILE